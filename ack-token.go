@@ -0,0 +1,286 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Column of every generated row holding its acknowledgment token
+const ackTokenColumn = "ack_token"
+
+// Shortest interval between acknowledgment queries, bounding the query cost
+const ackMinInterval = 10 * time.Second
+
+// AckSample holds the tokens sent and visible at one interval.  The confirmed
+// token is the high-water mark of durably visible rows, every token up to it
+// being visible, while the lag is the tokens sent beyond it.
+type AckSample struct {
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	SentToken      int64   `json:"sent_token"`
+	MaxVisible     int64   `json:"max_visible_token"`
+	VisibleTokens  int64   `json:"visible_tokens"`
+	ConfirmedToken int64   `json:"confirmed_token"`
+	Lag            int64   `json:"lag"`
+}
+
+// AckVerifier acknowledges the rows of a run individually.  Each row carries
+// a monotonically increasing token, and the verifier periodically queries the
+// tokens visible for the run_id, advancing the confirmed high-water mark over
+// a bounded window of tokens beyond it, so a missing row holds the mark at
+// the gap however many rows land after it.  A failed query skips the sample
+// rather than affecting the write workload.
+type AckVerifier struct {
+	client    *bigquery.Client
+	targets   []*StreamTarget
+	runID     string
+	interval  time.Duration
+	window    int64
+	startTime time.Time
+	next      atomic.Int64
+	sent      atomic.Int64
+
+	mu        sync.Mutex
+	confirmed int64
+	samples   []AckSample
+	skipped   int
+	cancel    context.CancelFunc
+	finished  chan struct{}
+}
+
+// NewAckVerifier creates the verifier querying the visible tokens every
+// interval, which is raised to the minimum interval if shorter, confirming
+// at most window tokens beyond the high-water mark with each query
+func NewAckVerifier(interval time.Duration, window int64) *AckVerifier {
+	if interval < ackMinInterval {
+		interval = ackMinInterval
+	}
+	return &AckVerifier{interval: interval, window: window}
+}
+
+// WithAckTokenColumn returns the schema with the NULLABLE INTEGER column of
+// the acknowledgment token appended
+func WithAckTokenColumn(schema bigquery.Schema) bigquery.Schema {
+	return append(append(bigquery.Schema{}, schema...), &bigquery.FieldSchema{Name: ackTokenColumn, Type: bigquery.IntegerFieldType})
+}
+
+// Generator wraps the generator, adding the token column to each record
+// generated.  The token is only assigned once the record is written, so the
+// records generated by the checks before the run carry none.
+func (v *AckVerifier) Generator(gen dataGenerator) dataGenerator {
+	return func(name string, uuid int64, create_time time.Time, run_id string) interface{} {
+		return &ackTokenRecord{record: gen(name, uuid, create_time, run_id)}
+	}
+}
+
+// Assign assigns the next token to a record about to be written for the
+// first time, so the tokens of the rows written are consecutive.  A nil
+// verifier, a record without a token column, or a record already assigned a
+// token, such as one being retried, is ignored.
+func (v *AckVerifier) Assign(data interface{}) {
+	if v == nil {
+		return
+	}
+	if r, ok := data.(*ackTokenRecord); ok && r.token == 0 {
+		r.token = v.next.Add(1)
+	}
+}
+
+// AddSent records the token of a record sent, a nil verifier or a record
+// without a token is ignored
+func (v *AckVerifier) AddSent(data interface{}) {
+	if v == nil {
+		return
+	}
+	if r, ok := data.(*ackTokenRecord); ok && r.token > v.sent.Load() {
+		v.sent.Store(r.token)
+	}
+}
+
+// Start begins querying the visible tokens of the run in the targets in the
+// background
+func (v *AckVerifier) Start(ctx context.Context, client *bigquery.Client, targets []*StreamTarget, runID string) {
+	v.client, v.targets, v.runID, v.startTime = client, targets, runID, time.Now()
+	ctx, v.cancel = context.WithCancel(ctx)
+	v.finished = make(chan struct{})
+	go func() {
+		defer close(v.finished)
+		ticker := time.NewTicker(v.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				v.sample(ctx, time.Since(v.startTime))
+			}
+		}
+	}()
+}
+
+// Stop ends the background queries, then takes a final sample once the run
+// has ended, returning the samples taken
+func (v *AckVerifier) Stop(ctx context.Context) []AckSample {
+	v.cancel()
+	<-v.finished
+	v.sample(ctx, time.Since(v.startTime))
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	LogAckSummary(v.samples, v.skipped)
+	return v.samples
+}
+
+// sample queries the visible tokens across the targets, bounding the query
+// by the interval so a slow query never overlaps the next
+func (v *AckVerifier) sample(ctx context.Context, elapsed time.Duration) {
+	sent := v.sent.Load()
+	ctx, cancel := context.WithTimeout(ctx, v.interval)
+	defer cancel()
+
+	v.mu.Lock()
+	floor := v.confirmed
+	v.mu.Unlock()
+	maxVisible, visible, window, err := v.query(ctx, floor)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Debug().Err(err).Msg("  Skipping Acknowledgment Sample")
+		}
+		v.mu.Lock()
+		v.skipped++
+		v.mu.Unlock()
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.confirmed = AdvanceConfirmedToken(v.confirmed, window)
+	sample := AckSample{ElapsedSeconds: elapsed.Seconds(), SentToken: sent, MaxVisible: maxVisible, VisibleTokens: visible, ConfirmedToken: v.confirmed, Lag: max(0, sent-v.confirmed)}
+	v.samples = append(v.samples, sample)
+	logger.Info().Int64("Sent Token", sample.SentToken).Int64("Max Visible Token", sample.MaxVisible).Int64("Visible Tokens", sample.VisibleTokens).
+		Int64("Confirmed Token", sample.ConfirmedToken).Int64("Lag", sample.Lag).Msg("Acknowledged Rows")
+}
+
+// query returns the highest and number of distinct tokens visible for the
+// run, along with the distinct tokens in the window beyond the floor
+func (v *AckVerifier) query(ctx context.Context, floor int64) (int64, int64, []int64, error) {
+	selects := make([]string, 0, len(v.targets))
+	for _, target := range v.targets {
+		selects = append(selects, fmt.Sprintf("SELECT %s FROM `%s.%s` WHERE run_id = @run_id", ackTokenColumn, target.DatasetID, target.TableID))
+	}
+	q := v.client.Query(fmt.Sprintf(`WITH tokens AS (%s)
+SELECT (SELECT MAX(%[2]s) FROM tokens), (SELECT COUNT(DISTINCT %[2]s) FROM tokens),
+  ARRAY(SELECT DISTINCT %[2]s FROM tokens WHERE %[2]s > @floor AND %[2]s <= @ceiling ORDER BY %[2]s)`,
+		strings.Join(selects, " UNION ALL "), ackTokenColumn))
+	q.Parameters = []bigquery.QueryParameter{
+		{Name: "run_id", Value: v.runID},
+		{Name: "floor", Value: floor},
+		{Name: "ceiling", Value: floor + v.window},
+	}
+
+	it, err := ReadQuery(ctx, q)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	var row []bigquery.Value
+	if err := it.Next(&row); err != nil {
+		return 0, 0, nil, err
+	}
+	var window []int64
+	if values, ok := row[2].([]bigquery.Value); ok {
+		for _, value := range values {
+			window = append(window, valueInt64(value))
+		}
+	}
+	return valueInt64(row[0]), valueInt64(row[1]), window, nil
+}
+
+// AdvanceConfirmedToken advances the confirmed token over the consecutive
+// tokens of the window which follow it, stopping at the first gap
+func AdvanceConfirmedToken(confirmed int64, window []int64) int64 {
+	for _, token := range window {
+		if token != confirmed+1 {
+			break
+		}
+		confirmed = token
+	}
+	return confirmed
+}
+
+// LogAckSummary outputs the final confirmed count against the tokens sent,
+// along with the largest lag seen and the first missing token, if any
+func LogAckSummary(samples []AckSample, skipped int) {
+	if len(samples) == 0 {
+		logger.Warn().Int("Skipped", skipped).Msg("Row Acknowledgment Took No Samples")
+		return
+	}
+	final := samples[len(samples)-1]
+	var maxLag int64
+	for _, sample := range samples {
+		maxLag = max(maxLag, sample.Lag)
+	}
+	logger.Info().Int64("Sent Token", final.SentToken).Int64("Confirmed Count", final.ConfirmedToken).Int64("Max Lag", maxLag).
+		Int("Samples", len(samples)).Int("Skipped", skipped).Msg("Row Acknowledgment")
+	if final.ConfirmedToken < final.SentToken {
+		logger.Warn().Int64("First Missing Token", final.ConfirmedToken+1).Int64("Unconfirmed", final.SentToken-final.ConfirmedToken).
+			Msg("  Rows Sent are Not Yet Confirmed Visible")
+	}
+}
+
+// ackTokenRecord is a generated record along with its acknowledgment token,
+// zero until the record is written
+type ackTokenRecord struct {
+	record interface{}
+	token  int64
+}
+
+// Save implements bigquery.ValueSaver.Save
+func (ar *ackTokenRecord) Save() (row map[string]bigquery.Value, insertID string, err error) {
+	saver, ok := ar.record.(bigquery.ValueSaver)
+	if !ok {
+		return nil, "", fmt.Errorf("%T does not implement bigquery.ValueSaver", ar.record)
+	}
+	row, insertID, err = saver.Save()
+	if err != nil {
+		return nil, "", err
+	}
+	if ar.token > 0 {
+		row[ackTokenColumn] = ar.token
+	}
+	return row, insertID, nil
+}
+
+// MarshalJSON implements json.Marshaler.MarshalJSON
+func (ar *ackTokenRecord) MarshalJSON() ([]byte, error) {
+	row, _, err := ar.Save()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(row)
+}
+
+// EnableInsertID implements insertIDEnabler for the wrapped record
+func (ar *ackTokenRecord) EnableInsertID() {
+	if r, ok := ar.record.(insertIDEnabler); ok {
+		r.EnableInsertID()
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestAckTokensAfterSelfCheck runs the schema self-check, generating rows
+// which are never written, before streaming, checking the rows written still
+// carry the tokens from 1 so the confirmed token advances over every one
+func TestAckTokensAfterSelfCheck(t *testing.T) {
+	acks := NewAckVerifier(time.Minute, 100)
+	schema := WithAckTokenColumn(tableDataBigQuerySchema)
+	gen := acks.Generator(NewTableData)
+
+	if violations := ValidateGeneratedRows(schema, gen, "run-1", selfCheckRows); len(violations) > 0 {
+		t.Fatalf("%d violations, the first %s", len(violations), violations[0])
+	}
+	unwritten, _, err := gen(randomNames[0], 0, time.Now(), "run-1").(*ackTokenRecord).Save()
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if token, ok := unwritten[ackTokenColumn]; ok {
+		t.Errorf("a row never written carries the token %v", token)
+	}
+
+	// Write three rows, the second being retried before it is sent
+	var tokens []int64
+	for i := 0; i < 3; i++ {
+		data := gen(randomNames[i], int64(i), time.Now(), "run-1")
+		acks.Assign(data)
+		if i == 1 {
+			acks.Assign(data)
+		}
+		acks.AddSent(data)
+		row, _, err := data.(*ackTokenRecord).Save()
+		if err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		tokens = append(tokens, row[ackTokenColumn].(int64))
+	}
+	if want := []int64{1, 2, 3}; !slices.Equal(tokens, want) {
+		t.Errorf("tokens written %v, expected %v", tokens, want)
+	}
+	if sent := acks.sent.Load(); sent != 3 {
+		t.Errorf("sent token %d, expected 3", sent)
+	}
+	if confirmed := AdvanceConfirmedToken(0, tokens); confirmed != 3 {
+		t.Errorf("confirmed token %d once every row is visible, expected 3", confirmed)
+	}
+}
+
+func TestAdvanceConfirmedToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		confirmed int64
+		window    []int64
+		want      int64
+	}{
+		{"Empty Window", 5, nil, 5},
+		{"Consecutive", 0, []int64{1, 2, 3}, 3},
+		{"Gap", 0, []int64{1, 2, 4, 5}, 2},
+		{"Gap Above the Confirmed Token", 0, []int64{11, 12}, 0},
+		{"From the Confirmed Token", 10, []int64{11, 12, 14}, 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AdvanceConfirmedToken(tt.confirmed, tt.window); got != tt.want {
+				t.Errorf("AdvanceConfirmedToken = %d, expected %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// Custom metric of the records per second written by streaming jobs using
+// the bqwriter library, which the alert policy monitors
+const recordsPerSecondMetric = "custom.googleapis.com/bqwrite_test/records_per_second"
+
+// Duration the records per second must stay below the threshold before the
+// alert policy fires, and the period each time series is aligned to
+const (
+	alertPolicyDuration  = "300s"
+	alertPolicyAlignment = "60s"
+)
+
+// CreateAlertPolicy creates a Cloud Monitoring alert policy in the project
+// which fires when the records per second stay below the threshold for 5
+// consecutive minutes, returning the name of the policy created
+func CreateAlertPolicy(ctx context.Context, projectID string, thresholdRPS float64) (string, error) {
+	service, err := monitoring.NewService(ctx)
+	if err != nil {
+		return "", err
+	}
+	policy := &monitoring.AlertPolicy{
+		DisplayName: fmt.Sprintf("bqwrite-test Records per Second Below %g", thresholdRPS),
+		Combiner:    "OR",
+		Conditions: []*monitoring.Condition{{
+			DisplayName: fmt.Sprintf("Records per Second Below %g for 5 Minutes", thresholdRPS),
+			ConditionThreshold: &monitoring.MetricThreshold{
+				Filter:         fmt.Sprintf("metric.type = %q", recordsPerSecondMetric),
+				Comparison:     "COMPARISON_LT",
+				ThresholdValue: thresholdRPS,
+				Duration:       alertPolicyDuration,
+				Aggregations:   []*monitoring.Aggregation{{AlignmentPeriod: alertPolicyAlignment, PerSeriesAligner: "ALIGN_MEAN"}},
+				Trigger:        &monitoring.Trigger{Count: 1},
+			},
+		}},
+		Documentation: &monitoring.Documentation{
+			Content:  fmt.Sprintf("The records per second streamed to BigQuery, %s, dropped below %g for 5 consecutive minutes.", recordsPerSecondMetric, thresholdRPS),
+			MimeType: "text/markdown",
+		},
+		UserLabels: map[string]string{"created_by": "bqwrite-test"},
+	}
+	created, err := service.Projects.AlertPolicies.Create("projects/"+projectID, policy).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return created.Name, nil
+}
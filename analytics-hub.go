@@ -0,0 +1,143 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	analyticshub "cloud.google.com/go/bigquery/analyticshub/apiv1"
+	"cloud.google.com/go/bigquery/analyticshub/apiv1/analyticshubpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// analyticsHubListingName matches the full resource name of a listing
+var analyticsHubListingName = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/dataExchanges/[^/]+/listings/([^/]+)$`)
+
+// datasetRef identifies a dataset within a project
+type datasetRef struct {
+	ProjectID string
+	DatasetID string
+}
+
+// String returns the dataset reference in project.dataset form
+func (r datasetRef) String() string {
+	return r.ProjectID + "." + r.DatasetID
+}
+
+// AnalyticsHubSubscription holds the shared dataset behind a listing and the
+// linked dataset created by subscribing to it
+type AnalyticsHubSubscription struct {
+	Listing      string
+	Subscription string
+	Source       datasetRef
+	Linked       datasetRef
+}
+
+// SubscribeAnalyticsHubListing subscribes to the Analytics Hub listing,
+// creating a linked dataset in the project in the location of the shared
+// dataset.  An existing linked dataset from an earlier run is reused.
+func SubscribeAnalyticsHubListing(ctx context.Context, client *bigquery.Client, projectID, listingName string) (*AnalyticsHubSubscription, error) {
+	match := analyticsHubListingName.FindStringSubmatch(listingName)
+	if match == nil {
+		return nil, fmt.Errorf("invalid listing %q, expected projects/P/locations/L/dataExchanges/E/listings/L", listingName)
+	}
+
+	hub, err := analyticshub.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer hub.Close()
+
+	// Resolve the shared dataset behind the listing
+	listing, err := hub.GetListing(ctx, &analyticshubpb.GetListingRequest{Name: listingName})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the listing: %w", err)
+	}
+	parts := strings.Split(listing.GetBigqueryDataset().GetDataset(), "/")
+	if len(parts) != 4 || parts[0] != "projects" || parts[2] != "datasets" {
+		return nil, fmt.Errorf("listing %q does not share a BigQuery dataset", listingName)
+	}
+	source := datasetRef{ProjectID: parts[1], DatasetID: parts[3]}
+	sourceMetaData, err := client.DatasetInProject(source.ProjectID, source.DatasetID).Metadata(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the shared dataset %s: %w", source, err)
+	}
+
+	// Subscribe, creating the linked dataset
+	subscription := &AnalyticsHubSubscription{
+		Listing: listingName,
+		Source:  source,
+		Linked:  datasetRef{ProjectID: projectID, DatasetID: "bqwrite_test_" + strings.ReplaceAll(match[1], "-", "_")},
+	}
+	response, err := hub.SubscribeListing(ctx, &analyticshubpb.SubscribeListingRequest{
+		Name: listingName,
+		Destination: &analyticshubpb.SubscribeListingRequest_DestinationDataset{
+			DestinationDataset: &analyticshubpb.DestinationDataset{
+				DatasetReference: &analyticshubpb.DestinationDatasetReference{
+					ProjectId: subscription.Linked.ProjectID,
+					DatasetId: subscription.Linked.DatasetID,
+				},
+				Location: sourceMetaData.Location,
+			},
+		},
+	})
+	switch {
+	case status.Code(err) == codes.AlreadyExists:
+		logger.Info().Str("Linked Dataset", subscription.Linked.String()).Msg("Reusing the Existing Linked Dataset")
+	case err != nil:
+		return nil, fmt.Errorf("failed to subscribe to the listing: %w", err)
+	default:
+		subscription.Subscription = response.GetSubscription().GetName()
+	}
+	return subscription, nil
+}
+
+// VerifyAnalyticsHubTargets counts the rows tagged with the run_id through
+// the linked dataset, verifying the rows written to each shared table are
+// visible to the subscriber.
+func VerifyAnalyticsHubTargets(ctx context.Context, client *bigquery.Client, subscription *AnalyticsHubSubscription, targets []*StreamTarget, runID string) {
+	logger.Info().Str("Linked Dataset", subscription.Linked.String()).Msg("Verifying Rows are Visible to the Subscriber")
+	for _, target := range targets {
+		rows, err := CountRunRows(ctx, client, subscription.Linked.DatasetID, target.TableID, runID)
+		if SkippedOnInterrupt("Rows Visible to the Subscriber", err) {
+			return
+		}
+		if err != nil {
+			logger.Warn().Err(err).Str("Table", target.TableID).Msg("  Failed to Count Rows")
+			continue
+		}
+
+		event := logger.Info()
+		if rows < int64(target.RecordsSent) {
+			event = logger.Warn()
+		}
+		event.Str("Table", target.TableID).Int("Records Sent", target.RecordsSent).Int64("Rows Visible", rows).Msg(indent)
+	}
+}
+
+// LogAnalyticsHubSubscription outputs the datasets of the subscription
+func LogAnalyticsHubSubscription(subscription *AnalyticsHubSubscription) {
+	logger.Info().Str("Listing", subscription.Listing).Msg("Subscribed to Analytics Hub Listing")
+	if subscription.Subscription != "" {
+		logger.Info().Str("Subscription", subscription.Subscription).Msg(indent)
+	}
+	logger.Info().Str("Shared Dataset", subscription.Source.String()).Msg(indent)
+	logger.Info().Str("Linked Dataset", subscription.Linked.String()).Msg(indent)
+}
@@ -0,0 +1,99 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Templates of the bqwriter log messages reporting rows its workers failed
+// to write, the only way bqwriter reports a failure once a row is queued
+const (
+	insertAllDropTemplate = "BQ InsertAll Client: Flush: dropping %d row(s) due to error: %v"
+	storageAppendTemplate = "ready append resulted in error: %v"
+	storagePutTemplate    = "worker thread data job received: put data to client: failure: %v"
+	storagePutErrorPrefix = "BQ Storage Client"
+)
+
+// AsyncFailures collects the rows the streamer workers failed to write after
+// the retries of bqwriter, which are only logged, so the write loop can pass
+// them to the record error handler.  bqwriter does not return the rows of a
+// failed request, so only their number and the error are known.
+type AsyncFailures struct {
+	rows atomic.Int64
+	mu   sync.Mutex
+	err  error
+}
+
+// Observe counts the rows failed according to a bqwriter error log message,
+// a nil collector ignores them
+func (f *AsyncFailures) Observe(template string, args []interface{}) {
+	if f == nil || len(args) == 0 {
+		return
+	}
+	err, _ := args[len(args)-1].(error)
+	if err == nil {
+		return
+	}
+	rows := 0
+	switch {
+	case template == insertAllDropTemplate:
+		rows, _ = args[0].(int)
+	case strings.HasSuffix(template, storageAppendTemplate):
+		rows = 1
+	case template == storagePutTemplate && strings.HasPrefix(err.Error(), storagePutErrorPrefix):
+		rows = 1
+	}
+	if rows == 0 {
+		return
+	}
+	f.mu.Lock()
+	f.err = err
+	f.mu.Unlock()
+	f.rows.Add(int64(rows))
+}
+
+// Take returns the number of rows failed since the last call along with the
+// most recent error, checked on every write so the common case of no
+// failures takes no lock.  A nil collector returns none.
+func (f *AsyncFailures) Take() (int, error) {
+	if f == nil || f.rows.Load() == 0 {
+		return 0, nil
+	}
+	rows := f.rows.Swap(0)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return int(rows), f.err
+}
+
+// HandleAsyncFailures passes the rows failed since the last call to the
+// record error handler, as a nil record.  The rows were counted as sent once
+// accepted, so unless the handler aborts the run, returning the error, they
+// are moved from the records sent to those skipped.
+func HandleAsyncFailures(config *BenchmarkConfig, summary *RunSummary) error {
+	rows, err := config.Failures.Take()
+	if rows == 0 {
+		return nil
+	}
+	if config.RecordErrorHandler().Handle(nil, err) != ActionSkip {
+		return fmt.Errorf("%d records failed to be written: %w", rows, err)
+	}
+	summary.RecordsSent -= rows
+	summary.RecordsSkipped += rows
+	return nil
+}
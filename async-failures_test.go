@@ -0,0 +1,90 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAsyncFailuresObserve(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name     string
+		template string
+		args     []interface{}
+		rows     int
+	}{
+		{"insertAll Flush", insertAllDropTemplate, []interface{}{10, errFailed}, 10},
+		{"Storage Append", "exit checkAppendResultsAsync: " + storageAppendTemplate, []interface{}{errFailed}, 1},
+		{"Storage Put", storagePutTemplate, []interface{}{errors.New(storagePutErrorPrefix + ": Put Data: encode data: invalid")}, 1},
+		{"insertAll Put Already Counted", storagePutTemplate, []interface{}{errors.New("thick insertAll BQ client: put batched rows (count=10)")}, 0},
+		{"Close Failure", "streamer: failed to close worker's BQ client: %v", []interface{}{errFailed}, 0},
+		{"No Error", insertAllDropTemplate, []interface{}{10, nil}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failures AsyncFailures
+			failures.Observe(tt.template, tt.args)
+			rows, err := failures.Take()
+			if rows != tt.rows {
+				t.Errorf("%d rows failed, expected %d", rows, tt.rows)
+			}
+			if tt.rows > 0 && err == nil {
+				t.Error("the error was not returned with the failed rows")
+			}
+			if rows, _ := failures.Take(); rows != 0 {
+				t.Errorf("%d rows remain after they were taken", rows)
+			}
+		})
+	}
+}
+
+func TestHandleAsyncFailures(t *testing.T) {
+	tests := []struct {
+		handler string
+		abort   bool
+	}{
+		{errorHandlerAbort, true},
+		{errorHandlerRetry, true},
+		{errorHandlerSkip, false},
+		{errorHandlerLogOnly, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.handler, func(t *testing.T) {
+			handler, err := NewErrorHandler(tt.handler, 3)
+			if err != nil {
+				t.Fatalf("NewErrorHandler: %v", err)
+			}
+			config := &BenchmarkConfig{ErrorHandler: handler, Failures: &AsyncFailures{}}
+			config.Failures.Observe(insertAllDropTemplate, []interface{}{10, errors.New("failed")})
+			summary := &RunSummary{RecordsSent: 25}
+
+			err = HandleAsyncFailures(config, summary)
+			if tt.abort {
+				if err == nil {
+					t.Fatal("the failed rows did not abort the run")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("HandleAsyncFailures: %v", err)
+			}
+			if summary.RecordsSent != 15 || summary.RecordsSkipped != 10 {
+				t.Errorf("%d records sent and %d skipped, expected 15 and 10", summary.RecordsSent, summary.RecordsSkipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+// Default tolerances of a baseline blessed without them
+const (
+	defaultBaselineThroughputPercent = 10
+	defaultBaselineMaxErrorRate      = 0.01
+	defaultBaselineLatencyPercent    = 25
+)
+
+// BaselineTolerances are the bands a run must fall within to match its
+// baseline, the records per second within plus or minus the percentage, the
+// error rate at most the ceiling, and each write latency percentile at most
+// the percentage above that of the baseline
+type BaselineTolerances struct {
+	ThroughputPercent float64 `json:"throughput_percent"`
+	MaxErrorRate      float64 `json:"max_error_rate"`
+	LatencyPercent    float64 `json:"latency_percent"`
+}
+
+// Baseline is the results of a run blessed as expected of a host class,
+// stored as the results schema along with its name and tolerances
+type Baseline struct {
+	Name       string
+	Results    *RunResults
+	Tolerances BaselineTolerances
+}
+
+// baselineFields are the fields a baseline adds to the results schema
+type baselineFields struct {
+	Name       string              `json:"baseline_name"`
+	Tolerances *BaselineTolerances `json:"tolerances"`
+}
+
+// BaselineCheck is the comparison of a single metric of a run against its
+// baseline, the limit being the bound the actual value must fall within
+type BaselineCheck struct {
+	Metric   string
+	Baseline float64
+	Actual   float64
+	Limit    string
+	Passed   bool
+}
+
+// RunBless creates a baseline from the results file of a run
+func RunBless(args []string) int {
+	flags := flag.NewFlagSet("bless", flag.ContinueOnError)
+	var resultsFile = flags.String("results", "", "Results File of the Run to Bless  (Required)")
+	var name = flags.String("name", "", "Name of the Baseline, such as the Host Class  (Required)")
+	var outputFile = flags.String("output", "", "File or Cloud Storage Object, gs://bucket/object, to Write the Baseline to  (Required)")
+	var throughput = flags.Float64("throughput-tolerance", defaultBaselineThroughputPercent, "Percentage the Records per Second may Deviate Either Way")
+	var errorRate = flags.Float64("max-error-rate", defaultBaselineMaxErrorRate, "Highest Fraction of Records which may Fail")
+	var latency = flags.Float64("latency-tolerance", defaultBaselineLatencyPercent, "Percentage the Write Latency Percentiles may Exceed the Baseline by")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if *resultsFile == "" || *name == "" || *outputFile == "" {
+		flags.Usage()
+		return 1
+	}
+
+	ctx := context.Background()
+	data, err := ReadLocation(ctx, *resultsFile)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error [ReadLocation]")
+		return 1
+	}
+	results, err := ParseResults(data)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error [ParseResults]")
+		return 1
+	}
+	baseline := &Baseline{Name: *name, Results: results, Tolerances: BaselineTolerances{ThroughputPercent: *throughput, MaxErrorRate: *errorRate, LatencyPercent: *latency}}
+	if err := baseline.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if data, err = MarshalBaseline(baseline); err == nil {
+		err = WriteLocation(ctx, *outputFile, data)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("Error [WriteBaseline]")
+		return 1
+	}
+	logger.Info().Str("Baseline", *name).Str("Run ID", results.RunID).Str("Output", *outputFile).Msg("Baseline Blessed")
+	return 0
+}
+
+// Validate rejects a baseline blessed from a failed run, or with negative
+// tolerances
+func (b *Baseline) Validate() error {
+	switch {
+	case b.Results.Error != "":
+		return fmt.Errorf("baseline %q was blessed from a failed run: %s", b.Name, b.Results.Error)
+	case b.Results.RecordsPerSecond <= 0:
+		return fmt.Errorf("baseline %q was blessed from a run which sent no records", b.Name)
+	case b.Tolerances.ThroughputPercent < 0 || b.Tolerances.MaxErrorRate < 0 || b.Tolerances.LatencyPercent < 0:
+		return fmt.Errorf("the tolerances of baseline %q must not be negative", b.Name)
+	}
+	return nil
+}
+
+// MarshalBaseline encodes the baseline as its results, adding the name and
+// tolerances
+func MarshalBaseline(baseline *Baseline) ([]byte, error) {
+	data, err := MarshalResults(baseline.Results)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	fields["baseline_name"], _ = json.Marshal(baseline.Name)
+	fields["tolerances"], _ = json.Marshal(baseline.Tolerances)
+	data, err = json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// ParseBaseline decodes a baseline, its results read as any results file
+func ParseBaseline(data []byte) (*Baseline, error) {
+	results, err := ParseResults(data)
+	if err != nil {
+		return nil, err
+	}
+	var fields baselineFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if fields.Tolerances == nil {
+		return nil, errors.New("the results have no tolerances, a baseline is created by the bless subcommand")
+	}
+	baseline := &Baseline{Name: fields.Name, Results: results, Tolerances: *fields.Tolerances}
+	return baseline, baseline.Validate()
+}
+
+// LoadBaseline reads the baseline from a file or Cloud Storage object
+func LoadBaseline(ctx context.Context, location string) (*Baseline, error) {
+	data, err := ReadLocation(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+	baseline, err := ParseBaseline(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the baseline %s: %w", location, err)
+	}
+	return baseline, nil
+}
+
+// CompareBaseline compares the records per second, error rate and write
+// latency percentiles of the run against the bands of the baseline.  The
+// latency percentiles are compared only when both sampled the write latency.
+func CompareBaseline(baseline *Baseline, results *RunResults) []BaselineCheck {
+	tolerances := baseline.Tolerances
+	expected := baseline.Results.RecordsPerSecond
+	deviation := expected * tolerances.ThroughputPercent / 100
+	checks := []BaselineCheck{
+		{
+			Metric:   "records_per_second",
+			Baseline: expected,
+			Actual:   results.RecordsPerSecond,
+			Limit:    fmt.Sprintf("%.1f to %.1f", expected-deviation, expected+deviation),
+			Passed:   math.Abs(results.RecordsPerSecond-expected) <= deviation,
+		},
+		{
+			Metric:   "error_rate",
+			Baseline: ErrorRate(baseline.Results),
+			Actual:   ErrorRate(results),
+			Limit:    fmt.Sprintf("at most %g", tolerances.MaxErrorRate),
+			Passed:   ErrorRate(results) <= tolerances.MaxErrorRate,
+		},
+	}
+
+	if baseline.Results.WriteLatency == nil || results.WriteLatency == nil {
+		return checks
+	}
+	for _, percentile := range []struct {
+		metric           string
+		expected, actual float64
+	}{
+		{"p50_ms", baseline.Results.WriteLatency.P50MS, results.WriteLatency.P50MS},
+		{"p95_ms", baseline.Results.WriteLatency.P95MS, results.WriteLatency.P95MS},
+		{"p99_ms", baseline.Results.WriteLatency.P99MS, results.WriteLatency.P99MS},
+	} {
+		limit := percentile.expected * (1 + tolerances.LatencyPercent/100)
+		checks = append(checks, BaselineCheck{
+			Metric:   percentile.metric,
+			Baseline: percentile.expected,
+			Actual:   percentile.actual,
+			Limit:    fmt.Sprintf("at most %.1f", limit),
+			Passed:   percentile.actual <= limit,
+		})
+	}
+	return checks
+}
+
+// ErrorRate returns the fraction of the records of the run which failed,
+// being the errors aggregated over those errors and the records sent
+func ErrorRate(results *RunResults) float64 {
+	failed := 0
+	for _, group := range results.ErrorReport {
+		failed += group.Count
+	}
+	if failed == 0 {
+		return 0
+	}
+	return float64(failed) / float64(failed+results.RecordsSent)
+}
+
+// LogBaselineComparison outputs the comparison of each metric, returning
+// true if every metric fell within the bands of the baseline
+func LogBaselineComparison(baseline *Baseline, checks []BaselineCheck) bool {
+	logger.Info().Str("Baseline", baseline.Name).Str("Baseline Run ID", baseline.Results.RunID).Msg("Baseline Comparison")
+	passed := true
+	for _, check := range checks {
+		event := logger.Info()
+		status := "Within Tolerance"
+		if !check.Passed {
+			event, status, passed = logger.Warn(), "Deviation", false
+		}
+		event.Str("Metric", check.Metric).Float64("Baseline", check.Baseline).Float64("Actual", check.Actual).Str("Limit", check.Limit).Msg("  " + status)
+	}
+	return passed
+}
+
+// ReadLocation reads a local file, or a Cloud Storage object given as
+// gs://bucket/object
+func ReadLocation(ctx context.Context, location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "gs://") {
+		return os.ReadFile(location)
+	}
+	bucket, object, err := ParseStorageLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	storageService, err := storage.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response, err := storageService.Objects.Get(bucket, object).Context(ctx).Download()
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	return io.ReadAll(response.Body)
+}
+
+// WriteLocation writes JSON to a local file, or a Cloud Storage object given
+// as gs://bucket/object
+func WriteLocation(ctx context.Context, location string, data []byte) error {
+	if !strings.HasPrefix(location, "gs://") {
+		return os.WriteFile(location, data, 0o644)
+	}
+	bucket, object, err := ParseStorageLocation(location)
+	if err != nil {
+		return err
+	}
+	storageService, err := storage.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = storageService.Objects.Insert(bucket, &storage.Object{Name: object, ContentType: "application/json"}).Media(bytes.NewReader(data)).Context(ctx).Do()
+	return err
+}
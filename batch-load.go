@@ -0,0 +1,177 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/OTA-Insight/bqwriter"
+)
+
+// NDJSONBatch accumulates the records of a load job as newline-delimited
+// JSON.  The batch client of the streamer loads each payload written to it
+// as a single load job read from an io.Reader, rather than accepting the
+// bigquery.ValueSaver records of the insertAll client, so each record is
+// marshalled as it is added.
+type NDJSONBatch struct {
+	buf  bytes.Buffer
+	rows int
+}
+
+// Add marshals the record as the next line of the batch
+func (b *NDJSONBatch) Add(data interface{}) error {
+	line, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	b.buf.Write(line)
+	b.buf.WriteByte('\n')
+	b.rows++
+	return nil
+}
+
+// Rows returns the number of records in the batch
+func (b *NDJSONBatch) Rows() int {
+	return b.rows
+}
+
+// Take returns the payload of the batch, emptying it for the next batch
+func (b *NDJSONBatch) Take() io.Reader {
+	payload := bytes.NewReader(bytes.Clone(b.buf.Bytes()))
+	b.buf.Reset()
+	b.rows = 0
+	return payload
+}
+
+// NewBatchStreamer creates a BigQuery (stream) writer thread-safe client for
+// the table loading each payload written to it as an NDJSON load job, the
+// workers each running a load job at a time
+func NewBatchStreamer(config *BenchmarkConfig) (*bqwriter.Streamer, error) {
+	schema := config.TableSchema()
+	return bqwriter.NewStreamer(
+		context.Background(),
+		config.ProjectID,
+		config.DatasetID,
+		config.TableID,
+		&bqwriter.StreamerConfig{
+			WorkerCount:     config.NumberWorkers,
+			WorkerQueueSize: config.NumberWorkers,
+			Logger:          &streamerLogger{tracker: config.RequestIDs, errors: config.Errors},
+			BatchClient: &bqwriter.BatchClientConfig{
+				BigQuerySchema:       &schema,
+				SourceFormat:         bigquery.JSON,
+				FailForUnknownValues: true,
+				WriteDisposition:     bigquery.WriteAppend,
+			},
+		},
+	)
+}
+
+// ExecuteBatchLoad will load the generated records into the target BigQuery
+// table through load jobs rather than streaming, every batch of -b records
+// marshalled to NDJSON and loaded as a single job, so the throughput of load
+// jobs can be compared against insertAll and the Storage Write API on the
+// same host.  The records are only known to be loaded once the streamer has
+// closed, having waited for every load job to complete.
+func ExecuteBatchLoad(ctx context.Context, config *BenchmarkConfig) (*RunSummary, error) {
+	logger.Info().Msg("Establish BigQuery Batch Load Client")
+	streamer, err := NewBatchStreamer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &RunSummary{}
+	batch := &NDJSONBatch{}
+	flush := func() error {
+		summary.Batches++
+		return streamer.Write(batch.Take())
+	}
+
+	startTime := time.Now()
+	logger.Info().Int("Batch Size", config.BatchSize).Msg("Start Loading Data")
+	for data := range newGenerator(ctx, config.NumberIterations, config.RunID, config.DataGenerator()) {
+		// Stop the run once the next record would exceed the cost budget
+		if config.Budget != nil && !config.Budget.Allows(summary, RecordSize(data)) {
+			summary.BudgetExhausted = true
+			logger.Warn().Int("Records Sent", summary.RecordsSent).Msg("  Stopping as the Next Record Would Exceed the Cost Budget")
+			break
+		}
+
+		err := batch.Add(data)
+		for err != nil {
+			config.Errors.Add(err)
+			switch config.RecordErrorHandler().Handle(data, err) {
+			case ActionAbort:
+				CloseStreamer(streamer, config.DrainTimeout)
+				return summary, err
+			case ActionRetry:
+				summary.RecordsRetried++
+				err = batch.Add(data)
+				continue
+			}
+			summary.RecordsSkipped++
+			break
+		}
+		if err != nil {
+			continue
+		}
+		summary.RecordsSent++
+		config.Landed.AddSent(1)
+		config.Heartbeat.AddSent(1)
+		config.Health.AddSent(1)
+		summary.AddRecordBytes(RecordSize(data))
+		if batch.Rows() == config.BatchSize {
+			if err := flush(); err != nil {
+				CloseStreamer(streamer, config.DrainTimeout)
+				return summary, err
+			}
+		}
+
+		if config.Verbose {
+			if math.Mod(float64(summary.RecordsSent), 10000) == 0 {
+				logger.Info().Int("Records Sent", summary.RecordsSent).Msg(indent)
+			}
+		}
+	}
+	if batch.Rows() > 0 {
+		if err := flush(); err != nil {
+			CloseStreamer(streamer, config.DrainTimeout)
+			return summary, err
+		}
+	}
+	logger.Info().Msg("End Loading Data")
+
+	// Close the streamer, waiting for the load jobs still running to complete
+	logger.Info().Int("Load Jobs", summary.Batches).Msg("Waiting for the Load Jobs to Complete")
+	drainStart := time.Now()
+	drained := CloseStreamer(streamer, config.DrainTimeout)
+	summary.DrainElapsed = time.Since(drainStart)
+	if !drained {
+		logger.Warn().Dur("Drain Timeout", config.DrainTimeout).Msg("  Load Jobs Failed to Complete Before the Timeout")
+		return summary, errDrainTimeout
+	}
+	summary.Elapsed = time.Since(startTime)
+	logger.Info().Int("Records Sent", summary.RecordsSent).Int("Load Jobs", summary.Batches).Dur("Time Taken", summary.Elapsed).
+		Str("Records per Second", fmt.Sprintf("%.1f", float64(summary.RecordsSent)/summary.Elapsed.Seconds())).Msg(indent)
+	LogThroughput(summary, config.BatchSize)
+	return summary, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+)
+
+// Largest batch size of a single insertAll request
+const maxInsertAllBatchSize = 50000
+
+// BatchRamp doubles the batch size of an insertAll run from the start toward
+// the end every interval of records, showing whether there is an optimal
+// transition point and whether changing the batch size mid-run disrupts the
+// stream.  The batch size of a streamer is fixed, so each change rebuilds the
+// streamers, after flushing the rows of the previous batch size.
+type BatchRamp struct {
+	start    int
+	end      int
+	interval int
+	size     int
+	next     int
+	marked   int
+	markedAt time.Time
+}
+
+// NewBatchRamp creates the ramp from the start to the end batch size,
+// doubling every interval of records
+func NewBatchRamp(start, end, interval int) *BatchRamp {
+	return &BatchRamp{start: start, end: end, interval: interval, size: start, next: interval}
+}
+
+// Start marks the start of the run, from which the rate of the first batch
+// size is measured
+func (r *BatchRamp) Start() {
+	if r == nil {
+		return
+	}
+	r.size, r.next, r.marked, r.markedAt = r.start, r.interval, 0, time.Now()
+}
+
+// Next returns the batch size to change to once the records have been sent,
+// and false while the batch size is unchanged.  A nil ramp never changes the
+// batch size.
+func (r *BatchRamp) Next(recordsSent int) (int, bool) {
+	if r == nil || r.size >= r.end || recordsSent < r.next {
+		return r.Size(), false
+	}
+	previous := r.size
+	r.size = min(r.size*2, r.end)
+	r.next += r.interval
+	LogBatchRampChange(previous, r.size, recordsSent, r.rate(recordsSent))
+	return r.size, true
+}
+
+// Finish outputs the records per second achieved by the final batch size
+func (r *BatchRamp) Finish(recordsSent int) {
+	if r == nil {
+		return
+	}
+	logger.Info().Int("Batch Size", r.size).Int("Records Sent", recordsSent).Float64("Records per Second", r.rate(recordsSent)).Msg("  Final Batch Size")
+}
+
+// Size returns the current batch size, zero for a nil ramp
+func (r *BatchRamp) Size() int {
+	if r == nil {
+		return 0
+	}
+	return r.size
+}
+
+// rate returns the records per second sent since the last change, marking
+// the start of the next
+func (r *BatchRamp) rate(recordsSent int) float64 {
+	rate := 0.0
+	if elapsed := time.Since(r.markedAt); elapsed > 0 {
+		rate = float64(recordsSent-r.marked) / elapsed.Seconds()
+	}
+	r.marked, r.markedAt = recordsSent, time.Now()
+	return rate
+}
+
+// LogBatchRampChange outputs a change of the batch size, along with the
+// records per second achieved by the previous batch size
+func LogBatchRampChange(from, to, recordsSent int, rate float64) {
+	logger.Info().Int("From", from).Int("To", to).Int("Records Sent", recordsSent).Float64("Records per Second", rate).Msg("Batch Size Changed")
+}
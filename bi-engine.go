@@ -0,0 +1,123 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// biEngineBigQuerySchema is the BI Engine friendly schema, holding only the
+// INTEGER and STRING columns of the table data schema
+var biEngineBigQuerySchema = bigquery.Schema{
+	{Name: "name", Type: bigquery.StringFieldType},
+	{Name: "uuid", Type: bigquery.IntegerFieldType},
+	{Name: "run_id", Type: bigquery.StringFieldType},
+}
+
+// ExecuteBIEngineTest creates a table clustered for BI Engine, loads the
+// given number of generated records and runs an aggregate query, logging
+// whether the query was accelerated by BI Engine.  BI Engine is applied
+// automatically when the project has a reservation covering the table, so
+// no job configuration is required to request it.  The table is deleted
+// afterwards.
+func ExecuteBIEngineTest(ctx context.Context, client *bigquery.Client, datasetID, tableID, runID string, rows int) error {
+	biTableID := tableID + "_bi_engine"
+	table := client.Dataset(datasetID).Table(biTableID)
+
+	logger.Info().Str("Table Name", biTableID).Msg("Creating BI Engine Test BigQuery Table")
+	err := table.Create(ctx, &bigquery.TableMetadata{
+		Schema:         biEngineBigQuerySchema,
+		Clustering:     &bigquery.Clustering{Fields: []string{"name"}},
+		ExpirationTime: time.Now().Add(24 * time.Hour),
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		logger.Info().Str("Table Name", biTableID).Msg("Deleting BI Engine Test BigQuery Table")
+		if err := table.Delete(context.Background()); err != nil {
+			logger.Warn().Err(err).Msg("Error [table.Delete]")
+		}
+	}()
+
+	// Records are loaded rather than streamed, as rows in the streaming
+	// buffer are not eligible for BI Engine acceleration
+	logger.Info().Int("Records", rows).Msg("  Loading Records")
+	if err := LoadGeneratedRows(ctx, table, biEngineBigQuerySchema, runID, rows, NewTableData); err != nil {
+		return err
+	}
+
+	q := client.Query(fmt.Sprintf("SELECT name, COUNT(*) FROM `%s.%s` GROUP BY name", datasetID, biTableID))
+	q.DisableQueryCache = true
+	job, err := q.Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := WaitForJob(ctx, job)
+	if err != nil {
+		return err
+	}
+	if err := status.Err(); err != nil {
+		return err
+	}
+
+	it, err := job.Read(ctx)
+	if err != nil {
+		return err
+	}
+	groups := 0
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		groups++
+	}
+
+	logger.Info().Str("Job ID", job.ID()).Int("Groups", groups).Msg("  BI Engine Aggregate Query Complete")
+	LogBIEngineStatistics(status.Statistics)
+	return nil
+}
+
+// LogBIEngineStatistics outputs whether a query job used BI Engine, and the
+// reasons given by BigQuery when it was not fully accelerated.
+func LogBIEngineStatistics(statistics *bigquery.JobStatistics) {
+	var biEngine *bigquery.BIEngineStatistics
+	if statistics != nil {
+		if queryStatistics, ok := statistics.Details.(*bigquery.QueryStatistics); ok {
+			biEngine = queryStatistics.BIEngineStatistics
+		}
+	}
+
+	if biEngine == nil || biEngine.BIEngineMode == "" || biEngine.BIEngineMode == "DISABLED" {
+		logger.Warn().Msg("  Query was not Accelerated by BI Engine")
+	} else {
+		logger.Info().Str("BI Engine Mode", biEngine.BIEngineMode).Msg("  Query was Accelerated by BI Engine")
+	}
+	if biEngine != nil {
+		for _, reason := range biEngine.BIEngineReasons {
+			logger.Info().Str("Code", reason.Code).Str("Message", reason.Message).Msg(indent)
+		}
+	}
+}
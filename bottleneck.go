@@ -0,0 +1,137 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Records are timed 1 in bottleneckSampleEvery for the bottleneck heuristic,
+// keeping the clock reads off the hot path
+const bottleneckSampleEvery = 100
+
+// Bottleneck verdicts
+const (
+	bottleneckGenerator    = "generator-bound"
+	bottleneckClientCPU    = "client-CPU-bound"
+	bottleneckBackpressure = "queue/backpressure-bound"
+	bottleneckNetwork      = "network/API-latency-bound"
+	bottleneckQuota        = "quota-bound"
+	bottleneckInconclusive = "inconclusive"
+)
+
+// Thresholds of the bottleneck heuristic, as fractions of the elapsed time,
+// or of the CPU time available for the CPU utilisation
+const (
+	bottleneckDominant     = 0.50
+	bottleneckMinor        = 0.20
+	bottleneckCPUSaturated = 0.85
+	bottleneckBurstRatio   = 10
+)
+
+// BottleneckMeasurements holds the measurements of a run used to classify
+// its bottleneck
+type BottleneckMeasurements struct {
+	Elapsed       time.Duration
+	CPUs          int
+	ProcessCPU    time.Duration
+	GeneratorWait time.Duration
+	WriteBlocked  time.Duration
+	WriteP50      time.Duration
+	WriteP95      time.Duration
+	QuotaErrors   int
+}
+
+// BottleneckEvidence is one of the numbers justifying a verdict
+type BottleneckEvidence struct {
+	Name  string
+	Value string
+}
+
+// Bottleneck holds the verdict of the classification and its evidence
+type Bottleneck struct {
+	Verdict  string
+	Evidence []BottleneckEvidence
+}
+
+// fraction returns the duration as a fraction of the elapsed time
+func (m BottleneckMeasurements) fraction(d time.Duration) float64 {
+	if m.Elapsed <= 0 {
+		return 0
+	}
+	return float64(d) / float64(m.Elapsed)
+}
+
+// CPUUtilisation returns the process CPU time as a fraction of the CPU time
+// available over the run
+func (m BottleneckMeasurements) CPUUtilisation() float64 {
+	if m.CPUs < 1 {
+		return 0
+	}
+	return m.fraction(m.ProcessCPU) / float64(m.CPUs)
+}
+
+// ClassifyBottleneck conservatively classifies the bottleneck of a run.
+// Each regime is recognised by its own signals, and the result is
+// inconclusive unless exactly one regime is recognised.
+func ClassifyBottleneck(m BottleneckMeasurements) Bottleneck {
+	generator := m.fraction(m.GeneratorWait)
+	blocked := m.fraction(m.WriteBlocked)
+	cpu := m.CPUUtilisation()
+
+	generatorEvidence := BottleneckEvidence{"Generator Wait", percent(generator)}
+	blockedEvidence := BottleneckEvidence{"Blocked in Write", percent(blocked)}
+	cpuEvidence := BottleneckEvidence{"CPU Utilisation", percent(cpu)}
+	latencyEvidence := BottleneckEvidence{"Write p50/p95", fmt.Sprintf("%s/%s", m.WriteP50, m.WriteP95)}
+
+	var verdicts []Bottleneck
+	if generator >= bottleneckDominant && blocked < bottleneckMinor {
+		verdicts = append(verdicts, Bottleneck{bottleneckGenerator, []BottleneckEvidence{generatorEvidence, blockedEvidence}})
+	}
+	if cpu >= bottleneckCPUSaturated && generator < bottleneckDominant {
+		verdicts = append(verdicts, Bottleneck{bottleneckClientCPU, []BottleneckEvidence{cpuEvidence, generatorEvidence, blockedEvidence}})
+	}
+	if blocked >= bottleneckDominant {
+		switch {
+		case m.QuotaErrors > 0:
+			verdicts = append(verdicts, Bottleneck{bottleneckQuota, []BottleneckEvidence{{"Quota Errors", fmt.Sprint(m.QuotaErrors)}, blockedEvidence}})
+		case m.WriteP50 <= 0 || m.WriteP95 <= 0:
+			// Without the write latency, backpressure and latency cannot be told apart
+		case m.WriteP95 >= bottleneckBurstRatio*m.WriteP50:
+			verdicts = append(verdicts, Bottleneck{bottleneckBackpressure, []BottleneckEvidence{blockedEvidence, latencyEvidence}})
+		default:
+			verdicts = append(verdicts, Bottleneck{bottleneckNetwork, []BottleneckEvidence{blockedEvidence, latencyEvidence, cpuEvidence}})
+		}
+	}
+
+	if len(verdicts) == 1 {
+		return verdicts[0]
+	}
+	return Bottleneck{bottleneckInconclusive, []BottleneckEvidence{generatorEvidence, blockedEvidence, cpuEvidence}}
+}
+
+// percent formats a fraction as a percentage
+func percent(fraction float64) string {
+	return fmt.Sprintf("%.1f%%", fraction*100)
+}
+
+// LogBottleneck outputs the verdict and the numbers justifying it
+func LogBottleneck(bottleneck Bottleneck) {
+	logger.Info().Str("Verdict", bottleneck.Verdict).Msg("Bottleneck")
+	for _, evidence := range bottleneck.Evidence {
+		logger.Info().Str(evidence.Name, evidence.Value).Msg(indent)
+	}
+}
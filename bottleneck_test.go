@@ -0,0 +1,46 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClassifyBottleneck(t *testing.T) {
+	// Synthetic measurements of one minute runs on four CPUs representing
+	// each regime
+	tests := []struct {
+		name         string
+		measurements BottleneckMeasurements
+		verdict      string
+	}{
+		{"Generator", BottleneckMeasurements{Elapsed: time.Minute, CPUs: 4, ProcessCPU: 70 * time.Second, GeneratorWait: 45 * time.Second, WriteBlocked: 5 * time.Second, WriteP50: time.Microsecond, WriteP95: 2 * time.Microsecond}, bottleneckGenerator},
+		{"Client CPU", BottleneckMeasurements{Elapsed: time.Minute, CPUs: 4, ProcessCPU: 220 * time.Second, GeneratorWait: 10 * time.Second, WriteBlocked: 20 * time.Second, WriteP50: 2 * time.Microsecond, WriteP95: 5 * time.Microsecond}, bottleneckClientCPU},
+		{"Backpressure", BottleneckMeasurements{Elapsed: time.Minute, CPUs: 4, ProcessCPU: 30 * time.Second, GeneratorWait: 5 * time.Second, WriteBlocked: 48 * time.Second, WriteP50: 3 * time.Microsecond, WriteP95: 40 * time.Millisecond}, bottleneckBackpressure},
+		{"Network", BottleneckMeasurements{Elapsed: time.Minute, CPUs: 4, ProcessCPU: 20 * time.Second, GeneratorWait: 5 * time.Second, WriteBlocked: 50 * time.Second, WriteP50: 8 * time.Millisecond, WriteP95: 20 * time.Millisecond}, bottleneckNetwork},
+		{"Quota", BottleneckMeasurements{Elapsed: time.Minute, CPUs: 4, ProcessCPU: 15 * time.Second, GeneratorWait: 2 * time.Second, WriteBlocked: 52 * time.Second, WriteP50: 10 * time.Millisecond, WriteP95: 900 * time.Millisecond, QuotaErrors: 12}, bottleneckQuota},
+		{"Busy CPU and Slow Network", BottleneckMeasurements{Elapsed: time.Minute, CPUs: 4, ProcessCPU: 230 * time.Second, GeneratorWait: 5 * time.Second, WriteBlocked: 50 * time.Second, WriteP50: 8 * time.Millisecond, WriteP95: 20 * time.Millisecond}, bottleneckInconclusive},
+		{"Blocked without Latency", BottleneckMeasurements{Elapsed: time.Minute, CPUs: 4, ProcessCPU: 20 * time.Second, GeneratorWait: 5 * time.Second, WriteBlocked: 50 * time.Second}, bottleneckInconclusive},
+		{"No Dominant Wait", BottleneckMeasurements{Elapsed: time.Minute, CPUs: 4, ProcessCPU: 40 * time.Second, GeneratorWait: 20 * time.Second, WriteBlocked: 20 * time.Second}, bottleneckInconclusive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if verdict := ClassifyBottleneck(tt.measurements).Verdict; verdict != tt.verdict {
+				t.Errorf("classified %s, expected %s", verdict, tt.verdict)
+			}
+		})
+	}
+}
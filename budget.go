@@ -0,0 +1,118 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// CostBudget caps the estimated spend of a run, converted to a byte budget
+// using the price per GiB of the write API
+type CostBudget struct {
+	API         string
+	MaxCost     float64
+	PricePerGiB float64
+	MaxBytes    int64
+}
+
+// WriteAPI returns the write API billed for the method of the run, the
+// committed streams and -m storage writing through the Storage Write API
+func WriteAPI(writeMode string, committed bool) string {
+	if committed || writeMode == modeStorage {
+		return apiStorage
+	}
+	return apiInsertAll
+}
+
+// WritePricePerGiB returns the list price in USD per GiB written using the
+// named API in the region, being the first tier for the Storage Write API
+func WritePricePerGiB(api, region string) float64 {
+	if api == apiStorage {
+		multiplier := 1.0
+		if price, ok := streamingPricePerGiB[region]; ok && streamingPricePerGiB["US"] > 0 {
+			multiplier = price / streamingPricePerGiB["US"]
+		}
+		return storageWriteTierPricePerGiB * multiplier
+	}
+	return streamingPricePerGiB[region]
+}
+
+// NewCostBudget creates a budget of maxCost at the given price per GiB
+func NewCostBudget(api string, maxCost, pricePerGiB float64) (*CostBudget, error) {
+	if pricePerGiB <= 0 {
+		return nil, fmt.Errorf("a positive price per GiB is required to apply a maximum cost of %.2f", maxCost)
+	}
+	return &CostBudget{
+		API:         api,
+		MaxCost:     maxCost,
+		PricePerGiB: pricePerGiB,
+		MaxBytes:    int64(maxCost / pricePerGiB * bytesPerGiB),
+	}, nil
+}
+
+// billedBytes returns the bytes billed for a record of the given size, the
+// insertAll API applying a minimum billable row size
+func (b *CostBudget) billedBytes(size int) int64 {
+	if b.API == apiInsertAll && size < minimumBillableRowBytes {
+		return minimumBillableRowBytes
+	}
+	return int64(size)
+}
+
+// SpentBytes returns the bytes of the run counted against the budget
+func (b *CostBudget) SpentBytes(summary *RunSummary) int64 {
+	if b.API == apiInsertAll {
+		return summary.BillableBytes
+	}
+	return summary.BytesSent
+}
+
+// Allows reports whether a record of the given size can be sent without the
+// cumulative bytes exceeding the budget
+func (b *CostBudget) Allows(summary *RunSummary, size int) bool {
+	return b.SpentBytes(summary)+b.billedBytes(size) <= b.MaxBytes
+}
+
+// EstimatedCost returns the estimated spend of the bytes
+func (b *CostBudget) EstimatedCost(bytes int64) float64 {
+	return float64(bytes) / bytesPerGiB * b.PricePerGiB
+}
+
+// EstimatePlannedBytes estimates the bytes billed for the planned number of
+// records, from the size of a generated sample record
+func (b *CostBudget) EstimatePlannedBytes(gen dataGenerator, runID string, records int) int64 {
+	sample := gen(randomNames[0], 0, time.Now().UTC(), runID)
+	return b.billedBytes(RecordSize(sample)) * int64(records)
+}
+
+// LogEstimate outputs the pre-run estimate of the planned workload
+func (b *CostBudget) LogEstimate(plannedBytes int64) {
+	logger.Info().Msg("Pre-Run Cost Estimate")
+	logger.Info().Str("API", b.API).Float64("Price per GiB", b.PricePerGiB).Msg(indent)
+	logger.Info().Int64("Planned Bytes", plannedBytes).Str("Estimated Cost", fmt.Sprintf("%.6f", b.EstimatedCost(plannedBytes))).Msg(indent)
+	logger.Info().Int64("Budget Bytes", b.MaxBytes).Str("Maximum Cost", fmt.Sprintf("%.6f", b.MaxCost)).Msg(indent)
+}
+
+// LogSpend outputs the estimated spend of the run against the budget
+func (b *CostBudget) LogSpend(summary *RunSummary) {
+	spent := b.SpentBytes(summary)
+	event := logger.Info()
+	if summary.BudgetExhausted {
+		event = logger.Warn()
+	}
+	event.Int64("Bytes", spent).Str("Estimated Spend", fmt.Sprintf("%.6f", b.EstimatedCost(spent))).
+		Str("Maximum Cost", fmt.Sprintf("%.6f", b.MaxCost)).Bool("Budget Exhausted", summary.BudgetExhausted).Msg("Cost Budget")
+}
@@ -0,0 +1,40 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+// TestWriteAPI expects the Storage Write API to be billed for every method
+// writing through it, and the insertAll API otherwise
+func TestWriteAPI(t *testing.T) {
+	tests := []struct {
+		name      string
+		writeMode string
+		committed bool
+		expected  string
+	}{
+		{"insertAll", modeInsertAll, false, apiInsertAll},
+		{"Storage Write API", modeStorage, false, apiStorage},
+		{"Committed Stream", modeInsertAll, true, apiStorage},
+		{"Batch Load", modeBatch, false, apiInsertAll},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if api := WriteAPI(tt.writeMode, tt.committed); api != tt.expected {
+				t.Errorf("WriteAPI returned %s, expected %s", api, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	run "google.golang.org/api/run/v2"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// Interval between polls of the execution of a Cloud Run Job
+const cloudRunPollInterval = 10 * time.Second
+
+// Name of the results file written by each task of a Cloud Run Job
+const cloudRunResultsFile = "task-%d.json"
+
+// cloudRunControllerFlags are the flags of the process submitting a Cloud Run
+// Job which are not passed on to its tasks, the table being created, and any
+// preload and results file written, by the submitting process alone
+var cloudRunControllerFlags = map[string]bool{
+	"cleanup":           true,
+	"cloud-run-job":     true,
+	"cloud-run-tasks":   true,
+	"cloud-run-region":  true,
+	"cloud-run-results": true,
+	"o":                 true,
+	"output":            true,
+	"preload-rows":      true,
+}
+
+// CloudRunTask identifies a task of a Cloud Run Job execution, detected from
+// the variables Cloud Run sets in the environment of each task
+type CloudRunTask struct {
+	Index int
+	Count int
+}
+
+// DetectCloudRunTask returns the task this process runs as, nil outside of a
+// Cloud Run Job
+func DetectCloudRunTask() *CloudRunTask {
+	index, err := strconv.Atoi(os.Getenv("CLOUD_RUN_TASK_INDEX"))
+	if err != nil {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("CLOUD_RUN_TASK_COUNT"))
+	if err != nil || count < 1 || index < 0 || index >= count {
+		return nil
+	}
+	return &CloudRunTask{Index: index, Count: count}
+}
+
+// Shard returns the records written by this task, the total split evenly
+// with any remainder written by the first tasks, along with the offset of
+// its first record, so every task generates a distinct range of uuids
+func (t *CloudRunTask) Shard(records int) (int, int) {
+	share, remainder := records/t.Count, records%t.Count
+	offset := t.Index*share + min(t.Index, remainder)
+	if t.Index < remainder {
+		share++
+	}
+	return share, offset
+}
+
+// ParseStorageLocation splits a gs://bucket/prefix location into its bucket
+// and prefix
+func ParseStorageLocation(location string) (string, string, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, "gs://"), "/")
+	if !strings.HasPrefix(location, "gs://") || bucket == "" {
+		return "", "", fmt.Errorf("invalid Cloud Storage location %q, expected gs://bucket/prefix", location)
+	}
+	return bucket, strings.Trim(prefix, "/"), nil
+}
+
+// CloudRunJob executes the tasks of an existing Cloud Run Job, whose
+// container runs this binary, each task writing its results to a shared
+// Cloud Storage location
+type CloudRunJob struct {
+	Name    string
+	Tasks   int
+	Bucket  string
+	Prefix  string
+	run     *run.Service
+	storage *storage.Service
+}
+
+// NewCloudRunJob creates the clients used to execute the job, given by name
+// in the region or by its full resource name, with the results of the run
+// written under the gs://bucket/prefix location
+func NewCloudRunJob(ctx context.Context, projectID, region, job string, tasks int, location, runID string) (*CloudRunJob, error) {
+	bucket, prefix, err := ParseStorageLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	name := job
+	if !strings.HasPrefix(job, "projects/") {
+		name = fmt.Sprintf("projects/%s/locations/%s/jobs/%s", projectID, region, job)
+	}
+
+	runService, err := run.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	storageService, err := storage.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &CloudRunJob{Name: name, Tasks: tasks, Bucket: bucket, Prefix: path.Join(prefix, runID), run: runService, storage: storageService}, nil
+}
+
+// Location returns the gs://bucket/prefix location the tasks write their
+// results to
+func (j *CloudRunJob) Location() string {
+	return fmt.Sprintf("gs://%s/%s", j.Bucket, j.Prefix)
+}
+
+// Execute runs the tasks of the job with the arguments, waiting for the
+// execution to complete.  The context being cancelled stops the wait, not
+// the execution.
+func (j *CloudRunJob) Execute(ctx context.Context, args []string) error {
+	request := &run.GoogleCloudRunV2RunJobRequest{
+		Overrides: &run.GoogleCloudRunV2Overrides{
+			TaskCount:          int64(j.Tasks),
+			ContainerOverrides: []*run.GoogleCloudRunV2ContainerOverride{{Args: args}},
+		},
+	}
+	operation, err := j.run.Projects.Locations.Jobs.Run(j.Name, request).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	logger.Info().Str("Job", j.Name).Int("Tasks", j.Tasks).Str("Operation", operation.Name).Msg("Executing Cloud Run Job")
+
+	for !operation.Done {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(cloudRunPollInterval):
+		}
+		if operation, err = j.run.Projects.Locations.Operations.Get(operation.Name).Context(ctx).Do(); err != nil {
+			return err
+		}
+	}
+	if operation.Error != nil {
+		return fmt.Errorf("the execution of Cloud Run Job %s failed: %s", j.Name, operation.Error.Message)
+	}
+	return nil
+}
+
+// ReadResults reads the results written by each task, returning the indexes
+// of the tasks which wrote none
+func (j *CloudRunJob) ReadResults(ctx context.Context) ([]*RunResults, []int, error) {
+	var results []*RunResults
+	var missing []int
+	for i := 0; i < j.Tasks; i++ {
+		response, err := j.storage.Objects.Get(j.Bucket, path.Join(j.Prefix, fmt.Sprintf(cloudRunResultsFile, i))).Context(ctx).Download()
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			missing = append(missing, i)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		task, err := ParseResults(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read the results of task %d: %w", i, err)
+		}
+		results = append(results, task)
+	}
+	return results, missing, nil
+}
+
+// WriteCloudRunTaskResults writes the results of this task under the
+// gs://bucket/prefix location given to the tasks
+func WriteCloudRunTaskResults(ctx context.Context, location string, task *CloudRunTask, data []byte) error {
+	return WriteLocation(ctx, strings.TrimRight(location, "/")+"/"+fmt.Sprintf(cloudRunResultsFile, task.Index), data)
+}
+
+// CloudRunTaskArgs returns the arguments of this process to pass on to the
+// tasks, less the flags of the submitting process, adding the location the
+// tasks write their results to
+func CloudRunTaskArgs(args []string, location string) []string {
+	return append(StripFlags(args, cloudRunControllerFlags), "-cloud-run-results", location)
+}
+
+// StripFlags returns the arguments less the named flags, along with the
+// value of each which is not a boolean flag given as a separate argument
+func StripFlags(args []string, names map[string]bool) []string {
+	var stripped []string
+	for i := 0; i < len(args); i++ {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") || !names[name] {
+			stripped = append(stripped, args[i])
+			continue
+		}
+		if f := flag.Lookup(name); !hasValue && f != nil {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				i++
+			}
+		}
+	}
+	return stripped
+}
+
+// AggregateCloudRunResults combines the results of the tasks into those of
+// the whole run, the records per second being those sent by every task over
+// the elapsed time of the slowest
+func AggregateCloudRunResults(base *RunResults, tasks []*RunResults) *RunResults {
+	results := *base
+	results.CloudRunTasks = tasks
+	for _, task := range tasks {
+		results.RecordsSent += task.RecordsSent
+		results.RecordsAbandoned += task.RecordsAbandoned
+		results.RecordsSkipped += task.RecordsSkipped
+		results.RecordsRetried += task.RecordsRetried
+		results.BytesSent += task.BytesSent
+		results.BillableBytes += task.BillableBytes
+		results.ElapsedSeconds = max(results.ElapsedSeconds, task.ElapsedSeconds)
+	}
+	if results.ElapsedSeconds > 0 {
+		results.RecordsPerSecond = float64(results.RecordsSent) / results.ElapsedSeconds
+	}
+	return &results
+}
+
+// LogCloudRunResults outputs the results of each task and of the whole run
+func LogCloudRunResults(results *RunResults, missing []int) {
+	logger.Info().Int("Tasks", len(results.CloudRunTasks)).Msg("Cloud Run Job Results")
+	for _, task := range results.CloudRunTasks {
+		event := logger.Info()
+		if task.Error != "" {
+			event = logger.Warn().Str("Error", task.Error)
+		}
+		event.Str("Run ID", task.RunID).Int("Records Sent", task.RecordsSent).Float64("Elapsed Seconds", task.ElapsedSeconds).
+			Str("Records per Second", fmt.Sprintf("%.1f", task.RecordsPerSecond)).Msg(indent)
+	}
+	if len(missing) > 0 {
+		logger.Warn().Ints("Tasks", missing).Msg("  Tasks Which Wrote No Results")
+	}
+	logger.Info().Int("Records Sent", results.RecordsSent).Float64("Elapsed Seconds", results.ElapsedSeconds).
+		Str("Records per Second", fmt.Sprintf("%.1f", results.RecordsPerSecond)).Msg("  Total")
+}
@@ -0,0 +1,565 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/avro"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+	"github.com/apache/arrow/go/v15/parquet"
+	"github.com/apache/arrow/go/v15/parquet/file"
+	"github.com/apache/arrow/go/v15/parquet/pqarrow"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// Formats of the columnar -input files, detected from their extension
+const (
+	columnarParquet = "parquet"
+	columnarAvro    = "avro"
+)
+
+// Rows decoded into each Arrow record read from a columnar input, bounding the
+// memory held however large the file
+const columnarBatchRows = 1024
+
+// ColumnarInputFormat returns the format of a Parquet or Avro -input file,
+// local or gs://bucket/object, empty for any other input
+func ColumnarInputFormat(address string) string {
+	if address == stdioAddress || strings.HasPrefix(address, unixSocketAddress) {
+		return ""
+	}
+	switch strings.ToLower(path.Ext(address)) {
+	case ".parquet":
+		return columnarParquet
+	case ".avro":
+		return columnarAvro
+	}
+	return ""
+}
+
+// ColumnMismatch describes a field of a columnar input which does not map
+// cleanly onto the table schema.  A fatal mismatch prevents the input being
+// streamed at all.
+type ColumnMismatch struct {
+	Field  string
+	Reason string
+	Fatal  bool
+}
+
+// ColumnarInput streams the rows of a Parquet or Avro file in place of the
+// generated records, mapping its fields onto the table schema by name
+type ColumnarInput struct {
+	Format  string
+	records array.RecordReader
+	schema  bigquery.Schema
+	closer  io.Closer
+	rows    int64
+}
+
+// OpenColumnarInput opens the Parquet or Avro file, local or in Cloud Storage,
+// and checks its fields against the table schema, logging every mismatch and
+// returning an error if any field cannot be written.  The file is read a batch
+// of rows at a time, never being held in memory whole.
+func OpenColumnarInput(ctx context.Context, address string, schema bigquery.Schema) (*ColumnarInput, error) {
+	input := &ColumnarInput{Format: ColumnarInputFormat(address), schema: schema, rows: -1}
+	var err error
+	switch input.Format {
+	case columnarParquet:
+		err = input.openParquet(ctx, address)
+	case columnarAvro:
+		err = input.openAvro(ctx, address)
+	default:
+		return nil, fmt.Errorf("%s is neither a .parquet nor an .avro file", address)
+	}
+	if err != nil {
+		input.Close()
+		return nil, err
+	}
+
+	mismatches := MatchColumnarSchema(input.records.Schema(), schema)
+	logger.Info().Str("Input", address).Str("Format", input.Format).Int("Fields", len(input.records.Schema().Fields())).Msg("Checking the Input Schema")
+	fatal := 0
+	for _, mismatch := range mismatches {
+		if mismatch.Fatal {
+			fatal++
+			logger.Error().Str("Field", mismatch.Field).Str("Reason", mismatch.Reason).Msg(indent)
+		} else {
+			logger.Warn().Str("Field", mismatch.Field).Str("Reason", mismatch.Reason).Msg(indent)
+		}
+	}
+	if fatal > 0 {
+		input.Close()
+		return nil, fmt.Errorf("%d fields of %s cannot be written to the table", fatal, address)
+	}
+	return input, nil
+}
+
+// openParquet reads the Parquet file through a reader of its row groups, a
+// Cloud Storage object being read by ranged requests
+func (c *ColumnarInput) openParquet(ctx context.Context, address string) error {
+	var source parquet.ReaderAtSeeker
+	if strings.HasPrefix(address, "gs://") {
+		object, err := openStorageObjectReaderAt(ctx, address)
+		if err != nil {
+			return err
+		}
+		source = object
+	} else {
+		f, err := os.Open(address)
+		if err != nil {
+			return err
+		}
+		c.closer, source = f, f
+	}
+
+	reader, err := file.NewParquetReader(source)
+	if err != nil {
+		return err
+	}
+	c.rows = reader.NumRows()
+	fileReader, err := pqarrow.NewFileReader(reader, pqarrow.ArrowReadProperties{BatchSize: columnarBatchRows}, memory.DefaultAllocator)
+	if err != nil {
+		return err
+	}
+	c.records, err = fileReader.GetRecordReader(ctx, nil, nil)
+	return err
+}
+
+// openAvro reads the Avro object container file as a stream
+func (c *ColumnarInput) openAvro(ctx context.Context, address string) error {
+	var source io.ReadCloser
+	if strings.HasPrefix(address, "gs://") {
+		bucket, object, err := ParseStorageLocation(address)
+		if err != nil {
+			return err
+		}
+		storageService, err := storage.NewService(ctx)
+		if err != nil {
+			return err
+		}
+		response, err := storageService.Objects.Get(bucket, object).Context(ctx).Download()
+		if err != nil {
+			return err
+		}
+		source = response.Body
+	} else {
+		f, err := os.Open(address)
+		if err != nil {
+			return err
+		}
+		source = f
+	}
+	c.closer = source
+
+	reader, err := avro.NewOCFReader(source, avro.WithChunk(columnarBatchRows))
+	if err != nil {
+		return err
+	}
+	c.records = reader
+	return nil
+}
+
+// Close releases the reader and closes the file
+func (c *ColumnarInput) Close() error {
+	if c.records != nil {
+		c.records.Release()
+	}
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
+
+// Rows reads the rows of the input, tagged with the run_id of this run.  A
+// row whose values cannot be written to the table is skipped with a warning,
+// the same as an invalid row of an NDJSON input, and the rows read and skipped
+// are logged once the input is exhausted so the count of rows written can be
+// reconciled exactly with the file.
+func (c *ColumnarInput) Rows(ctx context.Context, runID string) <-chan interface{} {
+	ch := make(chan interface{}, 1)
+	go func() {
+		defer close(ch)
+		var read, skipped int64
+		for c.records.Next() {
+			record := c.records.Record()
+			columns := columnarColumns(record.Schema(), c.schema)
+			for i := 0; i < int(record.NumRows()); i++ {
+				read++
+				row, err := columnarRow(record, i, columns)
+				if err != nil {
+					skipped++
+					logger.Warn().Err(err).Int64("Row", read).Msg("  Skipping an Invalid Input Row")
+					continue
+				}
+				row["run_id"] = runID
+
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- &schemaDataRecord{row: row}:
+				}
+			}
+		}
+		if err := c.records.Err(); err != nil && !errors.Is(err, io.EOF) {
+			logger.Warn().Err(err).Msg("  Failed to Read the Input Rows")
+		}
+		event := logger.Info()
+		if c.rows >= 0 && read != c.rows {
+			event = logger.Warn().Int64("Rows in File", c.rows)
+		}
+		event.Int64("Rows Read", read).Int64("Rows Skipped", skipped).Msg("  Input Rows")
+	}()
+	return ch
+}
+
+// columnarColumn maps a field of the table to its column of the input
+type columnarColumn struct {
+	field  *bigquery.FieldSchema
+	column int
+}
+
+// columnarColumns maps each field of the table present in the input to its
+// column, the run_id being set by the run
+func columnarColumns(source *arrow.Schema, target bigquery.Schema) []columnarColumn {
+	var columns []columnarColumn
+	for _, field := range target {
+		if field.Name == "run_id" {
+			continue
+		}
+		if indices := source.FieldIndices(field.Name); len(indices) > 0 {
+			columns = append(columns, columnarColumn{field: field, column: indices[0]})
+		}
+	}
+	return columns
+}
+
+// columnarRow converts a row of the record into the JSON representation of
+// each field mapped from the input
+func columnarRow(record arrow.Record, i int, columns []columnarColumn) (map[string]bigquery.Value, error) {
+	row := make(map[string]bigquery.Value, len(columns)+1)
+	for _, column := range columns {
+		value, err := columnarValue(record.Column(column.column), i, column.field)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", column.field.Name, err)
+		}
+		if value != nil {
+			row[column.field.Name] = value
+		}
+	}
+	return row, nil
+}
+
+// columnarValue converts the value at index i of the column into the JSON
+// representation of the field, the same as the generated records
+func columnarValue(column arrow.Array, i int, field *bigquery.FieldSchema) (bigquery.Value, error) {
+	if column.IsNull(i) {
+		if field.Required {
+			return nil, errors.New("NULL in a REQUIRED field")
+		}
+		return nil, nil
+	}
+	if field.Repeated {
+		list, ok := column.(*array.List)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a list", column.DataType())
+		}
+		element := *field
+		element.Repeated, element.Required = false, true
+		start, end := list.ValueOffsets(i)
+		values := make([]bigquery.Value, 0, end-start)
+		for j := start; j < end; j++ {
+			value, err := columnarValue(list.ListValues(), int(j), &element)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	if field.Type == bigquery.RecordFieldType {
+		record, ok := column.(*array.Struct)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a struct", column.DataType())
+		}
+		structType := record.DataType().(*arrow.StructType)
+		nested := make(map[string]bigquery.Value, len(field.Schema))
+		for _, child := range field.Schema {
+			index, ok := structType.FieldIdx(child.Name)
+			if !ok {
+				continue
+			}
+			value, err := columnarValue(record.Field(index), i, child)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", child.Name, err)
+			}
+			if value != nil {
+				nested[child.Name] = value
+			}
+		}
+		return nested, nil
+	}
+	return columnarScalar(column, i, field.Type)
+}
+
+// columnarScalar converts a scalar value, coercing it to the field type by the
+// rules of columnarCoercible
+func columnarScalar(column arrow.Array, i int, fieldType bigquery.FieldType) (bigquery.Value, error) {
+	switch column := column.(type) {
+	case *array.Dictionary:
+		return columnarScalar(column.Dictionary(), column.GetValueIndex(i), fieldType)
+	case *array.String:
+		return coerceString(strings.Clone(column.Value(i)), fieldType), nil
+	case *array.LargeString:
+		return coerceString(strings.Clone(column.Value(i)), fieldType), nil
+	case *array.Binary:
+		return base64.StdEncoding.EncodeToString(column.Value(i)), nil
+	case *array.LargeBinary:
+		return base64.StdEncoding.EncodeToString(column.Value(i)), nil
+	case *array.FixedSizeBinary:
+		return base64.StdEncoding.EncodeToString(column.Value(i)), nil
+	case *array.Boolean:
+		return column.Value(i), nil
+	case *array.Int8:
+		return coerceInt(int64(column.Value(i)), fieldType), nil
+	case *array.Int16:
+		return coerceInt(int64(column.Value(i)), fieldType), nil
+	case *array.Int32:
+		return coerceInt(int64(column.Value(i)), fieldType), nil
+	case *array.Int64:
+		return coerceInt(column.Value(i), fieldType), nil
+	case *array.Uint8:
+		return coerceInt(int64(column.Value(i)), fieldType), nil
+	case *array.Uint16:
+		return coerceInt(int64(column.Value(i)), fieldType), nil
+	case *array.Uint32:
+		return coerceInt(int64(column.Value(i)), fieldType), nil
+	case *array.Uint64:
+		if column.Value(i) > math.MaxInt64 {
+			return nil, fmt.Errorf("%d is beyond the range of an INTEGER", column.Value(i))
+		}
+		return coerceInt(int64(column.Value(i)), fieldType), nil
+	case *array.Float32:
+		return float64(column.Value(i)), nil
+	case *array.Float64:
+		return column.Value(i), nil
+	case *array.Decimal128:
+		return column.Value(i).ToString(column.DataType().(*arrow.Decimal128Type).Scale), nil
+	case *array.Timestamp:
+		return coerceTime(column.Value(i).ToTime(column.DataType().(*arrow.TimestampType).Unit), fieldType), nil
+	case *array.Date32:
+		return coerceTime(column.Value(i).ToTime(), fieldType), nil
+	case *array.Date64:
+		return coerceTime(column.Value(i).ToTime(), fieldType), nil
+	case *array.Time32:
+		return column.Value(i).ToTime(column.DataType().(*arrow.Time32Type).Unit).Format("15:04:05.000000"), nil
+	case *array.Time64:
+		return column.Value(i).ToTime(column.DataType().(*arrow.Time64Type).Unit).Format("15:04:05.000000"), nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", column.DataType())
+}
+
+// coerceString converts a string to a BYTES field as base64, otherwise as is
+func coerceString(value string, fieldType bigquery.FieldType) bigquery.Value {
+	if fieldType == bigquery.BytesFieldType {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	return value
+}
+
+// coerceInt converts an integer to a FLOAT or NUMERIC field, otherwise as is
+func coerceInt(value int64, fieldType bigquery.FieldType) bigquery.Value {
+	switch fieldType {
+	case bigquery.FloatFieldType:
+		return float64(value)
+	case bigquery.NumericFieldType, bigquery.BigNumericFieldType:
+		return strconv.FormatInt(value, 10)
+	}
+	return value
+}
+
+// coerceTime formats a timestamp or date as a TIMESTAMP, DATETIME or DATE
+func coerceTime(value time.Time, fieldType bigquery.FieldType) bigquery.Value {
+	value = value.UTC()
+	switch fieldType {
+	case bigquery.DateTimeFieldType:
+		return value.Format("2006-01-02 15:04:05.000000")
+	case bigquery.DateFieldType:
+		return value.Format("2006-01-02")
+	}
+	return value.Format("2006-01-02 15:04:05.000000 UTC")
+}
+
+// columnarCoercible lists the Arrow types of the input each field type can be
+// written from, a Parquet or Avro type being read as its Arrow equivalent
+var columnarCoercible = map[bigquery.FieldType][]arrow.Type{
+	bigquery.StringFieldType:     {arrow.STRING, arrow.LARGE_STRING},
+	bigquery.JSONFieldType:       {arrow.STRING, arrow.LARGE_STRING},
+	bigquery.GeographyFieldType:  {arrow.STRING, arrow.LARGE_STRING},
+	bigquery.BytesFieldType:      {arrow.BINARY, arrow.LARGE_BINARY, arrow.FIXED_SIZE_BINARY, arrow.STRING, arrow.LARGE_STRING},
+	bigquery.IntegerFieldType:    {arrow.INT8, arrow.INT16, arrow.INT32, arrow.INT64, arrow.UINT8, arrow.UINT16, arrow.UINT32, arrow.UINT64},
+	bigquery.FloatFieldType:      {arrow.FLOAT32, arrow.FLOAT64, arrow.INT8, arrow.INT16, arrow.INT32, arrow.INT64, arrow.UINT8, arrow.UINT16, arrow.UINT32, arrow.UINT64},
+	bigquery.NumericFieldType:    {arrow.DECIMAL128, arrow.INT8, arrow.INT16, arrow.INT32, arrow.INT64, arrow.UINT8, arrow.UINT16, arrow.UINT32, arrow.UINT64},
+	bigquery.BigNumericFieldType: {arrow.DECIMAL128, arrow.INT8, arrow.INT16, arrow.INT32, arrow.INT64, arrow.UINT8, arrow.UINT16, arrow.UINT32, arrow.UINT64},
+	bigquery.BooleanFieldType:    {arrow.BOOL},
+	bigquery.TimestampFieldType:  {arrow.TIMESTAMP, arrow.DATE32, arrow.DATE64},
+	bigquery.DateTimeFieldType:   {arrow.TIMESTAMP, arrow.DATE32, arrow.DATE64},
+	bigquery.DateFieldType:       {arrow.DATE32, arrow.DATE64, arrow.TIMESTAMP},
+	bigquery.TimeFieldType:       {arrow.TIME32, arrow.TIME64},
+	bigquery.RecordFieldType:     {arrow.STRUCT},
+}
+
+// MatchColumnarSchema checks each field of the table against the field of the
+// same name in the input, returning the mismatches found.  A field whose type
+// cannot be coerced, or a REQUIRED field absent from the input, is fatal.
+// Fields of the input not in the table are ignored, and a nullable input
+// field written to a REQUIRED field skips each row holding a NULL.
+func MatchColumnarSchema(source *arrow.Schema, target bigquery.Schema) []ColumnMismatch {
+	return matchColumnarFields("", source.Fields(), target)
+}
+
+// matchColumnarFields matches the fields of a record, prefixing field names
+// with the path to the record
+func matchColumnarFields(prefix string, source []arrow.Field, target bigquery.Schema) []ColumnMismatch {
+	var mismatches []ColumnMismatch
+	inTarget := make(map[string]bool, len(target))
+	for _, field := range target {
+		inTarget[field.Name] = true
+		if prefix == "" && field.Name == "run_id" {
+			continue
+		}
+		name := prefix + field.Name
+		index := -1
+		for i := range source {
+			if source[i].Name == field.Name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			if field.Required {
+				mismatches = append(mismatches, ColumnMismatch{Field: name, Reason: "REQUIRED field is missing from the input", Fatal: true})
+			} else {
+				mismatches = append(mismatches, ColumnMismatch{Field: name, Reason: "missing from the input, written as NULL"})
+			}
+			continue
+		}
+		mismatches = append(mismatches, matchColumnarField(name, source[index], field)...)
+	}
+	for _, field := range source {
+		if !inTarget[field.Name] {
+			mismatches = append(mismatches, ColumnMismatch{Field: prefix + field.Name, Reason: fmt.Sprintf("%s is not in the table, ignored", field.Type)})
+		}
+	}
+	return mismatches
+}
+
+// matchColumnarField matches a single field of the input to the table
+func matchColumnarField(name string, source arrow.Field, target *bigquery.FieldSchema) []ColumnMismatch {
+	var mismatches []ColumnMismatch
+	dataType := source.Type
+	if target.Repeated {
+		list, ok := dataType.(*arrow.ListType)
+		if !ok {
+			return []ColumnMismatch{{Field: name, Reason: fmt.Sprintf("%s cannot be written to a REPEATED field", dataType), Fatal: true}}
+		}
+		dataType = list.Elem()
+	} else if _, ok := dataType.(*arrow.ListType); ok {
+		return []ColumnMismatch{{Field: name, Reason: fmt.Sprintf("%s can only be written to a REPEATED field", dataType), Fatal: true}}
+	}
+	if target.Required && source.Nullable {
+		mismatches = append(mismatches, ColumnMismatch{Field: name, Reason: "nullable in the input but REQUIRED in the table, rows holding NULL are skipped"})
+	}
+	if dictionary, ok := dataType.(*arrow.DictionaryType); ok {
+		dataType = dictionary.ValueType
+	}
+	if !columnarTypeCoercible(dataType.ID(), target.Type) {
+		return append(mismatches, ColumnMismatch{Field: name, Reason: fmt.Sprintf("%s cannot be written to a %s field", dataType, target.Type), Fatal: true})
+	}
+	if structType, ok := dataType.(*arrow.StructType); ok {
+		mismatches = append(mismatches, matchColumnarFields(name+".", structType.Fields(), target.Schema)...)
+	}
+	return mismatches
+}
+
+// columnarTypeCoercible reports whether the Arrow type can be written to the
+// field type
+func columnarTypeCoercible(id arrow.Type, fieldType bigquery.FieldType) bool {
+	for _, coercible := range columnarCoercible[fieldType] {
+		if id == coercible {
+			return true
+		}
+	}
+	return false
+}
+
+// storageObjectReaderAt reads a Cloud Storage object by ranged requests, so a
+// Parquet file is read a column chunk at a time rather than downloaded whole
+type storageObjectReaderAt struct {
+	ctx     context.Context
+	service *storage.Service
+	bucket  string
+	object  string
+}
+
+// openStorageObjectReaderAt opens the gs://bucket/object for random access
+func openStorageObjectReaderAt(ctx context.Context, location string) (*io.SectionReader, error) {
+	bucket, object, err := ParseStorageLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	storageService, err := storage.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := storageService.Objects.Get(bucket, object).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	reader := &storageObjectReaderAt{ctx: ctx, service: storageService, bucket: bucket, object: object}
+	return io.NewSectionReader(reader, 0, int64(metadata.Size)), nil
+}
+
+// ReadAt implements io.ReaderAt
+func (r *storageObjectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	call := r.service.Objects.Get(r.bucket, r.object).Context(r.ctx)
+	call.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	response, err := call.Download()
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	n, err := io.ReadFull(response.Body, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
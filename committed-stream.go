@@ -0,0 +1,333 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Names of the write modes reported in the results
+const (
+	modeInsertAll = "insertall"
+	modeStorage   = "storage"
+	modeCommitted = "committed"
+	modeBatch     = "batch"
+)
+
+// Maximum number of times a committed stream is reconnected with
+// -auto-reconnect, each after a linearly increasing delay
+const (
+	maxStreamReconnects  = 5
+	streamReconnectDelay = time.Second
+)
+
+// pendingAppend is an append awaiting its result, retaining its rows and
+// offset so it can be sent again after a reconnection
+type pendingAppend struct {
+	result  *managedwriter.AppendResult
+	batch   [][]byte
+	offset  int64
+	rows    int
+	bytes   int64
+	sent    time.Time
+	attempt int
+}
+
+// ExecuteCommittedStream will stream the records to the target BigQuery table
+// using a committed stream of the Storage Write API, appending each batch at
+// an explicit offset and tracking the offsets returned.
+func ExecuteCommittedStream(ctx context.Context, config *BenchmarkConfig) (*RunSummary, error) {
+	schema := config.TableSchema()
+	descriptor, err := rowDescriptor(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info().Msg("Establish BigQuery Storage Write Client")
+	writeClient, err := managedwriter.NewClient(ctx, config.ProjectID, config.StorageOptions...)
+	if err != nil {
+		return nil, err
+	}
+	defer writeClient.Close()
+
+	stream, err := writeClient.NewManagedStream(ctx,
+		managedwriter.WithDestinationTable(managedwriter.TableParentFromParts(config.ProjectID, config.DatasetID, config.TableID)),
+		managedwriter.WithType(managedwriter.CommittedStream),
+		managedwriter.WithSchemaDescriptor(descriptor),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { stream.Close() }()
+
+	summary := &RunSummary{Offsets: &OffsetTracker{StreamName: stream.StreamName()}}
+	var pending []pendingAppend
+	var batch [][]byte
+
+	// Re-create the connection to the same stream after a network failure,
+	// resuming from the last acknowledged offset by sending every pending
+	// append again at its original offset
+	reconnect := func(cause error) error {
+		if !config.AutoReconnect || ClassifyError(cause) != errorTypeNetwork || len(summary.Offsets.Reconnects) >= maxStreamReconnects {
+			return cause
+		}
+		summary.Offsets.Reconnect(summary.Offsets.NextOffset, cause)
+		stream.Close()
+		time.Sleep(time.Duration(len(summary.Offsets.Reconnects)) * streamReconnectDelay)
+
+		var err error
+		stream, err = writeClient.NewManagedStream(ctx,
+			managedwriter.WithStreamName(summary.Offsets.StreamName),
+			managedwriter.WithSchemaDescriptor(descriptor),
+		)
+		if err != nil {
+			return err
+		}
+		for i := range pending {
+			pending[i].result, err = stream.AppendRows(ctx, pending[i].batch, managedwriter.WithOffset(pending[i].offset))
+			if err != nil {
+				return err
+			}
+			pending[i].sent = time.Now()
+			pending[i].attempt++
+		}
+		return nil
+	}
+
+	// Wait for the oldest append to complete, observing its offset.  An
+	// append sent again after a reconnection which already exists landed
+	// before the failure, at its original offset.
+	resolve := func() error {
+		for {
+			next := pending[0]
+			offset, err := next.result.GetResult(ctx)
+			config.RequestLog.LogAppend(next.sent, next.rows, next.bytes, next.attempt, err)
+			config.Heartbeat.ObserveAppend(next.sent, next.rows, err)
+			if err != nil && next.attempt > 1 && status.Code(err) == codes.AlreadyExists {
+				offset, err = next.offset, nil
+			}
+			if err == nil {
+				pending = pending[1:]
+				summary.Offsets.Observe(offset, next.rows)
+				return nil
+			}
+			config.Errors.Add(err)
+			if err := reconnect(err); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Append the batch at the expected offset, keeping one append in flight
+	// per worker
+	flush := func() error {
+		offset := summary.Offsets.NextOffset
+		for _, p := range pending {
+			offset += int64(p.rows)
+		}
+		var size int64
+		for _, row := range batch {
+			size += int64(len(row))
+		}
+		pending = append(pending, pendingAppend{batch: batch, offset: offset, rows: len(batch), bytes: size, sent: time.Now(), attempt: 1})
+		summary.Batches++
+		batch = nil
+		last := len(pending) - 1
+		result, err := stream.AppendRows(ctx, pending[last].batch, managedwriter.WithOffset(offset))
+		if err != nil {
+			config.Errors.Add(err)
+			if err := reconnect(err); err != nil {
+				return err
+			}
+		} else {
+			pending[last].result = result
+		}
+		for len(pending) > config.NumberWorkers {
+			if err := resolve(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	startTime := time.Now()
+	logger.Info().Str("Stream", stream.StreamName()).Msg("Start Streaming Data")
+	for data := range newGenerator(ctx, config.NumberIterations, config.RunID, config.DataGenerator()) {
+		// Stop the run once the next record would exceed the cost budget
+		if config.Budget != nil && !config.Budget.Allows(summary, RecordSize(data)) {
+			summary.BudgetExhausted = true
+			logger.Warn().Int("Records Sent", summary.RecordsSent).Msg("  Stopping as the Next Record Would Exceed the Cost Budget")
+			break
+		}
+
+		row, err := encodeRow(schema, data)
+		for err != nil {
+			config.Errors.Add(err)
+			switch config.RecordErrorHandler().Handle(data, err) {
+			case ActionAbort:
+				return summary, err
+			case ActionRetry:
+				summary.RecordsRetried++
+				row, err = encodeRow(schema, data)
+				continue
+			}
+			summary.RecordsSkipped++
+			break
+		}
+		if err != nil {
+			continue
+		}
+		batch = append(batch, row)
+		summary.RecordsSent++
+		config.Landed.AddSent(1)
+		config.Heartbeat.AddSent(1)
+		config.Health.AddSent(1)
+		summary.AddRecordBytes(RecordSize(data))
+		if len(batch) == config.BatchSize {
+			if err := flush(); err != nil {
+				return summary, err
+			}
+		}
+
+		if config.Verbose {
+			if math.Mod(float64(summary.RecordsSent), 10000) == 0 {
+				logger.Info().Int("Records Sent", summary.RecordsSent).Msg(indent)
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return summary, err
+		}
+	}
+	drainStart := time.Now()
+	for len(pending) > 0 {
+		if err := resolve(); err != nil {
+			return summary, err
+		}
+	}
+
+	rowCount, err := stream.Finalize(ctx)
+	summary.DrainElapsed = time.Since(drainStart)
+	if err != nil {
+		return summary, err
+	}
+	summary.Offsets.Finalize(rowCount)
+	summary.Elapsed = time.Since(startTime)
+	logger.Info().Int("Records Sent", summary.RecordsSent).Dur("Time Taken", summary.Elapsed).Msg(indent)
+	logger.Info().Msg("End Streaming Data")
+	summary.Offsets.Log()
+	LogThroughput(summary, config.BatchSize)
+	return summary, nil
+}
+
+// rowDescriptor builds the proto2 descriptor of a flat schema, numbering the
+// fields in schema order
+func rowDescriptor(schema bigquery.Schema) (*descriptorpb.DescriptorProto, error) {
+	descriptor := &descriptorpb.DescriptorProto{Name: proto.String("BenchmarkRow")}
+	for i, field := range schema {
+		kind, ok := protoFieldTypes[field.Type]
+		if !ok || field.Repeated {
+			return nil, fmt.Errorf("column %q: %s columns are not supported by the committed stream", field.Name, fieldTypeName(field))
+		}
+		label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		if field.Required {
+			label = descriptorpb.FieldDescriptorProto_LABEL_REQUIRED
+		}
+		descriptor.Field = append(descriptor.Field, &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(field.Name),
+			Number: proto.Int32(int32(i + 1)),
+			Label:  label.Enum(),
+			Type:   kind.Enum(),
+		})
+	}
+	return descriptor, nil
+}
+
+// protoFieldTypes maps the supported column types to their proto type, with
+// the civil time types sent in their canonical string form
+var protoFieldTypes = map[bigquery.FieldType]descriptorpb.FieldDescriptorProto_Type{
+	bigquery.StringFieldType:    descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	bigquery.IntegerFieldType:   descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	bigquery.FloatFieldType:     descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+	bigquery.BooleanFieldType:   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	bigquery.DateTimeFieldType:  descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	bigquery.DateFieldType:      descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	bigquery.TimeFieldType:      descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	bigquery.NumericFieldType:   descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	bigquery.GeographyFieldType: descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	bigquery.JSONFieldType:      descriptorpb.FieldDescriptorProto_TYPE_STRING,
+}
+
+// fieldTypeName describes the type of a column for error messages
+func fieldTypeName(field *bigquery.FieldSchema) string {
+	if field.Repeated {
+		return "REPEATED " + string(field.Type)
+	}
+	return string(field.Type)
+}
+
+// encodeRow encodes the values saved by a generated record using the field
+// numbers of rowDescriptor
+func encodeRow(schema bigquery.Schema, data interface{}) ([]byte, error) {
+	saver, ok := data.(bigquery.ValueSaver)
+	if !ok {
+		return nil, fmt.Errorf("%T does not implement bigquery.ValueSaver", data)
+	}
+	values, _, err := saver.Save()
+	if err != nil {
+		return nil, err
+	}
+
+	var row []byte
+	for i, field := range schema {
+		value := values[field.Name]
+		if value == nil {
+			continue
+		}
+		number := protowire.Number(i + 1)
+		switch v := value.(type) {
+		case string:
+			row = protowire.AppendTag(row, number, protowire.BytesType)
+			row = protowire.AppendString(row, v)
+		case int64:
+			row = protowire.AppendTag(row, number, protowire.VarintType)
+			row = protowire.AppendVarint(row, uint64(v))
+		case int:
+			row = protowire.AppendTag(row, number, protowire.VarintType)
+			row = protowire.AppendVarint(row, uint64(v))
+		case float64:
+			row = protowire.AppendTag(row, number, protowire.Fixed64Type)
+			row = protowire.AppendFixed64(row, math.Float64bits(v))
+		case bool:
+			row = protowire.AppendTag(row, number, protowire.VarintType)
+			row = protowire.AppendVarint(row, protowire.EncodeBool(v))
+		default:
+			return nil, fmt.Errorf("column %q: cannot encode %T", field.Name, value)
+		}
+	}
+	return row, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCommittedStreamOffsetGaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		scenario FaultScenario
+		gaps     int
+	}{
+		{"Contiguous", FaultScenario{}, 0},
+		{"Gap at the First Append", FaultScenario{OffsetGapAt: 1, OffsetGap: 5}, 1},
+		{"Gap at the Third Append", faultScenarios["offset-gap"], 1},
+		{"Gap After the Last Append", FaultScenario{OffsetGapAt: 11, OffsetGap: 5}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewFakeBigQueryServer()
+			defer server.Close()
+			server.CreateTable("bqwrite", "committed", nil)
+			server.SetFaultScenario(tt.scenario)
+
+			config := &BenchmarkConfig{
+				ProjectID:        "bqwrite-test",
+				DatasetID:        "bqwrite",
+				TableID:          "committed",
+				RunID:            "committed-run",
+				BatchSize:        10,
+				NumberWorkers:    2,
+				NumberIterations: 100,
+				DrainTimeout:     30 * time.Second,
+				StorageOptions:   FakeStorageWriteOptions(server),
+			}
+			summary, err := ExecuteCommittedStream(context.Background(), config)
+			if err != nil {
+				t.Fatalf("ExecuteCommittedStream: %v", err)
+			}
+
+			offsets := summary.Offsets
+			if offsets.Appends != 10 || offsets.FinalOffset != 100 {
+				t.Errorf("%d appends and a final offset of %d, expected 10 and 100", offsets.Appends, offsets.FinalOffset)
+			}
+			if offsets.GapCount != tt.gaps || offsets.Contiguous() != (tt.gaps == 0) {
+				t.Fatalf("%d gaps detected, contiguous %t, expected %d gaps", offsets.GapCount, offsets.Contiguous(), tt.gaps)
+			}
+			if tt.gaps > 0 {
+				gap := offsets.Gaps[0]
+				if gap.Append != tt.scenario.OffsetGapAt || gap.Returned-gap.Expected != tt.scenario.OffsetGap {
+					t.Errorf("gap %+v detected, expected a jump of %d at append %d", gap, tt.scenario.OffsetGap, tt.scenario.OffsetGapAt)
+				}
+			}
+			if rows := server.RunRows("bqwrite", "committed", config.RunID); rows != 100 {
+				t.Errorf("%d rows landed, expected 100", rows)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Suffix of the table the Storage Write API writes to in a comparison
+const compareStorageSuffix = "_storage"
+
+// CompareResult holds the metrics of the run of a single API of a comparison
+type CompareResult struct {
+	API              string  `json:"api"`
+	TableID          string  `json:"table_id"`
+	RecordsSent      int     `json:"records_sent"`
+	ElapsedSeconds   float64 `json:"elapsed_seconds"`
+	RecordsPerSecond float64 `json:"records_per_second"`
+	Errors           int     `json:"errors"`
+	BytesSent        int64   `json:"bytes_sent"`
+	BillableBytes    int64   `json:"billable_bytes"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// BilledBytes returns the bytes the API of the run is billed for, insertAll
+// billing every row at its minimum size and the Storage Write API the bytes
+// sent
+func (r CompareResult) BilledBytes() int64 {
+	if r.API == apiInsertAll {
+		return r.BillableBytes
+	}
+	return r.BytesSent
+}
+
+// CompareTableNames returns the tables of a comparison, the insertAll API
+// writing to the table and the Storage Write API to the table suffixed
+// _storage, so neither run sees the rows of the other
+func CompareTableNames(tableID string) []string {
+	return []string{tableID, tableID + compareStorageSuffix}
+}
+
+// compareRunner executes a single run of the API being compared
+type compareRunner func(ctx context.Context, config *BenchmarkConfig) (*RunSummary, error)
+
+// ExecuteCompare runs the same number of records and batch size through the
+// insertAll API and then the Storage Write API, each into its own table of
+// the two targets, using the runners of a single run.  A failed run is
+// recorded in its result while the other still runs, the first failure
+// being returned.
+func ExecuteCompare(ctx context.Context, config *BenchmarkConfig) ([]CompareResult, error) {
+	apis := []string{modeInsertAll, modeStorage}
+	runners := []compareRunner{ExecuteLegacyStream, ExecuteStorageStream}
+	targets := config.StreamTargets()
+	if len(targets) != len(apis) {
+		return nil, fmt.Errorf("a comparison needs %d tables, %d are in the rotation", len(apis), len(targets))
+	}
+
+	var firstErr error
+	results := make([]CompareResult, 0, len(apis))
+	for i, api := range apis {
+		step := *config
+		target := targets[i]
+		step.Targets = []*StreamTarget{{DatasetID: target.DatasetID, TableID: target.TableID, BatchSize: target.BatchSize}}
+		logger.Info().Str("API", api).Str("Table", target.TableID).Int("Records", step.NumberIterations).Int("Batch Size", target.BatchSize).Msg("Comparison Run")
+
+		failuresBefore := 0
+		if config.RequestIDs != nil {
+			failuresBefore = config.RequestIDs.Failures()
+		}
+		summary, err := runners[i](ctx, &step)
+		result := CompareResult{API: api, TableID: target.TableID}
+		if summary != nil {
+			result.RecordsSent = summary.RecordsSent
+			result.ElapsedSeconds = summary.Elapsed.Seconds()
+			result.Errors = summary.RecordsSkipped
+			result.BytesSent, result.BillableBytes = summary.BytesSent, summary.BillableBytes
+			if summary.Elapsed > 0 {
+				result.RecordsPerSecond = float64(summary.RecordsSent) / summary.Elapsed.Seconds()
+			}
+		}
+		if config.RequestIDs != nil {
+			result.Errors += config.RequestIDs.Failures() - failuresBefore
+		}
+		if err != nil {
+			result.Error = err.Error()
+			logger.Warn().Err(err).Str("API", api).Msg("  The Comparison Run Failed")
+			if firstErr == nil {
+				firstErr = fmt.Errorf("the %s comparison run failed: %w", api, err)
+			}
+		}
+		results = append(results, result)
+	}
+	return results, firstErr
+}
+
+// LogCompareResults outputs the comparison table, a line per API with its
+// metrics as fields, followed by the throughput of the Storage Write API
+// relative to insertAll when both runs succeeded
+func LogCompareResults(results []CompareResult) {
+	if len(results) == 0 {
+		return
+	}
+	logger.Info().Msg("API Comparison")
+	for _, result := range results {
+		event := logger.Info()
+		if result.Error != "" {
+			event = logger.Warn().Str("Error", result.Error)
+		}
+		event.Str("API", result.API).Str("Table", result.TableID).Int("Records Sent", result.RecordsSent).
+			Float64("Elapsed Seconds", result.ElapsedSeconds).Str("Records per Second", fmt.Sprintf("%.1f", result.RecordsPerSecond)).
+			Int("Errors", result.Errors).Msg(indent)
+	}
+	if len(results) == 2 && results[0].Error == "" && results[1].Error == "" && results[0].RecordsPerSecond > 0 {
+		delta := results[1].RecordsPerSecond - results[0].RecordsPerSecond
+		logger.Info().Str("Records per Second Delta", fmt.Sprintf("%.1f", delta)).
+			Str("Delta %", fmt.Sprintf("%.1f", delta/results[0].RecordsPerSecond*100)).Msg("  Storage Write API Relative to insertAll")
+	}
+}
+
+// LogCompareCosts outputs the cost breakdown of each API of the comparison,
+// computed from the bytes of its own run and extrapolated to the monthly
+// records, so the APIs are compared on the payload each actually sent
+func LogCompareCosts(results []CompareResult, region string, monthlyRecords int) {
+	for _, result := range results {
+		if result.RecordsSent == 0 {
+			continue
+		}
+		monthlyBytes := ExtrapolateMonthlyBytes(result.BilledBytes(), result.RecordsSent, monthlyRecords)
+		LogCostBreakdown(result.API, ComputeCost(result.API, result.BilledBytes(), region), ComputeCost(result.API, monthlyBytes, region))
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestCompareResultBilledBytes(t *testing.T) {
+	tests := []struct {
+		api      string
+		expected int64
+	}{
+		{apiInsertAll, 1024000},
+		{apiStorage, 120000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.api, func(t *testing.T) {
+			result := CompareResult{API: tt.api, RecordsSent: 1000, BytesSent: 120000, BillableBytes: 1024000}
+			if billed := result.BilledBytes(); billed != tt.expected {
+				t.Errorf("%d bytes billed, expected %d", billed, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Nominal round trip of an insertAll request, used to estimate the rate the
+// workers can flush rows at before the queue fills
+const lintInsertLatency = 100 * time.Millisecond
+
+// Worker count from which single row batches with a single row queue are
+// considered drop-prone
+const lintManyWorkers = 20
+
+// Batch sizes suggested by the lint rules, being those at which
+// CalculateWorkerQueueSize steps up the worker queue size
+var lintBatchSteps = []int{50, 200, 500}
+
+// LintInput holds the combination of settings evaluated by the lint rules.
+// An expected rate or number of records of zero is unknown, skipping the
+// rules which depend on it.
+type LintInput struct {
+	Name         string
+	Workers      int
+	BatchSize    int
+	QueueSize    int
+	Records      int
+	ExpectedRate float64
+}
+
+// LintWarning is a single warning raised by a lint rule
+type LintWarning struct {
+	Rule    string
+	Name    string
+	Limit   float64
+	Message string
+}
+
+// lintRule is a single data-driven rule, raising a warning when it applies
+// to the combination of settings
+type lintRule struct {
+	name    string
+	applies func(in LintInput) bool
+	message func(in LintInput) string
+}
+
+// lintRules lists the rules evaluated before a run, in the order reported
+var lintRules = []lintRule{
+	{
+		name: "rate-exceeds-flush-capacity",
+		applies: func(in LintInput) bool {
+			return in.ExpectedRate > in.FlushCapacity()
+		},
+		message: func(in LintInput) string {
+			return fmt.Sprintf("with -w %d and -b %d, queue size %d, rows will likely be dropped above ~%.0f rows/sec; %s",
+				in.Workers, in.BatchSize, in.QueueSize, in.FlushCapacity(), in.suggestion())
+		},
+	},
+	{
+		name: "single-row-queue",
+		applies: func(in LintInput) bool {
+			return in.BatchSize == 1 && in.QueueSize == 1 && in.Workers >= lintManyWorkers
+		},
+		message: func(in LintInput) string {
+			return fmt.Sprintf("with -b 1 and queue size 1 across %d workers, every row is a request of its own and rows will likely be dropped above ~%.0f rows/sec; consider -b %d for a queue size of %d",
+				in.Workers, in.FlushCapacity(), lintBatchSteps[0], CalculateWorkerQueueSize(lintBatchSteps[0]))
+		},
+	},
+	{
+		name: "batches-never-fill",
+		applies: func(in LintInput) bool {
+			return in.Records > 0 && in.Records < in.Workers*in.BatchSize
+		},
+		message: func(in LintInput) string {
+			return fmt.Sprintf("with -i %d below -w %d x -b %d, no batch fills and every row waits to be flushed on close; consider -b %d",
+				in.Records, in.Workers, in.BatchSize, max(1, in.Records/in.Workers))
+		},
+	},
+}
+
+// FlushCapacity estimates the rows per second the workers can flush at,
+// each sending one batch per nominal insertAll round trip
+func (in LintInput) FlushCapacity() float64 {
+	return float64(in.Workers*in.BatchSize) / lintInsertLatency.Seconds()
+}
+
+// suggestion returns the smallest batch size stepping up the queue size
+// whose flush capacity covers the expected rate, or more workers when even
+// the largest step does not
+func (in LintInput) suggestion() string {
+	for _, batchSize := range lintBatchSteps {
+		if batchSize <= in.BatchSize {
+			continue
+		}
+		candidate := LintInput{Workers: in.Workers, BatchSize: batchSize}
+		if candidate.FlushCapacity() >= in.ExpectedRate {
+			return fmt.Sprintf("consider -b %d for a queue size of %d", batchSize, CalculateWorkerQueueSize(batchSize))
+		}
+	}
+	batchSize := max(in.BatchSize, lintBatchSteps[len(lintBatchSteps)-1])
+	perWorker := float64(batchSize) / lintInsertLatency.Seconds()
+	return fmt.Sprintf("consider -b %d with -w %d", batchSize, int(math.Ceil(in.ExpectedRate/perWorker)))
+}
+
+// LintConfig evaluates every lint rule against each combination of
+// settings, returning the warnings raised
+func LintConfig(inputs ...LintInput) []LintWarning {
+	var warnings []LintWarning
+	for _, in := range inputs {
+		for _, rule := range lintRules {
+			if rule.applies(in) {
+				warnings = append(warnings, LintWarning{Rule: rule.name, Name: in.Name, Limit: in.FlushCapacity(), Message: rule.message(in)})
+			}
+		}
+	}
+	return warnings
+}
+
+// LogLintWarnings outputs each lint warning as a structured warning
+func LogLintWarnings(warnings []LintWarning) {
+	for _, warning := range warnings {
+		event := logger.Warn().Str("Rule", warning.Rule)
+		if warning.Name != "" {
+			event.Str("Phase", warning.Name)
+		}
+		event.Float64("Limit (rows/sec)", warning.Limit).Msg("  " + warning.Message)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLintConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		input LintInput
+		rules []string
+	}{
+		{"Healthy", LintInput{Workers: 5, BatchSize: 500, QueueSize: 100, Records: 100000, ExpectedRate: 1000}, nil},
+		{"Rate Exceeds Flush Capacity", LintInput{Workers: 5, BatchSize: 1, QueueSize: 1, Records: 100000, ExpectedRate: 1000}, []string{"rate-exceeds-flush-capacity"}},
+		{"Single Row Queue", LintInput{Workers: 50, BatchSize: 1, QueueSize: 1, Records: 100000}, []string{"single-row-queue"}},
+		{"Rate and Single Row Queue", LintInput{Workers: 50, BatchSize: 1, QueueSize: 1, Records: 100000, ExpectedRate: 5000}, []string{"rate-exceeds-flush-capacity", "single-row-queue"}},
+		{"Batches Never Fill", LintInput{Workers: 10, BatchSize: 500, QueueSize: 100, Records: 1000}, []string{"batches-never-fill"}},
+		{"No Records", LintInput{Workers: 10, BatchSize: 500, QueueSize: 100}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rules []string
+			for _, warning := range LintConfig(tt.input) {
+				rules = append(rules, warning.Rule)
+			}
+			if !slices.Equal(rules, tt.rules) {
+				t.Errorf("raised %v, expected %v", rules, tt.rules)
+			}
+		})
+	}
+}
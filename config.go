@@ -0,0 +1,188 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"runtime"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+)
+
+// BenchmarkConfig holds the parameters used to execute a single benchmark run
+type BenchmarkConfig struct {
+	ProjectID        string
+	DatasetID        string
+	TableID          string
+	RunID            string
+	Targets          []*StreamTarget
+	Schema           bigquery.Schema
+	Generator        dataGenerator
+	NumberWorkers    int
+	BatchSize        int
+	NumberIterations int
+	Mode             string
+	DrainTimeout     time.Duration
+	InterruptDrain   time.Duration
+	InsertIDs        bool
+	AutoReconnect    bool
+	Duplicates       *DuplicateSchedule
+	LatencySample    int
+	RequestIDs       *RequestIDTracker
+	Errors           *ErrorAggregator
+	Failures         *AsyncFailures
+	RequestLog       *RequestLog
+	StreamerOptions  []option.ClientOption
+	StorageOptions   []option.ClientOption
+	ErrorHandler     ErrorHandler
+	Budget           *CostBudget
+	Landed           *LandedTracker
+	Metadata         *MetadataPoller
+	Quota            *QuotaMeter
+	Batches          *BatchCounter
+	Acks             *AckVerifier
+	Heartbeat        *Heartbeat
+	Health           *HealthMonitor
+	Recorder         *WorkloadRecorder
+	Tags             RunTags
+	Timing           *TimingBreakdown
+	Sizes            *SizeHistogram
+	Splitter         *RequestSplitter
+	BatchRamp        *BatchRamp
+	Partitions       *PartitionPlan
+	Kubernetes       *KubernetesInfo
+	SweepCache       *SweepCache
+	ReplayFile       string
+	Input            io.Reader
+	Columnar         *ColumnarInput
+	DualWrite        bool
+	UUIDOffset       int
+	ReplaySpeed      float64
+	Generators       int
+	RowBytes         int
+	Rate             float64
+	Slots            *SlotEstimator
+	Verbose          bool
+}
+
+// RunSummary holds the outcome of a single benchmark run
+type RunSummary struct {
+	RecordsSent        int
+	RecordsAbandoned   int
+	RecordsSkipped     int
+	RecordsRetried     int
+	DuplicatesSent     int
+	RequestSplits      int64
+	PropagationRetries int
+	BytesSent          int64
+	BillableBytes      int64
+	Elapsed            time.Duration
+	DrainElapsed       time.Duration
+	Interrupted        bool
+	TargetRate         float64
+	RowBytes           int
+	Batches            int
+	BatchesEstimated   bool
+	GeneratorWait      time.Duration
+	WriteBlocked       time.Duration
+	ProcessCPU         time.Duration
+	Latency            *LatencyRecorder
+	WriteSample        *LatencyRecorder
+	ReplayDrift        *LatencyRecorder
+	Timing             *TimingAverages
+	Targets            []*StreamTarget
+	Offsets            *OffsetTracker
+	BudgetExhausted    bool
+	Landed             []LandedSample
+	Acks               []AckSample
+	Retries            *RetryTelemetry
+	EstimatedSlots     float64
+}
+
+// TableSchema returns the schema of the target table, defaulting to the
+// built-in table data schema.
+func (c *BenchmarkConfig) TableSchema() bigquery.Schema {
+	if c.Schema != nil {
+		return c.Schema
+	}
+	return tableDataBigQuerySchema
+}
+
+// DataGenerator returns the generator used to create each record,
+// defaulting to the built-in table data generator.
+func (c *BenchmarkConfig) DataGenerator() dataGenerator {
+	gen := dataGenerator(NewTableData)
+	if c.Generator != nil {
+		gen = c.Generator
+	}
+	return c.Partitions.Generator(OffsetGenerator(gen, c.UUIDOffset), c.NumberIterations)
+}
+
+// GeneratorBuffer returns the number of records buffered between the
+// generators and the write loop, scaling with the workers of every target
+// once the records are generated in parallel
+func (c *BenchmarkConfig) GeneratorBuffer() int {
+	if c.Generators <= 1 {
+		return 1
+	}
+	return c.NumberWorkers * len(c.StreamTargets()) * generatorBufferPerWorker
+}
+
+// RecordErrorHandler returns the handler deciding the action taken for each
+// record error, defaulting to aborting the run.
+func (c *BenchmarkConfig) RecordErrorHandler() ErrorHandler {
+	if c.ErrorHandler != nil {
+		return c.ErrorHandler
+	}
+	return abortErrorHandler{}
+}
+
+// StreamTargets returns the targets to stream to, defaulting to the single
+// dataset and table of the configuration.
+func (c *BenchmarkConfig) StreamTargets() []*StreamTarget {
+	if len(c.Targets) > 0 {
+		return c.Targets
+	}
+	return []*StreamTarget{{DatasetID: c.DatasetID, TableID: c.TableID, BatchSize: c.BatchSize}}
+}
+
+// BottleneckMeasurements returns the measurements of the run used to
+// classify its bottleneck, along with the quota errors observed.
+func (s *RunSummary) BottleneckMeasurements(quotaErrors int) BottleneckMeasurements {
+	m := BottleneckMeasurements{
+		Elapsed:       s.Elapsed,
+		CPUs:          runtime.GOMAXPROCS(0),
+		ProcessCPU:    s.ProcessCPU,
+		GeneratorWait: s.GeneratorWait,
+		WriteBlocked:  s.WriteBlocked,
+		QuotaErrors:   quotaErrors,
+	}
+	if s.WriteSample != nil && s.WriteSample.Count() > 0 {
+		m.WriteP50, m.WriteP95 = s.WriteSample.Percentile(50), s.WriteSample.Percentile(95)
+	}
+	return m
+}
+
+// AddRecordBytes accumulates the serialized size of a single record, applying
+// the minimum billable row size used by the BigQuery Streaming API.
+func (s *RunSummary) AddRecordBytes(size int) {
+	s.BytesSent += int64(size)
+	if size < minimumBillableRowBytes {
+		size = minimumBillableRowBytes
+	}
+	s.BillableBytes += int64(size)
+}
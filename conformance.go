@@ -0,0 +1,186 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Drain timeout used by the stall conformance check, well short of the stall
+const conformanceDrainTimeout = 5 * time.Second
+
+// conformanceChecks maps each fault scenario to the check asserting the
+// documented behaviour of the tool under it.  The unavailable scenario is
+// covered by the insertAll Retries check.
+var conformanceChecks = map[string]selfTestCheck{
+	"invalid-row": {"Conformance: Invalid Rows", (*selfTest).checkInvalidRowConformance},
+	"stall":       {"Conformance: Stall", (*selfTest).checkStallConformance},
+	"reset":       {"Conformance: Connection Reset", (*selfTest).checkResetConformance},
+	"offset-gap":  {"Conformance: Offset Gap", (*selfTest).checkOffsetGapConformance},
+}
+
+// SelfTestChecks returns the self-test checks followed by the conformance
+// checks of the named fault scenario, or of every scenario for all
+func SelfTestChecks(scenario string) ([]selfTestCheck, error) {
+	checks := append([]selfTestCheck(nil), selfTestChecks...)
+	switch scenario {
+	case "", "unavailable":
+		return checks, nil
+	case "all":
+		for _, name := range FaultScenarioNames() {
+			if check, ok := conformanceChecks[name]; ok {
+				checks = append(checks, check)
+			}
+		}
+		return checks, nil
+	}
+	check, ok := conformanceChecks[scenario]
+	if !ok {
+		return nil, fmt.Errorf("unknown fault scenario %q, expected one of %s or all", scenario, strings.Join(FaultScenarioNames(), ", "))
+	}
+	return append(checks, check), nil
+}
+
+// checkInvalidRowConformance streams the records while the fake server
+// rejects one row of each batch.  As invalid rows are not skipped the whole
+// batch is rejected, so no rows may land and the errors must be surfaced to
+// the summary.  The rejected rows must end the run with the default error
+// handler, and be counted as skipped rather than sent when skipping.
+func (t *selfTest) checkInvalidRowConformance() error {
+	t.server.SetFaultScenario(faultScenarios["invalid-row"])
+	defer t.server.SetFaultScenario(FaultScenario{})
+
+	config := *t.config
+	config.RunID = NewRunID()
+	if _, err := ExecuteLegacyStream(t.ctx, &config); err == nil {
+		return errors.New("the rejected rows did not end the run with the abort error handler")
+	}
+
+	config.RunID = NewRunID()
+	config.ErrorHandler = skipErrorHandler{}
+	tracker, err := NewRequestIDTracker("")
+	if err != nil {
+		return err
+	}
+	defer tracker.Close()
+	config.RequestIDs = tracker
+
+	summary, err := ExecuteLegacyStream(t.ctx, &config)
+	if err != nil {
+		return err
+	}
+
+	stats := t.server.FaultStats()
+	rows := t.server.RunRows(selfTestDataset, selfTestTable, config.RunID)
+	switch {
+	case rows != 0:
+		return fmt.Errorf("the server holds %d rows from batches with an invalid row, expected 0", rows)
+	case summary.RecordsSent != 0:
+		return fmt.Errorf("%d records were counted as sent, though every batch was rejected", summary.RecordsSent)
+	case summary.RecordsSkipped == 0 || summary.RecordsSkipped > stats.RejectedRows:
+		return fmt.Errorf("%d records were counted as skipped, which does not reconcile with the %d rows rejected", summary.RecordsSkipped, stats.RejectedRows)
+	case tracker.Failures() == 0:
+		return errors.New("the rejected rows were not reported as failures")
+	}
+	return nil
+}
+
+// checkStallConformance streams the records while the fake server stalls the
+// final insertAll request, checking the drain timeout fires and the records
+// held by the stalled request are counted as abandoned
+func (t *selfTest) checkStallConformance() error {
+	scenario := faultScenarios["stall"]
+	scenario.StallAfter = t.config.NumberIterations/t.config.BatchSize - 1
+	t.server.SetFaultScenario(scenario)
+	defer t.server.SetFaultScenario(FaultScenario{})
+
+	config := *t.config
+	config.RunID = NewRunID()
+	config.DrainTimeout = conformanceDrainTimeout
+	summary, err := ExecuteLegacyStream(t.ctx, &config)
+	if !errors.Is(err, errDrainTimeout) {
+		return fmt.Errorf("expected the drain timeout to fire, got %v", err)
+	}
+
+	stalled := int64(summary.RecordsSent) - t.server.RunRows(selfTestDataset, selfTestTable, config.RunID)
+	switch {
+	case t.server.FaultStats().Stalls == 0:
+		return errors.New("no request was stalled")
+	case stalled <= 0:
+		return errors.New("every record landed despite the stall")
+	case int64(summary.RecordsAbandoned) < stalled:
+		return fmt.Errorf("%d records were counted as abandoned, but %d were held by the stalled request", summary.RecordsAbandoned, stalled)
+	}
+	return nil
+}
+
+// checkResetConformance streams the records while the fake server resets the
+// connection part way through the body of some insertAll requests, checking
+// the retries delivered every record exactly once
+func (t *selfTest) checkResetConformance() error {
+	t.server.SetFaultScenario(faultScenarios["reset"])
+	defer t.server.SetFaultScenario(FaultScenario{})
+
+	config := *t.config
+	config.RunID = NewRunID()
+	summary, err := ExecuteLegacyStream(t.ctx, &config)
+	if err != nil {
+		return err
+	}
+
+	if t.server.FaultStats().Resets == 0 {
+		return errors.New("no connections were reset")
+	}
+	if rows := t.server.RunRows(selfTestDataset, selfTestTable, config.RunID); rows != int64(summary.RecordsSent) {
+		return fmt.Errorf("the server holds %d rows, expected %d", rows, summary.RecordsSent)
+	}
+	return nil
+}
+
+// checkOffsetGapConformance streams the records through a committed stream
+// while the fake server shifts the offset returned for one append.  The gap
+// must be detected at that append with the jump injected, and the stream
+// reported as not contiguous, while every record still arrives.
+func (t *selfTest) checkOffsetGapConformance() error {
+	scenario := faultScenarios["offset-gap"]
+	t.server.SetFaultScenario(scenario)
+	defer t.server.SetFaultScenario(FaultScenario{})
+
+	config := *t.config
+	config.RunID = NewRunID()
+	summary, err := ExecuteCommittedStream(t.ctx, &config)
+	if err != nil {
+		return err
+	}
+
+	offsets := summary.Offsets
+	switch {
+	case t.server.FaultStats().OffsetGaps != 1:
+		return errors.New("no offset gap was injected")
+	case offsets.GapCount != 1 || len(offsets.Gaps) != 1:
+		return fmt.Errorf("%d offset gaps were detected, expected 1", offsets.GapCount)
+	case offsets.Gaps[0].Append != scenario.OffsetGapAt || offsets.Gaps[0].Returned-offsets.Gaps[0].Expected != scenario.OffsetGap:
+		return fmt.Errorf("the gap %+v was detected, expected a jump of %d at append %d", offsets.Gaps[0], scenario.OffsetGap, scenario.OffsetGapAt)
+	case offsets.Contiguous():
+		return errors.New("the stream was reported as contiguous despite the gap")
+	}
+	if rows := t.server.RunRows(selfTestDataset, selfTestTable, config.RunID); rows != int64(summary.RecordsSent) {
+		return fmt.Errorf("the server holds %d rows, expected %d", rows, summary.RecordsSent)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	server := NewFakeBigQueryServer()
+	defer server.Close()
+	st, err := newSelfTest(context.Background(), server)
+	if err != nil {
+		t.Fatalf("newSelfTest: %v", err)
+	}
+	defer st.client.Close()
+	if err := st.checkCreateTable(); err != nil {
+		t.Fatalf("checkCreateTable: %v", err)
+	}
+
+	// The unavailable scenario is covered by the insertAll Retries check,
+	// every other scenario by its conformance check
+	for _, name := range FaultScenarioNames() {
+		t.Run(name, func(t *testing.T) {
+			check, ok := conformanceChecks[name]
+			if name == "unavailable" {
+				check, ok = selfTestCheck{"insertAll Retries", (*selfTest).checkInsertAllRetries}, true
+			}
+			if !ok {
+				t.Fatalf("the %s fault scenario has no conformance check", name)
+			}
+			if err := check.run(st); errors.Is(err, errSelfTestSkipped) {
+				t.Skip(err)
+			} else if err != nil {
+				t.Errorf("%s: %v", check.name, err)
+			}
+		})
+	}
+}
+
+func TestSelfTestChecks(t *testing.T) {
+	tests := []struct {
+		scenario string
+		checks   int
+		valid    bool
+	}{
+		{"", len(selfTestChecks), true},
+		{"unavailable", len(selfTestChecks), true},
+		{"stall", len(selfTestChecks) + 1, true},
+		{"all", len(selfTestChecks) + len(conformanceChecks), true},
+		{"unknown", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scenario, func(t *testing.T) {
+			checks, err := SelfTestChecks(tt.scenario)
+			if (err == nil) != tt.valid {
+				t.Fatalf("SelfTestChecks returned %v, expected valid %t", err, tt.valid)
+			}
+			if len(checks) != tt.checks {
+				t.Errorf("%d checks, expected %d", len(checks), tt.checks)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// Interval between polls of the coordination table, and the lead given to
+// every participant to observe the start instant before it is reached
+const (
+	coordinatePollInterval = 2 * time.Second
+	coordinateStartLead    = 3 * coordinatePollInterval
+)
+
+// Events recorded in the coordination table
+const (
+	coordinateRegister = "register"
+	coordinateResult   = "result"
+)
+
+// coordinationSchema is the schema of the coordination table
+var coordinationSchema = bigquery.Schema{
+	{Name: "session", Type: bigquery.StringFieldType, Required: true},
+	{Name: "host", Type: bigquery.StringFieldType, Required: true},
+	{Name: "run_id", Type: bigquery.StringFieldType, Required: true},
+	{Name: "event", Type: bigquery.StringFieldType, Required: true},
+	{Name: "event_time", Type: bigquery.TimestampFieldType, Required: true},
+	{Name: "records_sent", Type: bigquery.IntegerFieldType},
+	{Name: "elapsed_seconds", Type: bigquery.FloatFieldType},
+	{Name: "error", Type: bigquery.StringFieldType},
+}
+
+// Participant is a host registered in a coordination session
+type Participant struct {
+	Host           string    `bigquery:"host"`
+	RunID          string    `bigquery:"run_id"`
+	EventTime      time.Time `bigquery:"event_time"`
+	RecordsSent    int64     `bigquery:"records_sent"`
+	ElapsedSeconds float64   `bigquery:"elapsed_seconds"`
+	Error          string    `bigquery:"error"`
+}
+
+// Coordinator synchronises the start of the runs of several hosts through a
+// shared coordination table, using only BigQuery DML and queries
+type Coordinator struct {
+	client       *bigquery.Client
+	datasetID    string
+	tableID      string
+	session      string
+	host         string
+	runID        string
+	participants int
+	startAt      time.Time
+	timeout      time.Duration
+	registered   []Participant
+}
+
+// NewCoordinator creates a coordinator for the session in the table, named
+// DATASET.TABLE or TABLE within the default dataset.  The run starts once
+// the number of participants register, or the start time is reached.
+func NewCoordinator(client *bigquery.Client, table, defaultDataset, session, runID string, participants int, startAt time.Time, timeout time.Duration) (*Coordinator, error) {
+	datasetID, tableID := defaultDataset, table
+	if i := strings.Index(table, "."); i >= 0 {
+		datasetID, tableID = table[:i], table[i+1:]
+	}
+	if datasetID == "" || tableID == "" {
+		return nil, fmt.Errorf("invalid coordination table %q, expected DATASET.TABLE", table)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return &Coordinator{
+		client:       client,
+		datasetID:    datasetID,
+		tableID:      tableID,
+		session:      session,
+		host:         host,
+		runID:        runID,
+		participants: participants,
+		startAt:      startAt,
+		timeout:      timeout,
+	}, nil
+}
+
+// IsLeader reports whether this participant was the first to register,
+// which makes it responsible for reporting the aggregate
+func (c *Coordinator) IsLeader() bool {
+	return len(c.registered) > 0 && c.registered[0].RunID == c.runID
+}
+
+// Register creates the coordination table if required and registers this
+// participant in the session
+func (c *Coordinator) Register(ctx context.Context) error {
+	table := c.client.Dataset(c.datasetID).Table(c.tableID)
+	if err := table.Create(ctx, &bigquery.TableMetadata{Schema: coordinationSchema}); err != nil {
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != http.StatusConflict {
+			return err
+		}
+	}
+	logger.Info().Str("Session", c.session).Str("Host", c.host).Msg("Registering with the Coordination Table")
+	return c.insert(ctx, coordinateRegister, nil, nil)
+}
+
+// insert records an event for this participant via DML, so it is visible to
+// the queries of the other participants as soon as it completes
+func (c *Coordinator) insert(ctx context.Context, event string, summary *RunSummary, runErr error) error {
+	q := c.client.Query(fmt.Sprintf("INSERT INTO `%s.%s` (session, host, run_id, event, event_time, records_sent, elapsed_seconds, error) "+
+		"VALUES (@session, @host, @run_id, @event, CURRENT_TIMESTAMP(), @records_sent, @elapsed_seconds, @error)", c.datasetID, c.tableID))
+	params := map[string]interface{}{"session": c.session, "host": c.host, "run_id": c.runID, "event": event,
+		"records_sent": bigquery.NullInt64{}, "elapsed_seconds": bigquery.NullFloat64{}, "error": bigquery.NullString{}}
+	if summary != nil {
+		params["records_sent"] = bigquery.NullInt64{Int64: int64(summary.RecordsSent), Valid: true}
+		params["elapsed_seconds"] = bigquery.NullFloat64{Float64: summary.Elapsed.Seconds(), Valid: true}
+	}
+	if runErr != nil {
+		params["error"] = bigquery.NullString{StringVal: runErr.Error(), Valid: true}
+	}
+	for name, value := range params {
+		q.Parameters = append(q.Parameters, bigquery.QueryParameter{Name: name, Value: value})
+	}
+	_, err := ReadQuery(ctx, q)
+	return err
+}
+
+// events queries the participants which recorded the event in the session,
+// in the order they recorded it
+func (c *Coordinator) events(ctx context.Context, event string) ([]Participant, error) {
+	q := c.client.Query(fmt.Sprintf("SELECT host, run_id, event_time, IFNULL(records_sent, 0) AS records_sent, "+
+		"IFNULL(elapsed_seconds, 0) AS elapsed_seconds, IFNULL(error, '') AS error FROM `%s.%s` "+
+		"WHERE session = @session AND event = @event ORDER BY event_time, run_id", c.datasetID, c.tableID))
+	q.Parameters = []bigquery.QueryParameter{{Name: "session", Value: c.session}, {Name: "event", Value: event}}
+	it, err := ReadQuery(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	var participants []Participant
+	for {
+		var p Participant
+		err := it.Next(&p)
+		if errors.Is(err, iterator.Done) {
+			return participants, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		participants = append(participants, p)
+	}
+}
+
+// WaitForStart polls the registered participants until the expected number
+// have registered, the start time is reached, or the timeout from the first
+// registration expires, then sleeps until the common start instant.  Every
+// participant derives the same instant from the same rows, so the hosts'
+// clocks must be synchronised.
+func (c *Coordinator) WaitForStart(ctx context.Context) error {
+	for {
+		registered, err := c.events(ctx, coordinateRegister)
+		if err != nil {
+			return err
+		}
+		c.registered = registered
+
+		start, ready := c.startInstant(registered)
+		if ready {
+			logger.Info().Int("Participants", len(registered)).Time("Start", start).Bool("Leader", c.IsLeader()).Msg("  Waiting for the Coordinated Start")
+			if wait := time.Until(start); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		}
+
+		select {
+		case <-time.After(coordinatePollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// startInstant returns the common start instant derived from the registered
+// participants, and whether it is known yet
+func (c *Coordinator) startInstant(registered []Participant) (time.Time, bool) {
+	if !c.startAt.IsZero() && !time.Now().Before(c.startAt) {
+		return c.startAt, true
+	}
+	if c.participants > 0 && len(registered) >= c.participants {
+		return registered[c.participants-1].EventTime.Add(coordinateStartLead), true
+	}
+	if len(registered) > 0 && c.timeout > 0 {
+		if deadline := registered[0].EventTime.Add(c.timeout); !time.Now().Before(deadline) {
+			return deadline, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Finish records the results of this participant's run
+func (c *Coordinator) Finish(ctx context.Context, summary *RunSummary, runErr error) error {
+	return c.insert(ctx, coordinateResult, summary, runErr)
+}
+
+// WaitForResults polls until every registered participant has recorded its
+// results, or the timeout expires, returning the participants with results
+// and the stragglers without
+func (c *Coordinator) WaitForResults(ctx context.Context) ([]Participant, []Participant, error) {
+	deadline := time.Now().Add(c.timeout)
+	for {
+		results, err := c.events(ctx, coordinateResult)
+		if err != nil {
+			return nil, nil, err
+		}
+		finished := make(map[string]bool, len(results))
+		for _, p := range results {
+			finished[p.RunID] = true
+		}
+		var stragglers []Participant
+		for _, p := range c.registered {
+			if !finished[p.RunID] {
+				stragglers = append(stragglers, p)
+			}
+		}
+		if len(stragglers) == 0 || !time.Now().Before(deadline) {
+			return results, stragglers, nil
+		}
+
+		select {
+		case <-time.After(coordinatePollInterval):
+		case <-ctx.Done():
+			return results, stragglers, ctx.Err()
+		}
+	}
+}
+
+// LogCoordinatedResults outputs the results of each participant, the
+// aggregate throughput of the project, and any stragglers
+func LogCoordinatedResults(results, stragglers []Participant) {
+	logger.Info().Int("Participants", len(results)).Int("Stragglers", len(stragglers)).Msg("Coordinated Results")
+	var records int64
+	var rate float64
+	for _, p := range results {
+		event := logger.Info().Str("Host", p.Host).Str("Run ID", p.RunID).Int64("Records Sent", p.RecordsSent).Float64("Elapsed Seconds", p.ElapsedSeconds)
+		if p.Error != "" {
+			event.Str("Error", p.Error)
+		}
+		event.Msg(indent)
+		records += p.RecordsSent
+		if p.ElapsedSeconds > 0 {
+			rate += float64(p.RecordsSent) / p.ElapsedSeconds
+		}
+	}
+	logger.Info().Int64("Records Sent", records).Float64("Aggregate Records per Second", rate).Msg(indent)
+	for _, p := range stragglers {
+		logger.Warn().Str("Host", p.Host).Str("Run ID", p.RunID).Msg("  Participant Never Reported Results")
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// Default number of rows sampled when profiling a table
+const defaultProfileSampleRows = 100000
+
+// Number of quantiles of the string and bytes lengths collected by a profile
+const profileLengthQuantiles = 10
+
+// profiledTypes are the column types a profile collects statistics for,
+// every other column being generated with the defaults of its type
+var profiledTypes = map[bigquery.FieldType]bool{
+	bigquery.StringFieldType:     true,
+	bigquery.BytesFieldType:      true,
+	bigquery.IntegerFieldType:    true,
+	bigquery.FloatFieldType:      true,
+	bigquery.NumericFieldType:    true,
+	bigquery.BigNumericFieldType: true,
+	bigquery.BooleanFieldType:    true,
+	bigquery.TimestampFieldType:  true,
+	bigquery.DateTimeFieldType:   true,
+	bigquery.DateFieldType:       true,
+	bigquery.TimeFieldType:       true,
+}
+
+// ColumnProfile holds the statistics of a single column of a table.  The
+// minimum and maximum of a TIMESTAMP, DATETIME or DATE column are in
+// microseconds since the Unix epoch, and of a TIME column in microseconds
+// since midnight.
+type ColumnProfile struct {
+	Name            string   `json:"name"`
+	Type            string   `json:"type"`
+	Cardinality     int64    `json:"cardinality"`
+	NullFraction    float64  `json:"null_fraction"`
+	Min             *float64 `json:"min,omitempty"`
+	Max             *float64 `json:"max,omitempty"`
+	LengthQuantiles []int64  `json:"length_quantiles,omitempty"`
+}
+
+// DataProfile holds the statistics of the columns of a sample of a table,
+// written by the profile-table subcommand and read by -data-profile
+type DataProfile struct {
+	Table      string          `json:"table"`
+	SampleRows int64           `json:"sample_rows"`
+	ProfiledAt time.Time       `json:"profiled_at"`
+	Columns    []ColumnProfile `json:"columns"`
+}
+
+// RunProfileTable profiles the columns of a sample of an existing table,
+// writing the statistics to a JSON file for -data-profile, and returns the
+// exit status
+func RunProfileTable(args []string) int {
+	flags := flag.NewFlagSet("profile-table", flag.ContinueOnError)
+	var projectID = flags.String("p", "", "Google Cloud Project ID  (Required)")
+	var datasetID = flags.String("d", "", "BigQuery Dataset  (Required)")
+	var tableID = flags.String("t", "", "BigQuery Table to Profile  (Required)")
+	var sampleRows = flags.Int64("sample-rows", defaultProfileSampleRows, "Maximum Number of Rows Sampled")
+	var outputFile = flags.String("output", "", "File to Write the Data Profile as JSON  (Required)")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if *projectID == "" || *datasetID == "" || *tableID == "" || *outputFile == "" || *sampleRows < 1 {
+		flags.Usage()
+		return 1
+	}
+
+	ctx := context.Background()
+	client, err := bigquery.NewClient(ctx, *projectID)
+	if err != nil {
+		logger.Error().Err(WrapClientError(err, *projectID)).Msg("Error [bigquery.NewClient]")
+		return 1
+	}
+	defer client.Close()
+
+	profile, err := ProfileTable(ctx, client, *datasetID, *tableID, *sampleRows)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error [ProfileTable]")
+		return 1
+	}
+	LogDataProfile(profile)
+	data, err := json.MarshalIndent(profile, "", "  ")
+	if err == nil {
+		err = os.WriteFile(*outputFile, append(data, '\n'), 0o644)
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("Error [WriteDataProfile]")
+		return 1
+	}
+	logger.Info().Str("Output", *outputFile).Msg("Data Profile Written")
+	return 0
+}
+
+// ProfileTable collects the statistics of every top-level column of a
+// profiled type with a single query over a bounded sample of the table's
+// rows.  Only statistics are collected, never the values themselves.
+func ProfileTable(ctx context.Context, client *bigquery.Client, datasetID, tableID string, sampleRows int64) (*DataProfile, error) {
+	metadata, err := client.Dataset(datasetID).Table(tableID).Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var columns []*bigquery.FieldSchema
+	expressions := []string{"COUNT(*) AS sample_rows"}
+	for _, field := range metadata.Schema {
+		if field.Repeated || !profiledTypes[field.Type] {
+			continue
+		}
+		i := len(columns)
+		columns = append(columns, field)
+		expressions = append(expressions, profileExpressions(i, field)...)
+	}
+	q := client.Query(fmt.Sprintf("SELECT %s FROM (SELECT * FROM `%s.%s` LIMIT %d)", strings.Join(expressions, ", "), datasetID, tableID, sampleRows))
+
+	it, err := ReadQuery(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	var row map[string]bigquery.Value
+	if err := it.Next(&row); err != nil && err != iterator.Done {
+		return nil, err
+	}
+
+	profile := &DataProfile{Table: fmt.Sprintf("%s.%s", datasetID, tableID), SampleRows: valueInt64(row["sample_rows"]), ProfiledAt: time.Now().UTC()}
+	for i, field := range columns {
+		column := ColumnProfile{Name: field.Name, Type: string(field.Type), Cardinality: valueInt64(row[fmt.Sprintf("c%d_distinct", i)])}
+		if profile.SampleRows > 0 {
+			column.NullFraction = float64(valueInt64(row[fmt.Sprintf("c%d_nulls", i)])) / float64(profile.SampleRows)
+		}
+		if v, ok := row[fmt.Sprintf("c%d_min", i)].(float64); ok {
+			column.Min = &v
+		}
+		if v, ok := row[fmt.Sprintf("c%d_max", i)].(float64); ok {
+			column.Max = &v
+		}
+		if lengths, ok := row[fmt.Sprintf("c%d_lengths", i)].([]bigquery.Value); ok {
+			for _, length := range lengths {
+				column.LengthQuantiles = append(column.LengthQuantiles, valueInt64(length))
+			}
+		}
+		profile.Columns = append(profile.Columns, column)
+	}
+	return profile, nil
+}
+
+// profileExpressions returns the aggregate expressions collecting the
+// statistics of the i-th profiled column
+func profileExpressions(i int, field *bigquery.FieldSchema) []string {
+	column := fmt.Sprintf("`%s`", field.Name)
+	expressions := []string{
+		fmt.Sprintf("COUNTIF(%s IS NULL) AS c%d_nulls", column, i),
+		fmt.Sprintf("APPROX_COUNT_DISTINCT(%s) AS c%d_distinct", column, i),
+	}
+	var bound string
+	switch field.Type {
+	case bigquery.IntegerFieldType, bigquery.FloatFieldType, bigquery.NumericFieldType, bigquery.BigNumericFieldType:
+		bound = "%s(%s)"
+	case bigquery.TimestampFieldType:
+		bound = "UNIX_MICROS(%s(%s))"
+	case bigquery.DateTimeFieldType, bigquery.DateFieldType:
+		bound = "UNIX_MICROS(TIMESTAMP(%s(%s)))"
+	case bigquery.TimeFieldType:
+		bound = "TIME_DIFF(%s(%s), TIME '00:00:00', MICROSECOND)"
+	case bigquery.StringFieldType, bigquery.BytesFieldType:
+		expressions = append(expressions, fmt.Sprintf("APPROX_QUANTILES(LENGTH(%s), %d) AS c%d_lengths", column, profileLengthQuantiles, i))
+	}
+	if bound != "" {
+		expressions = append(expressions,
+			fmt.Sprintf("CAST("+bound+" AS FLOAT64) AS c%d_min", "MIN", column, i),
+			fmt.Sprintf("CAST("+bound+" AS FLOAT64) AS c%d_max", "MAX", column, i))
+	}
+	return expressions
+}
+
+// LogDataProfile outputs the statistics of each column of the profile
+func LogDataProfile(profile *DataProfile) {
+	logger.Info().Str("Table", profile.Table).Int64("Sample Rows", profile.SampleRows).Int("Columns", len(profile.Columns)).Msg("Data Profile")
+	for _, column := range profile.Columns {
+		event := logger.Info().Str("Column", column.Name).Str("Type", column.Type).Int64("Cardinality", column.Cardinality).
+			Str("Null Fraction", fmt.Sprintf("%.3f", column.NullFraction))
+		if column.Min != nil && column.Max != nil {
+			event = event.Float64("Min", *column.Min).Float64("Max", *column.Max)
+		}
+		if len(column.LengthQuantiles) > 0 {
+			event = event.Int64("Min Length", column.LengthQuantiles[0]).Int64("Max Length", column.LengthQuantiles[len(column.LengthQuantiles)-1])
+		}
+		event.Msg(indent)
+	}
+}
+
+// LoadDataProfile reads a data profile written by the profile-table
+// subcommand
+func LoadDataProfile(path string) (*DataProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profile DataProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("failed to parse the data profile %s: %w", path, err)
+	}
+	return &profile, nil
+}
+
+// NewProfileDataGenerator returns a dataGenerator producing values matching
+// the statistics of the profiled columns of the same name and type, along
+// with the names of the columns generated with the defaults of their type
+// as the profile has no statistics for them
+func NewProfileDataGenerator(schema bigquery.Schema, profile *DataProfile) (dataGenerator, []string) {
+	columns := make(map[string]ColumnProfile, len(profile.Columns))
+	for _, column := range profile.Columns {
+		columns[column.Name] = column
+	}
+	profiled := make(map[string]ColumnProfile)
+	var fallback []string
+	for _, field := range schema {
+		if column, ok := columns[field.Name]; ok && column.Type == string(field.Type) && !field.Repeated && profiledTypes[field.Type] {
+			profiled[field.Name] = column
+		} else if !generatedColumns[field.Name] {
+			fallback = append(fallback, field.Name)
+		}
+	}
+	return newSchemaDataGenerator(schema, func(r *rand.Rand, field *bigquery.FieldSchema) bigquery.Value {
+		if column, ok := profiled[field.Name]; ok {
+			return profileValue(r, field, column)
+		}
+		return randomFieldValue(r, field)
+	}), fallback
+}
+
+// profileValue generates a value of the column matching its statistics, a
+// null in proportion to its null fraction, otherwise one of as many distinct
+// values as its cardinality spread evenly between its minimum and maximum
+func profileValue(r *rand.Rand, field *bigquery.FieldSchema, column ColumnProfile) bigquery.Value {
+	if !field.Required && r.Float64() < column.NullFraction {
+		return nil
+	}
+	cardinality := max(1, column.Cardinality)
+	k := r.Int64N(cardinality)
+	position := 0.0
+	if cardinality > 1 {
+		position = float64(k) / float64(cardinality-1)
+	}
+
+	switch field.Type {
+	case bigquery.StringFieldType:
+		return profileString(k, column.LengthQuantiles)
+	case bigquery.BytesFieldType:
+		return base64.StdEncoding.EncodeToString([]byte(profileString(k, column.LengthQuantiles)))
+	case bigquery.BooleanFieldType:
+		return k%2 == 1
+	}
+	if column.Min == nil || column.Max == nil {
+		return randomScalarValue(r, field)
+	}
+	value := *column.Min + (*column.Max-*column.Min)*position
+	switch field.Type {
+	case bigquery.IntegerFieldType:
+		return int64(math.Round(value))
+	case bigquery.FloatFieldType:
+		return value
+	case bigquery.NumericFieldType, bigquery.BigNumericFieldType:
+		return strconv.FormatFloat(value, 'f', 9, 64)
+	case bigquery.TimestampFieldType:
+		return time.UnixMicro(int64(value)).UTC().Format("2006-01-02 15:04:05.000000 UTC")
+	case bigquery.DateTimeFieldType:
+		return time.UnixMicro(int64(value)).UTC().Format("2006-01-02 15:04:05.000000")
+	case bigquery.DateFieldType:
+		return time.UnixMicro(int64(value)).UTC().Format("2006-01-02")
+	case bigquery.TimeFieldType:
+		return time.UnixMicro(int64(value)).UTC().Format("15:04:05.000000")
+	}
+	return randomScalarValue(r, field)
+}
+
+// profileString generates the k-th distinct string of a column, its length
+// drawn from between a pair of adjacent length quantiles chosen by k, so the
+// same k always generates the same string
+func profileString(k int64, quantiles []int64) string {
+	if len(quantiles) < 2 {
+		return randomNames[k%int64(len(randomNames))]
+	}
+	r := seededRand(uint64(k))
+	bucket := r.IntN(len(quantiles) - 1)
+	length := quantiles[bucket] + r.Int64N(max(0, quantiles[bucket+1]-quantiles[bucket])+1)
+	token := strconv.FormatUint(splitMix64(uint64(k)), 36)
+	return strings.Repeat(token, int(length)/len(token)+1)[:length]
+}
@@ -0,0 +1,219 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// ddlCreateTable matches the start of the first CREATE TABLE statement
+var ddlCreateTable = regexp.MustCompile(`(?is)CREATE\s+(?:OR\s+REPLACE\s+)?(?:TEMP(?:ORARY)?\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?[^\s(]+\s*\(`)
+
+// ddlComment matches a single line comment
+var ddlComment = regexp.MustCompile(`--[^\n]*`)
+
+// ddlFieldTypes maps the GoogleSQL type names, and their aliases, to the
+// column types
+var ddlFieldTypes = map[string]bigquery.FieldType{
+	"STRING":     bigquery.StringFieldType,
+	"BYTES":      bigquery.BytesFieldType,
+	"INT64":      bigquery.IntegerFieldType,
+	"INT":        bigquery.IntegerFieldType,
+	"SMALLINT":   bigquery.IntegerFieldType,
+	"INTEGER":    bigquery.IntegerFieldType,
+	"BIGINT":     bigquery.IntegerFieldType,
+	"TINYINT":    bigquery.IntegerFieldType,
+	"BYTEINT":    bigquery.IntegerFieldType,
+	"FLOAT64":    bigquery.FloatFieldType,
+	"NUMERIC":    bigquery.NumericFieldType,
+	"DECIMAL":    bigquery.NumericFieldType,
+	"BIGNUMERIC": bigquery.BigNumericFieldType,
+	"BIGDECIMAL": bigquery.BigNumericFieldType,
+	"BOOL":       bigquery.BooleanFieldType,
+	"BOOLEAN":    bigquery.BooleanFieldType,
+	"DATE":       bigquery.DateFieldType,
+	"DATETIME":   bigquery.DateTimeFieldType,
+	"TIME":       bigquery.TimeFieldType,
+	"TIMESTAMP":  bigquery.TimestampFieldType,
+	"GEOGRAPHY":  bigquery.GeographyFieldType,
+	"JSON":       bigquery.JSONFieldType,
+	"INTERVAL":   bigquery.IntervalFieldType,
+}
+
+// ParseBigQueryDDL converts the column definitions of the first CREATE TABLE
+// statement of GoogleSQL DDL into a bigquery.Schema, including STRUCT columns
+// as RECORD and ARRAY columns as REPEATED.  Table constraints and column
+// options are ignored.
+func ParseBigQueryDDL(ddl string) (bigquery.Schema, error) {
+	ddl = ddlComment.ReplaceAllString(ddl, "")
+	loc := ddlCreateTable.FindStringIndex(ddl)
+	if loc == nil {
+		return nil, errors.New("no CREATE TABLE statement was found")
+	}
+
+	// Find the closing parenthesis of the column definitions
+	body := ddl[loc[1]:]
+	depth := 1
+	end := -1
+	for i, r := range body {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		if depth == 0 {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return nil, errors.New("the CREATE TABLE column definitions are not closed")
+	}
+
+	var schema bigquery.Schema
+	for _, definition := range splitTopLevel(body[:end], ',') {
+		definition = strings.TrimSpace(definition)
+		upper := strings.ToUpper(definition)
+		if definition == "" || strings.HasPrefix(upper, "PRIMARY KEY") || strings.HasPrefix(upper, "FOREIGN KEY") || strings.HasPrefix(upper, "CONSTRAINT") {
+			continue
+		}
+		field, err := parseDDLColumn(definition)
+		if err != nil {
+			return nil, err
+		}
+		schema = append(schema, field)
+	}
+	if len(schema) == 0 {
+		return nil, errors.New("the CREATE TABLE statement has no columns")
+	}
+	return schema, nil
+}
+
+// parseDDLColumn parses a single column definition of a name, a type and
+// any trailing NOT NULL or options
+func parseDDLColumn(definition string) (*bigquery.FieldSchema, error) {
+	name, rest := splitDDLName(definition)
+	if name == "" || rest == "" {
+		return nil, fmt.Errorf("invalid column definition %q", definition)
+	}
+	typeExpr, options := splitDDLType(rest)
+	field, err := parseDDLType(name, typeExpr)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(strings.ToUpper(options), "NOT NULL") && !field.Repeated {
+		field.Required = true
+	}
+	return field, nil
+}
+
+// parseDDLType parses a type expression, such as ARRAY<STRUCT<a INT64>>
+func parseDDLType(name, typeExpr string) (*bigquery.FieldSchema, error) {
+	typeExpr = strings.TrimSpace(typeExpr)
+	upper := strings.ToUpper(typeExpr)
+	switch {
+	case strings.HasPrefix(upper, "ARRAY<") && strings.HasSuffix(typeExpr, ">"):
+		element, err := parseDDLType(name, typeExpr[len("ARRAY<"):len(typeExpr)-1])
+		if err != nil {
+			return nil, err
+		}
+		if element.Repeated {
+			return nil, fmt.Errorf("column %q: arrays of arrays are not supported by BigQuery", name)
+		}
+		element.Repeated = true
+		return element, nil
+	case strings.HasPrefix(upper, "STRUCT<") && strings.HasSuffix(typeExpr, ">"):
+		field := &bigquery.FieldSchema{Name: name, Type: bigquery.RecordFieldType}
+		for _, member := range splitTopLevel(typeExpr[len("STRUCT<"):len(typeExpr)-1], ',') {
+			nested, err := parseDDLColumn(strings.TrimSpace(member))
+			if err != nil {
+				return nil, fmt.Errorf("column %q: %w", name, err)
+			}
+			field.Schema = append(field.Schema, nested)
+		}
+		return field, nil
+	}
+
+	// Parameterised types such as STRING(10) or NUMERIC(10, 2)
+	if i := strings.IndexByte(upper, '('); i >= 0 {
+		upper = strings.TrimSpace(upper[:i])
+	}
+	fieldType, ok := ddlFieldTypes[upper]
+	if !ok {
+		return nil, fmt.Errorf("column %q: unsupported type %q", name, typeExpr)
+	}
+	return &bigquery.FieldSchema{Name: name, Type: fieldType}, nil
+}
+
+// splitDDLName splits the column name, which may be quoted, from the rest of
+// the definition
+func splitDDLName(definition string) (string, string) {
+	if strings.HasPrefix(definition, "`") {
+		if end := strings.IndexByte(definition[1:], '`'); end >= 0 {
+			return definition[1 : end+1], strings.TrimSpace(definition[end+2:])
+		}
+		return "", ""
+	}
+	name, rest, _ := strings.Cut(definition, " ")
+	return name, strings.TrimSpace(rest)
+}
+
+// splitDDLType splits the type expression from any trailing column options,
+// the type ending at the first space outside angle brackets or parentheses
+func splitDDLType(rest string) (string, string) {
+	depth := 0
+	for i, r := range rest {
+		switch r {
+		case '<', '(':
+			depth++
+		case '>', ')':
+			depth--
+		case ' ', '\t', '\n', '\r':
+			if depth == 0 {
+				return rest[:i], rest[i+1:]
+			}
+		}
+	}
+	return rest, ""
+}
+
+// splitTopLevel splits on the separator outside of any angle brackets,
+// parentheses or quotes
+func splitTopLevel(value string, separator rune) []string {
+	var parts []string
+	depth, start := 0, 0
+	quoted := false
+	for i, r := range value {
+		switch {
+		case r == '`' || r == '\'' || r == '"':
+			quoted = !quoted
+		case quoted:
+		case r == '<' || r == '(':
+			depth++
+		case r == '>' || r == ')':
+			depth--
+		case r == separator && depth == 0:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
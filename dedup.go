@@ -0,0 +1,116 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// dedupKey is the column telling the distinct records of a run apart from
+// the duplicates injected by -dup-percent
+const dedupKey = "uuid"
+
+// DuplicateSchedule chooses the records sent a second time, spreading the
+// percentage of duplicates evenly through the run
+type DuplicateSchedule struct {
+	percent float64
+	credit  float64
+}
+
+// NewDuplicateSchedule creates a schedule re-sending percent of the records,
+// returning nil when no duplicates are to be sent
+func NewDuplicateSchedule(percent float64) *DuplicateSchedule {
+	if percent <= 0 {
+		return nil
+	}
+	return &DuplicateSchedule{percent: percent}
+}
+
+// Next reports whether the record just sent is to be sent again, a nil
+// schedule never re-sending a record
+func (d *DuplicateSchedule) Next() bool {
+	if d == nil {
+		return false
+	}
+	d.credit += d.percent
+	if d.credit < 100 {
+		return false
+	}
+	d.credit -= 100
+	return true
+}
+
+// CountRunRows counts the rows in the target table tagged with the run_id,
+// including those still in the streaming buffer.
+func CountRunRows(ctx context.Context, client *bigquery.Client, datasetID, tableID, runID string) (int64, error) {
+	q := client.Query(fmt.Sprintf("SELECT COUNT(*) FROM `%s.%s` WHERE run_id = @run_id", datasetID, tableID))
+	q.Parameters = []bigquery.QueryParameter{{Name: "run_id", Value: runID}}
+
+	it, err := ReadQuery(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+
+	var row []bigquery.Value
+	if err := it.Next(&row); err != nil {
+		return 0, err
+	}
+	return valueInt64(row[0]), nil
+}
+
+// CountDistinctRunRows counts the distinct records in the target table tagged
+// with the run_id, the duplicates surviving deduplication counted once
+func CountDistinctRunRows(ctx context.Context, client *bigquery.Client, datasetID, tableID, runID string) (int64, error) {
+	q := client.Query(fmt.Sprintf("SELECT COUNT(DISTINCT %s) FROM `%s.%s` WHERE run_id = @run_id", dedupKey, datasetID, tableID))
+	q.Parameters = []bigquery.QueryParameter{{Name: "run_id", Value: runID}}
+
+	it, err := ReadQuery(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+
+	var row []bigquery.Value
+	if err := it.Next(&row); err != nil {
+		return 0, err
+	}
+	return valueInt64(row[0]), nil
+}
+
+// DeduplicationRate returns the percentage of duplicate records which were
+// removed by BigQuery, given the number of rows found in the table.
+func DeduplicationRate(recordsSent, duplicatesSent int, rowsFound int64) float64 {
+	if duplicatesSent == 0 {
+		return 0
+	}
+	removed := int64(recordsSent+duplicatesSent) - rowsFound
+	if removed < 0 {
+		removed = 0
+	}
+	return float64(removed) / float64(duplicatesSent) * 100
+}
+
+// LogDeduplicationRate outputs the measured best-effort deduplication rate
+func LogDeduplicationRate(summary *RunSummary, rowsFound, distinctRows int64) {
+	logger.Info().Msg("Deduplication Rate")
+	logger.Info().Int("Records Sent", summary.RecordsSent).Msg(indent)
+	logger.Info().Int("Duplicates Sent", summary.DuplicatesSent).Msg(indent)
+	logger.Info().Int64("Rows Found", rowsFound).Msg(indent)
+	logger.Info().Int64("Distinct Rows Found", distinctRows).Msg(indent)
+	logger.Info().Str("Deduplication Rate", fmt.Sprintf("%.2f%%", DeduplicationRate(summary.RecordsSent, summary.DuplicatesSent, rowsFound))).Msg(indent)
+	logger.Info().Msg("  Note: Insert ID deduplication is best-effort within a window of roughly one minute, and is not guaranteed")
+}
@@ -0,0 +1,232 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Supported schema-mismatch drill classes
+const (
+	drillMissingRequired  = "missing-required"
+	drillWrongType        = "wrong-type"
+	drillExtraField       = "extra-field"
+	drillWrongFieldNumber = "wrong-field-number"
+	drillAll              = "all"
+)
+
+// drillClasses lists each mismatch class in the order they are executed
+var drillClasses = []string{drillMissingRequired, drillWrongType, drillExtraField, drillWrongFieldNumber}
+
+// drillExplanations holds a plain-English explanation of each mismatch class
+var drillExplanations = map[string]string{
+	drillMissingRequired: "The row omitted a value for the REQUIRED column \"name\". The Storage Write API rejects the " +
+		"row, and the error names the missing field. Check the generator sets every REQUIRED column.",
+	drillWrongType: "The descriptor declared \"uuid\" as a proto string, but the table column is INTEGER. The Storage " +
+		"Write API validates the descriptor against the table schema when the stream is used, and reports the " +
+		"incompatible field and both types.",
+	drillExtraField: "The descriptor declared \"extra_field\", which does not exist in the table schema. The error " +
+		"lists the extra fields; either add the columns to the table or remove them from the descriptor.",
+	drillWrongFieldNumber: "The row was encoded with \"name\" as field 1 and \"uuid\" as field 2, but the descriptor sent " +
+		"with the stream swaps those numbers. The backend decodes the bytes using the descriptor, so the values land " +
+		"in the wrong fields and the row fails to parse. Make sure the descriptor is derived from the same message " +
+		"used to encode the rows.",
+}
+
+// drillBigQuerySchema is the schema of the scratch table used by the drill
+var drillBigQuerySchema = bigquery.Schema{
+	{Name: "name", Type: bigquery.StringFieldType, Required: true},
+	{Name: "uuid", Type: bigquery.IntegerFieldType},
+	{Name: "create_time", Type: bigquery.DateTimeFieldType},
+}
+
+// drillField describes a single field of the descriptor sent with a stream
+type drillField struct {
+	name   string
+	number int32
+	kind   descriptorpb.FieldDescriptorProto_Type
+}
+
+// DrillResult holds the outcome of a single mismatch drill
+type DrillResult struct {
+	Class       string
+	Error       string
+	Explanation string
+}
+
+// ParseDrillClasses returns the drill classes selected by the flag value
+func ParseDrillClasses(value string) ([]string, error) {
+	if value == drillAll {
+		return drillClasses, nil
+	}
+	if _, ok := drillExplanations[value]; !ok {
+		return nil, fmt.Errorf("unknown drill class %q, expected one of %s or %s", value, strings.Join(drillClasses, ", "), drillAll)
+	}
+	return []string{value}, nil
+}
+
+// ExecuteSchemaDrill creates a scratch table, deliberately introduces each
+// selected class of schema mismatch using the Storage Write API, and reports
+// the exact error returned alongside an explanation.  The scratch table is
+// deleted afterwards.  The options configure the Storage Write API client.
+func ExecuteSchemaDrill(ctx context.Context, client *bigquery.Client, projectID, datasetID, runID string, classes []string, opts ...option.ClientOption) ([]DrillResult, error) {
+	tableID := fmt.Sprintf("bqwrite_test_drill_%s", strings.ReplaceAll(runID, "-", "_"))
+	table := client.Dataset(datasetID).Table(tableID)
+
+	logger.Info().Str("Table Name", tableID).Msg("Creating Scratch BigQuery Table")
+	err := table.Create(ctx, &bigquery.TableMetadata{
+		Schema:         drillBigQuerySchema,
+		ExpirationTime: time.Now().Add(24 * time.Hour),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		logger.Info().Str("Table Name", tableID).Msg("Deleting Scratch BigQuery Table")
+		if err := table.Delete(context.Background()); err != nil {
+			logger.Warn().Err(err).Msg("Error [table.Delete]")
+		}
+	}()
+
+	writeClient, err := managedwriter.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer writeClient.Close()
+
+	results := make([]DrillResult, 0, len(classes))
+	for _, class := range classes {
+		logger.Info().Str("Drill", class).Msg("Execute Schema Mismatch Drill")
+		result := DrillResult{Class: class, Explanation: drillExplanations[class]}
+
+		err := appendDrillRow(ctx, writeClient, managedwriter.TableParentFromParts(projectID, datasetID, tableID), class)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		LogDrillResult(result)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// appendDrillRow appends a single row containing the mismatch to the default
+// stream, or a valid row for any other class, returning the error reported
+// by the API.
+func appendDrillRow(ctx context.Context, client *managedwriter.Client, destination, class string) error {
+	descriptorFields := []drillField{
+		{"name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING},
+		{"uuid", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64},
+		{"create_time", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING},
+	}
+	createTime := time.Now().UTC().Format(dateTimeJSONLayout)
+
+	var row []byte
+	switch class {
+	case drillMissingRequired:
+		row = protowire.AppendTag(row, 2, protowire.VarintType)
+		row = protowire.AppendVarint(row, 42)
+		row = appendDrillString(row, 3, createTime)
+	case drillWrongType:
+		descriptorFields[1].kind = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		row = appendDrillString(row, 1, randomNames[0])
+		row = appendDrillString(row, 2, "forty-two")
+		row = appendDrillString(row, 3, createTime)
+	case drillExtraField:
+		descriptorFields = append(descriptorFields, drillField{"extra_field", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING})
+		row = appendDrillRowFields(row, createTime)
+		row = appendDrillString(row, 4, "unexpected")
+	case drillWrongFieldNumber:
+		descriptorFields[0].number, descriptorFields[1].number = 2, 1
+		row = appendDrillRowFields(row, createTime)
+	default:
+		row = appendDrillRowFields(row, createTime)
+	}
+
+	stream, err := client.NewManagedStream(ctx,
+		managedwriter.WithDestinationTable(destination),
+		managedwriter.WithType(managedwriter.DefaultStream),
+		managedwriter.WithSchemaDescriptor(drillDescriptor(descriptorFields)),
+	)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	result, err := stream.AppendRows(ctx, [][]byte{row})
+	if err != nil {
+		return err
+	}
+
+	// Row level errors are reported in the response alongside an error
+	// referring to them, so both are returned
+	response, err := result.FullResponse(ctx)
+	var rowErrors []string
+	for _, rowError := range response.GetRowErrors() {
+		rowErrors = append(rowErrors, fmt.Sprintf("row %d: %s", rowError.GetIndex(), rowError.GetMessage()))
+	}
+	if len(rowErrors) > 0 {
+		return errors.Join(err, errors.New(strings.Join(rowErrors, "; ")))
+	}
+	return err
+}
+
+// appendDrillRowFields encodes a valid row using the expected field numbers
+func appendDrillRowFields(row []byte, createTime string) []byte {
+	row = appendDrillString(row, 1, randomNames[0])
+	row = protowire.AppendTag(row, 2, protowire.VarintType)
+	row = protowire.AppendVarint(row, 42)
+	return appendDrillString(row, 3, createTime)
+}
+
+// appendDrillString encodes a single string field
+func appendDrillString(row []byte, number protowire.Number, value string) []byte {
+	row = protowire.AppendTag(row, number, protowire.BytesType)
+	return protowire.AppendString(row, value)
+}
+
+// drillDescriptor builds the proto2 descriptor sent with the stream
+func drillDescriptor(fields []drillField) *descriptorpb.DescriptorProto {
+	descriptor := &descriptorpb.DescriptorProto{Name: proto.String("DrillRow")}
+	for _, field := range fields {
+		descriptor.Field = append(descriptor.Field, &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(field.name),
+			Number: proto.Int32(field.number),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   field.kind.Enum(),
+		})
+	}
+	return descriptor
+}
+
+// LogDrillResult outputs the error captured by a drill and its explanation
+func LogDrillResult(result DrillResult) {
+	if result.Error == "" {
+		logger.Warn().Str("Drill", result.Class).Msg("  No Error was Returned, the Mismatch was Accepted")
+		return
+	}
+	logger.Info().Str("Error", result.Error).Msg("  Error Returned")
+	logger.Info().Str("Explanation", result.Explanation).Msg("  What Was Wrong")
+}
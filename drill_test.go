@@ -0,0 +1,114 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"google.golang.org/api/option"
+)
+
+// drillErrors are the drill classes along with a part of the error expected
+// of the fake server for each
+var drillErrors = []struct {
+	class string
+	err   string
+}{
+	{drillMissingRequired, "The required field name is missing from the row."},
+	{drillWrongType, "the proto field type string, BigQuery field type INTEGER"},
+	{drillExtraField, "extra fields: 'extra_field'"},
+	{drillWrongFieldNumber, "field numbers or wire types do not match the writer schema"},
+}
+
+func TestSchemaDrill(t *testing.T) {
+	server := NewFakeBigQueryServer()
+	defer server.Close()
+	ctx := context.Background()
+	client, err := bigquery.NewClient(ctx, selfTestProject, FakeClientOptions(server)...)
+	if err != nil {
+		t.Fatalf("bigquery.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	if len(drillErrors) != len(drillClasses) {
+		t.Fatalf("%d drill classes tested, expected %d", len(drillErrors), len(drillClasses))
+	}
+	runID := NewRunID()
+	results, err := ExecuteSchemaDrill(ctx, client, selfTestProject, selfTestDataset, runID, drillClasses, FakeStorageWriteOptions(server)...)
+	if err != nil {
+		t.Fatalf("ExecuteSchemaDrill: %v", err)
+	}
+	if tableID := "bqwrite_test_drill_" + strings.ReplaceAll(runID, "-", "_"); server.HasTable(selfTestDataset, tableID) {
+		t.Errorf("the scratch table %s was not deleted", tableID)
+	}
+	if len(results) != len(drillErrors) {
+		t.Fatalf("%d drill results, expected %d", len(results), len(drillErrors))
+	}
+	for i, tt := range drillErrors {
+		t.Run(tt.class, func(t *testing.T) {
+			result := results[i]
+			switch {
+			case result.Class != tt.class:
+				t.Errorf("drill %s, expected %s", result.Class, tt.class)
+			case !strings.Contains(result.Error, tt.err):
+				t.Errorf("error %q, expected it to contain %q", result.Error, tt.err)
+			case result.Explanation != drillExplanations[tt.class]:
+				t.Errorf("explanation %q, expected that of %s", result.Explanation, tt.class)
+			}
+		})
+	}
+}
+
+// TestSchemaDrillWithoutMismatch appends the row of the drill without any
+// mismatch, which the fake server must accept
+func TestSchemaDrillWithoutMismatch(t *testing.T) {
+	server := NewFakeBigQueryServer()
+	defer server.Close()
+	ctx := context.Background()
+	fields, err := drillBigQuerySchema.ToJSONFields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.CreateTable(selfTestDataset, "drill", fields)
+	writeClient, err := managedwriter.NewClient(ctx, selfTestProject, FakeStorageWriteOptions(server)...)
+	if err != nil {
+		t.Fatalf("managedwriter.NewClient: %v", err)
+	}
+	defer writeClient.Close()
+
+	if err := appendDrillRow(ctx, writeClient, managedwriter.TableParentFromParts(selfTestProject, selfTestDataset, "drill"), ""); err != nil {
+		t.Errorf("appendDrillRow: %v", err)
+	}
+}
+
+func TestIntegrationSchemaDrill(t *testing.T) {
+	env := requireIntegration(t)
+	results, err := ExecuteSchemaDrill(context.Background(), env.Client, env.ProjectID, env.DatasetID, NewRunID(), drillClasses, option.WithCredentialsFile(os.Getenv(envTestCredentials)))
+	if err != nil {
+		t.Fatalf("ExecuteSchemaDrill: %v", err)
+	}
+	for _, result := range results {
+		t.Run(result.Class, func(t *testing.T) {
+			if result.Error == "" {
+				t.Errorf("the %s mismatch was accepted", result.Class)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Column joining the rows of the old and new tables of a dual write
+const dualWriteKey = "uuid"
+
+// CountDualWriteMismatches counts the records of the run present in only one
+// of the old and new tables, joining them on uuid
+func CountDualWriteMismatches(ctx context.Context, client *bigquery.Client, datasetID, oldTableID, newTableID, runID string) (int64, error) {
+	q := client.Query(fmt.Sprintf("SELECT COUNT(*) "+
+		"FROM (SELECT %[4]s FROM `%[1]s.%[2]s` WHERE run_id = @run_id) AS o "+
+		"FULL OUTER JOIN (SELECT %[4]s FROM `%[1]s.%[3]s` WHERE run_id = @run_id) AS n ON o.%[4]s = n.%[4]s "+
+		"WHERE o.%[4]s IS NULL OR n.%[4]s IS NULL", datasetID, oldTableID, newTableID, dualWriteKey))
+	q.Parameters = []bigquery.QueryParameter{{Name: "run_id", Value: runID}}
+
+	it, err := ReadQuery(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	var row []bigquery.Value
+	if err := it.Next(&row); err != nil {
+		return 0, err
+	}
+	return valueInt64(row[0]), nil
+}
+
+// VerifyDualWrite confirms the old and new tables of a dual write received
+// the same records, logging the rows of the run in each and the records
+// present in only one, and returns an error if any are
+func VerifyDualWrite(ctx context.Context, client *bigquery.Client, datasetID, oldTableID, newTableID, runID string) error {
+	logger.Info().Str("Old Table", oldTableID).Str("New Table", newTableID).Msg("Verifying the Dual Write")
+	for _, tableID := range []string{oldTableID, newTableID} {
+		rows, err := CountRunRows(ctx, client, datasetID, tableID, runID)
+		if err != nil {
+			return err
+		}
+		logger.Info().Str("Table", tableID).Int64("Rows", rows).Msg(indent)
+	}
+	mismatches, err := CountDualWriteMismatches(ctx, client, datasetID, oldTableID, newTableID, runID)
+	if err != nil {
+		return err
+	}
+	if mismatches > 0 {
+		logger.Warn().Int64("Mismatches", mismatches).Msg("  Records Missing from One of the Tables")
+		return fmt.Errorf("%d records of the run are missing from either %s or %s", mismatches, oldTableID, newTableID)
+	}
+	logger.Info().Int64("Mismatches", mismatches).Msg("  Both Tables Received the Same Records")
+	return nil
+}
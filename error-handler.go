@@ -0,0 +1,197 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrorAction is the action taken for a record which failed to be written
+type ErrorAction int
+
+const (
+	// ActionAbort ends the run, the behaviour without an error handler
+	ActionAbort ErrorAction = iota
+	// ActionSkip drops the record and moves on to the next
+	ActionSkip
+	// ActionRetry writes the same record again
+	ActionRetry
+)
+
+// Supported error handler names
+const (
+	errorHandlerAbort   = "abort"
+	errorHandlerSkip    = "skip"
+	errorHandlerRetry   = "retry"
+	errorHandlerLogOnly = "log-only"
+)
+
+// errorHandlerNames lists the supported error handlers
+var errorHandlerNames = []string{errorHandlerAbort, errorHandlerSkip, errorHandlerRetry, errorHandlerLogOnly}
+
+// ErrorHandler decides the action taken for each record which fails to be
+// written.  The record is nil for the rows of a request which failed once
+// accepted by a streamer, which bqwriter only reports after its retries.
+type ErrorHandler interface {
+	Handle(record interface{}, err error) ErrorAction
+}
+
+// NewErrorHandler creates the named error handler, where retries is the
+// number of times the retry handler writes a record again before aborting.
+func NewErrorHandler(name string, retries int) (ErrorHandler, error) {
+	switch name {
+	case errorHandlerAbort:
+		return abortErrorHandler{}, nil
+	case errorHandlerSkip:
+		return skipErrorHandler{}, nil
+	case errorHandlerRetry:
+		return &retryErrorHandler{retries: retries}, nil
+	case errorHandlerLogOnly:
+		return logOnlyErrorHandler{}, nil
+	}
+	return nil, fmt.Errorf("unknown error handler %q, expected one of %s", name, strings.Join(errorHandlerNames, ", "))
+}
+
+// abortErrorHandler ends the run on the first record error
+type abortErrorHandler struct{}
+
+// Handle implements ErrorHandler.Handle
+func (abortErrorHandler) Handle(record interface{}, err error) ErrorAction {
+	return ActionAbort
+}
+
+// skipErrorHandler drops each failed record, which is counted as skipped
+type skipErrorHandler struct{}
+
+// Handle implements ErrorHandler.Handle
+func (skipErrorHandler) Handle(record interface{}, err error) ErrorAction {
+	return ActionSkip
+}
+
+// logOnlyErrorHandler logs each failed record error and moves on
+type logOnlyErrorHandler struct{}
+
+// Handle implements ErrorHandler.Handle
+func (logOnlyErrorHandler) Handle(record interface{}, err error) ErrorAction {
+	logger.Warn().Err(err).Msg("  Record Failed to be Written")
+	return ActionSkip
+}
+
+// retryErrorHandler writes a failed record again up to the retry limit,
+// aborting once the limit is exhausted.  Records are retried one at a time,
+// so only the attempts of the most recent record are tracked.  The rows of a
+// failed request have exhausted the retries of bqwriter, which does not
+// return them to be written again, so they abort the run.
+type retryErrorHandler struct {
+	retries  int
+	record   interface{}
+	attempts int
+}
+
+// Handle implements ErrorHandler.Handle
+func (h *retryErrorHandler) Handle(record interface{}, err error) ErrorAction {
+	if record == nil {
+		return ActionAbort
+	}
+	if record != h.record {
+		h.record, h.attempts = record, 0
+	}
+	if h.attempts >= h.retries {
+		return ActionAbort
+	}
+	h.attempts++
+	return ActionRetry
+}
+
+// RetryTelemetry measures the effectiveness of the retry error handler, the
+// number of records written after each number of retries, for tuning the
+// retry parameters without reading through the logs
+type RetryTelemetry struct {
+	TotalRetryAttempts        int     `json:"total_retry_attempts"`
+	MaxRetriesForSingleRecord int     `json:"max_retries_for_single_record"`
+	RetrySuccessRate          float64 `json:"retry_success_rate"`
+	RetriesPerRecord          []int   `json:"retries_per_record"`
+	current                   int
+	retried                   int
+	recovered                 int
+}
+
+// NewRetryTelemetry creates the telemetry when the error handler retries
+// records, nil otherwise
+func NewRetryTelemetry(handler ErrorHandler) *RetryTelemetry {
+	if h, ok := handler.(*retryErrorHandler); !ok || h.retries == 0 {
+		return nil
+	}
+	return &RetryTelemetry{RetriesPerRecord: []int{}}
+}
+
+// Retry counts another attempt to write the current record, a nil telemetry
+// ignores it
+func (t *RetryTelemetry) Retry() {
+	if t == nil {
+		return
+	}
+	t.current++
+	t.TotalRetryAttempts++
+}
+
+// Done records the outcome of the current record after its retries, a nil
+// telemetry ignores it
+func (t *RetryTelemetry) Done(written bool) {
+	if t == nil {
+		return
+	}
+	for len(t.RetriesPerRecord) <= t.current {
+		t.RetriesPerRecord = append(t.RetriesPerRecord, 0)
+	}
+	t.RetriesPerRecord[t.current]++
+	t.MaxRetriesForSingleRecord = max(t.MaxRetriesForSingleRecord, t.current)
+	if t.current > 0 {
+		t.retried++
+		if written {
+			t.recovered++
+		}
+	}
+	t.current = 0
+}
+
+// Finish counts a record still being retried when the run ended as failed,
+// then calculates the fraction of retried records eventually written
+func (t *RetryTelemetry) Finish() {
+	if t == nil {
+		return
+	}
+	if t.current > 0 {
+		t.Done(false)
+	}
+	if t.retried > 0 {
+		t.RetrySuccessRate = float64(t.recovered) / float64(t.retried)
+	}
+}
+
+// Log outputs the retry telemetry, a nil telemetry outputs nothing
+func (t *RetryTelemetry) Log() {
+	if t == nil {
+		return
+	}
+	logger.Info().Int("Total Retry Attempts", t.TotalRetryAttempts).Int("Max Retries for a Record", t.MaxRetriesForSingleRecord).
+		Str("Retry Success Rate", fmt.Sprintf("%.1f%%", t.RetrySuccessRate*100)).Msg("Retry Telemetry")
+	for retries, records := range t.RetriesPerRecord {
+		if records > 0 {
+			logger.Info().Int("Retries", retries).Int("Records", records).Msg(indent)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error types of the error report
+const (
+	errorTypeSchema    = "schema"
+	errorTypeNetwork   = "network"
+	errorTypeAuth      = "auth"
+	errorTypeQuota     = "quota"
+	errorTypeFileLimit = "file-limit"
+	errorTypeOther     = "other"
+)
+
+// errorFieldPatterns extract the field name mentioned by the message of a
+// schema error when the error carries no location
+var errorFieldPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)no such field:? ([\w.]+)`),
+	regexp.MustCompile(`(?i)missing required field:? ([\w.]+)`),
+	regexp.MustCompile(`(?i)field ([\w.]+)`),
+}
+
+// ErrorGroup holds the occurrences of errors of one type mentioning the
+// same field, the field being empty when none is mentioned
+type ErrorGroup struct {
+	Type      string    `json:"error_type"`
+	Field     string    `json:"field_name,omitempty"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// errorGroupKey identifies the group an error is aggregated into
+type errorGroupKey struct {
+	errorType string
+	field     string
+}
+
+// ErrorAggregator groups the errors observed during a run by type and field
+type ErrorAggregator struct {
+	mu     sync.Mutex
+	groups map[errorGroupKey]*ErrorGroup
+}
+
+// NewErrorAggregator creates an empty error aggregator
+func NewErrorAggregator() *ErrorAggregator {
+	return &ErrorAggregator{groups: make(map[errorGroupKey]*ErrorGroup)}
+}
+
+// Add aggregates the error, counting each row error of an insertAll request
+// separately.  A nil aggregator ignores the error.
+func (a *ErrorAggregator) Add(err error) {
+	if a == nil || err == nil {
+		return
+	}
+
+	var rowErrs bigquery.PutMultiError
+	if errors.As(err, &rowErrs) {
+		for _, rowErr := range rowErrs {
+			for _, fieldErr := range rowErr.Errors {
+				a.add(ClassifyError(fieldErr), ErrorField(fieldErr))
+			}
+		}
+		return
+	}
+	errorType := ClassifyError(err)
+	field := ""
+	if errorType == errorTypeSchema {
+		field = ErrorField(err)
+	}
+	a.add(errorType, field)
+}
+
+// add counts one occurrence of the group
+func (a *ErrorAggregator) add(errorType, field string) {
+	now := time.Now().UTC()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := errorGroupKey{errorType: errorType, field: field}
+	group, ok := a.groups[key]
+	if !ok {
+		group = &ErrorGroup{Type: errorType, Field: field, FirstSeen: now}
+		a.groups[key] = group
+	}
+	group.Count++
+	group.LastSeen = now
+}
+
+// Report returns the error groups, the most frequent first
+func (a *ErrorAggregator) Report() []ErrorGroup {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	report := make([]ErrorGroup, 0, len(a.groups))
+	for _, group := range a.groups {
+		report = append(report, *group)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Count != report[j].Count {
+			return report[i].Count > report[j].Count
+		}
+		if report[i].Type != report[j].Type {
+			return report[i].Type < report[j].Type
+		}
+		return report[i].Field < report[j].Field
+	})
+	return report
+}
+
+// ClassifyError returns the type of the error, one of schema, network,
+// auth, quota, file-limit or other
+func ClassifyError(err error) string {
+	if IsFileLimitError(err) {
+		return errorTypeFileLimit
+	}
+	if IsQuotaError(err) {
+		return errorTypeQuota
+	}
+
+	var bqErr *bigquery.Error
+	if errors.As(err, &bqErr) {
+		if bqErr.Reason == "invalid" || bqErr.Reason == "stopped" || bqErr.Location != "" {
+			return errorTypeSchema
+		}
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden:
+			return errorTypeAuth
+		case apiErr.Code == http.StatusBadRequest:
+			return errorTypeSchema
+		case apiErr.Code >= http.StatusInternalServerError:
+			return errorTypeNetwork
+		}
+		return errorTypeOther
+	}
+
+	if s, ok := status.FromError(err); ok && s.Code() != codes.Unknown {
+		switch s.Code() {
+		case codes.Unauthenticated, codes.PermissionDenied:
+			return errorTypeAuth
+		case codes.InvalidArgument:
+			return errorTypeSchema
+		case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+			return errorTypeNetwork
+		}
+		return errorTypeOther
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) || errors.Is(err, context.DeadlineExceeded) {
+		return errorTypeNetwork
+	}
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "credentials") || strings.Contains(message, "oauth2"):
+		return errorTypeAuth
+	case strings.Contains(message, "connection reset") || strings.Contains(message, "connection refused") || strings.Contains(message, "broken pipe"):
+		return errorTypeNetwork
+	case strings.Contains(message, "schema") || strings.Contains(message, "field"):
+		return errorTypeSchema
+	}
+	return errorTypeOther
+}
+
+// ErrorField returns the name of the field mentioned by a schema error,
+// preferring the location reported by BigQuery over the message
+func ErrorField(err error) string {
+	var bqErr *bigquery.Error
+	if errors.As(err, &bqErr) && bqErr.Location != "" {
+		return bqErr.Location
+	}
+	message := err.Error()
+	for _, pattern := range errorFieldPatterns {
+		if match := pattern.FindStringSubmatch(message); match != nil {
+			return strings.TrimSuffix(match[1], ".")
+		}
+	}
+	return ""
+}
+
+// LogErrorReport outputs the error groups as a table of error type, field
+// name, count, and the times first and last seen
+func LogErrorReport(report []ErrorGroup) {
+	if len(report) == 0 {
+		return
+	}
+	logger.Info().Msg("Error Report")
+	for _, group := range report {
+		logger.Info().Str("error_type", group.Type).Str("field_name", group.Field).Int("count", group.Count).
+			Time("first_seen", group.FirstSeen).Time("last_seen", group.LastSeen).Msg(indent)
+		if group.Type == errorTypeFileLimit {
+			limit, _ := fileDescriptorLimit()
+			logger.Warn().Uint64("Limit", limit).Msg("  The Process Ran Out of File Descriptors, Raise the Limit with ulimit -n or use -clamp-parallelism")
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Phases of a run to which the error ending it is attributed
+const (
+	phaseInit        = "init"
+	phaseCreateTable = "create_table"
+	phaseStream      = "stream"
+	phaseVerify      = "verify"
+)
+
+// errUsage reports invalid flags, for which the usage is printed
+var errUsage = errors.New("invalid usage")
+
+// BQWriteTestError is the error ending a run, recording the phase of the run
+// and the operation it occurred in, and whether repeating the run may
+// succeed, so callers can tell setup errors from streaming errors
+type BQWriteTestError struct {
+	Phase     string
+	Op        string
+	Retryable bool
+	ExitCode  int
+	Err       error
+}
+
+// NewBQWriteTestError wraps the error of the operation in the given phase,
+// retryable when the error is a network or quota error
+func NewBQWriteTestError(phase, op string, err error) *BQWriteTestError {
+	errorType := ClassifyError(err)
+	return &BQWriteTestError{
+		Phase:     phase,
+		Op:        op,
+		Retryable: errorType == errorTypeNetwork || errorType == errorTypeQuota,
+		Err:       err,
+	}
+}
+
+// InitError wraps an error in the validation of the flags
+func InitError(err error) *BQWriteTestError {
+	return &BQWriteTestError{Phase: phaseInit, Err: err}
+}
+
+// Error implements error
+func (e *BQWriteTestError) Error() string {
+	if e.Op == "" {
+		return fmt.Sprintf("%s: %v", e.Phase, e.Err)
+	}
+	return fmt.Sprintf("%s [%s]: %v", e.Phase, e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *BQWriteTestError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit status for the error ending a run, 1 unless
+// the error carries its own
+func ExitCode(err error) int {
+	var runErr *BQWriteTestError
+	if errors.As(err, &runErr) && runErr.ExitCode != 0 {
+		return runErr.ExitCode
+	}
+	return 1
+}
+
+// PrintError outputs the error ending a run.  Invalid flags are reported on
+// standard error, as they are validated before the logger is configured,
+// while any other error is logged along with its phase and whether it is
+// retryable.
+func PrintError(err error) {
+	var runErr *BQWriteTestError
+	switch {
+	case errors.Is(err, errUsage):
+		flag.Usage()
+	case !errors.As(err, &runErr):
+		logger.Error().Err(err).Msg("Error")
+	case runErr.Op == "":
+		fmt.Fprintln(os.Stderr, runErr.Err)
+	default:
+		logger.Error().Err(runErr.Err).Str("Phase", runErr.Phase).Bool("Retryable", runErr.Retryable).Msgf("Error [%s]", runErr.Op)
+	}
+}
+
+// WrapClientError pattern matches the common errors returned when creating
+// a BigQuery client, or on its first use, returning a human-readable error
+// which still wraps the original.
+func WrapClientError(err error, projectID string) error {
+	if err == nil || errors.Is(err, errColumnSecurity) {
+		return err
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		message := strings.ToLower(apiErr.Message)
+		switch {
+		case apiErr.Code == http.StatusNotFound && strings.Contains(message, "project"):
+			return fmt.Errorf("project %q not found — check that -p specifies a valid GCP project ID and that billing is enabled: %w", projectID, err)
+		case apiErr.Code == http.StatusNotFound && strings.Contains(message, "dataset"):
+			return fmt.Errorf("dataset not found in project %q — check that -d specifies an existing dataset: %w", projectID, err)
+		case apiErr.Code == http.StatusForbidden && strings.Contains(message, "billing"):
+			return fmt.Errorf("billing is not enabled for project %q — enable billing or use the BigQuery sandbox with a supported write path: %w", projectID, err)
+		case apiErr.Code == http.StatusForbidden && strings.Contains(message, "api") && strings.Contains(message, "disabled"):
+			return fmt.Errorf("the BigQuery API is not enabled for project %q — enable it with `gcloud services enable bigquery.googleapis.com`: %w", projectID, err)
+		case apiErr.Code == http.StatusForbidden:
+			return fmt.Errorf("permission denied in project %q — check the authenticated identity has the BigQuery Data Editor role: %w", projectID, err)
+		case apiErr.Code == http.StatusUnauthorized:
+			return fmt.Errorf("authentication failed for project %q — refresh your credentials with `gcloud auth application-default login`: %w", projectID, err)
+		}
+		return err
+	}
+
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "could not find default credentials"):
+		return fmt.Errorf("no Google Cloud credentials found — run `gcloud auth application-default login` or set GOOGLE_APPLICATION_CREDENTIALS: %w", err)
+	case projectID == "" && strings.Contains(message, "project"):
+		return fmt.Errorf("no project ID specified — set -p to a valid GCP project ID: %w", err)
+	}
+	return err
+}
@@ -0,0 +1,175 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Faults the fake server can inject into a single insertAll request
+type fakeFault int
+
+const (
+	faultNone fakeFault = iota
+	faultUnavailable
+	faultStall
+	faultReset
+)
+
+// FaultScenario scripts the faults injected into the insertAll requests of
+// the fake server, counting the requests from 1, and the offset gap injected
+// into the appends to a stream, counting the appends from 1
+type FaultScenario struct {
+	Name             string
+	UnavailableEvery int
+	UnavailableLimit int
+	InvalidRow       bool
+	StallAfter       int
+	StallFor         time.Duration
+	ResetEvery       int
+	ResetLimit       int
+	OffsetGapAt      int
+	OffsetGap        int64
+}
+
+// faultScenarios lists the scripted fault scenarios by name
+var faultScenarios = map[string]FaultScenario{
+	"unavailable": {Name: "unavailable", UnavailableEvery: 3, UnavailableLimit: 3},
+	"invalid-row": {Name: "invalid-row", InvalidRow: true},
+	"stall":       {Name: "stall", StallAfter: 9, StallFor: 60 * time.Second},
+	"reset":       {Name: "reset", ResetEvery: 4, ResetLimit: 2},
+	"offset-gap":  {Name: "offset-gap", OffsetGapAt: 3, OffsetGap: 10},
+}
+
+// FaultScenarioNames returns the sorted names of the fault scenarios
+func FaultScenarioNames() []string {
+	names := make([]string, 0, len(faultScenarios))
+	for name := range faultScenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FaultStats holds the faults injected by the fake server, and the delay
+// before each request failed with a 503 was retried
+type FaultStats struct {
+	Requests     int
+	Unavailable  int
+	RejectedRows int
+	Stalls       int
+	Resets       int
+	Appends      int
+	OffsetGaps   int
+	RetryDelays  []time.Duration
+}
+
+// MinRetryDelay returns the shortest delay before a failed request was retried
+func (s FaultStats) MinRetryDelay() time.Duration {
+	var delay time.Duration
+	for i, d := range s.RetryDelays {
+		if i == 0 || d < delay {
+			delay = d
+		}
+	}
+	return delay
+}
+
+// SetFaultScenario replaces the fault scenario, resetting the fault stats
+func (f *FakeBigQueryServer) SetFaultScenario(scenario FaultScenario) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.scenario = scenario
+	f.stats = FaultStats{}
+	f.failedAt = make(map[[sha256.Size]byte]time.Time)
+}
+
+// FaultStats returns the faults injected since the scenario was set
+func (f *FakeBigQueryServer) FaultStats() FaultStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stats := f.stats
+	stats.RetryDelays = append([]time.Duration(nil), f.stats.RetryDelays...)
+	return stats
+}
+
+// nextFault counts the insertAll request and returns the fault to inject
+// into it, the caller must hold the lock
+func (f *FakeBigQueryServer) nextFault() fakeFault {
+	f.stats.Requests++
+	n, s := f.stats.Requests, f.scenario
+	switch {
+	case s.UnavailableEvery > 0 && n%s.UnavailableEvery == 0 && f.stats.Unavailable < s.UnavailableLimit:
+		f.stats.Unavailable++
+		return faultUnavailable
+	case s.ResetEvery > 0 && n%s.ResetEvery == 0 && f.stats.Resets < s.ResetLimit:
+		f.stats.Resets++
+		return faultReset
+	case s.StallAfter > 0 && n == s.StallAfter+1:
+		f.stats.Stalls++
+		return faultStall
+	}
+	return faultNone
+}
+
+// observeRetry records the delay before a request body which previously
+// failed with a 503 was sent again, the caller must hold the lock
+func (f *FakeBigQueryServer) observeRetry(body []byte, failed bool) {
+	key := sha256.Sum256(body)
+	if at, ok := f.failedAt[key]; ok {
+		f.stats.RetryDelays = append(f.stats.RetryDelays, time.Since(at))
+		delete(f.failedAt, key)
+	}
+	if failed {
+		f.failedAt[key] = time.Now()
+	}
+}
+
+// stall holds the request for the duration, returning false if the server
+// was closed first
+func (f *FakeBigQueryServer) stall(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-f.stop:
+		return false
+	}
+}
+
+// resetConnection reads half of the request body and resets the connection,
+// so the client sees the connection reset mid-body
+func resetConnection(w http.ResponseWriter, r *http.Request) error {
+	if r.ContentLength > 1 {
+		io.CopyN(io.Discard, r.Body, r.ContentLength/2)
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("the response writer cannot be hijacked")
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	return conn.Close()
+}
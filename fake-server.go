@@ -0,0 +1,488 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// fakeTable is a table held by the fake server
+type fakeTable struct {
+	schema   json.RawMessage
+	rows     map[string]int64
+	distinct map[string]map[string]bool
+	etag     int
+}
+
+// insert counts a row with the run_id, told apart from the other rows of the
+// run by its key unless nil
+func (t *fakeTable) insert(runID string, key interface{}) {
+	t.rows[runID]++
+	if key == nil {
+		return
+	}
+	if t.distinct[runID] == nil {
+		t.distinct[runID] = make(map[string]bool)
+	}
+	t.distinct[runID][fmt.Sprint(key)] = true
+}
+
+// FakeBigQueryServer is an in-process fake of the BigQuery REST API,
+// implementing just enough of tables, insertAll and queries to exercise the
+// tool end-to-end without credentials, alongside the committed streams of the
+// gRPC Storage Write API.  Faults can be scripted into the insertAll requests
+// and appends to exercise the retry, accounting and offset tracking paths.
+type FakeBigQueryServer struct {
+	server     *httptest.Server
+	grpcServer *grpc.Server
+	grpcAddr   string
+	stop       chan struct{}
+
+	mu       sync.Mutex
+	tables   map[string]*fakeTable
+	streams  map[string]*fakeWriteStream
+	scenario FaultScenario
+	stats    FaultStats
+	failedAt map[[sha256.Size]byte]time.Time
+	jobs     map[string]int64
+}
+
+// Routes of the BigQuery REST API implemented by the fake server, relative to
+// the optional /bigquery/v2 base path
+var (
+	fakeTablesRoute   = regexp.MustCompile(`^/projects/([^/]+)/datasets/([^/]+)/tables$`)
+	fakeTableRoute    = regexp.MustCompile(`^/projects/([^/]+)/datasets/([^/]+)/tables/([^/]+)$`)
+	fakeInsertRoute   = regexp.MustCompile(`^/projects/([^/]+)/datasets/([^/]+)/tables/([^/]+)/insertAll$`)
+	fakeQueryRoute    = regexp.MustCompile(`^/projects/([^/]+)/queries(/[^/]+)?$`)
+	fakeJobsRoute     = regexp.MustCompile(`^/projects/([^/]+)/jobs$`)
+	fakeJobRoute      = regexp.MustCompile(`^/projects/([^/]+)/jobs/([^/]+)$`)
+	fakeCancelRoute   = regexp.MustCompile(`^/projects/([^/]+)/jobs/([^/]+)/cancel$`)
+	fakeQueryTableRef = regexp.MustCompile("FROM `([^.`]+)\\.([^`]+)`")
+)
+
+// NewFakeBigQueryServer starts a fake BigQuery server on a local port
+func NewFakeBigQueryServer() *FakeBigQueryServer {
+	f := &FakeBigQueryServer{
+		stop:     make(chan struct{}),
+		tables:   make(map[string]*fakeTable),
+		streams:  make(map[string]*fakeWriteStream),
+		failedAt: make(map[[sha256.Size]byte]time.Time),
+		jobs:     make(map[string]int64),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	f.startStorageWrite()
+	return f
+}
+
+// URL returns the base URL of the fake server
+func (f *FakeBigQueryServer) URL() string {
+	return f.server.URL
+}
+
+// FakeClientOptions point a BigQuery client, or the clients created by a
+// streamer, at the fake server without credentials, followed by any options
+// given, such as an instrumented HTTP client
+func FakeClientOptions(f *FakeBigQueryServer, opts ...option.ClientOption) []option.ClientOption {
+	return append([]option.ClientOption{option.WithEndpoint(f.URL() + "/bigquery/v2/"), option.WithoutAuthentication()}, opts...)
+}
+
+// Close releases any stalled requests and shuts down the fake server
+func (f *FakeBigQueryServer) Close() {
+	close(f.stop)
+	f.server.Close()
+	f.grpcServer.Stop()
+}
+
+// CreateTable creates a table with the given schema fields, as returned in
+// the REST representation
+func (f *FakeBigQueryServer) CreateTable(datasetID, tableID string, fields json.RawMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tables[datasetID+"."+tableID] = &fakeTable{schema: fields, rows: make(map[string]int64), distinct: make(map[string]map[string]bool)}
+}
+
+// HasTable reports whether the table exists
+func (f *FakeBigQueryServer) HasTable(datasetID, tableID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.tables[datasetID+"."+tableID]
+	return ok
+}
+
+// TableSchema returns the schema fields of the table
+func (f *FakeBigQueryServer) TableSchema(datasetID, tableID string) json.RawMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if table, ok := f.tables[datasetID+"."+tableID]; ok {
+		return table.schema
+	}
+	return nil
+}
+
+// RunRows returns the number of rows inserted into the table with the run_id
+func (f *FakeBigQueryServer) RunRows(datasetID, tableID, runID string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if table, ok := f.tables[datasetID+"."+tableID]; ok {
+		return table.rows[runID]
+	}
+	return 0
+}
+
+// RunDistinctRows returns the number of distinct records, told apart by
+// uuid, inserted into the table with the run_id
+func (f *FakeBigQueryServer) RunDistinctRows(datasetID, tableID, runID string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if table, ok := f.tables[datasetID+"."+tableID]; ok {
+		return int64(len(table.distinct[runID]))
+	}
+	return 0
+}
+
+// serveHTTP routes each request to its handler
+func (f *FakeBigQueryServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/bigquery/v2")
+
+	var m []string
+	switch {
+	case r.Method == http.MethodPost && fakeInsertRoute.MatchString(path):
+		m = fakeInsertRoute.FindStringSubmatch(path)
+		f.insertAll(w, r, m[2], m[3])
+	case r.Method == http.MethodPost && fakeTablesRoute.MatchString(path):
+		m = fakeTablesRoute.FindStringSubmatch(path)
+		f.createTable(w, r, m[1], m[2])
+	case fakeTableRoute.MatchString(path):
+		m = fakeTableRoute.FindStringSubmatch(path)
+		switch r.Method {
+		case http.MethodGet:
+			f.getTable(w, m[1], m[2], m[3])
+		case http.MethodPatch, http.MethodPut:
+			f.updateTable(w, r, m[1], m[2], m[3])
+		case http.MethodDelete:
+			f.deleteTable(w, m[1], m[2], m[3])
+		default:
+			writeFakeError(w, http.StatusMethodNotAllowed, "invalid", r.Method+" is not supported")
+		}
+	case fakeQueryRoute.MatchString(path):
+		m = fakeQueryRoute.FindStringSubmatch(path)
+		f.query(w, r, m[1], strings.TrimPrefix(m[2], "/"))
+	case r.Method == http.MethodPost && fakeJobsRoute.MatchString(path):
+		m = fakeJobsRoute.FindStringSubmatch(path)
+		f.insertJob(w, r, m[1])
+	case r.Method == http.MethodPost && fakeCancelRoute.MatchString(path):
+		m = fakeCancelRoute.FindStringSubmatch(path)
+		writeFakeJSON(w, map[string]interface{}{"job": fakeJobResource(m[1], m[2], "")})
+	case r.Method == http.MethodGet && fakeJobRoute.MatchString(path):
+		m = fakeJobRoute.FindStringSubmatch(path)
+		writeFakeJSON(w, fakeJobResource(m[1], m[2], ""))
+	default:
+		writeFakeError(w, http.StatusNotFound, "notFound", "Not found: "+path)
+	}
+}
+
+// tableResource renders the REST representation of a table
+func tableResource(projectID, datasetID, tableID string, table *fakeTable) map[string]interface{} {
+	var rows int64
+	for _, count := range table.rows {
+		rows += count
+	}
+	return map[string]interface{}{
+		"kind":           "bigquery#table",
+		"id":             fmt.Sprintf("%s:%s.%s", projectID, datasetID, tableID),
+		"etag":           strconv.Itoa(table.etag),
+		"type":           "TABLE",
+		"tableReference": map[string]string{"projectId": projectID, "datasetId": datasetID, "tableId": tableID},
+		"schema":         map[string]json.RawMessage{"fields": table.schema},
+		"numRows":        strconv.FormatInt(rows, 10),
+	}
+}
+
+// fakeTableRequest is the body of a table insert or update
+type fakeTableRequest struct {
+	TableReference struct {
+		TableID string `json:"tableId"`
+	} `json:"tableReference"`
+	Schema struct {
+		Fields json.RawMessage `json:"fields"`
+	} `json:"schema"`
+}
+
+// createTable implements tables.insert
+func (f *FakeBigQueryServer) createTable(w http.ResponseWriter, r *http.Request, projectID, datasetID string) {
+	var req fakeTableRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := datasetID + "." + req.TableReference.TableID
+	if _, ok := f.tables[key]; ok {
+		writeFakeError(w, http.StatusConflict, "duplicate", "Already Exists: Table "+key)
+		return
+	}
+	table := &fakeTable{schema: req.Schema.Fields, rows: make(map[string]int64), distinct: make(map[string]map[string]bool)}
+	f.tables[key] = table
+	writeFakeJSON(w, tableResource(projectID, datasetID, req.TableReference.TableID, table))
+}
+
+// getTable implements tables.get
+func (f *FakeBigQueryServer) getTable(w http.ResponseWriter, projectID, datasetID, tableID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	table, ok := f.tables[datasetID+"."+tableID]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "notFound", "Not found: Table "+datasetID+"."+tableID)
+		return
+	}
+	writeFakeJSON(w, tableResource(projectID, datasetID, tableID, table))
+}
+
+// updateTable implements tables.patch, replacing the schema if present
+func (f *FakeBigQueryServer) updateTable(w http.ResponseWriter, r *http.Request, projectID, datasetID, tableID string) {
+	var req fakeTableRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	table, ok := f.tables[datasetID+"."+tableID]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "notFound", "Not found: Table "+datasetID+"."+tableID)
+		return
+	}
+	if len(req.Schema.Fields) > 0 {
+		table.schema = req.Schema.Fields
+	}
+	table.etag++
+	writeFakeJSON(w, tableResource(projectID, datasetID, tableID, table))
+}
+
+// deleteTable implements tables.delete
+func (f *FakeBigQueryServer) deleteTable(w http.ResponseWriter, projectID, datasetID, tableID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.tables, datasetID+"."+tableID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// insertAll implements tabledata.insertAll, counting the rows of each run_id
+// and injecting the faults of the scenario
+func (f *FakeBigQueryServer) insertAll(w http.ResponseWriter, r *http.Request, datasetID, tableID string) {
+	f.mu.Lock()
+	fault, stallFor := f.nextFault(), f.scenario.StallFor
+	f.mu.Unlock()
+
+	switch fault {
+	case faultReset:
+		if err := resetConnection(w, r); err != nil {
+			writeFakeError(w, http.StatusInternalServerError, "internalError", err.Error())
+		}
+		return
+	case faultStall:
+		if !f.stall(stallFor) {
+			return
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	var req struct {
+		SkipInvalidRows bool `json:"skipInvalidRows"`
+		Rows            []struct {
+			JSON map[string]interface{} `json:"json"`
+		} `json:"rows"`
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.observeRetry(body, fault == faultUnavailable)
+	if fault == faultUnavailable {
+		writeFakeError(w, http.StatusServiceUnavailable, "backendError", "Injected failure")
+		return
+	}
+	table, ok := f.tables[datasetID+"."+tableID]
+	if !ok {
+		writeFakeError(w, http.StatusNotFound, "notFound", "Not found: Table "+datasetID+"."+tableID)
+		return
+	}
+
+	// Reject the first row of the batch, stopping the rest of the batch too
+	// unless invalid rows are skipped, as BigQuery does
+	var insertErrors []map[string]interface{}
+	if f.scenario.InvalidRow && len(req.Rows) > 0 {
+		for i := range req.Rows {
+			reason := "invalid"
+			if i > 0 {
+				if req.SkipInvalidRows {
+					break
+				}
+				reason = "stopped"
+			}
+			insertErrors = append(insertErrors, map[string]interface{}{
+				"index":  i,
+				"errors": []map[string]string{{"reason": reason, "message": "Injected " + reason + " row"}},
+			})
+		}
+		f.stats.RejectedRows += len(insertErrors)
+		if !req.SkipInvalidRows {
+			writeFakeJSON(w, map[string]interface{}{"kind": "bigquery#tableDataInsertAllResponse", "insertErrors": insertErrors})
+			return
+		}
+		req.Rows = req.Rows[1:]
+	}
+	for _, row := range req.Rows {
+		runID, _ := row.JSON["run_id"].(string)
+		table.insert(runID, row.JSON[dedupKey])
+	}
+	writeFakeJSON(w, map[string]interface{}{"kind": "bigquery#tableDataInsertAllResponse", "insertErrors": insertErrors})
+}
+
+// query implements jobs.query and jobs.getQueryResults for the COUNT(*) of
+// the rows with a run_id, the only query issued against the target table
+func (f *FakeBigQueryServer) query(w http.ResponseWriter, r *http.Request, projectID, jobID string) {
+	var req fakeQueryRequest
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeFakeError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+	}
+
+	var count int64
+	if jobID != "" {
+		f.mu.Lock()
+		count = f.jobs[jobID]
+		f.mu.Unlock()
+	} else {
+		jobID = "fake-query"
+		count = f.countQuery(req)
+	}
+	writeFakeJSON(w, map[string]interface{}{
+		"kind":         "bigquery#queryResponse",
+		"jobReference": map[string]string{"projectId": projectID, "jobId": jobID, "location": "US"},
+		"schema":       map[string]interface{}{"fields": []map[string]string{{"name": "f0_", "type": "INTEGER", "mode": "NULLABLE"}}},
+		"rows":         []map[string]interface{}{{"f": []map[string]string{{"v": strconv.FormatInt(count, 10)}}}},
+		"totalRows":    "1",
+		"jobComplete":  true,
+	})
+}
+
+// fakeQueryRequest is the query and parameters of a jobs.query request or of
+// the configuration of a query job
+type fakeQueryRequest struct {
+	Query           string `json:"query"`
+	QueryParameters []struct {
+		Name           string `json:"name"`
+		ParameterValue struct {
+			Value string `json:"value"`
+		} `json:"parameterValue"`
+	} `json:"queryParameters"`
+}
+
+// countQuery answers a query counting the rows, or the distinct records, of
+// a run in a table
+func (f *FakeBigQueryServer) countQuery(req fakeQueryRequest) int64 {
+	if m := fakeQueryTableRef.FindStringSubmatch(req.Query); m != nil {
+		for _, param := range req.QueryParameters {
+			if param.Name != "run_id" {
+				continue
+			}
+			if strings.Contains(req.Query, "COUNT(DISTINCT") {
+				return f.RunDistinctRows(m[1], m[2], param.ParameterValue.Value)
+			}
+			return f.RunRows(m[1], m[2], param.ParameterValue.Value)
+		}
+	}
+	return 0
+}
+
+// insertJob handles jobs.insert of a query job, answering the query at once
+// so the results are ready for getQueryResults
+func (f *FakeBigQueryServer) insertJob(w http.ResponseWriter, r *http.Request, projectID string) {
+	var req struct {
+		JobReference struct {
+			JobID string `json:"jobId"`
+		} `json:"jobReference"`
+		Configuration struct {
+			Query *fakeQueryRequest `json:"query"`
+		} `json:"configuration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Configuration.Query == nil {
+		writeFakeError(w, http.StatusBadRequest, "invalid", "only query jobs are supported")
+		return
+	}
+	jobID := req.JobReference.JobID
+	if jobID == "" {
+		jobID = "fake-job"
+	}
+	count := f.countQuery(*req.Configuration.Query)
+	f.mu.Lock()
+	f.jobs[jobID] = count
+	f.mu.Unlock()
+	writeFakeJSON(w, fakeJobResource(projectID, jobID, req.Configuration.Query.Query))
+}
+
+// fakeJobResource renders the REST representation of a completed query job
+func fakeJobResource(projectID, jobID, query string) map[string]interface{} {
+	return map[string]interface{}{
+		"kind":          "bigquery#job",
+		"jobReference":  map[string]string{"projectId": projectID, "jobId": jobID, "location": "US"},
+		"configuration": map[string]interface{}{"query": map[string]string{"query": query}},
+		"status":        map[string]string{"state": "DONE"},
+	}
+}
+
+// writeFakeJSON writes a successful JSON response
+func writeFakeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeFakeError writes an error response in the format of the BigQuery API
+func writeFakeError(w http.ResponseWriter, code int, reason, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"errors":  []map[string]string{{"reason": reason, "message": message}},
+		},
+	})
+}
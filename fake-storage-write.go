@@ -0,0 +1,387 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+
+	"cloud.google.com/go/bigquery/storage/apiv1/storagepb"
+	"google.golang.org/api/option"
+	statuspb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// fakeWriteStream is a write stream of the Storage Write API held by the fake
+// server, its rows landing in the table as they are appended
+type fakeWriteStream struct {
+	stream    *storagepb.WriteStream
+	tableKey  string
+	rows      int64
+	finalized bool
+}
+
+// fakeStorageWrite is the in-process fake of the gRPC Storage Write API
+// served alongside the REST API, implementing the committed streams of the
+// tool.  An offset gap can be scripted into its appends to exercise the
+// offset tracking.
+type fakeStorageWrite struct {
+	storagepb.UnimplementedBigQueryWriteServer
+	f *FakeBigQueryServer
+}
+
+// startStorageWrite serves the Storage Write API on a local port
+func (f *FakeBigQueryServer) startStorageWrite() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("fake Storage Write API: %v", err))
+	}
+	f.grpcAddr = listener.Addr().String()
+	f.grpcServer = grpc.NewServer()
+	storagepb.RegisterBigQueryWriteServer(f.grpcServer, &fakeStorageWrite{f: f})
+	go f.grpcServer.Serve(listener)
+}
+
+// FakeStorageWriteOptions point a Storage Write API client at the fake
+// server without credentials
+func FakeStorageWriteOptions(f *FakeBigQueryServer) []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(f.grpcAddr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	}
+}
+
+// CreateWriteStream implements the creation of a stream, numbering the
+// streams of the fake server
+func (s *fakeStorageWrite) CreateWriteStream(_ context.Context, req *storagepb.CreateWriteStreamRequest) (*storagepb.WriteStream, error) {
+	f := s.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tableKey, err := fakeTableKey(req.GetParent())
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.tables[tableKey]; !ok {
+		return nil, status.Errorf(codes.NotFound, "Not found: Table %s", tableKey)
+	}
+	stream := &storagepb.WriteStream{
+		Name:     fmt.Sprintf("%s/streams/fake-%d", req.GetParent(), len(f.streams)+1),
+		Type:     req.GetWriteStream().GetType(),
+		Location: "US",
+	}
+	f.streams[stream.Name] = &fakeWriteStream{stream: stream, tableKey: tableKey}
+	return stream, nil
+}
+
+// GetWriteStream implements the lookup of a stream, including the default
+// stream of a table
+func (s *fakeStorageWrite) GetWriteStream(_ context.Context, req *storagepb.GetWriteStreamRequest) (*storagepb.WriteStream, error) {
+	f := s.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if stream, ok := f.streams[req.GetName()]; ok {
+		return stream.stream, nil
+	}
+	if stream, ok := f.defaultStream(req.GetName()); ok {
+		return stream.stream, nil
+	}
+	return nil, status.Errorf(codes.NotFound, "Not found: Stream %s", req.GetName())
+}
+
+// FinalizeWriteStream implements the finalization of a stream, returning the
+// rows appended to it
+func (s *fakeStorageWrite) FinalizeWriteStream(_ context.Context, req *storagepb.FinalizeWriteStreamRequest) (*storagepb.FinalizeWriteStreamResponse, error) {
+	f := s.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stream, ok := f.streams[req.GetName()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Not found: Stream %s", req.GetName())
+	}
+	stream.finalized = true
+	return &storagepb.FinalizeWriteStreamResponse{RowCount: stream.rows}, nil
+}
+
+// AppendRows implements the appends to a stream, answering each request of
+// the connection in order.  The stream and writer schema are sent with the
+// first request of a connection and only repeated when they change.  An
+// append at an offset other than the end of the stream fails as BigQuery
+// does, while the offset returned for the append scripted by the fault
+// scenario is shifted to inject a gap.
+func (s *fakeStorageWrite) AppendRows(server storagepb.BigQueryWrite_AppendRowsServer) error {
+	f := s.f
+	var streamName string
+	var row protoreflect.MessageDescriptor
+	for {
+		req, err := server.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.GetWriteStream() != "" {
+			streamName = req.GetWriteStream()
+		}
+		if descriptor := req.GetProtoRows().GetWriterSchema().GetProtoDescriptor(); descriptor != nil {
+			if row, err = fakeRowDescriptor(descriptor); err != nil {
+				return status.Error(codes.InvalidArgument, err.Error())
+			}
+		}
+		if row == nil {
+			return status.Error(codes.InvalidArgument, "the writer schema was not sent")
+		}
+
+		resp, err := f.appendRows(streamName, row, req)
+		if err != nil {
+			return err
+		}
+		if err := server.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// appendRows appends the rows of a single request to the stream, counting
+// them into its table
+func (f *FakeBigQueryServer) appendRows(streamName string, row protoreflect.MessageDescriptor, req *storagepb.AppendRowsRequest) (*storagepb.AppendRowsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stream, ok := f.streams[streamName]
+	if !ok {
+		stream, ok = f.defaultStream(streamName)
+	}
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Not found: Stream %s", streamName)
+	}
+	appendError := func(code codes.Code, format string, args ...interface{}) *storagepb.AppendRowsResponse {
+		return &storagepb.AppendRowsResponse{
+			Response:    &storagepb.AppendRowsResponse_Error{Error: &statuspb.Status{Code: int32(code), Message: fmt.Sprintf(format, args...)}},
+			WriteStream: streamName,
+		}
+	}
+	switch offset := req.GetOffset(); {
+	case stream.finalized:
+		return appendError(codes.InvalidArgument, "Stream %s is finalized", streamName), nil
+	case offset != nil && offset.GetValue() < stream.rows:
+		return appendError(codes.AlreadyExists, "Offset %d already exists, the stream has %d rows", offset.GetValue(), stream.rows), nil
+	case offset != nil && offset.GetValue() > stream.rows:
+		return appendError(codes.OutOfRange, "Offset %d is beyond the end of the stream, %d rows", offset.GetValue(), stream.rows), nil
+	}
+
+	table, ok := f.tables[stream.tableKey]
+	if !ok {
+		return appendError(codes.NotFound, "Not found: Table %s", stream.tableKey), nil
+	}
+	// A table created without a schema accepts any writer schema
+	var columns []fakeSchemaField
+	if len(table.schema) > 0 {
+		if err := json.Unmarshal(table.schema, &columns); err != nil {
+			return appendError(codes.Internal, "Table %s has an invalid schema: %v", stream.tableKey, err), nil
+		}
+		if message := checkWriterSchema(row, columns); message != "" {
+			return appendError(codes.InvalidArgument, "%s Entity: %s", message, streamName), nil
+		}
+	}
+
+	// Every row is parsed before any lands, a row error failing the request
+	rows := req.GetProtoRows().GetRows().GetSerializedRows()
+	messages := make([]*dynamicpb.Message, len(rows))
+	var rowErrors []*storagepb.RowError
+	for i, serialized := range rows {
+		messages[i] = dynamicpb.NewMessage(row)
+		if message := checkRow(serialized, messages[i], columns); message != "" {
+			rowErrors = append(rowErrors, &storagepb.RowError{Index: int64(i), Code: storagepb.RowError_FIELDS_ERROR, Message: message})
+		}
+	}
+	if len(rowErrors) > 0 {
+		resp := appendError(codes.InvalidArgument, "Errors found while processing rows. Please refer to the row_errors field for details. Entity: %s", streamName)
+		resp.RowErrors = rowErrors
+		return resp, nil
+	}
+
+	runIDField, keyField := row.Fields().ByName("run_id"), row.Fields().ByName(dedupKey)
+	for _, message := range messages {
+		var runID string
+		var key interface{}
+		if runIDField != nil {
+			runID = message.Get(runIDField).String()
+		}
+		if keyField != nil && message.Has(keyField) {
+			key = message.Get(keyField).Interface()
+		}
+		table.insert(runID, key)
+	}
+
+	offset := stream.rows
+	stream.rows += int64(len(rows))
+	f.stats.Appends++
+	if f.scenario.OffsetGapAt > 0 && f.stats.Appends == f.scenario.OffsetGapAt {
+		f.stats.OffsetGaps++
+		offset += f.scenario.OffsetGap
+	}
+	return &storagepb.AppendRowsResponse{
+		Response:    &storagepb.AppendRowsResponse_AppendResult_{AppendResult: &storagepb.AppendRowsResponse_AppendResult{Offset: wrapperspb.Int64(offset)}},
+		WriteStream: streamName,
+	}, nil
+}
+
+// defaultStream returns the default stream of a table, which every table has
+// without it being created, adding it on first use.  The caller holds the
+// lock.
+func (f *FakeBigQueryServer) defaultStream(streamName string) (*fakeWriteStream, bool) {
+	parent, ok := strings.CutSuffix(streamName, "/streams/_default")
+	if !ok {
+		return nil, false
+	}
+	tableKey, err := fakeTableKey(parent)
+	if err != nil {
+		return nil, false
+	}
+	if _, ok := f.tables[tableKey]; !ok {
+		return nil, false
+	}
+	stream := &fakeWriteStream{stream: &storagepb.WriteStream{Name: streamName, Type: storagepb.WriteStream_COMMITTED, Location: "US"}, tableKey: tableKey}
+	f.streams[streamName] = stream
+	return stream, true
+}
+
+// fakeSchemaField is a column of the REST representation of a table schema
+type fakeSchemaField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+}
+
+// fakeProtoKinds are the proto field kinds accepted for each column type,
+// a column of any other type accepting every kind
+var fakeProtoKinds = func() map[string][]protoreflect.Kind {
+	integers := []protoreflect.Kind{
+		protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Sint32Kind, protoreflect.Sint64Kind,
+		protoreflect.Uint32Kind, protoreflect.Uint64Kind, protoreflect.Fixed32Kind, protoreflect.Fixed64Kind,
+		protoreflect.Sfixed32Kind, protoreflect.Sfixed64Kind, protoreflect.EnumKind,
+	}
+	withIntegers := func(kinds ...protoreflect.Kind) []protoreflect.Kind {
+		return append(kinds, integers...)
+	}
+	text := []protoreflect.Kind{protoreflect.StringKind}
+	records := []protoreflect.Kind{protoreflect.MessageKind, protoreflect.GroupKind}
+	return map[string][]protoreflect.Kind{
+		"STRING":     text,
+		"GEOGRAPHY":  text,
+		"JSON":       text,
+		"BYTES":      {protoreflect.BytesKind},
+		"INTEGER":    integers,
+		"INT64":      integers,
+		"FLOAT":      withIntegers(protoreflect.DoubleKind, protoreflect.FloatKind),
+		"FLOAT64":    withIntegers(protoreflect.DoubleKind, protoreflect.FloatKind),
+		"NUMERIC":    withIntegers(protoreflect.StringKind, protoreflect.BytesKind),
+		"BIGNUMERIC": withIntegers(protoreflect.StringKind, protoreflect.BytesKind),
+		"BOOLEAN":    {protoreflect.BoolKind},
+		"BOOL":       {protoreflect.BoolKind},
+		"TIMESTAMP":  withIntegers(protoreflect.StringKind),
+		"DATETIME":   withIntegers(protoreflect.StringKind),
+		"DATE":       withIntegers(protoreflect.StringKind),
+		"TIME":       withIntegers(protoreflect.StringKind),
+		"RECORD":     records,
+		"STRUCT":     records,
+	}
+}()
+
+// checkWriterSchema checks the fields of the writer schema against the
+// columns of the table, as the Storage Write API does when the stream is
+// used, returning the error of a field of no column or of an incompatible
+// kind, or empty when the fields match.  The fields nested in a RECORD are
+// not checked.
+func checkWriterSchema(row protoreflect.MessageDescriptor, columns []fakeSchemaField) string {
+	var extra []string
+	fields := row.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		j := slices.IndexFunc(columns, func(column fakeSchemaField) bool { return strings.EqualFold(column.Name, string(field.Name())) })
+		if j < 0 {
+			extra = append(extra, string(field.Name()))
+			continue
+		}
+		if kinds, ok := fakeProtoKinds[columns[j].Type]; ok && !slices.Contains(kinds, field.Kind()) {
+			return fmt.Sprintf("The proto field mismatched with BigQuery field at %s.%s, the proto field type %s, BigQuery field type %s.", row.Name(), field.Name(), field.Kind(), columns[j].Type)
+		}
+	}
+	if len(extra) > 0 {
+		return fmt.Sprintf("Input schema has more fields than BigQuery schema, extra fields: '%s'.", strings.Join(extra, ","))
+	}
+	return ""
+}
+
+// checkRow parses a serialized row into the message, returning the error of
+// a row which does not parse with the writer schema or omits a REQUIRED
+// column, or empty when the row is valid
+func checkRow(serialized []byte, message *dynamicpb.Message, columns []fakeSchemaField) string {
+	if err := proto.Unmarshal(serialized, message); err != nil {
+		return fmt.Sprintf("Row is not valid: %v", err)
+	}
+	if len(message.GetUnknown()) > 0 {
+		return "Row could not be parsed, its field numbers or wire types do not match the writer schema."
+	}
+	fields := message.Descriptor().Fields()
+	for _, column := range columns {
+		if column.Mode != "REQUIRED" {
+			continue
+		}
+		if field := fields.ByName(protoreflect.Name(column.Name)); field == nil || !message.Has(field) {
+			return fmt.Sprintf("The required field %s is missing from the row.", column.Name)
+		}
+	}
+	return ""
+}
+
+// fakeTableKey returns the dataset and table key of a table parent,
+// projects/P/datasets/D/tables/T
+func fakeTableKey(parent string) (string, error) {
+	parts := strings.Split(parent, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "datasets" || parts[4] != "tables" {
+		return "", status.Errorf(codes.InvalidArgument, "%q is not a table", parent)
+	}
+	return parts[3] + "." + parts[5], nil
+}
+
+// fakeRowDescriptor builds the descriptor of the rows from the writer
+// schema, a self-contained proto2 message
+func fakeRowDescriptor(descriptor *descriptorpb.DescriptorProto) (protoreflect.MessageDescriptor, error) {
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:        proto.String("fake_row.proto"),
+		Syntax:      proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{descriptor},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return file.Messages().Get(0), nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+// fastJSON switches tableDataRecord.MarshalJSON to the hand-written serializer
+var fastJSON = false
+
+// Capacity reserved up front for a serialized tableDataRecord, so the
+// buffer is allocated once
+const fastJSONRecordCapacity = 160
+
+// Hexadecimal digits used by the JSON string escapes
+const fastJSONHex = "0123456789abcdef"
+
+// appendJSON appends the record as JSON, byte for byte identical to the
+// output of json.Marshal on the map of its fields, with the keys sorted.
+func (td *tableDataRecord) appendJSON(b []byte) []byte {
+	b = append(b, `{"create_time":"`...)
+	b = td.create_time.AppendFormat(b, dateTimeJSONLayout)
+	b = append(b, `","name":`...)
+	b = appendJSONString(b, td.name)
+	b = append(b, `,"run_id":`...)
+	b = appendJSONString(b, td.run_id)
+	b = append(b, `,"uuid":`...)
+	b = strconv.AppendInt(b, td.uuid, 10)
+	return append(b, '}')
+}
+
+// jsonSize returns the length of the JSON encoding of the record without
+// serializing it, so every record is measured off the hot path whichever
+// serializer is used
+func (td *tableDataRecord) jsonSize() int {
+	var scratch [20]byte
+	return len(`{"create_time":"","name":,"run_id":,"uuid":}`) + len(dateTimeJSONLayout) +
+		jsonStringSize(td.name) + jsonStringSize(td.run_id) + len(strconv.AppendInt(scratch[:0], td.uuid, 10))
+}
+
+// marshalJSONFast serializes the record using appendJSON into a buffer
+// sized up front, returned without copying
+func (td *tableDataRecord) marshalJSONFast() []byte {
+	return td.appendJSON(make([]byte, 0, fastJSONRecordCapacity+len(td.name)+len(td.run_id)))
+}
+
+// appendJSONString appends the string as a quoted JSON string, escaping it
+// as encoding/json does, including the HTML characters and U+2028 and U+2029
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, `\n`...)
+			case '\r':
+				b = append(b, `\r`...)
+			case '\t':
+				b = append(b, `\t`...)
+			default:
+				b = append(b, `\u00`...)
+				b = append(b, fastJSONHex[c>>4], fastJSONHex[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, `\u202`...)
+			b = append(b, fastJSONHex[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
+
+// jsonStringSize returns the length of the string as quoted by
+// appendJSONString
+func jsonStringSize(s string) int {
+	size := len(`""`)
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&':
+				size++
+			case c == '"' || c == '\\' || c == '\n' || c == '\r' || c == '\t':
+				size += 2
+			default:
+				size += len(`\u0000`)
+			}
+			i++
+			continue
+		}
+
+		r, n := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && n == 1:
+			size += len("\ufffd")
+		case r == '\u2028' || r == '\u2029':
+			size += len(`\u2028`)
+		default:
+			size += n
+		}
+		i += n
+	}
+	return size
+}
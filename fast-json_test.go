@@ -0,0 +1,122 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// newFastJSONRecord creates a record with the name given
+func newFastJSONRecord(name string) *tableDataRecord {
+	return NewTableData(name, 4242, time.Date(2023, 4, 5, 6, 7, 8, 901234000, time.UTC), "20230405T060708-0badcafe").(*tableDataRecord)
+}
+
+// fastJSONNames are names of records exercising each escape of the JSON
+// strings
+var fastJSONNames = []struct {
+	name   string
+	record string
+}{
+	{"Plain", randomNames[0]},
+	{"Quotes and Backslashes", `Louis "Lou" Green\Jr`},
+	{"Control Characters", "Line\nBreak\tTab\rReturn\x01"},
+	{"HTML Characters", "<Skyla> & Morrison"},
+	{"Line Separators", "Annalise\u2028Rosario\u2029"},
+	{"Invalid UTF-8", "Francisco\xffCole"},
+	{"Multi-Byte", "Aron Downs ☃"},
+}
+
+func TestMarshalJSONFastMatchesMarshalJSON(t *testing.T) {
+	defer func() { fastJSON = false }()
+	for _, tt := range fastJSONNames {
+		t.Run(tt.name, func(t *testing.T) {
+			record := newFastJSONRecord(tt.record)
+			fastJSON = false
+			want, err := record.MarshalJSON()
+			if err != nil {
+				t.Fatalf("MarshalJSON: %v", err)
+			}
+			fastJSON = true
+			got, err := record.MarshalJSON()
+			if err != nil {
+				t.Fatalf("MarshalJSON: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("fast serializer wrote\n%s\nexpected\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestRecordSizeMatchesMarshalJSON(t *testing.T) {
+	for _, tt := range fastJSONNames {
+		t.Run(tt.name, func(t *testing.T) {
+			record := newFastJSONRecord(tt.record)
+			for _, data := range []interface{}{record, &paddedRecord{record: record, padding: tt.record}} {
+				want, err := json.Marshal(data)
+				if err != nil {
+					t.Fatalf("json.Marshal: %v", err)
+				}
+				if got := RecordSize(data); got != len(want) {
+					t.Errorf("%T measured as %d bytes, expected %d", data, got, len(want))
+				}
+			}
+		})
+	}
+}
+
+func TestSaveMatchesMarshalJSONCreateTime(t *testing.T) {
+	record := newFastJSONRecord(randomNames[0])
+	row, _, err := record.Save()
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	var encoded map[string]interface{}
+	b, err := record.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON: %v", err)
+	}
+	if err := json.Unmarshal(b, &encoded); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if row["create_time"] != encoded["create_time"] {
+		t.Errorf("Save formats create_time as %v, MarshalJSON as %v", row["create_time"], encoded["create_time"])
+	}
+}
+
+func BenchmarkMarshalJSON(b *testing.B) {
+	record := newFastJSONRecord(randomNames[0])
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := record.MarshalJSON(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalJSON_Fast(b *testing.B) {
+	fastJSON = true
+	defer func() { fastJSON = false }()
+	record := newFastJSONRecord(randomNames[0])
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := record.MarshalJSON(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+)
+
+// File descriptors reserved for the log and results files and the
+// connections of the BigQuery client, beyond the sockets of the streamers
+const fileDescriptorReserve = 64
+
+// Fraction of the file descriptor limit the sockets of the streamers may
+// comfortably use
+const fileDescriptorHeadroom = 0.8
+
+// FileLimitCheck compares the sockets implied by the parallelism of a run
+// with the file descriptor limit of the process
+type FileLimitCheck struct {
+	Limit       uint64
+	Sockets     int
+	Suggested   uint64
+	SafeWorkers int
+}
+
+// CheckFileLimit estimates the sockets of the streams, each worker of every
+// stream holding a connection, returning false if they fit comfortably within
+// the file descriptor limit, or the limit is unknown
+func CheckFileLimit(streams, workers int) (FileLimitCheck, bool) {
+	limit, ok := fileDescriptorLimit()
+	if !ok {
+		return FileLimitCheck{}, false
+	}
+	check := FileLimitCheck{Limit: limit, Sockets: streams*workers + fileDescriptorReserve}
+	comfortable := int(float64(limit) * fileDescriptorHeadroom)
+	if check.Sockets <= comfortable {
+		return check, false
+	}
+	check.Suggested = (uint64(float64(check.Sockets)/fileDescriptorHeadroom)/1024 + 1) * 1024
+	check.SafeWorkers = max(1, (comfortable-fileDescriptorReserve)/max(1, streams))
+	return check, true
+}
+
+// LogFileLimitWarning outputs the file descriptor limit constraining the
+// parallelism of the run, along with the limit suggested
+func LogFileLimitWarning(check FileLimitCheck) {
+	logger.Warn().Uint64("Limit", check.Limit).Int("Estimated Sockets", check.Sockets).Uint64("Suggested Limit", check.Suggested).
+		Msg("The File Descriptor Limit May Not Allow the Requested Parallelism, Raise it with ulimit -n or use -clamp-parallelism")
+}
+
+// IsFileLimitError returns true if the error is caused by the process
+// running out of file descriptors
+func IsFileLimitError(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || strings.Contains(strings.ToLower(err.Error()), "too many open files")
+}
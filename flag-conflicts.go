@@ -0,0 +1,120 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+)
+
+// Conditions of the flags named by the flag conflicts, alongside the flags
+// themselves
+const (
+	conflictSweeps           = "sweeps"
+	conflictMultipleDatasets = "multiple datasets"
+	conflictStorageMode      = "-m storage"
+	conflictBatchMode        = "-m batch"
+	conflictMinimalGenerator = "-generator minimal"
+)
+
+// flagConflict is a flag, or condition of the flags, which cannot be combined
+// with any of the others listed, along with any reason given with the error
+type flagConflict struct {
+	flag   string
+	with   []string
+	reason string
+}
+
+// flagConflicts lists the flags which cannot be combined, each with the flags
+// it cannot be combined with.  A flag is named once with every flag it
+// conflicts with, in place of a check per combination.
+var flagConflicts = []flagConflict{
+	{flag: "-scale-tables", with: []string{"-table-count", "-batch-sizes", conflictMultipleDatasets, "-scenario", "-committed-stream"}},
+	{flag: "-sweep-workers", with: []string{"-sweep-batch", "-scale-tables", "-scenario", "-committed-stream"}},
+	{flag: "-sweep-batch", with: []string{"-scale-tables", "-scenario", "-committed-stream"}},
+	{flag: "-cloud-run-job", with: []string{"-soak", conflictSweeps, "-coordinate", "-generate-process", "-input", "-replay"}},
+	{flag: "-dual-write", with: []string{"-table-count", "-batch-sizes", conflictMultipleDatasets, "-scenario", "-committed-stream", conflictSweeps, "-soak", "-measure-dedup-rate", "-dup-percent"}},
+	{flag: "-compare", with: []string{
+		"-m", "-committed-stream", "-scenario", conflictSweeps, "-soak", "-dual-write",
+		"-table-count", "-batch-sizes", conflictMultipleDatasets, "-batch-ramp-start", "-partition",
+		"-input", "-generate-process", "-replay", "-ack-tokens", "-coordinate", "-cloud-run-job", "-baseline",
+		"-insert-ids", "-worker-stats", "-fairness-test", "-timing-breakdown", "-request-log", "-heartbeat",
+	}},
+	{flag: conflictStorageMode, with: []string{
+		"-committed-stream", "-scenario", conflictSweeps, "-soak", "-batch-sizes", "-batch-ramp-start",
+		"-insert-ids", "-worker-stats", "-fairness-test", "-timing-breakdown", "-request-log", "-heartbeat",
+	}},
+	{flag: conflictBatchMode, with: []string{
+		"-committed-stream", "-scenario", conflictSweeps, "-soak", "-batch-sizes", "-batch-ramp-start",
+		"-input", "-generate-process", "-replay", "-dual-write", "-table-count", conflictMultipleDatasets,
+		"-insert-ids", "-worker-stats", "-fairness-test", "-timing-breakdown", "-request-log", "-heartbeat",
+	}},
+	{flag: "-batch-ramp-start", with: []string{"-batch-sizes", "-scenario", "-committed-stream", conflictSweeps, "-soak"}},
+	{flag: "-preconnect", with: []string{conflictStorageMode, conflictBatchMode, "-committed-stream"}, reason: "requiring the insertAll API"},
+	{flag: "-estimate-slots", with: []string{"-scenario", "-committed-stream", conflictSweeps, "-soak"}},
+	{flag: "-quota-measure", with: []string{"-committed-stream", "-scenario", "-soak", conflictBatchMode}},
+	{flag: "-metadata-poll-interval", with: []string{"-committed-stream", "-scenario", "-soak", conflictBatchMode, "-dual-write"}},
+	{flag: "-g", with: []string{"-committed-stream", "-scenario", "-soak", conflictBatchMode, "-input", "-replay", "-generate-process", "-ack-tokens", "-timing-breakdown"}},
+	{flag: "-rate", with: []string{"-committed-stream", "-scenario", "-soak", conflictBatchMode, "-replay"}},
+	{flag: "-verify", with: []string{conflictSweeps, "-compare", "-cloud-run-job"}},
+	{flag: "-track-landed", with: []string{conflictSweeps}},
+	{flag: "-soak", with: []string{"-scenario", "-committed-stream", conflictSweeps, conflictMultipleDatasets, "-table-count"}},
+	{flag: "-worker-stats", with: []string{"-scenario", "-committed-stream", conflictSweeps, "-soak"}},
+	{flag: "-fairness-test", with: []string{"-scenario", "-committed-stream", conflictSweeps, "-soak"}},
+	{flag: "-record", with: []string{"-scenario", "-committed-stream", conflictSweeps, "-soak"}},
+	{flag: "-replay", with: []string{"-scenario", "-committed-stream", conflictSweeps, "-soak"}},
+	{flag: "-baseline", with: []string{conflictSweeps, "-soak", "-cloud-run-job"}},
+	{flag: "-input", with: []string{"-scenario", "-committed-stream", conflictSweeps, "-soak", "-replay", "-generate-process", "-generate-serve"}},
+	{flag: "-generate-process", with: []string{"-scenario", "-committed-stream", conflictSweeps, "-soak", "-replay", "-generate-serve"}},
+	{flag: "-timing-breakdown", with: []string{"-scenario", "-committed-stream", "-soak", "-replay"}},
+	{flag: "-size-histogram", with: []string{"-scenario", "-committed-stream", "-soak"}},
+	{flag: "-coordinate", with: []string{conflictSweeps, "-soak"}},
+	{flag: "-committed-stream", with: []string{"-scenario", conflictMultipleDatasets, "-table-count"}},
+	{flag: conflictMinimalGenerator, with: []string{"-insert-ids", "-dup-percent", "-measure-dedup-rate"}, reason: "every record having the same uuid"},
+	{flag: "-schema", with: []string{"-json-schema", "-translate-schema"}},
+	{flag: "-translate-schema", with: []string{"-json-schema"}},
+	{flag: "-data-profile", with: []string{"-generator"}},
+	{flag: "-row-bytes", with: []string{"-input", "-replay"}},
+	{flag: "-ack-tokens", with: []string{"-scenario", "-committed-stream", conflictSweeps, "-soak", "-input", "-generate-process", "-replay"}},
+	{flag: "-partition", with: []string{"-scenario", conflictSweeps, "-soak", "-replay", "-measure-dedup-rate", "-dup-percent", "-partition-field", "-partition-type"}},
+	{flag: "-target-partition", with: []string{"-time-spread", "-event-lag"}},
+	{flag: "-cleanup", with: []string{"-coordinate"}, reason: "the hosts sharing the tables"},
+}
+
+// CheckFlagConflicts returns an error naming the first flag in use along with
+// a flag in use it cannot be combined with.  inUse holds whether each flag or
+// condition named by the conflicts is in use, a name missing from it being an
+// error whether in use or not, so a conflict is never silently ignored.
+func CheckFlagConflicts(conflicts []flagConflict, inUse map[string]bool) error {
+	for _, conflict := range conflicts {
+		set, ok := inUse[conflict.flag]
+		if !ok {
+			return fmt.Errorf("the flag conflicts name %s, which is not known", conflict.flag)
+		}
+		for _, with := range conflict.with {
+			withSet, ok := inUse[with]
+			if !ok {
+				return fmt.Errorf("the flag conflicts name %s, which is not known", with)
+			}
+			if !set || !withSet {
+				continue
+			}
+			if conflict.reason != "" {
+				return fmt.Errorf("%s cannot be combined with %s, %s", conflict.flag, with, conflict.reason)
+			}
+			return fmt.Errorf("%s cannot be combined with %s", conflict.flag, with)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+// flagsInUse returns every flag and condition named by the flag conflicts,
+// only those given being in use
+func flagsInUse(names ...string) map[string]bool {
+	inUse := make(map[string]bool)
+	for _, conflict := range flagConflicts {
+		inUse[conflict.flag] = false
+		for _, with := range conflict.with {
+			inUse[with] = false
+		}
+	}
+	for _, name := range names {
+		inUse[name] = true
+	}
+	return inUse
+}
+
+func TestCheckFlagConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		inUse    []string
+		expected string
+	}{
+		{"No Flags", nil, ""},
+		{"Compatible Flags", []string{"-compare", "-size-histogram", "-rate"}, ""},
+		{"Compare with Soak", []string{"-compare", "-soak"}, "-compare cannot be combined with -soak"},
+		{"Storage Mode with Insert IDs", []string{conflictStorageMode, "-insert-ids"}, "-m storage cannot be combined with -insert-ids"},
+		{"Batch Mode with Multiple Datasets", []string{conflictBatchMode, conflictMultipleDatasets}, "-m batch cannot be combined with multiple datasets"},
+		{"Sweeps with Verify", []string{conflictSweeps, "-verify"}, "-verify cannot be combined with sweeps"},
+		{"Two Sweeps", []string{"-sweep-workers", "-sweep-batch"}, "-sweep-workers cannot be combined with -sweep-batch"},
+		{"Preconnect Reason", []string{"-preconnect", "-committed-stream"}, "-preconnect cannot be combined with -committed-stream, requiring the insertAll API"},
+		{"Cleanup Reason", []string{"-cleanup", "-coordinate"}, "-cleanup cannot be combined with -coordinate, the hosts sharing the tables"},
+		{"Minimal Generator", []string{conflictMinimalGenerator, "-dup-percent"}, "-generator minimal cannot be combined with -dup-percent, every record having the same uuid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckFlagConflicts(flagConflicts, flagsInUse(tt.inUse...))
+			switch {
+			case tt.expected == "" && err != nil:
+				t.Errorf("CheckFlagConflicts: %v", err)
+			case tt.expected != "" && err == nil:
+				t.Errorf("no conflict was found, expected %q", tt.expected)
+			case tt.expected != "" && err.Error() != tt.expected:
+				t.Errorf("conflict %q, expected %q", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCheckFlagConflictsUnknownFlag(t *testing.T) {
+	conflicts := []flagConflict{{flag: "-compare", with: []string{"-unknown"}}}
+	if err := CheckFlagConflicts(conflicts, map[string]bool{"-compare": false}); err == nil {
+		t.Error("a flag missing from the flags in use was not reported")
+	}
+}
+
+func TestFlagConflictsNeverConflictWithThemselves(t *testing.T) {
+	for _, conflict := range flagConflicts {
+		for _, with := range conflict.with {
+			if with == conflict.flag {
+				t.Errorf("%s is listed as conflicting with itself", conflict.flag)
+			}
+		}
+	}
+}
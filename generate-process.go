@@ -0,0 +1,153 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Address of the standard streams, and the prefix of a unix socket address,
+// for -generate-serve and -input
+const (
+	stdioAddress      = "-"
+	unixSocketAddress = "unix:"
+)
+
+// Flags forked into a separate generator process
+const (
+	generateProcessFlag = "generate-process"
+	generateServeFlag   = "generate-serve"
+)
+
+// ServeGeneratedRows writes the generated records as newline-delimited JSON,
+// to standard output for the address -, otherwise to the first connection
+// accepted on the unix socket unix:PATH
+func ServeGeneratedRows(ctx context.Context, address string, iterations int, runID string, gen dataGenerator) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if address == stdioAddress {
+		return writeNDJSON(ctx, os.Stdout, newGenerator(ctx, iterations, runID, gen))
+	}
+
+	listener, err := net.Listen("unix", strings.TrimPrefix(address, unixSocketAddress))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return writeNDJSON(ctx, conn, newGenerator(ctx, iterations, runID, gen))
+}
+
+// OpenRowInput opens the newline-delimited JSON rows to stream in place of
+// the generator, from standard input for the address -, from the unix socket
+// unix:PATH, otherwise from the file
+func OpenRowInput(address string) (io.ReadCloser, error) {
+	switch {
+	case address == stdioAddress:
+		return os.Stdin, nil
+	case strings.HasPrefix(address, unixSocketAddress):
+		return net.Dial("unix", strings.TrimPrefix(address, unixSocketAddress))
+	default:
+		return os.Open(address)
+	}
+}
+
+// newInputGenerator reads the newline-delimited JSON rows of the input, tagged
+// with the run_id of this run
+func newInputGenerator(ctx context.Context, input io.Reader, runID string) <-chan interface{} {
+	ch := make(chan interface{}, 1)
+	go func() {
+		defer close(ch)
+		scanner := bufio.NewScanner(input)
+		scanner.Buffer(nil, maxWorkloadLine)
+		for line := 1; scanner.Scan(); line++ {
+			var row map[string]bigquery.Value
+			decoder := json.NewDecoder(strings.NewReader(scanner.Text()))
+			decoder.UseNumber()
+			if err := decoder.Decode(&row); err != nil || row == nil {
+				logger.Warn().Err(err).Int("Line", line).Msg("  Skipping an Invalid Input Row")
+				continue
+			}
+			row["run_id"] = runID
+
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- &schemaDataRecord{row: row}:
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			logger.Warn().Err(err).Msg("  Failed to Read the Input Rows")
+		}
+	}()
+	return ch
+}
+
+// GeneratorProcess is this binary forked with -generate-serve, generating
+// the records in a separate OS process and streaming them over a pipe
+type GeneratorProcess struct {
+	cmd    *exec.Cmd
+	output io.ReadCloser
+}
+
+// StartGeneratorProcess forks this binary with the same arguments, less
+// -generate-process, serving the generated records on its standard output
+func StartGeneratorProcess() (*GeneratorProcess, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	args := StripFlags(os.Args[1:], map[string]bool{generateProcessFlag: true})
+	cmd := exec.Command(executable, append(args, "-"+generateServeFlag, stdioAddress)...)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &GeneratorProcess{cmd: cmd, output: output}, nil
+}
+
+// Output returns the rows served by the generator process
+func (p *GeneratorProcess) Output() io.Reader {
+	return p.output
+}
+
+// Wait closes the pipe, in case the run stopped before reading every row,
+// and waits for the generator process to exit, returning its CPU time
+func (p *GeneratorProcess) Wait() (time.Duration, error) {
+	p.output.Close()
+	err := p.cmd.Wait()
+	if p.cmd.ProcessState == nil {
+		return 0, err
+	}
+	return p.cmd.ProcessState.UserTime() + p.cmd.ProcessState.SystemTime(), err
+}
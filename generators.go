@@ -0,0 +1,92 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Name of the generator used when -generator is not given
+const defaultGeneratorName = "default"
+
+// Length of the names generated by the stress generator, keeping a batch of
+// 500 records under the 10 MB insertAll request limit
+const stressStringLength = 16 * 1024
+
+// stressCreateTime is the latest value of a BigQuery DATETIME, used by the
+// stress generator
+var stressCreateTime = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
+// stressPadding pads the names generated by the stress generator up to the
+// stress string length
+var stressPadding = strings.Repeat("x", stressStringLength)
+
+// generators is the registry of the named data generators of the built-in
+// table schema, selected with -generator
+var generators = map[string]dataGenerator{
+	defaultGeneratorName: NewTableData,
+	"minimal":            NewMinimalTableData,
+	"stress":             NewStressTableData,
+}
+
+// RegisterGenerator adds the data generator to the registry under the name,
+// replacing any generator already registered with the name
+func RegisterGenerator(name string, gen dataGenerator) {
+	generators[name] = gen
+}
+
+// LookupGenerator returns the data generator registered with the name
+func LookupGenerator(name string) (dataGenerator, error) {
+	gen, ok := generators[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown generator %q, expected one of %s", name, strings.Join(GeneratorNames(), ", "))
+	}
+	return gen, nil
+}
+
+// GeneratorNames returns the names of the registered data generators, sorted
+func GeneratorNames() []string {
+	names := make([]string, 0, len(generators))
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewMinimalTableData creates a record of the smallest size, with an empty
+// name, a zero uuid and the zero create_time, keeping only the run_id
+func NewMinimalTableData(name string, uuid int64, create_time time.Time, run_id string) interface{} {
+	return &tableDataRecord{run_id: run_id}
+}
+
+// NewStressTableData creates a record of the largest size, with the name
+// padded to the stress string length, the uuid counting down from the
+// largest INT64 and the latest DATETIME
+func NewStressTableData(name string, uuid int64, create_time time.Time, run_id string) interface{} {
+	if len(name) < stressStringLength {
+		name += stressPadding[:stressStringLength-len(name)]
+	}
+	return &tableDataRecord{
+		name:        name,
+		uuid:        math.MaxInt64 - uuid,
+		create_time: stressCreateTime,
+		run_id:      run_id,
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Number of health checks the rolling records per second is measured over
+const healthWindowChecks = 5
+
+// Fraction of the peak records per second below which the health monitor
+// alerts
+const healthAlertFraction = 0.5
+
+// healthSample is the number of records sent at the time of a health check
+type healthSample struct {
+	time time.Time
+	sent int64
+}
+
+// HealthMonitor checks the rolling records per second every interval,
+// alerting when it drops below half the peak observed during the run
+type HealthMonitor struct {
+	interval time.Duration
+	sent     atomic.Int64
+	samples  []healthSample
+	peak     float64
+	alerting bool
+	cancel   context.CancelFunc
+	finished chan struct{}
+}
+
+// NewHealthMonitor creates a health monitor checking every interval
+func NewHealthMonitor(interval time.Duration) *HealthMonitor {
+	return &HealthMonitor{interval: interval}
+}
+
+// AddSent accumulates the records sent, a nil health monitor ignores them
+func (m *HealthMonitor) AddSent(n int) {
+	if m == nil {
+		return
+	}
+	m.sent.Add(int64(n))
+}
+
+// Start begins checking the health of the run in the background
+func (m *HealthMonitor) Start(ctx context.Context) {
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.finished = make(chan struct{})
+	m.samples = []healthSample{{time: time.Now()}}
+	go func() {
+		defer close(m.finished)
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				m.Check(now)
+			}
+		}
+	}()
+}
+
+// Stop ends the health checks, a nil health monitor is ignored
+func (m *HealthMonitor) Stop() {
+	if m == nil || m.cancel == nil {
+		return
+	}
+	m.cancel()
+	<-m.finished
+}
+
+// Check measures the records per second over the last checks, raising the
+// peak or alerting once when the rate drops below half of it
+func (m *HealthMonitor) Check(now time.Time) {
+	m.samples = append(m.samples, healthSample{time: now, sent: m.sent.Load()})
+	if len(m.samples) > healthWindowChecks+1 {
+		m.samples = m.samples[1:]
+	}
+	first, last := m.samples[0], m.samples[len(m.samples)-1]
+	elapsed := last.time.Sub(first.time).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	rps := float64(last.sent-first.sent) / elapsed
+	m.peak = max(m.peak, rps)
+
+	threshold := m.peak * healthAlertFraction
+	switch {
+	case rps < threshold && !m.alerting:
+		m.alerting = true
+		m.Alert("Records per Second", rps, threshold)
+	case rps >= threshold && m.alerting:
+		m.alerting = false
+		logger.Info().Float64("Records per Second", rps).Float64("Peak", m.peak).Msg("Health Recovered")
+	}
+}
+
+// Alert logs an ALERT line at warning level, visible without -v, for the
+// metric whose current value crossed the threshold
+func (m *HealthMonitor) Alert(metric string, current, threshold float64) {
+	logger.Warn().Str("Metric", metric).Float64("Current", current).Float64("Threshold", threshold).Msg("ALERT")
+}
@@ -0,0 +1,249 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Maximum number of request latencies retained per heartbeat interval
+const heartbeatMaxSamples = 10000
+
+// Number of recent failed requests logged while the heartbeat is escalated
+const heartbeatRecentErrors = 3
+
+// HeartbeatThresholds holds the levels beyond which the heartbeat escalates
+// to debug detail, a zero threshold never being crossed
+type HeartbeatThresholds struct {
+	ErrorRate float64
+	P99       time.Duration
+	Gap       int64
+}
+
+// Breaches returns the thresholds crossed by the measurements of a single
+// heartbeat interval, empty when the run is healthy
+func (t HeartbeatThresholds) Breaches(errorRate float64, p99 time.Duration, gap int64) []string {
+	var breaches []string
+	if t.ErrorRate > 0 && errorRate > t.ErrorRate {
+		breaches = append(breaches, fmt.Sprintf("error rate %.1f%% above %.1f%%", errorRate*100, t.ErrorRate*100))
+	}
+	if t.P99 > 0 && p99 > t.P99 {
+		breaches = append(breaches, fmt.Sprintf("p99 request latency %s above %s", p99, t.P99))
+	}
+	if t.Gap > 0 && gap > t.Gap {
+		breaches = append(breaches, fmt.Sprintf("sent/acked gap %d above %d", gap, t.Gap))
+	}
+	return breaches
+}
+
+// Heartbeat logs one compact line every interval while the run is healthy,
+// escalating the global log level to debug with extra detail for as long as
+// any threshold is crossed, then dropping back.  The requests are observed
+// through a transport on the streamer clients.
+type Heartbeat struct {
+	interval   time.Duration
+	thresholds HeartbeatThresholds
+	requestIDs *RequestIDTracker
+	sent       atomic.Int64
+	acked      atomic.Int64
+
+	mu          sync.Mutex
+	requests    int
+	failures    int
+	latencies   []time.Duration
+	escalated   bool
+	escalations int
+	level       zerolog.Level
+	cancel      context.CancelFunc
+	finished    chan struct{}
+}
+
+// NewHeartbeat creates a heartbeat logging every interval, taking the recent
+// failed requests from the request ID tracker while escalated
+func NewHeartbeat(interval time.Duration, thresholds HeartbeatThresholds, requestIDs *RequestIDTracker) *Heartbeat {
+	return &Heartbeat{interval: interval, thresholds: thresholds, requestIDs: requestIDs}
+}
+
+// AddSent accumulates the records sent, a nil heartbeat ignores them
+func (h *Heartbeat) AddSent(n int) {
+	if h == nil {
+		return
+	}
+	h.sent.Add(int64(n))
+}
+
+// observe records a completed insertAll request of the given number of rows
+func (h *Heartbeat) observe(latency time.Duration, rows int, failed bool) {
+	if !failed {
+		h.acked.Add(int64(rows))
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests++
+	if failed {
+		h.failures++
+	}
+	if len(h.latencies) < heartbeatMaxSamples {
+		h.latencies = append(h.latencies, latency)
+	}
+}
+
+// ObserveAppend records an append to a committed stream, sent at the given
+// time and completed with the error, a nil heartbeat ignores it
+func (h *Heartbeat) ObserveAppend(sent time.Time, rows int, err error) {
+	if h == nil {
+		return
+	}
+	h.observe(time.Since(sent), rows, err != nil)
+}
+
+// Start begins logging the heartbeat in the background
+func (h *Heartbeat) Start(ctx context.Context) {
+	ctx, h.cancel = context.WithCancel(ctx)
+	h.finished = make(chan struct{})
+	go func() {
+		defer close(h.finished)
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.beat()
+			}
+		}
+	}()
+}
+
+// Stop ends the heartbeat, restoring the log level if still escalated, and
+// returns the number of escalations, a nil heartbeat returning zero
+func (h *Heartbeat) Stop() int {
+	if h == nil {
+		return 0
+	}
+	if h.cancel != nil {
+		h.cancel()
+		<-h.finished
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.escalated {
+		h.escalated = false
+		zerolog.SetGlobalLevel(h.level)
+	}
+	logger.Info().Int("Escalations", h.escalations).Msg("Heartbeat Stopped")
+	return h.escalations
+}
+
+// Escalations returns the number of times the heartbeat has escalated, a
+// nil heartbeat returning zero
+func (h *Heartbeat) Escalations() int {
+	if h == nil {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.escalations
+}
+
+// beat measures the interval just ended, escalating or dropping back as the
+// thresholds are crossed, and logs the heartbeat
+func (h *Heartbeat) beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	requests, failures, latencies := h.requests, h.failures, h.latencies
+	h.requests, h.failures, h.latencies = 0, 0, nil
+
+	errorRate := 0.0
+	if requests > 0 {
+		errorRate = float64(failures) / float64(requests)
+	}
+	var p99 time.Duration
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		p99 = latencies[(len(latencies)*99-1)/100]
+	}
+	sent, acked := h.sent.Load(), h.acked.Load()
+	gap := sent - acked
+
+	breaches := h.thresholds.Breaches(errorRate, p99, gap)
+	switch {
+	case len(breaches) > 0 && !h.escalated:
+		h.escalated = true
+		h.escalations++
+		h.level = zerolog.GlobalLevel()
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+		logger.Warn().Strs("Breaches", breaches).Int("Escalation", h.escalations).Msg("Heartbeat Escalated to Debug Detail")
+	case len(breaches) == 0 && h.escalated:
+		h.escalated = false
+		zerolog.SetGlobalLevel(h.level)
+		logger.Info().Msg("Heartbeat Recovered")
+	}
+
+	logger.Info().Int64("Sent", sent).Int64("Acked", acked).Int("Requests", requests).
+		Str("Error Rate", fmt.Sprintf("%.1f%%", errorRate*100)).Dur("p99", p99).Msg("Heartbeat")
+	if h.escalated {
+		logger.Debug().Strs("Breaches", breaches).Int64("Queue Estimate", gap).Msg("  Heartbeat Detail")
+		recent := h.requestIDs.Recent()
+		if len(recent) > heartbeatRecentErrors {
+			recent = recent[len(recent)-heartbeatRecentErrors:]
+		}
+		for _, record := range recent {
+			logger.Debug().Time("Time", record.Time).Str("Request ID", record.RequestID).Str("Status", record.Status).Str("Error", record.Error).Msg("  Recent Error")
+		}
+	}
+}
+
+// heartbeatTransport times every insertAll request made through it for the
+// heartbeat, counting the rows acknowledged
+type heartbeatTransport struct {
+	base      http.RoundTripper
+	heartbeat *Heartbeat
+}
+
+// Transport wraps the base transport, observing every insertAll request
+// made through it
+func (h *Heartbeat) Transport(base http.RoundTripper) http.RoundTripper {
+	return &heartbeatTransport{base: base, heartbeat: h}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *heartbeatTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isInsertAll(req) || req.Body == nil {
+		return t.base.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	t.heartbeat.observe(time.Since(start), insertAllRowCount(body), err != nil || resp.StatusCode >= http.StatusBadRequest)
+	return resp, err
+}
@@ -0,0 +1,121 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/api/option"
+)
+
+func TestHeartbeatThresholdsBreaches(t *testing.T) {
+	thresholds := HeartbeatThresholds{ErrorRate: 0.1, P99: time.Second, Gap: 100}
+
+	tests := []struct {
+		name       string
+		thresholds HeartbeatThresholds
+		errorRate  float64
+		p99        time.Duration
+		gap        int64
+		want       []string
+	}{
+		{"Healthy", thresholds, 0.05, 500 * time.Millisecond, 10, nil},
+		{"At the Thresholds", thresholds, 0.1, time.Second, 100, nil},
+		{"Error Rate", thresholds, 0.25, 0, 0, []string{"error rate 25.0% above 10.0%"}},
+		{"p99 Latency", thresholds, 0, 2 * time.Second, 0, []string{"p99 request latency 2s above 1s"}},
+		{"Gap", thresholds, 0, 0, 101, []string{"sent/acked gap 101 above 100"}},
+		{"Every Threshold", thresholds, 0.5, 3 * time.Second, 500, []string{
+			"error rate 50.0% above 10.0%",
+			"p99 request latency 3s above 1s",
+			"sent/acked gap 500 above 100",
+		}},
+		{"Zero Thresholds are Never Crossed", HeartbeatThresholds{}, 1, time.Hour, 1 << 20, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.thresholds.Breaches(tt.errorRate, tt.p99, tt.gap); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Breaches = %q, expected %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestHeartbeatFaultScenarios streams the records through a heartbeat while
+// the fake server injects each fault, checking the heartbeat escalates to
+// debug detail only for the faults and drops back once stopped
+func TestHeartbeatFaultScenarios(t *testing.T) {
+	server := NewFakeBigQueryServer()
+	defer server.Close()
+	st, err := newSelfTest(context.Background(), server)
+	if err != nil {
+		t.Fatalf("newSelfTest: %v", err)
+	}
+	defer st.client.Close()
+	if err := st.checkCreateTable(); err != nil {
+		t.Fatalf("checkCreateTable: %v", err)
+	}
+	thresholds := HeartbeatThresholds{ErrorRate: 0.1, P99: time.Second, Gap: 1000}
+
+	tests := []struct {
+		name     string
+		scenario FaultScenario
+		escalate bool
+	}{
+		{"Healthy", FaultScenario{}, false},
+		{"unavailable", faultScenarios["unavailable"], true},
+		{"reset", faultScenarios["reset"], true},
+		{"stall", FaultScenario{Name: "stall", StallAfter: 3, StallFor: 2 * time.Second}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			level := zerolog.GlobalLevel()
+			heartbeat := NewHeartbeat(time.Minute, thresholds, &RequestIDTracker{})
+			config := *st.config
+			config.RunID = NewRunID()
+			config.Heartbeat = heartbeat
+			config.StreamerOptions = FakeClientOptions(server, option.WithHTTPClient(&http.Client{Transport: heartbeat.Transport(http.DefaultTransport)}))
+
+			server.SetFaultScenario(tt.scenario)
+			_, err := ExecuteLegacyStream(context.Background(), &config)
+			server.SetFaultScenario(FaultScenario{})
+			if err != nil {
+				t.Fatalf("ExecuteLegacyStream: %v", err)
+			}
+
+			// Beat once for the whole run rather than waiting for the interval
+			heartbeat.beat()
+			if escalated := heartbeat.Escalations() > 0; escalated != tt.escalate {
+				t.Fatalf("escalated %t, expected %t", escalated, tt.escalate)
+			}
+			if tt.escalate && zerolog.GlobalLevel() != zerolog.DebugLevel {
+				t.Errorf("log level %s while escalated, expected %s", zerolog.GlobalLevel(), zerolog.DebugLevel)
+			}
+
+			// Beat again with no requests, dropping back to the original level
+			heartbeat.beat()
+			if zerolog.GlobalLevel() != level {
+				t.Errorf("log level %s once recovered, expected %s", zerolog.GlobalLevel(), level)
+			}
+			if escalations := heartbeat.Stop(); escalations > 1 {
+				t.Errorf("%d escalations, expected at most 1", escalations)
+			}
+		})
+	}
+}
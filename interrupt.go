@@ -0,0 +1,167 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Exit status when a second interrupt abandons the process
+const exitInterrupted = 130
+
+// Maximum time spent cancelling the job of an interrupted query
+const jobCancelTimeout = 10 * time.Second
+
+// interruptDrainKey is the context key of the time limit to drain the
+// streamers within once the run is interrupted
+type interruptDrainKey struct{}
+
+// errInterrupted is returned by a query interrupted by a signal
+var errInterrupted = errors.New("interrupted")
+
+// NotifyInterrupt returns a context cancelled by the first SIGINT or SIGTERM,
+// cancelling the queries in flight, while a second signal exits immediately,
+// abandoning even the cancellation of their jobs.  The stop function stops
+// handling the signals.
+func NotifyInterrupt(parent context.Context) (context.Context, func()) {
+	return notifySignals(parent, "Cancelling the Queries in Flight")
+}
+
+// ExecuteInterruptible executes the runner with a context cancelled by the
+// first SIGINT or SIGTERM, which stops the writes so the streamers are
+// drained and the summary of the records sent is still reported, while a
+// second signal exits immediately.  The context carries the interrupt drain
+// timeout of the config, so an interrupted run drains the streamers within
+// the shorter time limit.  An interrupted run returns its summary along with
+// an error wrapping errInterrupted.
+func ExecuteInterruptible(ctx context.Context, config *BenchmarkConfig, runner func(context.Context, *BenchmarkConfig) (*RunSummary, error)) (*RunSummary, error) {
+	runCtx, stop := notifySignals(context.WithValue(ctx, interruptDrainKey{}, config.InterruptDrain), "Stopping the Writes and Draining the Streamers")
+	defer stop()
+	summary, err := runner(runCtx, config)
+	if err == nil && runCtx.Err() != nil {
+		err = fmt.Errorf("streaming %w", errInterrupted)
+	}
+	return summary, err
+}
+
+// DrainTimeout returns the time limit to drain the streamers within, being
+// the drain timeout of the config unless the context carrying the shorter
+// interrupt drain timeout has been cancelled by an interrupt
+func DrainTimeout(ctx context.Context, config *BenchmarkConfig) time.Duration {
+	timeout, ok := ctx.Value(interruptDrainKey{}).(time.Duration)
+	if !ok || ctx.Err() == nil || timeout <= 0 || timeout >= config.DrainTimeout {
+		return config.DrainTimeout
+	}
+	return timeout
+}
+
+// notifySignals returns a context cancelled by the first SIGINT or SIGTERM,
+// logging the action taken, while a second signal exits immediately
+func notifySignals(parent context.Context, action string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-signals:
+			logger.Warn().Msgf("Interrupted, %s, Interrupt Again to Exit Immediately", action)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case <-signals:
+			logger.Warn().Msg("Interrupted Again, Exiting Immediately")
+			os.Exit(exitInterrupted)
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
+
+// queryJob is the part of a BigQuery job awaited by WaitForJob
+type queryJob interface {
+	Wait(ctx context.Context) (*bigquery.JobStatus, error)
+	Cancel(ctx context.Context) error
+}
+
+// WaitForJob waits for the job to complete.  If the context is cancelled the
+// job is cancelled server-side rather than left running, and an error
+// wrapping errInterrupted is returned.
+func WaitForJob(ctx context.Context, job queryJob) (*bigquery.JobStatus, error) {
+	status, err := job.Wait(ctx)
+	if err == nil || ctx.Err() == nil {
+		return status, err
+	}
+	cancelCtx, cancel := context.WithTimeout(context.Background(), jobCancelTimeout)
+	defer cancel()
+	if err := job.Cancel(cancelCtx); err != nil {
+		logger.Warn().Err(err).Msg("  Failed to Cancel the Interrupted Query")
+	}
+	return nil, interruptedError(ctx, err)
+}
+
+// ReadQuery runs the query and reads its rows, cancelling its job if the
+// context is cancelled while it runs
+func ReadQuery(ctx context.Context, q *bigquery.Query) (*bigquery.RowIterator, error) {
+	job, err := q.Run(ctx)
+	if err != nil {
+		return nil, interruptedError(ctx, err)
+	}
+	status, err := WaitForJob(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+	it, err := job.Read(ctx)
+	if err != nil {
+		return nil, interruptedError(ctx, err)
+	}
+	return it, nil
+}
+
+// interruptedError wraps the error of a query with errInterrupted once the
+// context is cancelled
+func interruptedError(ctx context.Context, err error) error {
+	if ctx.Err() == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", errInterrupted, err)
+}
+
+// SkippedOnInterrupt logs the verification as skipped if its error is an
+// interruption, returning whether it was
+func SkippedOnInterrupt(name string, err error) bool {
+	if !errors.Is(err, errInterrupted) {
+		return false
+	}
+	logger.Warn().Str("Verification", name).Msg("  Skipped (Interrupted)")
+	return true
+}
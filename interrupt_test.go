@@ -0,0 +1,195 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// fakeQueryJob is a query job which completes with the status and error, or
+// with block set waits until its context is cancelled, recording whether the
+// job was then cancelled
+type fakeQueryJob struct {
+	status    *bigquery.JobStatus
+	err       error
+	block     bool
+	cancelErr error
+	cancelled bool
+}
+
+// Wait implements queryJob
+func (j *fakeQueryJob) Wait(ctx context.Context) (*bigquery.JobStatus, error) {
+	if j.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return j.status, j.err
+}
+
+// Cancel implements queryJob
+func (j *fakeQueryJob) Cancel(ctx context.Context) error {
+	j.cancelled = true
+	return j.cancelErr
+}
+
+func TestWaitForJob(t *testing.T) {
+	errFailed := errors.New("query failed")
+	done := &bigquery.JobStatus{State: bigquery.Done}
+
+	tests := []struct {
+		name        string
+		job         *fakeQueryJob
+		interrupt   bool
+		status      *bigquery.JobStatus
+		err         error
+		interrupted bool
+		cancelled   bool
+	}{
+		{"Completed", &fakeQueryJob{status: done}, false, done, nil, false, false},
+		{"Failed", &fakeQueryJob{err: errFailed}, false, nil, errFailed, false, false},
+		{"Interrupted", &fakeQueryJob{block: true}, true, nil, context.Canceled, true, true},
+		{"Interrupted and the Cancel Failed", &fakeQueryJob{block: true, cancelErr: errFailed}, true, nil, context.Canceled, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.interrupt {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+
+			status, err := WaitForJob(ctx, tt.job)
+			if status != tt.status {
+				t.Errorf("status %v, expected %v", status, tt.status)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("error %v, expected %v", err, tt.err)
+			}
+			if interrupted := errors.Is(err, errInterrupted); interrupted != tt.interrupted {
+				t.Errorf("interrupted %t, expected %t", interrupted, tt.interrupted)
+			}
+			if tt.job.cancelled != tt.cancelled {
+				t.Errorf("job cancelled %t, expected %t", tt.job.cancelled, tt.cancelled)
+			}
+			if skipped := SkippedOnInterrupt("Test", err); skipped != tt.interrupted {
+				t.Errorf("verification skipped %t, expected %t", skipped, tt.interrupted)
+			}
+		})
+	}
+}
+
+func TestExecuteInterruptible(t *testing.T) {
+	config := &BenchmarkConfig{DrainTimeout: time.Minute, InterruptDrain: time.Second}
+	tests := []struct {
+		name        string
+		interrupt   bool
+		runErr      error
+		interrupted bool
+		drain       time.Duration
+	}{
+		{"Completed", false, nil, false, time.Minute},
+		{"Failed", false, errUsage, false, time.Minute},
+		{"Interrupted", true, nil, true, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &fakeQueryJob{block: true}
+			runner := func(ctx context.Context, config *BenchmarkConfig) (*RunSummary, error) {
+				// The streamers are drained within the interrupt drain
+				// timeout once interrupted
+				defer func() {
+					if drain := DrainTimeout(ctx, config); drain != tt.drain {
+						t.Errorf("drain timeout %s, expected %s", drain, tt.drain)
+					}
+				}()
+				if !tt.interrupt {
+					return &RunSummary{RecordsSent: 1}, tt.runErr
+				}
+				process, err := os.FindProcess(os.Getpid())
+				if err == nil {
+					err = process.Signal(os.Interrupt)
+				}
+				if err != nil {
+					t.Skipf("cannot interrupt the test process: %v", err)
+				}
+
+				// The interrupt cancels the query job in flight
+				_, err = WaitForJob(ctx, job)
+				if !errors.Is(err, errInterrupted) {
+					t.Errorf("query returned %v, expected it to be interrupted", err)
+				}
+				return &RunSummary{RecordsSent: 1}, nil
+			}
+
+			summary, err := ExecuteInterruptible(context.Background(), config, runner)
+			if summary == nil || summary.RecordsSent != 1 {
+				t.Errorf("summary %+v, expected the summary of the run", summary)
+			}
+			if interrupted := errors.Is(err, errInterrupted); interrupted != tt.interrupted {
+				t.Errorf("error %v, expected interrupted %t", err, tt.interrupted)
+			}
+			if !tt.interrupted && !errors.Is(err, tt.runErr) {
+				t.Errorf("error %v, expected %v", err, tt.runErr)
+			}
+			if job.cancelled != tt.interrupt {
+				t.Errorf("job cancelled %t, expected %t", job.cancelled, tt.interrupt)
+			}
+		})
+	}
+}
+
+// TestDrainTimeout expects the drain time limit to be the interrupt drain
+// timeout carried by the context once an interrupt has cancelled it, unless
+// the drain timeout is shorter
+func TestDrainTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		drain     time.Duration
+		interrupt time.Duration
+		signal    bool
+		expected  time.Duration
+	}{
+		{"Not Interrupted", time.Minute, time.Second, false, time.Minute},
+		{"Interrupted", time.Minute, time.Second, true, time.Second},
+		{"Interrupted with a Shorter Drain Timeout", time.Second, time.Minute, true, time.Second},
+		{"Interrupted without an Interrupt Drain Timeout", time.Minute, 0, true, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &BenchmarkConfig{DrainTimeout: tt.drain, InterruptDrain: tt.interrupt}
+			ctx, stop := notifySignals(context.WithValue(context.Background(), interruptDrainKey{}, config.InterruptDrain), "Testing the Drain Timeout")
+			defer stop()
+			if tt.signal {
+				process, err := os.FindProcess(os.Getpid())
+				if err == nil {
+					err = process.Signal(os.Interrupt)
+				}
+				if err != nil {
+					t.Skipf("cannot interrupt the test process: %v", err)
+				}
+				<-ctx.Done()
+			}
+			if drain := DrainTimeout(ctx, config); drain != tt.expected {
+				t.Errorf("drain timeout %s, expected %s", drain, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// JSONSchema is the subset of a JSON Schema (draft-07) document needed to
+// describe a BigQuery table.  Properties retain their declared order so the
+// resulting columns match the document.
+type JSONSchema struct {
+	Type        jsonSchemaType     `json:"type"`
+	Format      string             `json:"format"`
+	Description string             `json:"description"`
+	Properties  jsonSchemaProperty `json:"properties"`
+	Items       *JSONSchema        `json:"items"`
+	Required    []string           `json:"required"`
+}
+
+// jsonSchemaType holds the type keyword, which may be a single type or a
+// list of types such as ["string", "null"]
+type jsonSchemaType []string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (t *jsonSchemaType) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = jsonSchemaType{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings: %w", err)
+	}
+	*t = list
+	return nil
+}
+
+// jsonSchemaNamedProperty is a single named property of an object
+type jsonSchemaNamedProperty struct {
+	Name   string
+	Schema *JSONSchema
+}
+
+// jsonSchemaProperty holds the properties of an object in declared order
+type jsonSchemaProperty []jsonSchemaNamedProperty
+
+// UnmarshalJSON implements json.Unmarshaler, preserving the property order
+func (p *jsonSchemaProperty) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return errors.New("properties must be an object")
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		name, _ := token.(string)
+		schema := &JSONSchema{}
+		if err := decoder.Decode(schema); err != nil {
+			return fmt.Errorf("property %q: %w", name, err)
+		}
+		*p = append(*p, jsonSchemaNamedProperty{Name: name, Schema: schema})
+	}
+	return nil
+}
+
+// LoadJSONSchema reads a JSON Schema (draft-07) file
+func LoadJSONSchema(path string) (*JSONSchema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schema JSONSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON Schema %q: %w", path, err)
+	}
+	return &schema, nil
+}
+
+// JSONSchemaToBigQuerySchema converts the properties of a JSON Schema object
+// into a bigquery.Schema, mapping objects to RECORD and arrays to REPEATED.
+func JSONSchemaToBigQuerySchema(schema *JSONSchema) (bigquery.Schema, error) {
+	baseType, _ := schema.baseType()
+	if baseType != "object" {
+		return nil, fmt.Errorf("the root of the JSON Schema must be an object, not %q", baseType)
+	}
+	return jsonSchemaFields(schema)
+}
+
+// jsonSchemaFields converts each property of an object into a field
+func jsonSchemaFields(schema *JSONSchema) (bigquery.Schema, error) {
+	if len(schema.Properties) == 0 {
+		return nil, errors.New("an object must declare at least one property")
+	}
+
+	required := make(map[string]bool, len(schema.Required))
+	for _, name := range schema.Required {
+		required[name] = true
+	}
+
+	fields := make(bigquery.Schema, 0, len(schema.Properties))
+	for _, property := range schema.Properties {
+		field, err := jsonSchemaField(property.Name, property.Schema)
+		if err != nil {
+			return nil, err
+		}
+		field.Required = required[property.Name] && !field.Repeated
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// jsonSchemaField converts a single property into a field
+func jsonSchemaField(name string, schema *JSONSchema) (*bigquery.FieldSchema, error) {
+	field := &bigquery.FieldSchema{Name: name, Description: schema.Description}
+
+	baseType, err := schema.baseType()
+	if err != nil {
+		return nil, fmt.Errorf("property %q: %w", name, err)
+	}
+	if baseType == "array" {
+		if schema.Items == nil {
+			return nil, fmt.Errorf("property %q: an array must declare its items", name)
+		}
+		if itemType, _ := schema.Items.baseType(); itemType == "array" {
+			return nil, fmt.Errorf("property %q: arrays of arrays are not supported by BigQuery", name)
+		}
+		item, err := jsonSchemaField(name, schema.Items)
+		if err != nil {
+			return nil, err
+		}
+		item.Description = field.Description
+		item.Repeated = true
+		return item, nil
+	}
+
+	switch baseType {
+	case "string":
+		switch schema.Format {
+		case "date-time":
+			field.Type = bigquery.TimestampFieldType
+		case "date":
+			field.Type = bigquery.DateFieldType
+		case "time":
+			field.Type = bigquery.TimeFieldType
+		default:
+			field.Type = bigquery.StringFieldType
+		}
+	case "integer":
+		field.Type = bigquery.IntegerFieldType
+	case "number":
+		field.Type = bigquery.FloatFieldType
+	case "boolean":
+		field.Type = bigquery.BooleanFieldType
+	case "object":
+		nested, err := jsonSchemaFields(schema)
+		if err != nil {
+			return nil, fmt.Errorf("property %q: %w", name, err)
+		}
+		field.Type = bigquery.RecordFieldType
+		field.Schema = nested
+	default:
+		return nil, fmt.Errorf("property %q: unsupported type %q", name, baseType)
+	}
+	return field, nil
+}
+
+// baseType returns the single non-null type of the schema
+func (s *JSONSchema) baseType() (string, error) {
+	var types []string
+	for _, t := range s.Type {
+		if t != "null" {
+			types = append(types, t)
+		}
+	}
+	switch len(types) {
+	case 0:
+		if len(s.Properties) > 0 {
+			return "object", nil
+		}
+		return "", errors.New("a type is required")
+	case 1:
+		return types[0], nil
+	}
+	return "", fmt.Errorf("union types %v are not supported", types)
+}
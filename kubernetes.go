@@ -0,0 +1,72 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+
+	"github.com/rs/zerolog"
+)
+
+// Environment variables conventionally set from the Kubernetes Downward API
+const (
+	podNameEnv      = "MY_POD_NAME"
+	podNamespaceEnv = "MY_POD_NAMESPACE"
+	nodeNameEnv     = "MY_NODE_NAME"
+	podIPEnv        = "MY_POD_IP"
+)
+
+// KubernetesInfo identifies the pod a run executes in, from the environment
+// variables set by the Kubernetes Downward API
+type KubernetesInfo struct {
+	PodName      string `json:"pod_name,omitempty"`
+	PodNamespace string `json:"pod_namespace,omitempty"`
+	NodeName     string `json:"node_name,omitempty"`
+	PodIP        string `json:"pod_ip,omitempty"`
+}
+
+// DetectKubernetes returns the pod identity from the Downward API environment
+// variables, nil when none are set
+func DetectKubernetes() *KubernetesInfo {
+	info := &KubernetesInfo{
+		PodName:      os.Getenv(podNameEnv),
+		PodNamespace: os.Getenv(podNamespaceEnv),
+		NodeName:     os.Getenv(nodeNameEnv),
+		PodIP:        os.Getenv(podIPEnv),
+	}
+	if *info == (KubernetesInfo{}) {
+		return nil
+	}
+	return info
+}
+
+// WithKubernetesFields adds the pod identity to every line of the logger
+// context, a nil identity adding nothing
+func WithKubernetesFields(ctx zerolog.Context, info *KubernetesInfo) zerolog.Context {
+	if info == nil {
+		return ctx
+	}
+	for _, field := range []struct{ key, value string }{
+		{"pod", info.PodName},
+		{"namespace", info.PodNamespace},
+		{"node", info.NodeName},
+		{"pod_ip", info.PodIP},
+	} {
+		if field.value != "" {
+			ctx = ctx.Str(field.key, field.value)
+		}
+	}
+	return ctx
+}
@@ -0,0 +1,147 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Shortest interval between landed row counts, bounding the query cost
+const landedMinInterval = 10 * time.Second
+
+// Number of consecutive samples with a growing gap before warning of drops
+const landedGrowingSamples = 3
+
+// LandedSample holds the records sent and rows landed at one interval
+type LandedSample struct {
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	RecordsSent    int64   `json:"records_sent"`
+	RowsLanded     int64   `json:"rows_landed"`
+	Gap            int64   `json:"gap"`
+}
+
+// LandedTracker periodically counts the rows tagged with the run_id in each
+// target table while the run is in progress, so the landed count can be
+// watched converging on the records sent.  A failed count skips the sample
+// rather than affecting the write workload.
+type LandedTracker struct {
+	client   *bigquery.Client
+	targets  []*StreamTarget
+	runID    string
+	interval time.Duration
+	sent     atomic.Int64
+
+	mu       sync.Mutex
+	samples  []LandedSample
+	skipped  int
+	growing  int
+	warned   bool
+	cancel   context.CancelFunc
+	finished chan struct{}
+}
+
+// NewLandedTracker creates a tracker counting the landed rows every
+// interval, which is raised to the minimum interval if shorter
+func NewLandedTracker(client *bigquery.Client, targets []*StreamTarget, runID string, interval time.Duration) *LandedTracker {
+	if interval < landedMinInterval {
+		interval = landedMinInterval
+	}
+	return &LandedTracker{client: client, targets: targets, runID: runID, interval: interval}
+}
+
+// AddSent accumulates the records sent, a nil tracker ignores them
+func (t *LandedTracker) AddSent(n int) {
+	if t == nil {
+		return
+	}
+	t.sent.Add(int64(n))
+}
+
+// Start begins counting the landed rows in the background
+func (t *LandedTracker) Start(ctx context.Context) {
+	ctx, t.cancel = context.WithCancel(ctx)
+	t.finished = make(chan struct{})
+	go func() {
+		defer close(t.finished)
+		startTime := time.Now()
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				t.sample(ctx, time.Since(startTime))
+			}
+		}
+	}()
+}
+
+// Stop ends the counting and returns the samples taken
+func (t *LandedTracker) Stop() []LandedSample {
+	t.cancel()
+	<-t.finished
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.skipped > 0 {
+		logger.Info().Int("Samples", len(t.samples)).Int("Skipped", t.skipped).Msg("Landed Row Tracking")
+	}
+	return t.samples
+}
+
+// sample counts the landed rows across the targets, bounding the query by
+// the interval so a slow count never overlaps the next
+func (t *LandedTracker) sample(ctx context.Context, elapsed time.Duration) {
+	sent := t.sent.Load()
+	ctx, cancel := context.WithTimeout(ctx, t.interval)
+	defer cancel()
+
+	var landed int64
+	for _, target := range t.targets {
+		rows, err := CountRunRows(ctx, t.client, target.DatasetID, target.TableID, t.runID)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Debug().Err(err).Msg("  Skipping Landed Row Sample")
+			}
+			t.mu.Lock()
+			t.skipped++
+			t.mu.Unlock()
+			return
+		}
+		landed += rows
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sample := LandedSample{ElapsedSeconds: elapsed.Seconds(), RecordsSent: sent, RowsLanded: landed, Gap: sent - landed}
+	if n := len(t.samples); sample.Gap > 0 && n > 0 && sample.Gap > t.samples[n-1].Gap {
+		t.growing++
+	} else {
+		t.growing = 0
+	}
+	t.samples = append(t.samples, sample)
+	logger.Info().Int64("Records Sent", sample.RecordsSent).Int64("Rows Landed", sample.RowsLanded).Int64("Gap", sample.Gap).Msg("Landed Rows")
+
+	// Warn once when the gap persists and keeps growing
+	if t.growing >= landedGrowingSamples && !t.warned {
+		t.warned = true
+		WarnPossibleDrops(sample.RecordsSent, sample.RowsLanded)
+	}
+}
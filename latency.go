@@ -0,0 +1,144 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Maximum number of latency samples retained, beyond which reservoir
+// sampling keeps memory bounded for runs of up to 100M records
+const maxLatencySamples = 1000000
+
+// LatencyRecorder collects Write latencies for either every write or a
+// deterministic 1 in N sample of them.
+type LatencyRecorder struct {
+	sampleEvery int
+	samples     []time.Duration
+	observed    int
+	max         time.Duration
+	random      *rand.Rand
+	sorted      bool
+}
+
+// NewLatencyRecorder creates a recorder timing 1 in every sampleEvery writes
+func NewLatencyRecorder(sampleEvery int) *LatencyRecorder {
+	if sampleEvery < 1 {
+		sampleEvery = 1
+	}
+	return &LatencyRecorder{
+		sampleEvery: sampleEvery,
+		random:      rand.New(rand.NewSource(1)),
+	}
+}
+
+// Sampled reports whether the write of the given row index should be timed.
+// The row index is hashed so the selection is deterministic but does not
+// alias with the batch boundaries.
+func (l *LatencyRecorder) Sampled(index int) bool {
+	if l.sampleEvery == 1 {
+		return true
+	}
+	return splitMix64(uint64(index))%uint64(l.sampleEvery) == 0
+}
+
+// Record adds a single latency observation
+func (l *LatencyRecorder) Record(d time.Duration) {
+	l.observed++
+	l.sorted = false
+	if d > l.max {
+		l.max = d
+	}
+	if len(l.samples) < maxLatencySamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	if i := l.random.Intn(l.observed); i < maxLatencySamples {
+		l.samples[i] = d
+	}
+}
+
+// Count returns the number of latency observations recorded
+func (l *LatencyRecorder) Count() int {
+	return l.observed
+}
+
+// SampleEvery returns the sampling rate, where 1 means every write is timed
+func (l *LatencyRecorder) SampleEvery() int {
+	return l.sampleEvery
+}
+
+// Max returns the maximum latency observed
+func (l *LatencyRecorder) Max() time.Duration {
+	return l.max
+}
+
+// Percentile returns the latency at the given percentile, between 0 and 100
+func (l *LatencyRecorder) Percentile(p float64) time.Duration {
+	if len(l.samples) == 0 {
+		return 0
+	}
+	if !l.sorted {
+		sort.Slice(l.samples, func(i, j int) bool { return l.samples[i] < l.samples[j] })
+		l.sorted = true
+	}
+	rank := int(math.Ceil(p/100*float64(len(l.samples)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(l.samples) {
+		rank = len(l.samples) - 1
+	}
+	return l.samples[rank]
+}
+
+// ConfidenceInterval returns the approximate 95% confidence bounds of the
+// given percentile, based on the number of samples retained.
+func (l *LatencyRecorder) ConfidenceInterval(p float64) (time.Duration, time.Duration) {
+	n := float64(len(l.samples))
+	if n == 0 {
+		return 0, 0
+	}
+	q := p / 100
+	delta := 1.96 * math.Sqrt(q*(1-q)/n) * 100
+	return l.Percentile(math.Max(p-delta, 0)), l.Percentile(math.Min(p+delta, 100))
+}
+
+// Log outputs the latency percentiles, annotated with the sampling rate.  As
+// Write only enqueues the record in the streamer, the latency is that of the
+// enqueue, which grows when the workers apply back-pressure.
+func (l *LatencyRecorder) Log() {
+	logger.Info().Int("Sample Every", l.sampleEvery).Int("Samples", l.observed).Msg("Write Enqueue Latency")
+	for _, p := range []float64{50, 90, 99} {
+		low, high := l.ConfidenceInterval(p)
+		event := logger.Info().Dur("Latency", l.Percentile(p))
+		if l.sampleEvery > 1 {
+			event.Dur("95% CI Low", low).Dur("95% CI High", high)
+		}
+		event.Msgf("  p%.0f", p)
+	}
+	logger.Info().Dur("Latency", l.max).Msg("  max")
+}
+
+// splitMix64 is a fast, well distributed 64-bit hash
+func splitMix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
@@ -16,18 +16,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/OTA-Insight/bqwriter"
 	"github.com/rs/zerolog"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
 )
 
 var logger zerolog.Logger
@@ -35,6 +41,20 @@ var applicationText = "%s 0.2.4%s"
 var copyrightText = "Copyright 2021-2023, Matthew Winter\n"
 var indent = "..."
 
+// Exit status returned when the streamer failed to drain within the timeout
+const exitDrainTimeout = 3
+
+// Exit status returned when the run deviated from the baseline with
+// -baseline-fail
+const exitBaselineDeviation = 4
+
+// tableWait is the longest time the metadata of a table just created or
+// deleted is polled for, for the eventual consistency issue
+var tableWait = 3 * time.Minute
+
+// errDrainTimeout is returned when streamer.Close did not complete in time
+var errDrainTimeout = errors.New("timed out waiting for the streamer to drain")
+
 var helpText = `
 A command line application designed to provide a method to test the BigQuery
 Streaming API or BigQuery Storage Write API, allowing you to get a view of
@@ -45,11 +65,42 @@ Use --help for more details.
 
 USAGE:
     bqwrite-test -p PROJECT_ID -d DATASET -t TABLENAME -w WORKERS
+    bqwrite-test selftest [-fault-scenario SCENARIO]
 
 ARGS:
 `
 
+// subcommands are run in place of a benchmark run when named by the first
+// argument, each returning its exit code
+var subcommands = map[string]func(args []string) int{
+	"selftest":      RunSelfTest,
+	"bless":         RunBless,
+	"profile-table": RunProfileTable,
+}
+
 func main() {
+	os.Exit(runMain(os.Args[1:]))
+}
+
+// runMain executes the subcommand named by the first argument, or otherwise the
+// benchmark configured by the flags, returning the exit code
+func runMain(args []string) int {
+	if len(args) > 0 {
+		if subcommand, ok := subcommands[args[0]]; ok {
+			logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}).With().Timestamp().Logger()
+			return subcommand(args[1:])
+		}
+	}
+	if err := runBenchmark(); err != nil {
+		PrintError(err)
+		return ExitCode(err)
+	}
+	return 0
+}
+
+// runBenchmark executes the benchmark configured by the flags, returning
+// the error ending the run, if any
+func runBenchmark() (runErr error) {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, applicationText, filepath.Base(os.Args[0]), "\n")
 		fmt.Fprint(os.Stderr, copyrightText)
@@ -59,182 +110,2228 @@ func main() {
 
 	// Define the Long CLI flag names
 	var targetProject = flag.String("p", "", "Google Cloud Project ID  (Required)")
-	var targetDataset = flag.String("d", "", "BigQuery Dataset  (Required)")
+	var targetDataset = flag.String("d", "", "BigQuery Dataset, or Comma Separated Datasets to Round-Robin  (Required)")
 	var targetTable = flag.String("t", "bqwrite_test", "BigQuery Table")
 	var numberWorkers = flag.Int("w", 5, "Number of Parallel Workers, 1 to 100")
 	var numberIterations = flag.Int("i", 100, "Number of Records, 1 to 100000000")
 	var batchSize = flag.Int("b", 1, "Batch Size, 1 to 50000")
+	var rowBytes = flag.Int("row-bytes", 0, "Pad Each Generated Record to Approximately this Serialized Size in Bytes, 0 for no Padding")
+	var numberGenerators = flag.Int("g", 1, "Number of Parallel Generator Goroutines, 1 to 64")
+	var tableCount = flag.Int("table-count", 1, "Number of Tables to Fan Out Across, 1 to 100")
+	var dualWrite = flag.Bool("dual-write", false, "Write Every Record to both -old-table and -new-table, Verifying Neither Misses a Record")
+	var oldTable = flag.String("old-table", "", "Table Before a Schema Migration, Written by -dual-write")
+	var newTable = flag.String("new-table", "", "Table After a Schema Migration, Written by -dual-write")
+	var batchSizes = flag.String("batch-sizes", "", "Comma Separated Batch Sizes, One per Table")
+	var batchRampStart = flag.Int("batch-ramp-start", 0, "Batch Size to Start a Batch Size Ramp at, Doubling Toward -batch-ramp-end")
+	var batchRampEnd = flag.Int("batch-ramp-end", 0, "Batch Size a Batch Size Ramp Ends at")
+	var batchRampInterval = flag.Int("batch-ramp-interval", 10000, "Records Sent Between each Doubling of the Batch Size Ramp")
 	var overwriteTable = flag.Bool("o", false, "Overwrite BigQuery Table")
+	var propagationWindow = flag.Duration("propagation-window", 5*time.Minute, "Window After Creating a Table in which notFound is Retried by a Probe Record, 0 disables")
+	var tableWaitFlag = flag.Duration("table-wait", 3*time.Minute, "Maximum Time to Poll the Metadata of a Table Just Created or Deleted, 0 disables")
+	var clampParallelism = flag.Bool("clamp-parallelism", false, "Reduce the Workers to Fit Comfortably within the File Descriptor Limit")
+	var maxRequestBytes = flag.Int("max-request-bytes", defaultMaxRequestBytes, "Maximum Size of an insertAll Request, Splitting Larger Batches, 0 to Disable")
+	var drainTimeout = flag.Duration("drain-timeout", 5*time.Minute, "Maximum Time to Wait for the Streamer to Drain on Close")
+	var interruptDrain = flag.Duration("interrupt-drain-timeout", 30*time.Second, "Maximum Time to Wait for the Streamer to Drain Once Interrupted, Bounded by -drain-timeout")
+	var costCompareRegions = flag.String("cost-compare-regions", "", "Comma Separated Regions to Compare Estimated Streaming Cost")
+	var costRegion = flag.String("cost-region", "US", "Region Used for the Estimated Cost Breakdown")
+	var monthlyRecords = flag.Int("monthly-records", 0, "Number of Records per Month Used to Extrapolate the Cost Breakdown")
+	var pricingOverrides = flag.String("pricing-overrides", "", "JSON File of Region to USD per GiB Streaming Prices")
+	var namesFile = flag.String("names-file", "", "File of Names, One per Line, Used by the Generators in place of the Built-In Names, also Set by BQWRITE_TEST_NAMES_FILE")
+	var createAlert = flag.Bool("create-alert", false, "Create a Cloud Monitoring Alert Policy on the Records per Second Dropping Below -alert-threshold-rps, and Exit")
+	var alertThresholdRPS = flag.Float64("alert-threshold-rps", 0, "Records per Second the Alert Policy of -create-alert Fires Below for 5 Minutes")
+	var printSchema = flag.Bool("print-schema", false, "Print the Table Schema as BigQuery JSON, Usable with bq mk --schema, and Exit")
+	var dataProfile = flag.String("data-profile", "", "JSON Data Profile Written by profile-table, Generating Values Matching the Statistics of its Columns")
+	var generatorName = flag.String("generator", defaultGeneratorName, "Data Generator of the Built-In Table Schema, one of "+strings.Join(GeneratorNames(), ", "))
+	var safe = flag.Bool("safe", false, "Refuse to Write to Tables Without the bqwrite-test=true Label Set at Creation, also Enabled by BQWRITE_TEST_SAFE")
+	var force = flag.Bool("force", false, "Write to a Table Without the bqwrite-test=true Label Despite Safe Mode")
+	var ndjsonSink = flag.String("ndjson-sink", "", "Write the Generated Records to this Local NDJSON File in place of BigQuery, and Exit")
+	var generateServe = flag.String(generateServeFlag, "", "Serve the Generated Records as NDJSON on Standard Output, -, or a Unix Socket, unix:PATH, and Exit")
+	var generateProcess = flag.Bool(generateProcessFlag, false, "Generate the Records in a Separate Process Forked with -generate-serve, Reporting the CPU Time of Each")
+	var inputRows = flag.String("input", "", "NDJSON Rows to Stream in place of the Generated Records, from a File, Standard Input, -, or a Unix Socket, unix:PATH, or a .parquet or .avro File, Local or gs://")
+	var jsonSchemaFile = flag.String("json-schema", "", "JSON Schema (draft-07) File Defining the Table Schema")
+	var schemaFile = flag.String("schema", "", "BigQuery JSON Schema File, as Emitted by bq show --schema, Defining the Table Schema")
+	var translateDialect = flag.String("translate-schema", "", "Translate the -translate-ddl File from this Dialect, one of hive, redshift, snowflake, spark or teradata")
+	var translateDDL = flag.String("translate-ddl", "", "File Containing the CREATE TABLE Statement to Translate")
+	var translateGCS = flag.String("translate-gcs", "", "Cloud Storage Location, gs://bucket/prefix, Used to Stage the Translation")
+	var analyticsHubListing = flag.String("analytics-hub-listing", "", "Subscribe to the Analytics Hub Listing, projects/P/locations/L/dataExchanges/E/listings/L, and Stream to its Shared Dataset")
+	var fastJSONEncoding = flag.Bool("fast-json", false, "Serialize Records to JSON with the Hand-Written Encoder")
+	var estimateSlots = flag.Bool("estimate-slots", false, "Estimate the Slots Processing the Streaming Buffer by Polling its Size")
+	var trackLanded = flag.Bool("track-landed", false, "Periodically Count the Rows Landed During the Run")
+	var quotaMeasure = flag.Bool("quota-measure", false, "Log the Quota Remaining, or the Estimated Quota Utilization, Every 1000 Records and at the End of the Run")
+	var quotaRowsPerSecond = flag.Int("quota-rows-per-second", defaultQuotaRowsPerSecond, "Rows per Second Limit the Estimated Quota Utilization of -quota-measure is Measured Against")
+	var metadataPollInterval = flag.Duration("metadata-poll-interval", 0, "Interval Between Polls of the Table Metadata During Streaming, Logging the Rows Committed and the Buffer Lag, 0 disables")
+	var ackTokens = flag.Bool("ack-tokens", false, "Acknowledge Every Row by a Token Column, Querying the High-Water Mark of Visible Rows During the Run")
+	var ackInterval = flag.Duration("ack-interval", 30*time.Second, "Interval Between Queries of the Visible Acknowledgment Tokens, at least 10s")
+	var ackWindow = flag.Int64("ack-window", 100000, "Tokens Beyond the High-Water Mark Confirmed by each Acknowledgment Query")
+	var landedInterval = flag.Duration("landed-interval", 60*time.Second, "Interval Between Counts of the Rows Landed, at least 10s")
+	var cloudRunJob = flag.String("cloud-run-job", "", "Existing Cloud Run Job, Running this Binary, Used to Execute the Run Across -cloud-run-tasks Tasks")
+	var cloudRunTasks = flag.Int("cloud-run-tasks", 1, "Number of Cloud Run Job Tasks Sharing the Records")
+	var cloudRunRegion = flag.String("cloud-run-region", "us-central1", "Region of the Cloud Run Job")
+	var cloudRunResults = flag.String("cloud-run-results", "", "Cloud Storage Location, gs://bucket/prefix, the Cloud Run Job Tasks Write their Results to")
+	var uuidOffset = flag.Int("uuid-offset", 0, "Number of Records Offsetting the uuid of Each Record Generated")
+	var coordinateTable = flag.String("coordinate", "", "Coordination Table, DATASET.TABLE or TABLE, Used to Start the Runs of Several Hosts Together")
+	var coordinateSession = flag.String("coordinate-session", "", "Name of the Coordination Session Shared by the Participating Hosts")
+	var coordinateParticipants = flag.Int("coordinate-participants", 0, "Number of Participants to Register Before Starting, 0 to Wait for -coordinate-start")
+	var coordinateStart = flag.String("coordinate-start", "", "RFC 3339 Time at which the Coordinated Run Starts Regardless of Registrations")
+	var coordinateTimeout = flag.Duration("coordinate-timeout", 10*time.Minute, "Maximum Time to Wait for Participants to Register and Report their Results")
+	var workerStatsFlag = flag.Bool("worker-stats", false, "Count the Records and Requests Sent by Each Streamer Worker")
+	var fairnessTest = flag.Bool("fairness-test", false, "Measure the Coefficient of Variation of the Records Sent by Each Worker, implies -worker-stats")
+	var healthMonitorInterval = flag.Duration("health-monitor-interval", 0, "Interval Between Health Checks, Alerting when the Records per Second Drop Below Half the Peak, 0 disables")
+	var recordFile = flag.String("record", "", "NDJSON File to Record Each Row Sent with its Send Time, for Replay")
+	var replayFile = flag.String("replay", "", "NDJSON Workload File Recorded with -record to Replay in place of the Generated Records")
+	var replayTiming = flag.String("replay-timing", replayTimingAsFast, "Timing of -replay, one of asfast, original or scaled:N to Replay N Times as Fast")
+	var sizeHistogram = flag.Bool("size-histogram", false, "Log a Histogram of the Serialized Size of the Records After the Run")
+	var timingBreakdown = flag.Bool("timing-breakdown", false, "Average the Time Each Record Spends in Queue Wait, Serialization and the Network")
+	var heartbeatInterval = flag.Duration("heartbeat", 0, "Interval Between Heartbeat Lines, Escalating to Debug Detail While a Threshold is Crossed, 0 disables")
+	var heartbeatErrorRate = flag.Float64("heartbeat-error-rate", 0.05, "Fraction of Failed Requests in a Heartbeat Interval which Escalates the Heartbeat")
+	var heartbeatP99 = flag.Duration("heartbeat-p99", time.Second, "p99 Request Latency in a Heartbeat Interval which Escalates the Heartbeat")
+	var heartbeatGap = flag.Int64("heartbeat-gap", 10000, "Gap Between the Records Sent and Acknowledged which Escalates the Heartbeat")
+	var sweepWorkers = flag.Bool("sweep-workers", false, "Run the Benchmark for 1, 2, 4, 8, 16 and 32 Workers, up to -w")
+	var sweepBatch = flag.Bool("sweep-batch", false, "Run the Benchmark for Batch Sizes Doubling from 1 up to -b")
+	var scaleTables = flag.String("scale-tables", "", "Comma Separated Table Counts, such as 1,2,4,8,16, to Run the Benchmark for, Measuring the Throughput Scaling")
+	var sweepPrevious = flag.String("sweep-previous", "", "Previous -output Results File whose Recent, Stable Sweep Steps are Reused in place of Re-Running them")
+	var sweepFreshness = flag.Duration("sweep-freshness", 7*24*time.Hour, "Age within which a Sweep Step of -sweep-previous is Reused")
+	var sweepFull = flag.Bool("full", false, "Run Every Step of the Sweep, Ignoring -sweep-previous")
+	var soakDuration = flag.Duration("soak", 0, "Alternate Between insertAll and a Committed Stream for this Duration, Comparing the APIs")
+	var soakSlice = flag.Duration("soak-slice", 5*time.Minute, "Duration of Each Slice of an Alternating Soak")
+	var soakWarmup = flag.Duration("soak-warmup", 30*time.Second, "Warm-Up Excluded from the Metrics of Each Soak Slice")
+	var preconnect = flag.Int("preconnect", 0, "Number of Idle Connections to Open to BigQuery Before Streaming Starts, 0 disables")
+	var compare = flag.Bool("compare", false, "Run the insertAll API then the Storage Write API, each into its own Table, Comparing the APIs")
+	var autoReconnect = flag.Bool("auto-reconnect", false, "Re-Create a Committed Stream After a Network Failure, Resuming from the Last Acknowledged Offset")
+	var writeMode = flag.String("m", modeInsertAll, "Write Mode, insertall for the Legacy Streaming API, storage for the Storage Write API or batch for Load Jobs")
+	var committedStream = flag.Bool("committed-stream", false, "Stream via a Committed Stream of the Storage Write API, Tracking Offsets")
+	var outputFile = flag.String("output", "", "File to Write the Run Results as JSON")
+	var resultsFile = flag.String("results", "", "File to Write a Summary of the Run Results, Written even if the Run Ends Early")
+	var resultsFormat = flag.String("results-format", resultsFormatJSON, "Format of the -results File, json or csv, a csv File Gaining a Row per Run")
+	var baselineFile = flag.String("baseline", "", "Baseline Written by bless, a File or gs://bucket/object, to Compare the Run Against")
+	var baselineFail = flag.Bool("baseline-fail", false, "Fail the Run when it Deviates from the -baseline, Rather than Warning")
+	var scenarioFile = flag.String("scenario", "", "YAML Scenario File Describing the Phases to Execute")
+	var preloadRows = flag.Int("preload-rows", 0, "Number of Records to Preload via a Load Job, 0 to 100000000")
+	var drill = flag.String("drill", "", "Execute a Schema Mismatch Drill, one of missing-required, wrong-type, extra-field, wrong-field-number or all")
+	var insertIDs = flag.Bool("insert-ids", false, "Generate Deterministic Insert IDs for Best-Effort Deduplication")
+	var dedupe = flag.Bool("dedupe", false, "Alias of -insert-ids")
+	var measureDedupRate = flag.Bool("measure-dedup-rate", false, "Send Each Record Twice and Measure the Deduplication Rate, requires -insert-ids")
+	var dupPercent = flag.Float64("dup-percent", 0, "Percentage of Records Sent a Second Time, 0 to 100, Reported Against the Distinct Rows Found by -verify")
+	var biEngineTest = flag.Bool("bi-engine-test", false, "Test BI Engine Acceleration of an Aggregate Query After the Run")
+	var verifyACL = flag.Bool("verify-acl", false, "Verify the Current Identity Can Write to the Table Before Streaming")
+	var updateDatasetMetadata = flag.Bool("update-dataset-metadata", false, "Update the Description of each Dataset Before Streaming, Verifying the bigquery.datasets.update Permission")
+	runTags := RunTags{}
+	flag.Var(runTags, "tag", "Tag the Run with a key=value Pair Attached to its Results, may be Repeated")
+	var tagColumns = flag.Bool("tag-columns", false, "Also Write each -tag as a STRING Column of Every Generated Row")
+	var partitionField = flag.String("partition-field", "", "Partition the Tables Created on this DATE, TIMESTAMP or DATETIME Column, by day unless -partition-type is Given")
+	var partitionType = flag.String("partition-type", "", "Partition the Tables Created by hour, day, month or year, on the Ingestion Time unless -partition-field is Given")
+	var clusterFields = flag.String("cluster", "", "Comma Separated Columns, at most 4, to Cluster the Tables Created on")
+	var expire = flag.Duration("expire", 0, "Expire the Tables Created after this Duration, at least 1m, 0 never expires")
+	var cleanupTables = flag.Bool("cleanup", false, "Delete the Tables Created by the Run Once it Ends, Retaining Tables which Existed Before")
+	var partition = flag.String("partition", "", "Partition the Tables Created on create_time, one of hour, day, month or year, Verifying the Rows per Partition")
+	var timeSpread = flag.Duration("time-spread", 0, "Spread the create_time of the Records Evenly Back Over this Duration, requires -partition")
+	var eventLag = flag.Duration("event-lag", 0, "Lag of the create_time of the Records Behind the Start of the Run, Negative for Early Data, requires -partition")
+	var timeZone = flag.String("time-zone", "UTC", "Time Zone of a DATETIME create_time, requires -partition")
+	var targetPartition = flag.String("target-partition", "", "Write Every Record to this Partition, such as 2024-01-15 for day Partitioning, requires -partition")
+	var partitionTolerance = flag.Float64("partition-tolerance", 0, "Fraction of the Expected Rows per Partition a Partition may Differ by, 0 to 1")
+	var storageStats = flag.Bool("storage-stats", false, "Query INFORMATION_SCHEMA.TABLE_STORAGE After the Run")
+	var nestedStats = flag.Bool("nested-stats", false, "Query the 10 Most Frequent Element Values of Each REPEATED Field After the Run")
+	var verifyRows = flag.Bool("verify", false, "Count the Rows Tagged with the run_id After the Run, Failing if Fewer than the Records Sent Landed")
+	var verifyWindow = flag.Duration("verify-window", 60*time.Second, "Window the -verify Row Count is Retried over while the Rows Become Visible")
+	var verifySample = flag.Int("verify-sample", 0, "Read N Rows through the Storage Read API After the Run, Verifying each Name was Written")
+	var latency = flag.Bool("latency", false, "Time Every Write, Reporting the p50, p90, p99 and max Enqueue Latency")
+	var latencySample = flag.Int("latency-sample", 0, "Time 1 in N Writes for Latency Percentiles, 0 disables unless -perf")
+	var perfMode = flag.Bool("perf", false, "Maximise Throughput, Sampling 1 in 100 Writes for Latency by Default")
+	var logTimezone = flag.String("log-timezone", "", "Time Zone for Log Timestamps, such as America/New_York")
+	var requestLogFile = flag.String("request-log", "", "NDJSON File to Record the Details of Every API Request, for Offline Analysis")
+	var requestLogMaxSize = flag.Int("request-log-max-size", 100, "Size in MiB at which the -request-log File is Rotated")
+	var captureAllRequestIDs = flag.String("capture-all-request-ids", "", "File to Record the ID of Every Request Observed, for Support Investigations")
+	var errorReport = flag.Bool("error-report", false, "Aggregate the Errors of the Run by Type and Field, Reporting them After the Run")
+	var errorHandler = flag.String("error-handler", errorHandlerAbort, "Action for Each Record Error, one of abort, skip, retry or log-only")
+	var retries = flag.Int("retries", 3, "Number of Times the retry Error Handler Writes a Failed Record Again")
+	var maxCost = flag.Float64("max-cost", 0, "Maximum Estimated Cost of the Run in USD, 0 for no limit")
+	var pricePerGiB = flag.Float64("price-per-gib", 0, "Price in USD per GiB Written Used by -max-cost, 0 for the list price")
+	var maxCostOverride = flag.Bool("max-cost-override", false, "Start the Run Even if the Planned Workload Exceeds -max-cost")
+	var targetRate = flag.Float64("rate", 0, "Target Records per Second, Paced by a Token Bucket, 0 for Unlimited")
+	var expectedRate = flag.Float64("expected-rate", 0, "Expected Records per Second, Used to Lint the Configuration Before the Run")
+	var strictLint = flag.Bool("strict", false, "Treat Configuration Lint Warnings as Errors")
 	var verbose = flag.Bool("v", false, "Output Verbose Detail")
 
 	// Parse the flags
 	flag.Parse()
 
 	// Validate the Required Flags
-	if *targetDataset == "" {
-		flag.Usage()
-		os.Exit(1)
+	datasets := SplitList(*targetDataset)
+	if len(datasets) == 0 && !*printSchema && *analyticsHubListing == "" && *ndjsonSink == "" && *generateServe == "" && !*createAlert {
+		return InitError(errUsage)
+	}
+
+	// -dedupe Enables the Deterministic Insert IDs of -insert-ids
+	if *dedupe {
+		*insertIDs = true
+	}
+
+	// Verify the Alert Policy has a Project and a Threshold to Fire Below
+	if *createAlert && (*targetProject == "" || *alertThresholdRPS <= 0) {
+		return InitError(errors.New("-create-alert requires -p and an -alert-threshold-rps greater than 0"))
+	} else if !*createAlert && isFlagSet("alert-threshold-rps") {
+		return InitError(errors.New("-alert-threshold-rps requires -create-alert"))
 	}
 
 	// Verify Number of Parallel Workers is between 1 and 100
 	if *numberWorkers < 1 || *numberWorkers > 100 {
-		flag.Usage()
-		os.Exit(1)
+		return InitError(errUsage)
 	}
 
 	// Verify Number of Iterations is between 1 and 100000000
 	if *numberIterations < 1 || *numberIterations > 100000000 {
-		flag.Usage()
-		os.Exit(1)
+		return InitError(errUsage)
 	}
 
 	// Verify Batch Size is between 1 and 50000
 	if *batchSize < 1 || *batchSize > 50000 {
-		flag.Usage()
-		os.Exit(1)
+		return InitError(errUsage)
 	}
 
-	// Setup Zero Log for Consolo Output
-	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
-	logger = zerolog.New(output).With().Timestamp().Logger()
-	if *verbose {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	// Verify no Flags in Use Conflict, Before any are Adjusted by Another
+	err := CheckFlagConflicts(flagConflicts, map[string]bool{
+		"-scale-tables":           *scaleTables != "",
+		"-sweep-workers":          *sweepWorkers,
+		"-sweep-batch":            *sweepBatch,
+		conflictSweeps:            *sweepWorkers || *sweepBatch || *scaleTables != "",
+		"-table-count":            *tableCount > 1,
+		"-batch-sizes":            *batchSizes != "",
+		conflictMultipleDatasets:  len(datasets) > 1,
+		"-cloud-run-job":          *cloudRunJob != "",
+		"-soak":                   *soakDuration > 0,
+		"-coordinate":             *coordinateTable != "",
+		"-generate-process":       *generateProcess,
+		"-generate-serve":         *generateServe != "",
+		"-input":                  *inputRows != "",
+		"-record":                 *recordFile != "",
+		"-replay":                 *replayFile != "",
+		"-dual-write":             *dualWrite,
+		"-compare":                *compare,
+		"-m":                      *writeMode != modeInsertAll,
+		conflictStorageMode:       *writeMode == modeStorage,
+		conflictBatchMode:         *writeMode == modeBatch,
+		"-committed-stream":       *committedStream,
+		"-scenario":               *scenarioFile != "",
+		"-batch-ramp-start":       *batchRampStart != 0 || *batchRampEnd != 0,
+		"-preconnect":             *preconnect > 0,
+		"-partition":              *partition != "",
+		"-partition-field":        *partitionField != "",
+		"-partition-type":         *partitionType != "",
+		"-target-partition":       *targetPartition != "",
+		"-time-spread":            *timeSpread != 0,
+		"-event-lag":              *eventLag != 0,
+		"-ack-tokens":             *ackTokens,
+		"-baseline":               *baselineFile != "",
+		"-insert-ids":             *insertIDs,
+		"-measure-dedup-rate":     *measureDedupRate,
+		"-dup-percent":            *dupPercent > 0,
+		"-worker-stats":           *workerStatsFlag,
+		"-fairness-test":          *fairnessTest,
+		"-timing-breakdown":       *timingBreakdown,
+		"-size-histogram":         *sizeHistogram,
+		"-request-log":            *requestLogFile != "",
+		"-heartbeat":              *heartbeatInterval > 0,
+		"-estimate-slots":         *estimateSlots,
+		"-quota-measure":          *quotaMeasure,
+		"-metadata-poll-interval": *metadataPollInterval != 0,
+		"-g":                      *numberGenerators > 1,
+		"-rate":                   *targetRate > 0,
+		"-verify":                 *verifyRows,
+		"-track-landed":           *trackLanded,
+		"-generator":              *generatorName != defaultGeneratorName,
+		conflictMinimalGenerator:  *generatorName == "minimal",
+		"-data-profile":           *dataProfile != "",
+		"-schema":                 *schemaFile != "",
+		"-json-schema":            *jsonSchemaFile != "",
+		"-translate-schema":       *translateDialect != "",
+		"-row-bytes":              *rowBytes > 0,
+		"-cleanup":                *cleanupTables,
+	})
+	if err != nil {
+		return InitError(err)
+	}
+
+	// A Table Count Sweep Creates the Tables of its Largest Count
+	var scaleTableCounts []int
+	if *scaleTables != "" {
+		counts, err := ParseScaleTables(*scaleTables)
+		if err != nil {
+			return InitError(err)
+		}
+		scaleTableCounts = counts
+		*tableCount = counts[len(counts)-1]
+	}
+	sweepTables := len(scaleTableCounts) > 0
+
+	// A Cloud Run Job Executes the Run Across its Tasks, while each Task
+	// Writes its Shard of the Records, Offsetting their uuids
+	cloudRunTask := DetectCloudRunTask()
+	if *uuidOffset < 0 {
+		return InitError(errors.New("-uuid-offset must not be negative"))
+	}
+	if *cloudRunJob != "" || *cloudRunResults != "" {
+		if _, _, err := ParseStorageLocation(*cloudRunResults); err != nil {
+			return InitError(err)
+		}
+	}
+	if *cloudRunJob != "" {
+		if *cloudRunTasks < 1 || *cloudRunTasks > *numberIterations {
+			return InitError(errors.New("-cloud-run-tasks must be between 1 and the number of records"))
+		}
+	} else if *cloudRunResults != "" {
+		if cloudRunTask == nil {
+			return InitError(errors.New("-cloud-run-results requires -cloud-run-job, or running as a task of a Cloud Run Job"))
+		}
+		var offset int
+		*numberIterations, offset = cloudRunTask.Shard(*numberIterations)
+		*uuidOffset += offset
 	} else {
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+		cloudRunTask = nil
 	}
 
-	// Output Header
-	logger.Info().Msgf(applicationText, filepath.Base(os.Args[0]), "")
-	logger.Info().Msg("Arguments")
-	logger.Info().Str("Project ID", *targetProject).Msg(indent)
-	logger.Info().Str("Dataset", *targetDataset).Msg(indent)
-	logger.Info().Str("Table", *targetTable).Msg(indent)
-	logger.Info().Int("Number Workers", *numberWorkers).Msg(indent)
-	logger.Info().Int("Number Records", *numberIterations).Msg(indent)
-	logger.Info().Int("Batch Size", *batchSize).Msg(indent)
-	logger.Info().Msg("Begin")
+	// The Results are Delivered to each Sink Independently, a Failed Sink
+	// Never Failing the Run
+	var resultsSinks []ResultsSink
+	if *outputFile != "" {
+		resultsSinks = append(resultsSinks, FileResultsSink(*outputFile))
+	}
+	switch {
+	case *resultsFormat != resultsFormatJSON && *resultsFormat != resultsFormatCSV:
+		return InitError(errors.New("-results-format must be json or csv"))
+	case *resultsFile == "":
+	case *resultsFormat == resultsFormatCSV:
+		resultsSinks = append(resultsSinks, CSVResultsSink(*resultsFile))
+	default:
+		resultsSinks = append(resultsSinks, FileResultsSink(*resultsFile))
+	}
+	if cloudRunTask != nil {
+		resultsSinks = append(resultsSinks, CloudRunResultsSink(*cloudRunResults, cloudRunTask))
+	}
+	dispatcher := NewResultsDispatcher(resultsSinks...)
 
-	// Create a BigQuery Client
-	logger.Info().Msg("Establish BigQuery Client Connection")
-	ctx := context.Background()
-	client, err := bigquery.NewClient(ctx, *targetProject)
+	// A Dual Write Streams Every Record to both the Old and New Tables
+	if *dualWrite {
+		if *oldTable == "" || *newTable == "" || *oldTable == *newTable {
+			return InitError(errors.New("-dual-write requires different -old-table and -new-table"))
+		}
+		*tableCount = 2
+	} else if *oldTable != "" || *newTable != "" {
+		return InitError(errors.New("-old-table and -new-table require -dual-write"))
+	}
+
+	// A Comparison Runs insertAll then the Storage Write API, each into its
+	// own Table, so both Tables are Created Up Front
+	if *compare {
+		*tableCount = 2
+	}
+
+	// Verify the Table Count and Parse any Batch Sizes per Table
+	if *tableCount < 1 || *tableCount > 100 {
+		return InitError(errUsage)
+	}
+	tableBatchSizes := make([]int, *tableCount)
+	for i := range tableBatchSizes {
+		tableBatchSizes[i] = *batchSize
+	}
+	if *batchSizes != "" {
+		sizes, err := ParseBatchSizes(*batchSizes, *tableCount)
+		if err != nil {
+			return InitError(err)
+		}
+		tableBatchSizes = sizes
+	}
+
+	// Verify the Write Mode, the Storage Write API Sending its Requests over
+	// gRPC where the insertAll Instrumentation of the HTTP Client Cannot See
+	switch *writeMode {
+	case modeInsertAll, modeStorage, modeBatch:
+	default:
+		return InitError(errors.New("-m must be one of insertall, storage or batch"))
+	}
+
+	// A Batch Size Ramp Starts the insertAll Run at the Start Batch Size
+	if *batchRampStart != 0 || *batchRampEnd != 0 {
+		if *batchRampStart < 1 || *batchRampEnd <= *batchRampStart || *batchRampEnd > maxInsertAllBatchSize {
+			return InitError(errors.New("-batch-ramp-start and -batch-ramp-end must both be set, with the start less than the end and the end at most 50000"))
+		}
+		if *batchRampInterval < 1 {
+			return InitError(errors.New("-batch-ramp-interval must be at least 1"))
+		}
+		*batchSize = *batchRampStart
+		for i := range tableBatchSizes {
+			tableBatchSizes[i] = *batchSize
+		}
+	}
+
+	// Verify Number of Preload Rows is between 0 and 100000000
+	if *preloadRows < 0 || *preloadRows > 100000000 {
+		return InitError(errUsage)
+	}
+
+	// Verify the Sample Read After the Run can Hold every Name
+	if *verifySample != 0 && (*verifySample < len(randomNames) || *verifySample > 100000000) {
+		return InitError(fmt.Errorf("-verify-sample must be 0 or between %d, the number of names, and 100000000", len(randomNames)))
+	}
+
+	// Pre-Connection Warms the HTTP Connections of the insertAll API Alone
+	if *preconnect < 0 || *preconnect > maxPreconnect {
+		return InitError(fmt.Errorf("-preconnect must be between 0 and %d", maxPreconnect))
+	}
+
+	// Verify the Maximum Request Size Leaves Room for a Record
+	if *maxRequestBytes != 0 && *maxRequestBytes < 1024 {
+		return InitError(errors.New("-max-request-bytes must be 0 or at least 1024"))
+	}
+
+	// Load any Pricing Overrides and Validate the Cost Comparison Regions
+	if *pricingOverrides != "" {
+		if err := LoadPricingOverrides(*pricingOverrides); err != nil {
+			return InitError(err)
+		}
+	}
+	regions, err := ParseRegions(*costCompareRegions)
 	if err != nil {
-		logger.Error().Err(err).Msg("Error [bigquery.NewClient]")
-		os.Exit(1)
+		return InitError(err)
+	}
+	if _, err := ParseRegions(*costRegion); err != nil {
+		return InitError(err)
+	}
+	if *monthlyRecords < 0 || *expectedRate < 0 {
+		return InitError(errUsage)
+	}
+
+	// Perf mode selects sampled latency capture unless a rate was given
+	if *latencySample < 0 {
+		return InitError(errUsage)
+	}
+	if *latency && !isFlagSet("latency-sample") {
+		*latencySample = 1
+	}
+	if *latency && *latencySample == 0 {
+		return InitError(errors.New("-latency requires a -latency-sample of at least 1"))
+	}
+	if *perfMode && !isFlagSet("latency-sample") {
+		*latencySample = 100
+	}
+	if *batchSizes != "" && !isFlagSet("latency-sample") && *latencySample == 0 {
+		*latencySample = 1
+	}
+
+	fastJSON = *fastJSONEncoding
+
+	// Retry notFound after Creating a Table, Polling its Metadata Beforehand
+	if *propagationWindow < 0 || *tableWaitFlag < 0 {
+		return InitError(errUsage)
+	}
+	tableWait = *tableWaitFlag
+
+	// The Quota is Measured by the insertAll and Storage Write API Runners
+	if *quotaMeasure && *quotaRowsPerSecond < 1 {
+		return InitError(errors.New("-quota-rows-per-second must be at least 1"))
+	}
+
+	// The Table Metadata is Polled by the insertAll and Storage Write API Runners
+	if *metadataPollInterval != 0 && *metadataPollInterval < metadataPollMinInterval {
+		return InitError(fmt.Errorf("-metadata-poll-interval must be 0 or at least %s", metadataPollMinInterval))
+	}
+
+	// Records are Generated in Parallel by the insertAll and Storage Write API
+	// Runners, Delivered Out of Order
+	if *numberGenerators < 1 || *numberGenerators > 64 {
+		return InitError(errors.New("-g must be between 1 and 64"))
+	}
+
+	// The Writes of the insertAll and Storage Write API Runners are Paced to the Rate
+	if *targetRate < 0 {
+		return InitError(errors.New("-rate must not be negative"))
 	}
-	defer client.Close()
 
-	// Create the Target BigQuery Table if Required
-	err = CreateBigQueryTable(ctx, client, *targetDataset, *targetTable, *overwriteTable)
+	// The Row Count is Verified Against the Records Sent by a Single Run
+	if *verifyWindow < 0 {
+		return InitError(errors.New("-verify-window must not be negative"))
+	}
+
+	// An Alternating Soak needs at least one Slice per API, each Longer than its Warm-Up
+	if *soakDuration > 0 && (*soakWarmup < 0 || *soakSlice <= *soakWarmup || *soakDuration < 2**soakSlice) {
+		return InitError(errors.New("-soak must be at least two -soak-slice, each longer than -soak-warmup"))
+	}
+
+	if *autoReconnect && !*committedStream {
+		return InitError(errors.New("-auto-reconnect requires -committed-stream"))
+	}
+
+	if *healthMonitorInterval < 0 {
+		return InitError(errors.New("-health-monitor-interval must not be negative"))
+	}
+
+	// A Workload is Recorded and Replayed by a Single insertAll Run
+	replaySpeed, err := ParseReplayTiming(*replayTiming)
 	if err != nil {
-		logger.Error().Err(err).Msg("Error [CreateBigQueryTable]")
-		os.Exit(1)
+		return InitError(err)
 	}
 
-	// Execute Legacy Stream to Target BigQuery Table
-	err = ExecuteLegacyStream(ctx, *targetProject, *targetDataset, *targetTable, *numberWorkers, *batchSize, *numberIterations, *verbose)
+	// A Baseline is Compared Against the Results of a Single Run
+	var baseline *Baseline
+	if *baselineFile != "" {
+		var err error
+		if baseline, err = LoadBaseline(context.Background(), *baselineFile); err != nil {
+			return InitError(err)
+		}
+	} else if *baselineFail {
+		return InitError(errors.New("-baseline-fail requires -baseline"))
+	}
+
+	// Previous Sweep Results are Reused by a Sweep Only
+	if *sweepPrevious != "" && !*sweepWorkers && !*sweepBatch && !sweepTables {
+		return InitError(errors.New("-sweep-previous requires -sweep-workers, -sweep-batch or -scale-tables"))
+	}
+
+	// Heartbeat Thresholds of Zero are Never Crossed
+	if *heartbeatInterval < 0 || *heartbeatErrorRate < 0 || *heartbeatErrorRate > 1 || *heartbeatP99 < 0 || *heartbeatGap < 0 {
+		return InitError(errors.New("-heartbeat must not be negative, and -heartbeat-error-rate must be between 0 and 1"))
+	}
+
+	// A Coordinated Run Needs a Session and a Condition to Start
+	var coordinateStartAt time.Time
+	if *coordinateTable != "" {
+		if *coordinateSession == "" || (*coordinateParticipants < 1 && *coordinateStart == "") || *coordinateTimeout <= 0 {
+			return InitError(errors.New("-coordinate requires -coordinate-session and either -coordinate-participants or -coordinate-start"))
+		}
+		if *coordinateStart != "" {
+			coordinateStartAt, err = time.Parse(time.RFC3339, *coordinateStart)
+			if err != nil {
+				return InitError(err)
+			}
+		}
+	}
+
+	// Convert any Maximum Cost into a Byte Budget for the Write API
+	var budget *CostBudget
+	if *maxCost < 0 || *pricePerGiB < 0 {
+		return InitError(errUsage)
+	}
+	if *maxCost > 0 {
+		api := WriteAPI(*writeMode, *committedStream)
+		price := *pricePerGiB
+		if price == 0 {
+			price = WritePricePerGiB(api, *costRegion)
+		}
+		budget, err = NewCostBudget(api, *maxCost, price)
+		if err != nil {
+			return InitError(err)
+		}
+	}
+
+	// Create the Handler Deciding the Action for Each Record Error
+	if *retries < 0 {
+		return InitError(errUsage)
+	}
+	recordErrorHandler, err := NewErrorHandler(*errorHandler, *retries)
 	if err != nil {
-		logger.Error().Err(err).Msg("Error [ExecuteLegacyStream]")
-		os.Exit(1)
+		return InitError(err)
 	}
 
-	logger.Info().Msg("End")
-}
+	// Measuring the Deduplication Rate requires Insert IDs, and Sends Every
+	// Record Twice unless a Percentage of Duplicates was Given
+	if *measureDedupRate && !*insertIDs {
+		return InitError(errors.New("-measure-dedup-rate requires -insert-ids"))
+	}
+	if *dupPercent < 0 || *dupPercent > 100 {
+		return InitError(errors.New("-dup-percent must be between 0 and 100"))
+	}
+	if *measureDedupRate && !isFlagSet("dup-percent") {
+		*dupPercent = 100
+	}
+	if *dupPercent > 0 && (*writeMode != modeInsertAll || *committedStream) {
+		return InitError(errors.New("-dup-percent and -measure-dedup-rate require the insertAll API"))
+	}
 
-// CreateBigQueryTable will create the target BigQuery table if required
-func CreateBigQueryTable(ctx context.Context, client *bigquery.Client, datasetID, tableID string, overwrite bool) error {
-	var createTable bool = false
+	// Validate the Schema Mismatch Drill Classes
+	var selectedDrills []string
+	if *drill != "" {
+		selectedDrills, err = ParseDrillClasses(*drill)
+		if err != nil {
+			return InitError(err)
+		}
+	}
 
-	// Check to see if the Table Exists, if it does, delete the table
-	table := client.Dataset(datasetID).Table(tableID)
-	tableMetaData, err := table.Metadata(ctx)
+	// Load and Validate the Scenario before any Writes
+	var scenario *Scenario
+	if *scenarioFile != "" {
+		scenario, err = LoadScenario(*scenarioFile, *batchSize)
+		if err != nil {
+			return InitError(err)
+		}
+	}
+
+	// Load the Table Schema and Matching Data Generator
+	generator, err := LookupGenerator(*generatorName)
 	if err != nil {
-		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
-			createTable = true
-		} else {
-			return err
+		return InitError(err)
+	}
+	schema := tableDataBigQuerySchema
+	if *generatorName != defaultGeneratorName && (*jsonSchemaFile != "" || *schemaFile != "" || *translateDialect != "") {
+		return InitError(errors.New("-generator applies to the built-in table schema only, not -json-schema, -schema or -translate-schema"))
+	}
+	if *schemaFile != "" {
+		schema, err = LoadBigQuerySchema(*schemaFile)
+		if err != nil {
+			return InitError(err)
+		}
+		schema = WithRunIDColumn(schema)
+		generator = NewSchemaDataGenerator(schema)
+	}
+	if *jsonSchemaFile != "" {
+		jsonSchema, err := LoadJSONSchema(*jsonSchemaFile)
+		if err == nil {
+			schema, err = JSONSchemaToBigQuerySchema(jsonSchema)
+		}
+		if err != nil {
+			return InitError(err)
 		}
+		schema = WithRunIDColumn(schema)
+		generator = NewSchemaDataGenerator(schema)
 	}
 
-	// If the table already exists and the overwrite flag is present
-	if overwrite && tableMetaData != nil {
-		logger.Info().Str("Table Name", tableID).Msg("Deleting Existing BigQuery Table")
-		err = table.Delete(ctx)
+	// Translate the Table Schema from Another Dialect via the Migration Service
+	if *translateDialect != "" {
+		if *jsonSchemaFile != "" || *translateDDL == "" || *translateGCS == "" || *targetProject == "" {
+			return InitError(errUsage)
+		}
+		translated, err := TranslateSchemaFile(*targetProject, *translateDialect, *translateDDL, *translateGCS)
 		if err != nil {
-			logger.Error().Err(err).Msg("Error [table.Delete]")
-			os.Exit(1)
+			return InitError(err)
+		}
+		if !*printSchema {
+			if err := PrintSchema(os.Stdout, translated); err != nil {
+				return InitError(err)
+			}
 		}
+		schema = WithRunIDColumn(translated)
+		generator = NewSchemaDataGenerator(schema)
+	}
 
-		// Need to add a short sleep here, for the eventual consistency issue
-		logger.Info().Msg("  Sleeping for 10 minutes to allow for eventual consistency to propagate")
-		time.Sleep(10 * time.Minute)
+	// Nested Field Statistics Unnest the REPEATED Fields of the Table Schema
+	if *nestedStats && len(RepeatedFieldPaths(schema)) == 0 {
+		return InitError(errors.New("-nested-stats requires a -schema, -json-schema or translated schema with a REPEATED field"))
+	}
 
-		table = client.Dataset(datasetID).Table(tableID)
-		createTable = true
+	// Generate Values Matching the Statistics of a Profiled Table
+	var profileFallback []string
+	if *dataProfile != "" {
+		profile, err := LoadDataProfile(*dataProfile)
+		if err != nil {
+			return InitError(err)
+		}
+		generator, profileFallback = NewProfileDataGenerator(schema, profile)
 	}
 
-	// Finally, Create the BigQuery Table if required
-	if createTable {
-		logger.Info().Str("Table Name", tableID).Msg("Creating BigQuery Table")
-		if err := table.Create(ctx, &bigquery.TableMetadata{Schema: tableDataBigQuerySchema}); err != nil {
-			return err
+	// Validate the Run Tags, Optionally Written as Columns of Every Row
+	if err := runTags.Validate(schema, *tagColumns); err != nil {
+		return InitError(err)
+	}
+	if *tagColumns && len(runTags) > 0 {
+		schema = runTags.WithTagColumns(schema)
+		generator = runTags.Generator(generator)
+	}
+
+	// Pad Every Generated Row to the Requested Serialized Size
+	if *rowBytes < 0 || *rowBytes > maxRowBytes {
+		return InitError(fmt.Errorf("-row-bytes must be between 0 and %d", maxRowBytes))
+	}
+	if *rowBytes > 0 {
+		if slices.ContainsFunc(schema, func(field *bigquery.FieldSchema) bool { return strings.EqualFold(field.Name, paddingColumn) }) {
+			return InitError(fmt.Errorf("-row-bytes adds the %s column, which is already in the table schema", paddingColumn))
 		}
+		schema = WithPaddingColumn(schema)
+		generator = PaddingGenerator(generator, *rowBytes)
+	}
 
-		// Need to add a short sleep here, for the eventual consistency issue
-		logger.Info().Msg("  Sleeping for 10 minutes to allow for eventual consistency to propagate")
-		time.Sleep(10 * time.Minute)
+	// Acknowledge Every Generated Row of a Single Run by its Token
+	var acks *AckVerifier
+	if *ackTokens {
+		if *ackWindow < 1 {
+			return InitError(errors.New("-ack-window must be at least 1"))
+		}
+		if slices.ContainsFunc(schema, func(field *bigquery.FieldSchema) bool { return strings.EqualFold(field.Name, ackTokenColumn) }) {
+			return InitError(fmt.Errorf("-ack-tokens adds the %s column, which is already in the table schema", ackTokenColumn))
+		}
+		acks = NewAckVerifier(*ackInterval, *ackWindow)
+		schema = WithAckTokenColumn(schema)
+		generator = acks.Generator(generator)
 	}
 
-	return nil
-}
+	// A Dual Write Joins the Records of the Old and New Tables on uuid
+	if *dualWrite {
+		if !slices.ContainsFunc(schema, func(field *bigquery.FieldSchema) bool { return field.Name == dualWriteKey }) {
+			return InitError(fmt.Errorf("-dual-write requires a %s column in the table schema", dualWriteKey))
+		}
+	}
 
-// ExecuteLegacyStream will establish a stream to the target BigQuery table using the legacy API
-func ExecuteLegacyStream(ctx context.Context, projectID, datasetID, tableID string, numberWorkers, batchSize, numberIterations int, verbose bool) error {
-	// Create a BigQuery (stream) writer thread-safe client,
-	logger.Info().Msg("Establish BigQuery Streaming Client")
-	streamer, err := bqwriter.NewStreamer(
-		context.Background(),
-		projectID,
-		datasetID,
-		tableID,
-		&bqwriter.StreamerConfig{
-			WorkerCount:     numberWorkers,
-			WorkerQueueSize: CalculateWorkerQueueSize(batchSize),
-			InsertAllClient: &bqwriter.InsertAllClientConfig{
-				BatchSize:            batchSize,
-				FailOnInvalidRows:    true,
-				FailForUnknownValues: true,
-			},
-		},
-	)
+	// Duplicates are Told Apart from the Distinct Records by uuid
+	if *dupPercent > 0 && !slices.ContainsFunc(schema, func(field *bigquery.FieldSchema) bool { return field.Name == dedupKey }) {
+		return InitError(fmt.Errorf("-dup-percent and -measure-dedup-rate require a %s column in the table schema", dedupKey))
+	}
+
+	// Plan the Partitions of a Single Run, Predicting the Rows of each
+	var partitionPlan *PartitionPlan
+	if *partition != "" {
+		partitionPlan, err = NewPartitionPlan(*partition, *timeSpread, *eventLag, *timeZone, *partitionTolerance, schema)
+		if err != nil {
+			return InitError(err)
+		}
+		if *targetPartition != "" {
+			if err := partitionPlan.SetTarget(*targetPartition); err != nil {
+				return InitError(err)
+			}
+		}
+	} else if *timeSpread != 0 || *eventLag != 0 || *targetPartition != "" || isFlagSet("time-zone") || isFlagSet("partition-tolerance") {
+		return InitError(errors.New("-time-spread, -event-lag, -target-partition, -time-zone and -partition-tolerance require -partition"))
+	}
+
+	// Partition and Cluster the Tables Created, -partition Choosing its own Partitioning
+	layout, err := NewTableLayout(*partitionField, *partitionType, *clusterFields, schema)
 	if err != nil {
-		return err
+		return InitError(err)
+	}
+	if partitionPlan != nil {
+		layout.Partitioning = partitionPlan.TimePartitioning()
 	}
-	defer streamer.Close()
 
-	// You can now start writing data to your BQ table
-	startTime := time.Now()
-	count := 0
-	logger.Info().Msg("Start Streaming Data")
-	for data := range newGenerator(ctx, numberIterations, NewTableData) {
-		err = streamer.Write(data)
+	// Expire or Delete the Tables Created, Leaving no Benchmark Tables Behind
+	if *expire != 0 && *expire < time.Minute {
+		return InitError(errors.New("-expire must be 0 or at least 1m"))
+	}
+	layout.Expiration = *expire
+
+	// Print the Effective Table Schema without Touching any API
+	if *printSchema {
+		if err := PrintSchema(os.Stdout, schema); err != nil {
+			return InitError(err)
+		}
+		return nil
+	}
+
+	// Load the Time Zone used for the Console Output Timestamps
+	var logLocation *time.Location
+	if *logTimezone != "" {
+		logLocation, err = time.LoadLocation(*logTimezone)
 		if err != nil {
-			return err
+			return InitError(err)
+		}
+	}
+
+	// Setup Zero Log for Consolo Output
+	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+	if *generateServe == stdioAddress {
+		output.Out = os.Stderr
+	}
+	if logLocation != nil {
+		output.FormatTimestamp = ConsoleTimestampFormatter(logLocation)
+	}
+	kubernetes := DetectKubernetes()
+	logger = WithKubernetesFields(zerolog.New(output).With().Timestamp(), kubernetes).Logger()
+	if *verbose {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+
+	// Deliver the Results of a Run Ending Early, such as a Table which Fails
+	// to be Created, with the Error and the Phase it Ended in, as the Results
+	// Hook of the Shutdown is only Registered Once the Run is Configured
+	runID := NewRunID()
+	defer func() {
+		if runErr == nil || dispatcher.Delivered() {
+			return
+		}
+		mode := *writeMode
+		if *committedStream {
+			mode = modeCommitted
+		}
+		config := &BenchmarkConfig{
+			ProjectID:        *targetProject,
+			TableID:          *targetTable,
+			RunID:            runID,
+			NumberWorkers:    *numberWorkers,
+			BatchSize:        *batchSize,
+			NumberIterations: *numberIterations,
+			Tags:             runTags,
+		}
+		if len(datasets) > 0 {
+			config.DatasetID = datasets[0]
+		}
+		dispatcher.Deliver(context.Background(), NewRunResults(config, mode, nil, runErr))
+	}()
+
+	// Output Header
+	logger.Info().Msgf(applicationText, filepath.Base(os.Args[0]), "")
+	logger.Info().Msg("Arguments")
+	logger.Info().Str("Project ID", *targetProject).Msg(indent)
+	logger.Info().Strs("Dataset", datasets).Msg(indent)
+	logger.Info().Str("Table", *targetTable).Msg(indent)
+	logger.Info().Str("Run ID", runID).Msg(indent)
+	if *writeMode != modeInsertAll {
+		logger.Info().Str("Write Mode", *writeMode).Msg(indent)
+	}
+	if len(runTags) > 0 {
+		logger.Info().Str("Tags", runTags.String()).Msg(indent)
+	}
+	logger.Info().Int("Number Workers", *numberWorkers).Msg(indent)
+	logger.Info().Int("Number Records", *numberIterations).Msg(indent)
+	if cloudRunTask != nil {
+		logger.Info().Int("Cloud Run Task", cloudRunTask.Index).Int("Task Count", cloudRunTask.Count).Int("uuid Offset", *uuidOffset).Msg(indent)
+	} else if *cloudRunJob != "" {
+		logger.Info().Str("Cloud Run Job", *cloudRunJob).Int("Task Count", *cloudRunTasks).Msg(indent)
+	}
+	logger.Info().Int("Batch Size", *batchSize).Msg(indent)
+	if *batchRampEnd > 0 {
+		logger.Info().Int("Batch Ramp End", *batchRampEnd).Int("Batch Ramp Interval", *batchRampInterval).Msg(indent)
+	}
+	if *tableCount > 1 {
+		logger.Info().Int("Table Count", *tableCount).Ints("Batch Sizes", tableBatchSizes).Msg(indent)
+	}
+	if layout.Partitioning != nil || layout.Clustering != nil {
+		logger.Info().Str("Partitioning", DescribePartitioning(layout.Partitioning)).Str("Clustering", DescribeClustering(layout.Clustering)).Msg(indent)
+	}
+	if layout.Expiration > 0 || *cleanupTables {
+		logger.Info().Dur("Table Expiration", layout.Expiration).Bool("Table Cleanup", *cleanupTables).Msg(indent)
+	}
+	logger.Info().Dur("Drain Timeout", *drainTimeout).Dur("Interrupt Drain Timeout", *interruptDrain).Msg(indent)
+	if *dataProfile != "" {
+		logger.Info().Str("Data Profile", *dataProfile).Msg(indent)
+		if len(profileFallback) > 0 {
+			logger.Warn().Strs("Columns", profileFallback).Msg("  Columns Without Statistics in the Data Profile are Generated with the Defaults of their Type")
+		}
+	}
+	if *maxRequestBytes > 0 {
+		logger.Info().Int("Max Request Bytes", *maxRequestBytes).Msg(indent)
+	}
+	logger.Info().Msg("Begin")
+
+	// Warn when the File Descriptor Limit May Not Allow the Sockets of the
+	// Streamers, Reducing the Workers to Fit with -clamp-parallelism
+	if check, constrained := CheckFileLimit(max(1, len(datasets))**tableCount, *numberWorkers); constrained {
+		LogFileLimitWarning(check)
+		if *clampParallelism && check.SafeWorkers < *numberWorkers {
+			logger.Warn().Int("Requested Workers", *numberWorkers).Int("Clamped Workers", check.SafeWorkers).Msg("  Clamping the Workers to the File Descriptor Limit")
+			*numberWorkers = check.SafeWorkers
 		}
-		count++
+	}
 
-		if verbose {
-			if math.Mod(float64(count), 10000) == 0 {
-				logger.Info().Int("Records Sent", count).Msg(indent)
+	// Lint the Combination of Workers, Batch Size, Queue Size and Rate of the
+	// insertAll Streamers, Failing the Run on any Warning with -strict
+	if !*committedStream && !*sweepWorkers && !*sweepBatch && !sweepTables {
+		var inputs []LintInput
+		if scenario != nil {
+			for _, phase := range scenario.Phases {
+				inputs = append(inputs, LintInput{Name: phase.Name, Workers: *numberWorkers, BatchSize: phase.BatchSize, QueueSize: CalculateWorkerQueueSize(phase.BatchSize), ExpectedRate: phase.Rate})
+			}
+		} else {
+			streams := max(1, len(datasets)) * *tableCount
+			linted := make(map[int]bool)
+			for _, size := range tableBatchSizes {
+				if linted[size] {
+					continue
+				}
+				linted[size] = true
+				inputs = append(inputs, LintInput{Workers: *numberWorkers, BatchSize: size, QueueSize: CalculateWorkerQueueSize(size), Records: *numberIterations / streams, ExpectedRate: *expectedRate / float64(streams)})
+			}
+		}
+		if warnings := LintConfig(inputs...); len(warnings) > 0 {
+			LogLintWarnings(warnings)
+			if *strictLint {
+				return NewBQWriteTestError(phaseInit, "LintConfig", fmt.Errorf("%d configuration lint warnings are errors with -strict", len(warnings)))
 			}
 		}
 	}
-	elapsed := time.Since(startTime)
-	logger.Info().Int("Records Sent", count).Dur("Time Taken", elapsed).Msg(indent)
-	logger.Info().Msg("End Streaming Data")
-	logger.Info().Msg("Closing BigQuery Streaming Client")
 
-	return nil
+	// Load the Names Used by the Generators from a File if Required
+	if path := NamesFile(*namesFile); path != "" {
+		names, err := LoadNames(path)
+		if err != nil {
+			return NewBQWriteTestError(phaseInit, "LoadNames", err)
+		}
+		if len(names) < len(randomNames) {
+			logger.Warn().Str("Names File", path).Int("Names", len(names)).Msgf("  Fewer Names than the %d Built-In Names", len(randomNames))
+		}
+		randomNames = names
+		logger.Info().Str("Names File", path).Int("Names", len(names)).Msg(indent)
+	}
+
+	// Validate a Handful of Generated Records Against the Schema
+	if violations := ValidateGeneratedRows(schema, generator, runID, selfCheckRows); len(violations) > 0 {
+		LogSchemaViolations(violations)
+		return NewBQWriteTestError(phaseInit, "ValidateGeneratedRows", fmt.Errorf("%d generated values violate the table schema", len(violations)))
+	}
+
+	// Write the Generated Records to a Local File without any API Calls
+	if *ndjsonSink != "" {
+		records, written, err := WriteNDJSONSink(context.Background(), *ndjsonSink, *numberIterations, runID, generator)
+		if err != nil {
+			return NewBQWriteTestError(phaseStream, "WriteNDJSONSink", err)
+		}
+		logger.Info().Str("NDJSON Sink", *ndjsonSink).Int("Records Written", records).Int64("Bytes Written", written).Msg(indent)
+		logger.Info().Msg("End")
+		return nil
+	}
+
+	// Serve the Generated Records to a Writer Process without any API Calls
+	if *generateServe != "" {
+		if err := ServeGeneratedRows(context.Background(), *generateServe, *numberIterations, runID, generator); err != nil {
+			return NewBQWriteTestError(phaseStream, "ServeGeneratedRows", err)
+		}
+		logger.Info().Msg("End")
+		return nil
+	}
+
+	// Create the Cloud Monitoring Alert Policy on the Records per Second
+	if *createAlert {
+		logger.Info().Float64("Threshold", *alertThresholdRPS).Msg("Creating Cloud Monitoring Alert Policy")
+		name, err := CreateAlertPolicy(context.Background(), *targetProject, *alertThresholdRPS)
+		if err != nil {
+			return NewBQWriteTestError(phaseInit, "CreateAlertPolicy", err)
+		}
+		logger.Info().Str("Alert Policy", name).Msg(indent)
+		logger.Info().Msg("End")
+		return nil
+	}
+
+	// Hook the End of the Run into the Ordered Stages of the Shutdown
+	shutdown := NewShutdown()
+
+	// Track the Request IDs of Failed Requests, or All Requests if Required
+	requestIDs, err := NewRequestIDTracker(*captureAllRequestIDs)
+	if err != nil {
+		return NewBQWriteTestError(phaseInit, "NewRequestIDTracker", err)
+	}
+	shutdown.RegisterClose("Request IDs", requestIDs.Close)
+
+	// Record the Details of Every API Request if Required, Warning of its Size
+	var requestLog *RequestLog
+	if *requestLogFile != "" {
+		requestLog, err = NewRequestLog(*requestLogFile, int64(*requestLogMaxSize)*bytesPerMiB)
+		if err != nil {
+			return NewBQWriteTestError(phaseInit, "NewRequestLog", err)
+		}
+		shutdown.RegisterClose("Request Log", requestLog.Close)
+		logger.Warn().Str("Request Log", *requestLogFile).Int("Rotate at (MiB)", *requestLogMaxSize).Msg("  The Request Log Records Every API Request and Can Grow Large")
+	}
+
+	// Record Each Row Sent to a Workload File if Required
+	var recorder *WorkloadRecorder
+	if *recordFile != "" {
+		recorder, err = NewWorkloadRecorder(*recordFile)
+		if err != nil {
+			return NewBQWriteTestError(phaseInit, "NewWorkloadRecorder", err)
+		}
+		shutdown.RegisterClose("Workload Recorder", recorder.Close)
+	}
+
+	// Create a BigQuery Client
+	logger.Info().Msg("Establish BigQuery Client Connection")
+	ctx := context.Background()
+	var clientOptions []option.ClientOption
+	var clientTransports []transportWrapper
+	if requestLog != nil {
+		clientTransports = append(clientTransports, requestLog.Transport)
+	}
+	if requestIDs.CaptureAll() {
+		clientTransports = append(clientTransports, requestIDs.Transport)
+	}
+	if len(clientTransports) > 0 {
+		clientOptions, err = InstrumentedClientOptions(ctx, clientTransports...)
+		if err != nil {
+			return NewBQWriteTestError(phaseInit, "InstrumentedClientOptions", WrapClientError(err, *targetProject))
+		}
+	}
+	client, err := bigquery.NewClient(ctx, *targetProject, clientOptions...)
+	if err != nil {
+		err = WrapClientError(err, *targetProject)
+		return NewBQWriteTestError(phaseInit, "bigquery.NewClient", err)
+	}
+	shutdown.RegisterClose("BigQuery Client", client.Close)
+
+	// Execute the Schema Mismatch Drill in place of a Benchmark Run
+	if len(selectedDrills) > 0 {
+		if _, err := ExecuteSchemaDrill(ctx, client, *targetProject, datasets[0], runID, selectedDrills); err != nil {
+			shutdown.Run(ctx, err)
+			return NewBQWriteTestError(phaseStream, "ExecuteSchemaDrill", err)
+		}
+		shutdown.Run(ctx, nil)
+		logger.Info().Msg("End")
+		return nil
+	}
+
+	// Subscribe to the Analytics Hub Listing, Streaming to the Shared Dataset
+	// Behind it as the Linked Dataset of the Subscriber is Read-Only
+	var subscription *AnalyticsHubSubscription
+	if *analyticsHubListing != "" {
+		subscription, err = SubscribeAnalyticsHubListing(ctx, client, *targetProject, *analyticsHubListing)
+		if err != nil {
+			return NewBQWriteTestError(phaseInit, "SubscribeAnalyticsHubListing", WrapClientError(err, *targetProject))
+		}
+		LogAnalyticsHubSubscription(subscription)
+		if subscription.Source.ProjectID != *targetProject {
+			return NewBQWriteTestError(phaseInit, "SubscribeAnalyticsHubListing", fmt.Errorf("the shared dataset %s must be in the -p project", subscription.Source))
+		}
+		datasets = []string{subscription.Source.DatasetID}
+	}
+
+	// Guard Against Writing to Tables not Created by the Tool in Safe Mode
+	safeMode := NewSafeMode(*safe, *force)
+	if safeMode.Enabled {
+		logger.Info().Bool("Force", safeMode.Force).Msg("Safe Mode Enabled")
+	}
+
+	// Create the Target BigQuery Table in each Dataset if Required, removing
+	// any dataset which fails from the rotation when there are several
+	var targets []*StreamTarget
+	var propagationRetries int
+
+	// Delete the Tables Created Once the Run Ends if Required, including after
+	// a setup error returns before the Shutdown is Run
+	var tableCleanup *TableCleanup
+	if *cleanupTables {
+		tableCleanup = NewTableCleanup(client)
+		shutdown.Register(stageCleanup, "Table Cleanup", func(ctx context.Context) error {
+			tableCleanup.Run(ctx)
+			return nil
+		})
+		defer tableCleanup.Run(ctx)
+	}
+	for _, datasetID := range datasets {
+		tableNames := TableNames(*targetTable, *tableCount)
+		if *dualWrite {
+			tableNames = []string{*oldTable, *newTable}
+		} else if *compare {
+			tableNames = CompareTableNames(*targetTable)
+		}
+		for i, tableID := range tableNames {
+			created, protected, err := CreateBigQueryTable(ctx, client, datasetID, tableID, schema, layout, *overwriteTable, safeMode)
+			if err == nil {
+				tableCleanup.Add(datasetID, tableID, created)
+			}
+			if err == nil && len(protected) > 0 {
+				LogProtectedColumns(datasetID, tableID, protected)
+				var unverified []string
+				unverified, err = VerifyProtectedColumns(ctx, client, datasetID, tableID, runID, schema, generator, protected)
+				if len(unverified) > 0 {
+					logger.Warn().Strs("Columns", unverified).Msg("  The Protected Columns are not Generated, so are not Verified by the Canary")
+				}
+			}
+			if err == nil && created && *propagationWindow > 0 {
+				var retries int
+				retries, err = AwaitTablePropagation(ctx, client, datasetID, tableID, runID, generator, time.Now(), *propagationWindow)
+				propagationRetries += retries
+			}
+			if err != nil {
+				err = WrapClientError(err, *targetProject)
+				if errors.Is(err, errUnsafeTable) || (len(datasets) == 1 && *tableCount == 1) || sweepTables || *dualWrite || *compare {
+					return NewBQWriteTestError(phaseCreateTable, "CreateBigQueryTable", err)
+				}
+				logger.Warn().Err(err).Str("Dataset", datasetID).Str("Table", tableID).Msg("Removing Table from the Rotation")
+				continue
+			}
+			targets = append(targets, &StreamTarget{DatasetID: datasetID, TableID: tableID, BatchSize: tableBatchSizes[i]})
+		}
+	}
+	if len(targets) == 0 {
+		return NewBQWriteTestError(phaseCreateTable, "CreateBigQueryTable", errors.New("no tables remain in the rotation"))
+	}
+	if propagationRetries > 0 {
+		logger.Info().Int("Propagation Retries", propagationRetries).Msg("  Waited for the Created Tables to Propagate")
+	}
+	primaryDataset, primaryTable := targets[0].DatasetID, targets[0].TableID
+
+	// Verify the Current Identity Can Write to each Target Table if Required
+	if *verifyACL {
+		logger.Info().Msg("Verifying Table ACL")
+		for _, target := range targets {
+			acl, err := VerifyTableACL(ctx, client, target.DatasetID, target.TableID)
+			if err != nil {
+				return NewBQWriteTestError(phaseCreateTable, "VerifyTableACL", WrapClientError(err, *targetProject))
+			}
+			LogTableACL(target.DatasetID, target.TableID, acl)
+			if !acl.CanWrite {
+				return NewBQWriteTestError(phaseCreateTable, "VerifyTableACL", fmt.Errorf("the table %s.%s may not be writable by the current identity", target.DatasetID, target.TableID))
+			}
+		}
+	}
+
+	// Verify the Current Identity Can Update the Metadata of each Dataset
+	if *updateDatasetMetadata {
+		logger.Info().Msg("Updating Dataset Metadata")
+		updated := make(map[string]bool)
+		for _, target := range targets {
+			if updated[target.DatasetID] {
+				continue
+			}
+			updated[target.DatasetID] = true
+			if err := UpdateDatasetMetadata(ctx, client, target.DatasetID); err != nil {
+				return NewBQWriteTestError(phaseCreateTable, "UpdateDatasetMetadata", WrapClientError(err, *targetProject))
+			}
+			logger.Info().Str("Dataset", target.DatasetID).Str("Description", datasetUpdateDescription).Msg(indent)
+		}
+	}
+
+	// Check the Fields of a Parquet or Avro Input Before any Rows are Written
+	var columnar *ColumnarInput
+	if *inputRows != "" && ColumnarInputFormat(*inputRows) != "" {
+		columnar, err = OpenColumnarInput(ctx, *inputRows, schema)
+		if err != nil {
+			return NewBQWriteTestError(phaseInit, "OpenColumnarInput", err)
+		}
+		shutdown.Register(stageStopProducers, "Columnar Input", func(context.Context) error { return columnar.Close() })
+	}
+
+	// Preload the Target BigQuery Table if Required
+	if *preloadRows > 0 {
+		err = PreloadBigQueryTable(ctx, client, primaryDataset, primaryTable, runID+"-preload", *preloadRows, schema, generator)
+		if err != nil {
+			return NewBQWriteTestError(phaseCreateTable, "PreloadBigQueryTable", err)
+		}
+	}
+
+	// Read the Rows to Stream from an Input, or from a Forked Generator Process
+	var input io.Reader
+	var generatorProcess *GeneratorProcess
+	if *inputRows != "" && columnar == nil {
+		rowInput, err := OpenRowInput(*inputRows)
+		if err != nil {
+			return NewBQWriteTestError(phaseInit, "OpenRowInput", err)
+		}
+		shutdown.Register(stageStopProducers, "Row Input", func(context.Context) error { return rowInput.Close() })
+		input = rowInput
+	} else if *generateProcess {
+		generatorProcess, err = StartGeneratorProcess()
+		if err != nil {
+			return NewBQWriteTestError(phaseInit, "StartGeneratorProcess", err)
+		}
+		input = generatorProcess.Output()
+	}
+
+	// Execute Legacy Stream to Target BigQuery Table
+	config := &BenchmarkConfig{
+		ProjectID:        *targetProject,
+		DatasetID:        primaryDataset,
+		TableID:          primaryTable,
+		Targets:          targets,
+		Schema:           schema,
+		Generator:        generator,
+		RunID:            runID,
+		NumberWorkers:    *numberWorkers,
+		BatchSize:        *batchSize,
+		NumberIterations: *numberIterations,
+		DrainTimeout:     *drainTimeout,
+		InterruptDrain:   *interruptDrain,
+		InsertIDs:        *insertIDs,
+		AutoReconnect:    *autoReconnect,
+		Duplicates:       NewDuplicateSchedule(*dupPercent),
+		LatencySample:    *latencySample,
+		RequestIDs:       requestIDs,
+		ErrorHandler:     recordErrorHandler,
+		Budget:           budget,
+		RequestLog:       requestLog,
+		Recorder:         recorder,
+		Tags:             runTags,
+		Partitions:       partitionPlan,
+		Kubernetes:       kubernetes,
+		ReplayFile:       *replayFile,
+		Input:            input,
+		Columnar:         columnar,
+		DualWrite:        *dualWrite,
+		UUIDOffset:       *uuidOffset,
+		ReplaySpeed:      replaySpeed,
+		Generators:       *numberGenerators,
+		RowBytes:         *rowBytes,
+		Rate:             *targetRate,
+		Verbose:          *verbose && !*perfMode,
+	}
+
+	// Route the Requests of the Streamer Clients through the Worker Stats,
+	// the Heartbeat, the Timing Breakdown and the Request Log, with every
+	// oversized insertAll request split before any of them see it, and each
+	// batch of the streamers counted before it is split
+	var workerStats *WorkerStats
+	var streamerTransports []transportWrapper
+	if *workerStatsFlag || *fairnessTest {
+		workerStats = NewWorkerStats()
+		streamerTransports = append(streamerTransports, workerStats.Transport)
+	}
+	if *heartbeatInterval > 0 {
+		config.Heartbeat = NewHeartbeat(*heartbeatInterval, HeartbeatThresholds{ErrorRate: *heartbeatErrorRate, P99: *heartbeatP99, Gap: *heartbeatGap}, requestIDs)
+		streamerTransports = append(streamerTransports, config.Heartbeat.Transport)
+	}
+	if *sizeHistogram {
+		config.Sizes = NewSizeHistogram()
+	}
+	if *timingBreakdown {
+		config.Timing = NewTimingBreakdown()
+		streamerTransports = append(streamerTransports, config.Timing.Transport)
+	}
+	if requestLog != nil {
+		streamerTransports = append(streamerTransports, requestLog.Transport)
+	}
+	if *batchRampEnd > 0 {
+		config.BatchRamp = NewBatchRamp(*batchRampStart, *batchRampEnd, *batchRampInterval)
+	}
+	if *quotaMeasure {
+		config.Quota = NewQuotaMeter(*quotaRowsPerSecond)
+		if *writeMode == modeInsertAll {
+			streamerTransports = append(streamerTransports, config.Quota.Transport)
+		}
+	}
+	if *maxRequestBytes > 0 && *writeMode == modeInsertAll {
+		config.Splitter = NewRequestSplitter(*maxRequestBytes)
+		streamerTransports = append(streamerTransports, config.Splitter.Transport)
+	}
+	if *writeMode == modeInsertAll {
+		config.Batches = NewBatchCounter()
+		streamerTransports = append(streamerTransports, config.Batches.Transport)
+	}
+	var pool *ConnectionPool
+	if *preconnect > 0 {
+		pool = NewConnectionPool(*preconnect)
+	}
+	if len(streamerTransports) > 0 || pool != nil {
+		config.StreamerOptions, err = InstrumentedClientOptions(pool.Context(ctx), streamerTransports...)
+		if err != nil {
+			return NewBQWriteTestError(phaseInit, "InstrumentedClientOptions", WrapClientError(err, *targetProject))
+		}
+	}
+
+	// Refuse to Start a Run whose Planned Workload Exceeds the Cost Budget
+	if budget != nil {
+		plannedBytes := budget.EstimatePlannedBytes(generator, runID, *numberIterations)
+		budget.LogEstimate(plannedBytes)
+		if plannedBytes > budget.MaxBytes && !*maxCostOverride {
+			return NewBQWriteTestError(phaseInit, "CostBudget", errors.New("the planned workload exceeds -max-cost, use -max-cost-override to start the run regardless"))
+		}
+	}
+
+	// Aggregate the Errors of the Run by Type and Field if Required
+	if *errorReport {
+		config.Errors = NewErrorAggregator()
+	}
+
+	// Execute the Run Across the Tasks of a Cloud Run Job in place of a Local
+	// Run, Aggregating the Results each Task Wrote to Cloud Storage
+	if *cloudRunJob != "" {
+		job, err := NewCloudRunJob(ctx, *targetProject, *cloudRunRegion, *cloudRunJob, *cloudRunTasks, *cloudRunResults, runID)
+		if err != nil {
+			return NewBQWriteTestError(phaseInit, "NewCloudRunJob", err)
+		}
+		runErr := job.Execute(ctx, CloudRunTaskArgs(os.Args[1:], job.Location()))
+		if runErr != nil {
+			logger.Warn().Err(runErr).Msg("  Cloud Run Job Execution Failed, Reading the Results of the Tasks which Completed")
+		}
+		tasks, missing, err := job.ReadResults(ctx)
+		if err != nil {
+			return NewBQWriteTestError(phaseStream, "CloudRunJob.ReadResults", err)
+		}
+		runResults := AggregateCloudRunResults(NewRunResults(config, modeInsertAll, nil, runErr), tasks)
+		LogCloudRunResults(runResults, missing)
+		shutdown.Register(stageReport, "Results", func(ctx context.Context) error {
+			dispatcher.Deliver(ctx, runResults)
+			return nil
+		})
+		shutdown.Run(ctx, runErr)
+		if runErr != nil {
+			return NewBQWriteTestError(phaseStream, "CloudRunJob.Execute", runErr)
+		}
+		if len(missing) > 0 {
+			return NewBQWriteTestError(phaseStream, "CloudRunJob.ReadResults", fmt.Errorf("%d tasks wrote no results", len(missing)))
+		}
+		logger.Info().Msg("End")
+		return nil
+	}
+
+	// Register with the Coordination Table and Wait for the Other Hosts
+	var coordinator *Coordinator
+	if *coordinateTable != "" {
+		coordinator, err = NewCoordinator(client, *coordinateTable, primaryDataset, *coordinateSession, runID, *coordinateParticipants, coordinateStartAt, *coordinateTimeout)
+		if err == nil {
+			err = coordinator.Register(ctx)
+		}
+		if err == nil {
+			err = coordinator.WaitForStart(ctx)
+		}
+		if err != nil {
+			return NewBQWriteTestError(phaseInit, "Coordinator", WrapClientError(err, *targetProject))
+		}
+	}
+
+	// Poll the Table Metadata During Streaming if Required
+	if *metadataPollInterval > 0 {
+		config.Metadata = NewMetadataPoller(client, *metadataPollInterval)
+	}
+
+	// Open the Idle Connections of the Streamer Clients Before Streaming, so
+	// Connection Establishment is not Included in the Measured Throughput
+	if pool != nil {
+		start := time.Now()
+		established, err := pool.Preconnect(ctx, *targetProject)
+		if err != nil {
+			logger.Warn().Err(WrapClientError(err, *targetProject)).Msg("Pre-Connection Failed")
+		}
+		LogPreconnect(*preconnect, established, time.Since(start))
+	}
+
+	// Track the Rows Landed During the Run if Required
+	var landed []LandedSample
+	var ackSamples []AckSample
+	var estimatedSlots float64
+	if *trackLanded {
+		config.Landed = NewLandedTracker(client, targets, runID, *landedInterval)
+		config.Landed.Start(ctx)
+		shutdown.Register(stageReconcile, "Landed Rows", func(context.Context) error {
+			landed = config.Landed.Stop()
+			return nil
+		})
+	}
+
+	// Acknowledge the Rows Visible During the Run if Required
+	if acks != nil {
+		config.Acks = acks
+		config.Acks.Start(ctx, client, targets, runID)
+		shutdown.Register(stageReconcile, "Row Acknowledgment", func(ctx context.Context) error {
+			ackSamples = config.Acks.Stop(ctx)
+			return nil
+		})
+	}
+
+	// Poll the Streaming Buffer to Estimate the Processing Slots if Required
+	if *estimateSlots {
+		config.Slots = NewSlotEstimator(client, primaryDataset, primaryTable)
+		config.Slots.Start(ctx)
+		shutdown.Register(stageReconcile, "Slot Estimate", func(context.Context) error {
+			estimatedSlots = config.Slots.Finish()
+			LogSlotEstimate(config.Slots)
+			return nil
+		})
+	}
+
+	// Log the Adaptive Heartbeat Throughout the Run if Required
+	if config.Heartbeat != nil {
+		config.Heartbeat.Start(ctx)
+		shutdown.Register(stageReconcile, "Heartbeat", func(context.Context) error {
+			config.Heartbeat.Stop()
+			return nil
+		})
+	}
+
+	// Monitor the Health of the Run if Required
+	if *healthMonitorInterval > 0 {
+		config.Health = NewHealthMonitor(*healthMonitorInterval)
+		config.Health.Start(ctx)
+		shutdown.Register(stageReconcile, "Health Monitor", func(context.Context) error {
+			config.Health.Stop()
+			return nil
+		})
+	}
+
+	// Report the Request IDs and the Errors of the Run Once it has Ended
+	shutdown.Register(stageReport, "Request IDs", func(context.Context) error {
+		requestIDs.Log()
+		return nil
+	})
+	shutdown.Register(stageReport, "Error Report", func(context.Context) error {
+		LogErrorReport(config.Errors.Report())
+		return nil
+	})
+
+	// Execute an Alternating Soak in place of a Single Run
+	if *soakDuration > 0 {
+		slices, comparison, err := ExecuteSoak(ctx, config, *soakDuration, *soakSlice, *soakWarmup)
+		shutdown.Register(stageReport, "Results", func(ctx context.Context) error {
+			if comparison != nil {
+				LogSoakComparison(comparison)
+			}
+			runResults := NewRunResults(config, "soak", nil, err)
+			runResults.Soak, runResults.SoakComparison, runResults.Landed = slices, comparison, landed
+			runResults.ShutdownStages = shutdown.Timings()
+			dispatcher.Deliver(ctx, runResults)
+			return nil
+		})
+		shutdown.Run(ctx, err)
+		if err != nil {
+			return NewBQWriteTestError(phaseStream, "ExecuteSoak", err)
+		}
+		logger.Info().Msg("End")
+		return nil
+	}
+
+	// Sweep the Worker Counts, Batch Sizes or Table Counts in place of a Single
+	// Run, reusing the recent and stable steps of the previous results unless -full
+	if *sweepWorkers || *sweepBatch || sweepTables {
+		if *sweepPrevious != "" && !*sweepFull {
+			config.SweepCache, err = LoadSweepCache(*sweepPrevious, *sweepFreshness)
+			if err != nil {
+				return NewBQWriteTestError(phaseInit, "LoadSweepCache", err)
+			}
+		}
+		var results []SweepResult
+		if *sweepWorkers {
+			results, err = SweepWorkers(ctx, config, SweepWorkerCounts(*numberWorkers))
+			LogSweepWorkers(results)
+		} else if *sweepBatch {
+			results, err = SweepBatch(ctx, config, SweepBatchSizes(*batchSize))
+			LogSweepBatch(results)
+		} else {
+			results, err = SweepTables(ctx, config, scaleTableCounts)
+			LogSweepTables(results)
+		}
+		shutdown.Register(stageReport, "Results", func(ctx context.Context) error {
+			runResults := NewRunResults(config, modeInsertAll, nil, err)
+			runResults.Sweep = results
+			runResults.ShutdownStages = shutdown.Timings()
+			dispatcher.Deliver(ctx, runResults)
+			return nil
+		})
+		shutdown.Run(ctx, err)
+		if err != nil {
+			return NewBQWriteTestError(phaseStream, "Sweep", err)
+		}
+		logger.Info().Msg("End")
+		return nil
+	}
+
+	// Compare the insertAll API and the Storage Write API in place of a Single
+	// Run, running both whatever the outcome of the first
+	if *compare {
+		results, err := ExecuteCompare(ctx, config)
+		shutdown.Register(stageReport, "Results", func(ctx context.Context) error {
+			LogCompareResults(results)
+			runResults := NewRunResults(config, "compare", nil, err)
+			runResults.Compare = results
+			runResults.ShutdownStages = shutdown.Timings()
+			dispatcher.Deliver(ctx, runResults)
+			return nil
+		})
+		if *monthlyRecords > 0 {
+			shutdown.Register(stageReport, "Cost Breakdown", func(context.Context) error {
+				LogCompareCosts(results, *costRegion, *monthlyRecords)
+				return nil
+			})
+		}
+		shutdown.Run(ctx, err)
+		if err != nil {
+			return NewBQWriteTestError(phaseStream, "ExecuteCompare", err)
+		}
+		logger.Info().Msg("End")
+		return nil
+	}
+
+	// Predict the Rows Landing in each Partition Before Writing
+	if partitionPlan != nil {
+		partitionPlan.Start(time.Now())
+		LogPartitionPrediction(partitionPlan, partitionPlan.Predict(*numberIterations, *numberIterations))
+	}
+
+	var summary *RunSummary
+	mode := modeInsertAll
+	if scenario != nil {
+		_, summary, err = ExecuteScenario(ctx, config, scenario)
+		if err == nil {
+			logger.Info().Int("Records Sent", summary.RecordsSent).Dur("Time Taken", summary.Elapsed).Msg("Scenario Complete")
+		}
+	} else if *committedStream {
+		mode = modeCommitted
+		summary, err = ExecuteCommittedStream(ctx, config)
+	} else if *writeMode == modeStorage {
+		mode = modeStorage
+		summary, err = ExecuteInterruptible(ctx, config, ExecuteStorageStream)
+	} else if *writeMode == modeBatch {
+		mode = modeBatch
+		summary, err = ExecuteBatchLoad(ctx, config)
+	} else {
+		summary, err = ExecuteInterruptible(ctx, config, ExecuteLegacyStream)
+	}
+	// Stop the Producers, Reaping the Generator Process, the Runner having
+	// Already Drained its Streamers as the Drain Decides the Outcome of the Run
+	if generatorProcess != nil {
+		shutdown.Register(stageStopProducers, "Generator Process", func(context.Context) error {
+			generatorCPU, waitErr := generatorProcess.Wait()
+			if waitErr != nil {
+				logger.Warn().Err(waitErr).Msg("  Generator Process Exited with an Error")
+			}
+			if summary != nil {
+				logger.Info().Dur("Writer Process", summary.ProcessCPU).Dur("Generator Process", generatorCPU).Msg("CPU Time per Process")
+			}
+			return nil
+		})
+	}
+	if summary != nil {
+		shutdown.Drained("Streamers", summary.DrainElapsed)
+	} else {
+		shutdown.Skip(stageVerify, "the run ended before it had a summary of the records sent")
+	}
+
+	// Verify the Rows Landed in each Dataset when Round-Robin Streaming
+	if len(targets) > 1 && scenario == nil {
+		shutdown.Register(stageVerify, "VerifyTargets", func(ctx context.Context) error {
+			VerifyTargets(ctx, client, targets, runID)
+			return nil
+		})
+	}
+
+	// Verify the Rows Landed Match the Records Sent if Required
+	if *verifyRows {
+		shutdown.Register(stageVerify, "VerifyRowCount", func(ctx context.Context) error {
+			err := VerifyRowCount(ctx, client, targets, runID, int64(summary.RecordsSent), *verifyWindow, *dupPercent > 0, *dualWrite)
+			if err != nil && !SkippedOnInterrupt("Row Count", err) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	// Verify the Old and New Tables of a Dual Write Received the Same Records
+	if *dualWrite {
+		shutdown.Register(stageVerify, "VerifyDualWrite", func(ctx context.Context) error {
+			if err := VerifyDualWrite(ctx, client, primaryDataset, *oldTable, *newTable, runID); err != nil && !SkippedOnInterrupt("Dual Write", err) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	// Verify the Rows Landed in each Partition Match the Prediction
+	if partitionPlan != nil {
+		shutdown.Register(stageVerify, "VerifyPartitions", func(ctx context.Context) error {
+			expected := partitionPlan.Predict(summary.RecordsSent, *numberIterations)
+			if err := VerifyPartitions(ctx, client, targets, runID, partitionPlan, expected); err != nil && !SkippedOnInterrupt("Partitions", err) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	// Verify the Rows are Visible through the Analytics Hub Linked Dataset
+	if subscription != nil {
+		shutdown.Register(stageVerify, "VerifyAnalyticsHubTargets", func(ctx context.Context) error {
+			VerifyAnalyticsHubTargets(ctx, client, subscription, targets, runID)
+			return nil
+		})
+	}
+
+	// Measure the Deduplication Rate if Required, or of the Duplicates
+	// Injected into a Verified Run
+	if *measureDedupRate || (*verifyRows && *dupPercent > 0) {
+		shutdown.Register(stageVerify, "CountRunRows", func(ctx context.Context) error {
+			var count, distinct int64
+			for _, target := range targets {
+				rows, err := CountRunRows(ctx, client, target.DatasetID, target.TableID, runID)
+				if err == nil {
+					var distinctRows int64
+					distinctRows, err = CountDistinctRunRows(ctx, client, target.DatasetID, target.TableID, runID)
+					distinct += distinctRows
+				}
+				if err != nil {
+					if SkippedOnInterrupt("Deduplication Rate", err) {
+						return nil
+					}
+					return err
+				}
+				count += rows
+			}
+			LogDeduplicationRate(summary, count, distinct)
+			return nil
+		})
+	}
+
+	// Test BI Engine Compatibility if Required
+	if *biEngineTest {
+		shutdown.Register(stageVerify, "ExecuteBIEngineTest", func(ctx context.Context) error {
+			if err := ExecuteBIEngineTest(ctx, client, primaryDataset, primaryTable, runID, *numberIterations); err != nil && !SkippedOnInterrupt("BI Engine", err) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	// Query the Table Storage Statistics if Required
+	if *storageStats {
+		shutdown.Register(stageVerify, "QueryTableStorageStats", func(ctx context.Context) error {
+			stats, err := QueryTableStorageStats(ctx, client, *targetProject, primaryDataset, primaryTable)
+			if err == nil {
+				LogTableStorageStats(stats, summary.RecordsSent)
+			} else if !SkippedOnInterrupt("Storage Statistics", err) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	// Query the Most Frequent Element Values of each REPEATED Field if Required
+	if *nestedStats {
+		shutdown.Register(stageVerify, "LogNestedStats", func(ctx context.Context) error {
+			if err := LogNestedStats(ctx, client, primaryDataset, primaryTable, runID, schema); err != nil && !SkippedOnInterrupt("Nested Field Statistics", err) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	// Verify a Sample of the Rows Read through the Storage Read API if Required
+	if *verifySample > 0 {
+		shutdown.Register(stageVerify, "VerifySampleRows", func(ctx context.Context) error {
+			if err := VerifySampleRows(ctx, *targetProject, primaryDataset, primaryTable, *verifySample); err != nil && !SkippedOnInterrupt("Sample Read", err) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	// Deliver the Run Results, including those of a failed run and the timing
+	// of the stages before, to the -output file and the Cloud Run Job
+	// Submitting Process
+	var runResults *RunResults
+	shutdown.Register(stageReport, "Results", func(ctx context.Context) error {
+		if summary != nil {
+			summary.Landed, summary.Acks, summary.EstimatedSlots = landed, ackSamples, estimatedSlots
+			summary.PropagationRetries = propagationRetries
+		}
+		if budget != nil && summary != nil {
+			budget.LogSpend(summary)
+		}
+		runResults = NewRunResults(config, mode, summary, err)
+		runResults.ShutdownStages = shutdown.Timings()
+		dispatcher.Deliver(ctx, runResults)
+		return nil
+	})
+
+	// Record the Results of a Coordinated Run, the Leader Reporting the Aggregate
+	if coordinator != nil {
+		shutdown.Register(stageReport, "Coordinator", func(ctx context.Context) error {
+			if err := coordinator.Finish(ctx, summary, err); err != nil {
+				logger.Error().Err(err).Msg("Error [Coordinator.Finish]")
+			} else if coordinator.IsLeader() {
+				results, stragglers, err := coordinator.WaitForResults(ctx)
+				if err != nil {
+					logger.Error().Err(err).Msg("Error [Coordinator.WaitForResults]")
+				} else {
+					LogCoordinatedResults(results, stragglers)
+				}
+			}
+			return nil
+		})
+	}
+
+	// Compare the Run Against the Baseline, Failing the Run at the End on a
+	// Deviation with -baseline-fail
+	baselineDeviated := false
+	if baseline != nil && err == nil {
+		shutdown.Register(stageReport, "Baseline", func(context.Context) error {
+			baselineDeviated = !LogBaselineComparison(baseline, CompareBaseline(baseline, runResults))
+			return nil
+		})
+	}
+
+	// Classify the Bottleneck of a Single insertAll Run
+	if scenario == nil && !*committedStream && *writeMode != modeBatch && err == nil {
+		shutdown.Register(stageReport, "Bottleneck", func(context.Context) error {
+			LogBottleneck(ClassifyBottleneck(summary.BottleneckMeasurements(requestIDs.QuotaErrors())))
+			return nil
+		})
+	}
+
+	// Output the Records Sent by Each Worker, and their Fairness if Required
+	if workerStats != nil && err == nil {
+		shutdown.Register(stageReport, "Worker Stats", func(context.Context) error {
+			LogWorkerStats(workerStats, *numberWorkers*len(targets), *fairnessTest)
+			return nil
+		})
+	}
+
+	// Compare the Estimated Streaming Cost across the Requested Regions
+	if len(regions) > 0 && err == nil {
+		shutdown.Register(stageReport, "Region Costs", func(context.Context) error {
+			LogRegionCosts(CompareRegionCosts(regions, summary.BillableBytes), summary.BillableBytes)
+			return nil
+		})
+	}
+
+	// Output the Estimated Cost Breakdown, Extrapolated to the Monthly Volume
+	if *monthlyRecords > 0 && err == nil {
+		shutdown.Register(stageReport, "Cost Breakdown", func(context.Context) error {
+			monthlyBytes := ExtrapolateMonthlyBytes(summary.BytesSent, summary.RecordsSent, *monthlyRecords)
+			LogCostBreakdown(apiInsertAll,
+				ComputeCost(apiInsertAll, summary.BillableBytes, *costRegion),
+				ComputeCost(apiInsertAll, ExtrapolateMonthlyBytes(summary.BillableBytes, summary.RecordsSent, *monthlyRecords), *costRegion))
+			LogCostBreakdown(apiStorage,
+				ComputeCost(apiStorage, summary.BytesSent, *costRegion),
+				ComputeCost(apiStorage, monthlyBytes, *costRegion))
+			return nil
+		})
+	}
+
+	// Shut Down in Order, Verifying Only Once the Streamers have Drained
+	shutdownErr := shutdown.Run(ctx, err)
+	if err != nil {
+		runErr := NewBQWriteTestError(phaseStream, "ExecuteLegacyStream", err)
+		if errors.Is(err, errInterrupted) {
+			runErr.ExitCode = exitInterrupted
+		}
+		if errors.Is(err, errDrainTimeout) {
+			runErr.Err = fmt.Errorf("%w, abandoning an estimated %d records", err, summary.RecordsAbandoned)
+			runErr.ExitCode = exitDrainTimeout
+		}
+		return runErr
+	}
+	if shutdownErr != nil {
+		verifyErr := NewBQWriteTestError(phaseVerify, "Shutdown", shutdownErr)
+		if errors.Is(shutdownErr, errRowsMissing) {
+			verifyErr.ExitCode = exitRowsMissing
+		}
+		return verifyErr
+	}
+
+	if baselineDeviated && *baselineFail {
+		return &BQWriteTestError{Phase: phaseVerify, Op: "Baseline", Err: fmt.Errorf("the run deviated from the baseline %s", baseline.Name), ExitCode: exitBaselineDeviation}
+	}
+	logger.Info().Msg("End")
+	return nil
+}
+
+// ConsoleTimestampFormatter formats the console output timestamps in the
+// given location rather than the host's local time zone.
+func ConsoleTimestampFormatter(loc *time.Location) zerolog.Formatter {
+	return func(i interface{}) string {
+		value, ok := i.(string)
+		if !ok {
+			return fmt.Sprint(i)
+		}
+		t, err := time.Parse(zerolog.TimeFieldFormat, value)
+		if err != nil {
+			return value
+		}
+		return t.In(loc).Format(time.RFC3339)
+	}
+}
+
+// isFlagSet reports whether the named flag was explicitly set
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// CreateBigQueryTable will create the target BigQuery table if required,
+// reporting whether the table was created
+func CreateBigQueryTable(ctx context.Context, client *bigquery.Client, datasetID, tableID string, schema bigquery.Schema, layout TableLayout, overwrite bool, safe SafeMode) (bool, []ProtectedColumn, error) {
+	var createTable bool = false
+
+	// Check to see if the Table Exists, if it does, delete the table
+	table := client.Dataset(datasetID).Table(tableID)
+	tableMetaData, err := table.Metadata(ctx)
+	if err != nil {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+			createTable = true
+		} else {
+			return false, nil, err
+		}
+	}
+
+	// Refuse to write to or overwrite a table not created by the tool in safe mode
+	if err := safe.Check(datasetID, tableID, tableMetaData); err != nil {
+		return false, nil, err
+	}
+
+	// Detect the columns of an existing table protected by policy tags
+	var protected []ProtectedColumn
+	if tableMetaData != nil {
+		protected = ProtectedColumns(tableMetaData.Schema)
+	}
+
+	// If the table already exists and the overwrite flag is present, the
+	// policy tags of its columns are kept by the recreated table
+	if overwrite && tableMetaData != nil {
+		schema = WithPolicyTags(schema, tableMetaData.Schema)
+		protected = ProtectedColumns(schema)
+		logger.Info().Str("Table Name", tableID).Msg("Deleting Existing BigQuery Table")
+		if err := table.Delete(ctx); err != nil {
+			return false, nil, err
+		}
+
+		// Poll until the table is seen as deleted, for the eventual consistency issue
+		if err := AwaitTableState(ctx, table, false, tableWait); err != nil {
+			return false, nil, err
+		}
+
+		table = client.Dataset(datasetID).Table(tableID)
+		createTable = true
+	}
+
+	// Add any columns missing from an existing table, such as run_id
+	if !createTable {
+		if err := AddMissingColumns(ctx, table, tableMetaData, schema); err != nil {
+			return false, nil, err
+		}
+		if requested, existing := DescribePartitioning(layout.Partitioning), DescribePartitioning(tableMetaData.TimePartitioning); layout.Partitioning != nil && requested != existing {
+			logger.Warn().Str("Table Name", tableID).Str("Requested", requested).Str("Existing", existing).Msg("  The Existing Table is not Partitioned as Requested, -o Recreates it")
+		}
+		if requested, existing := DescribeClustering(layout.Clustering), DescribeClustering(tableMetaData.Clustering); layout.Clustering != nil && requested != existing {
+			logger.Warn().Str("Table Name", tableID).Str("Requested", requested).Str("Existing", existing).Msg("  The Existing Table is not Clustered as Requested, -o Recreates it")
+		}
+		if layout.Expiration > 0 {
+			logger.Warn().Str("Table Name", tableID).Msg("  The Existing Table Keeps its Expiration, -o Recreates it")
+		}
+	}
+
+	// Finally, Create the BigQuery Table if required
+	if createTable {
+		logger.Info().Str("Table Name", tableID).Msg("Creating BigQuery Table")
+		metadata := &bigquery.TableMetadata{Schema: schema, TimePartitioning: layout.Partitioning, Clustering: layout.Clustering, Labels: createdTableLabels}
+		if layout.Expiration > 0 {
+			metadata.ExpirationTime = time.Now().Add(layout.Expiration)
+		}
+		if err := table.Create(ctx, metadata); err != nil {
+			return false, nil, err
+		}
+
+		// Poll until the table is seen as created, for the eventual consistency issue
+		if err := AwaitTableState(ctx, table, true, tableWait); err != nil {
+			return false, nil, err
+		}
+	}
+
+	return createTable, protected, nil
+}
+
+// AddMissingColumns appends any fields from the schema which are not present
+// in an existing table, all of which must be NULLABLE.
+func AddMissingColumns(ctx context.Context, table *bigquery.Table, tableMetaData *bigquery.TableMetadata, required bigquery.Schema) error {
+	existing := make(map[string]bool, len(tableMetaData.Schema))
+	for _, field := range tableMetaData.Schema {
+		existing[field.Name] = true
+	}
+
+	schema := tableMetaData.Schema
+	for _, field := range required {
+		if !existing[field.Name] {
+			logger.Info().Str("Column Name", field.Name).Msg("  Adding Missing Column to Existing BigQuery Table")
+			schema = append(schema, field)
+		}
+	}
+	if len(schema) == len(tableMetaData.Schema) {
+		return nil
+	}
+
+	_, err := table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: schema}, tableMetaData.ETag)
+	return err
+}
+
+// ExecuteLegacyStream will establish a stream to the target BigQuery table using the legacy API
+func ExecuteLegacyStream(ctx context.Context, config *BenchmarkConfig) (*RunSummary, error) {
+	// Collect the rows the streamer workers fail to write for the error handler
+	if config.Failures == nil {
+		config.Failures = &AsyncFailures{}
+	}
+
+	// Create a BigQuery (stream) writer thread-safe client per target,
+	logger.Info().Msg("Establish BigQuery Streaming Client")
+	targets := config.StreamTargets()
+	for _, target := range targets {
+		if config.LatencySample > 0 && len(targets) > 1 {
+			target.Latency = NewLatencyRecorder(config.LatencySample)
+		}
+		streamer, err := NewTargetStreamer(config, target, target.BatchSize)
+		if err != nil {
+			CloseTargets(targets, config.DrainTimeout)
+			return nil, err
+		}
+		target.streamer = streamer
+	}
+
+	// You can now start writing data to your BQ table
+	var err error
+	summary := &RunSummary{Targets: targets}
+	if config.LatencySample > 0 {
+		summary.Latency = NewLatencyRecorder(config.LatencySample)
+	}
+	config.Metadata.Start(ctx, targets)
+	defer config.Metadata.Stop()
+	startTime := time.Now()
+	config.Quota.Start()
+	logger.Info().Msg("Start Streaming Data")
+	gen := config.DataGenerator()
+	var generated chan time.Time
+	if config.Timing != nil {
+		config.Timing.Reset()
+		generated = make(chan time.Time, timingStampBuffer)
+		gen = stampGenerator(gen, generated)
+	}
+	rows := newParallelGenerator(ctx, config.NumberIterations, config.RunID, gen, config.Generators, config.GeneratorBuffer())
+	if config.ReplayFile != "" {
+		if rows, err = newReplayGenerator(ctx, config.ReplayFile, config.RunID, config.ReplaySpeed); err != nil {
+			CloseTargets(targets, config.DrainTimeout)
+			return nil, err
+		}
+		if config.ReplaySpeed > 0 {
+			summary.ReplayDrift = NewLatencyRecorder(1)
+		}
+	}
+	if config.Input != nil {
+		rows = newInputGenerator(ctx, config.Input, config.RunID)
+	}
+	if config.Columnar != nil {
+		rows = config.Columnar.Rows(ctx, config.RunID)
+	}
+	config.Sizes.Reset()
+	source := NewRowSource(rows)
+	summary.WriteSample = NewLatencyRecorder(bottleneckSampleEvery)
+	summary.Retries = NewRetryTelemetry(config.RecordErrorHandler())
+	splitsBefore := config.Splitter.Splits()
+	batchesBefore := config.Batches.Count()
+	config.BatchRamp.Start()
+	cpuStart := processCPUTime()
+	var limiter *RateLimiter
+	if config.Rate > 0 {
+		limiter = NewRateLimiter(config.Rate)
+		summary.TargetRate = config.Rate
+	}
+	summary.RowBytes = config.RowBytes
+	var generatedAt time.Time
+	config.Failures.Take()
+	for {
+		// Pass the rows which the streamer workers failed to write to the
+		// error handler, ending the run unless they are skipped
+		if err = HandleAsyncFailures(config, summary); err != nil {
+			summary.Retries.Finish()
+			CloseTargets(targets, config.DrainTimeout)
+			return summary, err
+		}
+
+		// Time 1 in bottleneckSampleEvery records, scaling up the time
+		// waiting on the generator and blocked in Write
+		bottleneckSampled := summary.WriteSample.Sampled(summary.RecordsSent)
+		waitStart := time.Now()
+		held := source.Pending()
+		data, ok := source.Next(ctx)
+		if bottleneckSampled {
+			summary.GeneratorWait += time.Since(waitStart) * bottleneckSampleEvery
+		}
+		if !ok {
+			break
+		}
+		if generated != nil && !held {
+			generatedAt = <-generated
+		}
+		if config.InsertIDs {
+			if r, ok := data.(insertIDEnabler); ok {
+				r.EnableInsertID()
+			}
+		}
+
+		// Reject a record too large for any insertAll request, and stop the
+		// run once the next record would exceed the cost budget
+		size := RecordSize(data)
+		if err = config.Splitter.CheckRecord(size); err != nil {
+			CloseTargets(targets, config.DrainTimeout)
+			return summary, err
+		}
+		if config.Budget != nil && !config.Budget.Allows(summary, size) {
+			summary.BudgetExhausted = true
+			logger.Warn().Int("Records Sent", summary.RecordsSent).Msg("  Stopping as the Next Record Would Exceed the Cost Budget")
+			break
+		}
+
+		// Pace the writes to the target rate, stopping once interrupted
+		if limiter != nil && limiter.Wait(ctx) != nil {
+			break
+		}
+
+		// Distribute the records round-robin across the targets, or write
+		// each to the first then mirror it to the others when dual writing
+		target := targets[summary.RecordsSent%len(targets)]
+		if config.DualWrite {
+			target = targets[0]
+		}
+		config.Acks.Assign(data)
+		latencySampled := summary.Latency != nil && summary.Latency.Sampled(summary.RecordsSent)
+		var writeStart time.Time
+		var latency time.Duration
+		if latencySampled || bottleneckSampled || config.Timing != nil {
+			writeStart = time.Now()
+			err = target.ledger.Write(target.streamer, data)
+			latency = time.Since(writeStart)
+			if latencySampled {
+				summary.Latency.Record(latency)
+				if target.Latency != nil {
+					target.Latency.Record(latency)
+				}
+			}
+			if bottleneckSampled {
+				summary.WriteSample.Record(latency)
+				summary.WriteBlocked += latency * bottleneckSampleEvery
+			}
+		} else {
+			err = target.ledger.Write(target.streamer, data)
+		}
+		if err != nil {
+			config.Errors.Add(err)
+			switch config.RecordErrorHandler().Handle(data, err) {
+			case ActionSkip:
+				source.Ack()
+				summary.RecordsSkipped++
+				summary.Retries.Done(false)
+				continue
+			case ActionRetry:
+				summary.RecordsRetried++
+				summary.Retries.Retry()
+				continue
+			}
+
+			// Rebuild the streamer once, the unacknowledged row is then
+			// replayed into the new streamer on the next iteration
+			if target.Rebuilds >= maxStreamerRebuilds {
+				summary.Retries.Finish()
+				CloseTargets(targets, config.DrainTimeout)
+				return summary, err
+			}
+			logger.Warn().Err(err).Str("Dataset", target.DatasetID).Msg("  Rebuilding Streamer After a Write Failure")
+			if err = RebuildTarget(config, target); err != nil {
+				CloseTargets(targets, config.DrainTimeout)
+				return summary, err
+			}
+			continue
+		}
+		source.Ack()
+		summary.RecordsSent++
+		target.RecordsSent++
+		summary.Retries.Done(true)
+		config.Landed.AddSent(1)
+		config.Metadata.AddSent(1)
+		config.Quota.AddSent(1)
+		config.Acks.AddSent(data)
+		config.Heartbeat.AddSent(1)
+		config.Health.AddSent(1)
+		ObserveReplayDrift(summary.ReplayDrift, data)
+		if !generatedAt.IsZero() {
+			config.Timing.AddRecord(writeStart.Sub(generatedAt), latency)
+		}
+		if err = config.Recorder.Record(data); err != nil {
+			CloseTargets(targets, config.DrainTimeout)
+			return summary, err
+		}
+
+		// Send the record a second time when injecting duplicates
+		if config.Duplicates.Next() {
+			if err = target.ledger.Write(target.streamer, data); err != nil {
+				CloseTargets(targets, config.DrainTimeout)
+				return summary, err
+			}
+			summary.DuplicatesSent++
+		}
+		if config.DualWrite {
+			for _, mirror := range targets[1:] {
+				if err = mirror.ledger.Write(mirror.streamer, data); err != nil {
+					CloseTargets(targets, config.DrainTimeout)
+					return summary, err
+				}
+				mirror.RecordsSent++
+			}
+		}
+		config.Sizes.Add(data)
+		summary.AddRecordBytes(size)
+		config.Slots.AddIncoming(size)
+
+		if config.Verbose {
+			if math.Mod(float64(summary.RecordsSent), 10000) == 0 {
+				logger.Info().Int("Records Sent", summary.RecordsSent).Msg(indent)
+			}
+		}
+
+		// Double the batch size of a ramp, rebuilding the streamers
+		if batchSize, changed := config.BatchRamp.Next(summary.RecordsSent); changed {
+			if err = ResizeTargets(config, targets, batchSize); err != nil {
+				CloseTargets(targets, config.DrainTimeout)
+				return summary, err
+			}
+		}
+	}
+	summary.Elapsed = time.Since(startTime)
+	summary.ProcessCPU = processCPUTime() - cpuStart
+	summary.Interrupted = ctx.Err() != nil
+	config.BatchRamp.Finish(summary.RecordsSent)
+	if summary.Interrupted {
+		logger.Warn().Int("Records Sent", summary.RecordsSent).Dur("Time Taken", summary.Elapsed).Msg("  Interrupted, Summarising the Records Sent")
+	} else {
+		logger.Info().Int("Records Sent", summary.RecordsSent).Dur("Time Taken", summary.Elapsed).Msg(indent)
+	}
+	if summary.RecordsSkipped > 0 || summary.RecordsRetried > 0 {
+		logger.Info().Int("Records Skipped", summary.RecordsSkipped).Int("Records Retried", summary.RecordsRetried).Msg(indent)
+	}
+	config.Quota.Finish(summary.Elapsed)
+	summary.Retries.Finish()
+	summary.Retries.Log()
+	if summary.Latency != nil {
+		summary.Latency.Log()
+	}
+	LogReplayFidelity(summary.ReplayDrift)
+	config.Sizes.Log()
+	if len(targets) > 1 {
+		LogTargetSummary(targets, summary.Elapsed)
+	}
+	logger.Info().Msg("End Streaming Data")
+	logger.Info().Msg("Closing BigQuery Streaming Client")
+
+	// Close the streamers, replaying the rows dropped from their queues and
+	// abandoning any unflushed rows if the drain timeout expires, which is
+	// the shorter interrupt drain timeout once interrupted
+	drainConfig := *config
+	drainConfig.DrainTimeout = DrainTimeout(ctx, config)
+	drainStart := time.Now()
+	drained, err := DrainTargets(&drainConfig, targets)
+	summary.DrainElapsed = time.Since(drainStart)
+	if err != nil {
+		return summary, err
+	}
+	if !drained {
+		for _, target := range targets {
+			summary.RecordsAbandoned += EstimateUnflushedRecords(target.RecordsSent, config.NumberWorkers, CalculateWorkerQueueSize(target.BatchSize), target.BatchSize)
+		}
+		logger.Warn().Dur("Drain Timeout", drainConfig.DrainTimeout).Int("Records Abandoned", summary.RecordsAbandoned).Msg("  Streamer Failed to Drain Before the Timeout")
+		return summary, errDrainTimeout
+	}
+	if err = HandleAsyncFailures(config, summary); err != nil {
+		return summary, err
+	}
+
+	// Count the Batches Submitted once the Streamers have Sent Every Request,
+	// estimating them for the Storage Write API whose requests are not seen
+	if config.Batches != nil && config.Mode != modeStorage {
+		summary.Batches = config.Batches.Count() - batchesBefore
+	} else {
+		summary.Batches, summary.BatchesEstimated = EstimateBatches(targets), true
+	}
+	LogThroughput(summary, config.BatchSize)
+
+	// Count the Requests Split once the Streamers have Sent Every Request
+	summary.RequestSplits = config.Splitter.Splits() - splitsBefore
+	if summary.RequestSplits > 0 {
+		logger.Info().Int64("Requests Split", summary.RequestSplits).Msg(indent)
+	}
+
+	// Average the Timing Breakdown once the Streamers have Sent Every Request
+	summary.Timing = config.Timing.Averages()
+	LogTimingBreakdown(summary.Timing)
+
+	return summary, nil
+}
+
+// ExecuteStorageStream will establish a stream to the target BigQuery table
+// using the default stream of the Storage Write API, each record encoded from
+// its JSON by the schema of the table, with the same write loop and throughput
+// summary as the legacy stream
+func ExecuteStorageStream(ctx context.Context, config *BenchmarkConfig) (*RunSummary, error) {
+	storageConfig := *config
+	storageConfig.Mode = modeStorage
+	return ExecuteLegacyStream(ctx, &storageConfig)
+}
+
+// NewTargetStreamer creates the streamer for the target using the API of the
+// write mode of the run
+func NewTargetStreamer(config *BenchmarkConfig, target *StreamTarget, batchSize int) (*bqwriter.Streamer, error) {
+	if config.Mode == modeStorage {
+		return NewStorageStreamer(config, target, batchSize)
+	}
+	return NewLegacyStreamer(config, target, batchSize)
+}
+
+// NewStorageStreamer creates a BigQuery (stream) writer thread-safe client
+// for the target using the default stream of the Storage Write API.  The
+// requests are sent over gRPC, so the HTTP client options of the insertAll
+// streamer do not apply.
+func NewStorageStreamer(config *BenchmarkConfig, target *StreamTarget, batchSize int) (*bqwriter.Streamer, error) {
+	schema := config.TableSchema()
+	return bqwriter.NewStreamer(
+		context.Background(),
+		config.ProjectID,
+		target.DatasetID,
+		target.TableID,
+		&bqwriter.StreamerConfig{
+			WorkerCount:     config.NumberWorkers,
+			WorkerQueueSize: CalculateWorkerQueueSize(batchSize),
+			Logger:          &streamerLogger{tracker: config.RequestIDs, errors: config.Errors, failures: config.Failures},
+			StorageClient: &bqwriter.StorageClientConfig{
+				BigQuerySchema: &schema,
+			},
+		},
+	)
+}
+
+// NewLegacyStreamer creates a BigQuery (stream) writer thread-safe client
+// for the target using the legacy insertAll API with the given batch size.
+func NewLegacyStreamer(config *BenchmarkConfig, target *StreamTarget, batchSize int) (*bqwriter.Streamer, error) {
+	return bqwriter.NewStreamer(
+		context.Background(),
+		config.ProjectID,
+		target.DatasetID,
+		target.TableID,
+		&bqwriter.StreamerConfig{
+			WorkerCount:     config.NumberWorkers,
+			WorkerQueueSize: CalculateWorkerQueueSize(batchSize),
+			Logger:          &streamerLogger{tracker: config.RequestIDs, errors: config.Errors, failures: config.Failures},
+			InsertAllClient: &bqwriter.InsertAllClientConfig{
+				BatchSize:            batchSize,
+				FailOnInvalidRows:    true,
+				FailForUnknownValues: true,
+			},
+		},
+		config.StreamerOptions...,
+	)
+}
+
+// CloseStreamer closes the streamer in a goroutine, returning false if it has
+// not completed flushing before the timeout expires.
+func CloseStreamer(streamer *bqwriter.Streamer, timeout time.Duration) bool {
+	return CloseStreamers(timeout, streamer)
+}
+
+// CloseStreamers closes each of the streamers in parallel, returning false
+// if any have not completed flushing before the timeout expires.
+func CloseStreamers(timeout time.Duration, streamers ...*bqwriter.Streamer) bool {
+	var wg sync.WaitGroup
+	for _, streamer := range streamers {
+		if streamer == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(streamer *bqwriter.Streamer) {
+			defer wg.Done()
+			streamer.Close()
+		}(streamer)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wg.Wait()
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// EstimateUnflushedRecords estimates the upper bound of records still held by
+// the streamer workers, being the queued records plus a partial batch each.
+func EstimateUnflushedRecords(recordsSent, numberWorkers, workerQueueSize, batchSize int) int {
+	estimate := numberWorkers * (workerQueueSize + batchSize)
+	if estimate > recordsSent {
+		return recordsSent
+	}
+	return estimate
 }
 
 // CalculateWorkerQueueSize attempts to dynamically adjust the work queue size
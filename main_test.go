@@ -0,0 +1,127 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// Environment variables configuring the integration tests, which are
+// skipped unless every one of them is set
+const (
+	envTestProject     = "BQWRITE_TEST_PROJECT"
+	envTestDataset     = "BQWRITE_TEST_DATASET"
+	envTestCredentials = "BQWRITE_TEST_CREDENTIALS"
+)
+
+// integrationEnv holds the project, dataset and unique table shared by the
+// integration tests of a test run
+type integrationEnv struct {
+	ProjectID string
+	DatasetID string
+	TableID   string
+	Client    *bigquery.Client
+}
+
+// integration is the environment of the integration tests, nil when they
+// are not configured
+var integration *integrationEnv
+
+// missingIntegrationEnv lists the environment variables which are not set
+var missingIntegrationEnv []string
+
+// TestMain sets up the unique table of the integration tests when they are
+// configured, and deletes it once every test has completed
+func TestMain(m *testing.M) {
+	logger = zerolog.Nop()
+	for _, name := range []string{envTestProject, envTestDataset, envTestCredentials} {
+		if os.Getenv(name) == "" {
+			missingIntegrationEnv = append(missingIntegrationEnv, name)
+		}
+	}
+	if len(missingIntegrationEnv) > 0 {
+		os.Exit(m.Run())
+	}
+
+	ctx := context.Background()
+	client, err := bigquery.NewClient(ctx, os.Getenv(envTestProject), option.WithCredentialsFile(os.Getenv(envTestCredentials)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error [bigquery.NewClient]: %v\n", err)
+		os.Exit(1)
+	}
+	integration = &integrationEnv{
+		ProjectID: os.Getenv(envTestProject),
+		DatasetID: os.Getenv(envTestDataset),
+		TableID:   "bqwrite_test_" + strings.ReplaceAll(uuid.NewString(), "-", "_"),
+		Client:    client,
+	}
+
+	code := m.Run()
+	if err := integration.cleanup(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Error [Table.Delete] %s: %v\n", integration.TableID, err)
+		if code == 0 {
+			code = 1
+		}
+	}
+	client.Close()
+	os.Exit(code)
+}
+
+// cleanup deletes the table of the test run, if a test created it
+func (e *integrationEnv) cleanup(ctx context.Context) error {
+	err := e.Client.Dataset(e.DatasetID).Table(e.TableID).Delete(ctx)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// requireIntegration skips the test unless the integration tests are
+// configured, returning their environment otherwise
+func requireIntegration(t *testing.T) *integrationEnv {
+	t.Helper()
+	if integration == nil {
+		t.Skipf("integration tests require %s", strings.Join(missingIntegrationEnv, ", "))
+	}
+	return integration
+}
+
+func TestIntegrationCreateTable(t *testing.T) {
+	env := requireIntegration(t)
+	ctx := context.Background()
+	if _, _, err := CreateBigQueryTable(ctx, env.Client, env.DatasetID, env.TableID, tableDataBigQuerySchema, TableLayout{}, true, SafeMode{}); err != nil {
+		t.Fatalf("CreateBigQueryTable: %v", err)
+	}
+	metadata, err := env.Client.Dataset(env.DatasetID).Table(env.TableID).Metadata(ctx)
+	if err != nil {
+		t.Fatalf("Table.Metadata: %v", err)
+	}
+	if len(metadata.Schema) != len(tableDataBigQuerySchema) {
+		t.Errorf("the table has %d columns, expected %d", len(metadata.Schema), len(tableDataBigQuerySchema))
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Shortest interval between polls of the table metadata
+const metadataPollMinInterval = time.Second
+
+// MetadataPoller periodically reads the metadata of each target table while
+// the records are streamed, logging the rows and bytes committed to the
+// tables.  Streamed rows sit in the streaming buffer before being committed,
+// so the rows committed lag behind the records sent, the difference being
+// logged as the buffer lag.  A failed poll is skipped rather than affecting
+// the write workload.
+type MetadataPoller struct {
+	client   *bigquery.Client
+	interval time.Duration
+	sent     atomic.Int64
+	cancel   context.CancelFunc
+	finished chan struct{}
+}
+
+// NewMetadataPoller creates a poller reading the table metadata every
+// interval
+func NewMetadataPoller(client *bigquery.Client, interval time.Duration) *MetadataPoller {
+	return &MetadataPoller{client: client, interval: interval}
+}
+
+// AddSent accumulates the records sent, a nil poller ignores them
+func (p *MetadataPoller) AddSent(n int) {
+	if p == nil {
+		return
+	}
+	p.sent.Add(int64(n))
+}
+
+// Start begins polling the metadata of the targets in the background, the
+// rows already in the tables being taken as the baseline of the buffer lag.
+// A nil poller does nothing.
+func (p *MetadataPoller) Start(ctx context.Context, targets []*StreamTarget) {
+	if p == nil {
+		return
+	}
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.finished = make(chan struct{})
+	p.sent.Store(0)
+	baseline, _, err := p.poll(ctx, targets)
+	if err != nil {
+		logger.Debug().Err(err).Msg("  Skipping the Table Metadata Baseline")
+	}
+	logger.Info().Dur("Interval", p.interval).Uint64("Num Rows", baseline).Msg("Polling the Table Metadata")
+	go func() {
+		defer close(p.finished)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sent := p.sent.Load()
+				rows, bytes, err := p.poll(ctx, targets)
+				if err != nil {
+					if ctx.Err() == nil {
+						logger.Debug().Err(err).Msg("  Skipping a Table Metadata Poll")
+					}
+					continue
+				}
+				logger.Info().Int64("Records Sent", sent).Uint64("Num Rows", rows).Int64("Num Bytes", bytes).
+					Int64("Buffer Lag", sent-int64(rows-min(rows, baseline))).Msg("Table Metadata")
+			}
+		}
+	}()
+}
+
+// Stop ends the polling once the streamers have closed, a nil poller does
+// nothing
+func (p *MetadataPoller) Stop() {
+	if p == nil || p.cancel == nil {
+		return
+	}
+	p.cancel()
+	<-p.finished
+	p.cancel = nil
+}
+
+// poll reads the metadata of every target, bounding each read by the
+// interval so a slow poll never overlaps the next, returning the rows and
+// bytes committed across the tables
+func (p *MetadataPoller) poll(ctx context.Context, targets []*StreamTarget) (uint64, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+	var rows uint64
+	var bytes int64
+	for _, target := range targets {
+		metadata, err := p.client.Dataset(target.DatasetID).Table(target.TableID).Metadata(ctx)
+		if err != nil {
+			return 0, 0, err
+		}
+		rows += metadata.NumRows
+		bytes += metadata.NumBytes
+	}
+	return rows, bytes, nil
+}
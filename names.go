@@ -0,0 +1,62 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variable naming the names file when -names-file is not given
+const namesFileEnv = "BQWRITE_TEST_NAMES_FILE"
+
+// Maximum number of names loaded from a names file
+const maxNames = 100000
+
+// NamesFile returns the names file given by the flag, falling back to the
+// environment variable
+func NamesFile(path string) string {
+	if path != "" {
+		return path
+	}
+	return os.Getenv(namesFileEnv)
+}
+
+// LoadNames reads the names used by the generators from a file of one name
+// per line, ignoring blank lines and loading at most the first 100 000
+func LoadNames(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() && len(names) < maxNames {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			names = append(names, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("the names file %s holds no names", path)
+	}
+	return names, nil
+}
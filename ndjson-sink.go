@@ -0,0 +1,66 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// WriteNDJSONSink writes the generated records to a local file as
+// newline-delimited JSON, each line holding the row exactly as the insertAll
+// path sends it, and returns the number of records and bytes written.  The
+// file is loadable with bq load --source_format=NEWLINE_DELIMITED_JSON.
+func WriteNDJSONSink(ctx context.Context, path string, iterations int, runID string, gen dataGenerator) (int, int64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	records, written := 0, int64(0)
+	for data := range newGenerator(ctx, iterations, runID, gen) {
+		saver, ok := data.(bigquery.ValueSaver)
+		if !ok {
+			return records, written, fmt.Errorf("cannot write a record of type %T", data)
+		}
+		row, _, err := saver.Save()
+		if err != nil {
+			return records, written, err
+		}
+		line, err := json.Marshal(row)
+		if err != nil {
+			return records, written, err
+		}
+		n, err := writer.Write(append(line, '\n'))
+		if err != nil {
+			return records, written, err
+		}
+		records++
+		written += int64(n)
+	}
+	if err := writer.Flush(); err != nil {
+		return records, written, err
+	}
+	return records, written, f.Close()
+}
@@ -0,0 +1,135 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// Number of most frequent values reported for each REPEATED field
+const nestedStatsTopValues = 10
+
+// NestedValueCount is one of the most frequent element values of a REPEATED
+// field
+type NestedValueCount struct {
+	Value string
+	Count int64
+}
+
+// RepeatedFieldPaths returns the path to every REPEATED field of the schema,
+// including those nested within RECORD fields, each path holding the fields
+// from the root of the schema down to the REPEATED field
+func RepeatedFieldPaths(schema bigquery.Schema) [][]*bigquery.FieldSchema {
+	var paths [][]*bigquery.FieldSchema
+	var walk func(schema bigquery.Schema, parent []*bigquery.FieldSchema)
+	walk = func(schema bigquery.Schema, parent []*bigquery.FieldSchema) {
+		for _, field := range schema {
+			path := append(append([]*bigquery.FieldSchema(nil), parent...), field)
+			if field.Repeated {
+				paths = append(paths, path)
+			}
+			if field.Type == bigquery.RecordFieldType {
+				walk(field.Schema, path)
+			}
+		}
+	}
+	walk(schema, nil)
+	return paths
+}
+
+// FieldPathName returns the dotted name of the field path
+func FieldPathName(path []*bigquery.FieldSchema) string {
+	names := make([]string, len(path))
+	for i, field := range path {
+		names[i] = field.Name
+	}
+	return strings.Join(names, ".")
+}
+
+// NestedStatsQuery returns the query counting the element values of the
+// REPEATED field of the run, unnesting every REPEATED field along the path,
+// each value rendered as a string so values of any type can be grouped
+func NestedStatsQuery(datasetID, tableID string, path []*bigquery.FieldSchema) string {
+	from := fmt.Sprintf("`%s.%s` AS t", datasetID, tableID)
+	expr := "t"
+	for i, field := range path {
+		expr += ".`" + field.Name + "`"
+		if field.Repeated {
+			alias := fmt.Sprintf("e%d", i)
+			from += fmt.Sprintf(", UNNEST(%s) AS %s", expr, alias)
+			expr = alias
+		}
+	}
+
+	value := fmt.Sprintf("CAST(%s AS STRING)", expr)
+	switch path[len(path)-1].Type {
+	case bigquery.RecordFieldType, bigquery.JSONFieldType, bigquery.GeographyFieldType:
+		value = fmt.Sprintf("TO_JSON_STRING(%s)", expr)
+	case bigquery.BytesFieldType:
+		value = fmt.Sprintf("TO_BASE64(%s)", expr)
+	}
+	return fmt.Sprintf("SELECT %s AS value, COUNT(*) AS count FROM %s WHERE t.run_id = @run_id GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT %d", value, from, nestedStatsTopValues)
+}
+
+// QueryNestedStats returns the most frequent element values of the REPEATED
+// field among the rows of the run
+func QueryNestedStats(ctx context.Context, client *bigquery.Client, datasetID, tableID, runID string, path []*bigquery.FieldSchema) ([]NestedValueCount, error) {
+	q := client.Query(NestedStatsQuery(datasetID, tableID, path))
+	q.Parameters = []bigquery.QueryParameter{{Name: "run_id", Value: runID}}
+
+	it, err := ReadQuery(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	var counts []NestedValueCount
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			return counts, nil
+		}
+		if err != nil {
+			return nil, interruptedError(ctx, err)
+		}
+		value, _ := row[0].(string)
+		counts = append(counts, NestedValueCount{Value: value, Count: valueInt64(row[1])})
+	}
+}
+
+// LogNestedStats outputs the most frequent element values of each REPEATED
+// field, warning of a field whose elements were not found when unnested
+func LogNestedStats(ctx context.Context, client *bigquery.Client, datasetID, tableID, runID string, schema bigquery.Schema) error {
+	logger.Info().Msg("Nested Field Statistics")
+	for _, path := range RepeatedFieldPaths(schema) {
+		name := FieldPathName(path)
+		counts, err := QueryNestedStats(ctx, client, datasetID, tableID, runID, path)
+		if err != nil {
+			return err
+		}
+		if len(counts) == 0 {
+			logger.Warn().Str("Field", name).Msg("  No Elements Found when Unnesting the Field")
+			continue
+		}
+		for i, count := range counts {
+			logger.Info().Str("Field", name).Int("Rank", i+1).Str("Value", count.Value).Int64("Count", count.Count).Msg(indent)
+		}
+	}
+	return nil
+}
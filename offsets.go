@@ -0,0 +1,100 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "time"
+
+// Maximum number of offset gaps retained for the summary
+const maxOffsetGaps = 100
+
+// OffsetGap records an append whose returned offset did not match the offset
+// expected from the rows previously appended
+type OffsetGap struct {
+	Append   int   `json:"append"`
+	Rows     int   `json:"rows"`
+	Expected int64 `json:"expected_offset"`
+	Returned int64 `json:"returned_offset"`
+}
+
+// OffsetTracker tracks the offsets of the appends to a committed stream,
+// checking the offset progression was contiguous.  Gaps have historically
+// indicated silent data loss in client libraries.
+type OffsetTracker struct {
+	StreamName  string      `json:"stream_name"`
+	Appends     int         `json:"appends"`
+	NextOffset  int64       `json:"expected_final_offset"`
+	FinalOffset int64       `json:"final_offset"`
+	GapCount    int         `json:"gap_count"`
+	Gaps        []OffsetGap `json:"gaps,omitempty"`
+	Reconnects  []Reconnect `json:"reconnects,omitempty"`
+}
+
+// Reconnect records the stream being re-created after a failure, resuming
+// from the last acknowledged offset
+type Reconnect struct {
+	Time   time.Time `json:"time"`
+	Offset int64     `json:"resume_offset"`
+	Error  string    `json:"error"`
+}
+
+// Observe records the offset returned for an append of the given number of
+// rows, logging any discrepancy from the expected offset immediately.
+func (t *OffsetTracker) Observe(returned int64, rows int) {
+	t.Appends++
+	if returned != t.NextOffset {
+		gap := OffsetGap{Append: t.Appends, Rows: rows, Expected: t.NextOffset, Returned: returned}
+		t.GapCount++
+		if len(t.Gaps) < maxOffsetGaps {
+			t.Gaps = append(t.Gaps, gap)
+		}
+		logger.Warn().Str("Stream", t.StreamName).Int("Append", gap.Append).Int("Rows", rows).
+			Int64("Expected Offset", gap.Expected).Int64("Returned Offset", returned).
+			Int64("Jump", returned-gap.Expected).Msg("  Unexpected Stream Offset")
+	}
+	t.NextOffset += int64(rows)
+}
+
+// Reconnect records the stream being re-created after the failure, resuming
+// from the given offset
+func (t *OffsetTracker) Reconnect(offset int64, cause error) {
+	t.Reconnects = append(t.Reconnects, Reconnect{Time: time.Now().UTC(), Offset: offset, Error: cause.Error()})
+	logger.Warn().Err(cause).Str("Stream", t.StreamName).Int64("Resume Offset", offset).
+		Int("Reconnect", len(t.Reconnects)).Msg("  Reconnecting Stream")
+}
+
+// Finalize records the final offset of the stream reported by the API
+func (t *OffsetTracker) Finalize(rowCount int64) {
+	t.FinalOffset = rowCount
+	if rowCount != t.NextOffset {
+		logger.Warn().Str("Stream", t.StreamName).Int64("Expected Final Offset", t.NextOffset).
+			Int64("Final Offset", rowCount).Msg("  Unexpected Final Stream Offset")
+	}
+}
+
+// Contiguous reports whether every append landed at the expected offset and
+// the final offset matches the rows appended
+func (t *OffsetTracker) Contiguous() bool {
+	return t.GapCount == 0 && t.FinalOffset == t.NextOffset
+}
+
+// Log outputs the offset summary of the stream
+func (t *OffsetTracker) Log() {
+	event := logger.Info()
+	if !t.Contiguous() {
+		event = logger.Warn()
+	}
+	event.Str("Stream", t.StreamName).Int("Appends", t.Appends).Int64("Final Offset", t.FinalOffset).
+		Int("Gaps", t.GapCount).Int("Reconnects", len(t.Reconnects)).Bool("Contiguous", t.Contiguous()).Msg("Stream Offsets")
+}
@@ -0,0 +1,293 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// Column partitioning the table, which the event times are written to
+const partitionColumn = "create_time"
+
+// Layouts of the partition IDs of each granularity, in Go and BigQuery format
+var partitionLayouts = map[bigquery.TimePartitioningType][2]string{
+	bigquery.HourPartitioningType:  {"2006010215", "%Y%m%d%H"},
+	bigquery.DayPartitioningType:   {"20060102", "%Y%m%d"},
+	bigquery.MonthPartitioningType: {"200601", "%Y%m"},
+	bigquery.YearPartitioningType:  {"2006", "%Y"},
+}
+
+// Layouts accepted for the -target-partition of each granularity, a date or
+// time followed by the partition ID
+var targetPartitionLayouts = map[bigquery.TimePartitioningType][]string{
+	bigquery.HourPartitioningType:  {"2006-01-02T15", "2006-01-02 15", "2006010215"},
+	bigquery.DayPartitioningType:   {"2006-01-02", "20060102"},
+	bigquery.MonthPartitioningType: {"2006-01", "200601"},
+	bigquery.YearPartitioningType:  {"2006"},
+}
+
+// PartitionPlan partitions the table on create_time and generates the event
+// time of every record deterministically, spread evenly back over the time
+// spread from the start of the run less the event lag, so the rows landing in
+// each partition can be predicted before writing and verified afterwards.
+// With a target partition the event times are instead spread evenly across
+// that single partition.
+type PartitionPlan struct {
+	Granularity bigquery.TimePartitioningType
+	Spread      time.Duration
+	Lag         time.Duration
+	Location    *time.Location
+	Tolerance   float64
+	Mode        bigquery.FieldType
+	Target      time.Time
+	anchor      time.Time
+}
+
+// NewPartitionPlan creates the plan for the granularity, one of hour, day,
+// month or year, requiring a TIMESTAMP or DATETIME create_time column.  The
+// time zone applies to a DATETIME column, a TIMESTAMP being partitioned in UTC.
+func NewPartitionPlan(granularity string, spread, lag time.Duration, timeZone string, tolerance float64, schema bigquery.Schema) (*PartitionPlan, error) {
+	partitioning := bigquery.TimePartitioningType(strings.ToUpper(granularity))
+	if _, ok := partitionLayouts[partitioning]; !ok {
+		return nil, fmt.Errorf("invalid partition granularity %q, must be one of hour, day, month or year", granularity)
+	}
+	if spread < 0 || tolerance < 0 || tolerance > 1 {
+		return nil, fmt.Errorf("-time-spread must not be negative, and -partition-tolerance must be between 0 and 1")
+	}
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, err
+	}
+	var mode bigquery.FieldType
+	for _, field := range schema {
+		if field.Name == partitionColumn && !field.Repeated {
+			mode = field.Type
+		}
+	}
+	if mode != bigquery.TimestampFieldType && mode != bigquery.DateTimeFieldType {
+		return nil, fmt.Errorf("-partition requires a TIMESTAMP or DATETIME %s column in the table schema", partitionColumn)
+	}
+	return &PartitionPlan{Granularity: partitioning, Spread: spread, Lag: lag, Location: location, Tolerance: tolerance, Mode: mode}, nil
+}
+
+// TimePartitioning returns the partitioning of the tables created, nil for a
+// nil plan
+func (p *PartitionPlan) TimePartitioning() *bigquery.TimePartitioning {
+	if p == nil {
+		return nil
+	}
+	return &bigquery.TimePartitioning{Type: p.Granularity, Field: partitionColumn}
+}
+
+// SetTarget routes every record to the partition given by a date or time, or
+// a partition ID, of the granularity of the plan, such as 2024-01-15 or
+// 20240115 for day partitioning
+func (p *PartitionPlan) SetTarget(value string) error {
+	location := p.Location
+	if p.Mode == bigquery.TimestampFieldType {
+		location = time.UTC
+	}
+	layouts := targetPartitionLayouts[p.Granularity]
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			p.Target = t
+			return nil
+		}
+	}
+	forms := strings.NewReplacer("2006", "YYYY", "01", "MM", "02", "DD", "15", "HH").Replace(strings.Join(layouts, " or "))
+	return fmt.Errorf("-target-partition %q does not match the %s partitioning of the table, expected the form %s",
+		value, strings.ToLower(string(p.Granularity)), forms)
+}
+
+// partitionEnd returns the start of the partition following the one which
+// starts at the given time
+func (p *PartitionPlan) partitionEnd(start time.Time) time.Time {
+	switch p.Granularity {
+	case bigquery.HourPartitioningType:
+		return start.Add(time.Hour)
+	case bigquery.DayPartitioningType:
+		return start.AddDate(0, 0, 1)
+	case bigquery.MonthPartitioningType:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(1, 0, 0)
+	}
+}
+
+// Start anchors the event times at the start of the run, before predicting
+func (p *PartitionPlan) Start(now time.Time) {
+	p.anchor = now.UTC().Truncate(time.Second)
+}
+
+// Generator wraps the generator of a run of the given records, replacing the
+// create time of each with its event time.  The index of each record is
+// counted atomically, as the generator may be called by parallel
+// goroutines.  A nil plan returns the generator.
+func (p *PartitionPlan) Generator(gen dataGenerator, records int) dataGenerator {
+	if p == nil {
+		return gen
+	}
+	var next atomic.Int64
+	return func(name string, uuid int64, create_time time.Time, run_id string) interface{} {
+		eventTime := p.EventTime(int(next.Add(1)-1), records)
+		return gen(name, uuid, eventTime, run_id)
+	}
+}
+
+// EventTime returns the event time of the i-th of the records, in UTC for a
+// TIMESTAMP column, otherwise the civil time of the time zone
+func (p *PartitionPlan) EventTime(i, records int) time.Time {
+	t := p.anchor.Add(-p.Lag)
+	if !p.Target.IsZero() {
+		t = p.Target
+		if records > 0 {
+			t = t.Add(time.Duration(float64(p.partitionEnd(p.Target).Sub(p.Target)) * float64(i) / float64(records)))
+		}
+	} else if records > 0 {
+		t = t.Add(-time.Duration(float64(p.Spread) * float64(i) / float64(records)))
+	}
+	if p.Mode == bigquery.TimestampFieldType {
+		return t.UTC()
+	}
+	return t.In(p.Location)
+}
+
+// PartitionID returns the ID of the partition an event time lands in
+func (p *PartitionPlan) PartitionID(t time.Time) string {
+	return t.Format(partitionLayouts[p.Granularity][0])
+}
+
+// Predict returns the rows expected in each partition, once the first of the
+// records of the run have been sent
+func (p *PartitionPlan) Predict(sent, records int) map[string]int64 {
+	expected := make(map[string]int64)
+	for i := 0; i < sent; i++ {
+		expected[p.PartitionID(p.EventTime(i, records))]++
+	}
+	return expected
+}
+
+// CountPartitionRows counts the rows of the run landed in each partition of
+// the table
+func (p *PartitionPlan) CountPartitionRows(ctx context.Context, client *bigquery.Client, datasetID, tableID, runID string) (map[string]int64, error) {
+	partition := fmt.Sprintf("FORMAT_DATETIME('%s', %s)", partitionLayouts[p.Granularity][1], partitionColumn)
+	if p.Mode == bigquery.TimestampFieldType {
+		partition = fmt.Sprintf("FORMAT_TIMESTAMP('%s', %s, 'UTC')", partitionLayouts[p.Granularity][1], partitionColumn)
+	}
+	q := client.Query(fmt.Sprintf("SELECT %s, COUNT(*) FROM `%s.%s` WHERE run_id = @run_id GROUP BY 1", partition, datasetID, tableID))
+	q.Parameters = []bigquery.QueryParameter{{Name: "run_id", Value: runID}}
+
+	it, err := ReadQuery(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	actual := make(map[string]int64)
+	for {
+		var row []bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			return actual, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		id, _ := row[0].(string)
+		actual[id] += valueInt64(row[1])
+	}
+}
+
+// PartitionCell holds the expected and actual rows of a single partition
+type PartitionCell struct {
+	Partition string
+	Expected  int64
+	Actual    int64
+	Delta     int64
+	Mismatch  bool
+}
+
+// PartitionMatrix compares the expected and actual rows of every partition,
+// in order, a delta beyond the tolerance of the expected rows a mismatch
+func PartitionMatrix(expected, actual map[string]int64, tolerance float64) []PartitionCell {
+	partitions := make(map[string]bool)
+	for id := range expected {
+		partitions[id] = true
+	}
+	for id := range actual {
+		partitions[id] = true
+	}
+	cells := make([]PartitionCell, 0, len(partitions))
+	for id := range partitions {
+		cell := PartitionCell{Partition: id, Expected: expected[id], Actual: actual[id]}
+		cell.Delta = cell.Actual - cell.Expected
+		cell.Mismatch = math.Abs(float64(cell.Delta)) > tolerance*float64(cell.Expected)
+		cells = append(cells, cell)
+	}
+	sort.Slice(cells, func(i, j int) bool { return cells[i].Partition < cells[j].Partition })
+	return cells
+}
+
+// LogPartitionPrediction outputs the rows expected in each partition
+func LogPartitionPrediction(p *PartitionPlan, expected map[string]int64) {
+	event := logger.Info().Str("Granularity", string(p.Granularity)).Str("Mode", string(p.Mode)).Str("Time Zone", p.Location.String())
+	if p.Target.IsZero() {
+		event = event.Dur("Time Spread", p.Spread).Dur("Event Lag", p.Lag)
+	} else {
+		event = event.Str("Target Partition", p.PartitionID(p.Target))
+	}
+	event.Msg("Predicted Rows per Partition")
+	for _, cell := range PartitionMatrix(expected, nil, 1) {
+		logger.Info().Str("Partition", cell.Partition).Int64("Expected", cell.Expected).Msg(indent)
+	}
+}
+
+// VerifyPartitions counts the rows of the run landed in each partition across
+// the targets, outputting the matrix of expected and actual rows, and returns
+// an error naming the partitions whose delta exceeds the tolerance
+func VerifyPartitions(ctx context.Context, client *bigquery.Client, targets []*StreamTarget, runID string, p *PartitionPlan, expected map[string]int64) error {
+	actual := make(map[string]int64)
+	for _, target := range targets {
+		rows, err := p.CountPartitionRows(ctx, client, target.DatasetID, target.TableID, runID)
+		if err != nil {
+			return err
+		}
+		for id, count := range rows {
+			actual[id] += count
+		}
+	}
+
+	var mismatched []string
+	logger.Info().Float64("Tolerance", p.Tolerance).Msg("Partition Verification Matrix")
+	for _, cell := range PartitionMatrix(expected, actual, p.Tolerance) {
+		event := logger.Info()
+		if cell.Mismatch {
+			event = logger.Warn()
+			mismatched = append(mismatched, cell.Partition)
+		}
+		event.Str("Partition", cell.Partition).Int64("Expected", cell.Expected).Int64("Actual", cell.Actual).Int64("Delta", cell.Delta).Msg(indent)
+	}
+	if len(mismatched) > 0 {
+		return fmt.Errorf("the rows landed in partitions %s differ from the prediction beyond the tolerance of %g", strings.Join(mismatched, ", "), p.Tolerance)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+// errColumnSecurity marks a write denied by column-level security
+var errColumnSecurity = errors.New("column-level security denied writing the columns protected by policy tags")
+
+// ProtectedColumn is a column of a table under column-level security, named
+// by its dotted path, along with its policy tags
+type ProtectedColumn struct {
+	Name       string
+	PolicyTags []string
+}
+
+// ProtectedColumns returns the columns of the schema carrying policy tags,
+// including nested columns
+func ProtectedColumns(schema bigquery.Schema) []ProtectedColumn {
+	var columns []ProtectedColumn
+	var walk func(prefix string, schema bigquery.Schema)
+	walk = func(prefix string, schema bigquery.Schema) {
+		for _, field := range schema {
+			name := prefix + field.Name
+			if field.PolicyTags != nil && len(field.PolicyTags.Names) > 0 {
+				columns = append(columns, ProtectedColumn{Name: name, PolicyTags: field.PolicyTags.Names})
+			}
+			walk(name+".", field.Schema)
+		}
+	}
+	walk("", schema)
+	return columns
+}
+
+// WithPolicyTags returns a copy of the schema with the policy tags of the
+// same named columns of the existing schema, so a table recreated with -o
+// keeps its column-level security
+func WithPolicyTags(schema, existing bigquery.Schema) bigquery.Schema {
+	tagged := make(map[string]*bigquery.FieldSchema, len(existing))
+	for _, field := range existing {
+		tagged[field.Name] = field
+	}
+	copied := make(bigquery.Schema, len(schema))
+	for i, field := range schema {
+		f := *field
+		if old, ok := tagged[field.Name]; ok {
+			if f.PolicyTags == nil {
+				f.PolicyTags = old.PolicyTags
+			}
+			f.Schema = WithPolicyTags(field.Schema, old.Schema)
+		}
+		copied[i] = &f
+	}
+	return copied
+}
+
+// LogProtectedColumns outputs the columns of the table under column-level
+// security
+func LogProtectedColumns(datasetID, tableID string, columns []ProtectedColumn) {
+	logger.Info().Str("Dataset", datasetID).Str("Table", tableID).Int("Columns", len(columns)).Msg("Columns Protected by Policy Tags")
+	for _, column := range columns {
+		logger.Info().Str("Column", column.Name).Strs("Policy Tags", column.PolicyTags).Msg(indent)
+	}
+}
+
+// VerifyProtectedColumns streams a canary record, tagged with the run_id
+// suffixed by -canary, to verify the caller can write the protected columns
+// generated by the schema.  It returns the protected columns not generated,
+// which the canary cannot verify, and an error attributed to column-level
+// security if the canary is denied.
+func VerifyProtectedColumns(ctx context.Context, client *bigquery.Client, datasetID, tableID, runID string, schema bigquery.Schema, gen dataGenerator, columns []ProtectedColumn) ([]string, error) {
+	generated := make(map[string]bool)
+	for _, column := range schemaColumnNames("", schema) {
+		generated[column] = true
+	}
+	var written, unverified []string
+	for _, column := range columns {
+		if generated[column.Name] {
+			written = append(written, column.Name)
+		} else {
+			unverified = append(unverified, column.Name)
+		}
+	}
+	if len(written) == 0 {
+		return unverified, nil
+	}
+
+	canary := gen(randomNames[0], 0, time.Now().UTC(), runID+"-canary")
+	if err := client.Dataset(datasetID).Table(tableID).Inserter().Put(ctx, canary); err != nil {
+		return unverified, ColumnSecurityError(err, written)
+	}
+	return unverified, nil
+}
+
+// ColumnSecurityError attributes a permission denied writing the protected
+// columns to column-level security, rather than a generic permission error
+func ColumnSecurityError(err error, columns []string) error {
+	var apiErr *googleapi.Error
+	message := strings.ToLower(err.Error())
+	if (errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden) ||
+		strings.Contains(message, "policy tag") || strings.Contains(message, "fine-grained") || strings.Contains(message, "access denied") {
+		return fmt.Errorf("%w, %s — check the caller holds the fine-grained roles, such as Fine-Grained Reader, on their policy tags: %w",
+			errColumnSecurity, strings.Join(columns, ", "), err)
+	}
+	return err
+}
+
+// schemaColumnNames returns the dotted paths of every column of the schema
+func schemaColumnNames(prefix string, schema bigquery.Schema) []string {
+	var names []string
+	for _, field := range schema {
+		names = append(names, prefix+field.Name)
+		names = append(names, schemaColumnNames(prefix+field.Name+".", field.Schema)...)
+	}
+	return names
+}
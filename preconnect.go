@@ -0,0 +1,108 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// URL of the lightweight request sent to open each connection of the pool
+const preconnectURL = "https://bigquery.googleapis.com/bigquery/v2/projects/%s"
+
+// Maximum number of connections opened by -preconnect
+const maxPreconnect = 1000
+
+// ConnectionPool is the transport shared by the streamer clients, whose idle
+// connections are opened before streaming starts so connection establishment
+// is not included in the measured throughput
+type ConnectionPool struct {
+	connections int
+	transport   *http.Transport
+}
+
+// NewConnectionPool creates the pool, keeping up to the given number of idle
+// connections to the host rather than the default of 2
+func NewConnectionPool(connections int) *ConnectionPool {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = max(connections, transport.MaxIdleConnsPerHost)
+	transport.MaxIdleConns = max(connections, transport.MaxIdleConns)
+	return &ConnectionPool{connections: connections, transport: transport}
+}
+
+// Context returns the context under which the authenticated clients created
+// use the transport of the pool.  A nil pool returns the context as given.
+func (p *ConnectionPool) Context(ctx context.Context) context.Context {
+	if p == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: p.transport})
+}
+
+// Preconnect sends the requests opening the connections of the pool in
+// parallel, discarding the responses, returning the number of new
+// connections established.  The requests bypass the instrumented transports,
+// so are never counted as part of the run.
+func (p *ConnectionPool) Preconnect(ctx context.Context, projectID string) (int, error) {
+	client, err := google.DefaultClient(p.Context(ctx), bigquery.Scope)
+	if err != nil {
+		return 0, err
+	}
+	var established atomic.Int64
+	var wg sync.WaitGroup
+	errs := make(chan error, p.connections)
+	for i := 0; i < p.connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+				if !info.Reused {
+					established.Add(1)
+				}
+			}}
+			req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, fmt.Sprintf(preconnectURL, projectID), nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return int(established.Load()), <-errs
+}
+
+// LogPreconnect outputs the connections established before streaming, which
+// are fewer than requested when the requests are multiplexed over HTTP/2
+func LogPreconnect(requested, established int, elapsed time.Duration) {
+	logger.Info().Int("Requested", requested).Int("Established", established).Dur("Time Taken", elapsed).Msg("Pre-Connected to BigQuery")
+}
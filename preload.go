@@ -0,0 +1,115 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// PreloadBigQueryTable inserts the given number of generated rows into the
+// target table using a load job, before any measured streaming begins.  The
+// rows are tagged with their own run_id so they can be told apart from the
+// streamed rows.  The row count of the table is output before and after, so
+// a run streaming into a large table can be compared with one streaming into
+// an empty table.
+func PreloadBigQueryTable(ctx context.Context, client *bigquery.Client, datasetID, tableID, runID string, rows int, schema bigquery.Schema, gen dataGenerator) error {
+	table := client.Dataset(datasetID).Table(tableID)
+	tableMetaData, err := table.Metadata(ctx)
+	if err != nil {
+		return err
+	}
+	if tableMetaData.NumRows > 0 {
+		logger.Warn().Uint64("Existing Rows", tableMetaData.NumRows).Msg("Preloading into a Non-Empty BigQuery Table")
+	}
+
+	logger.Info().Int("Preload Rows", rows).Str("Preload Run ID", runID).Uint64("Table Rows Before", tableMetaData.NumRows).Msg("Start Preloading Data")
+	startTime := time.Now()
+	if err := LoadGeneratedRows(ctx, table, schema, runID, rows, gen); err != nil {
+		return err
+	}
+	logger.Info().Int("Records Loaded", rows).Dur("Time Taken", time.Since(startTime)).Msg(indent)
+
+	// The load job has committed once it completes, so the row count of the
+	// table metadata already includes the preloaded rows
+	tableMetaData, err = table.Metadata(ctx)
+	if err != nil {
+		return err
+	}
+	logger.Info().Uint64("Table Rows After", tableMetaData.NumRows).Msg(indent)
+	logger.Info().Msg("End Preloading Data")
+	return nil
+}
+
+// LoadGeneratedRows appends the given number of generated rows to the table
+// using a load job, ignoring any generated columns not in the schema.
+func LoadGeneratedRows(ctx context.Context, table *bigquery.Table, schema bigquery.Schema, runID string, rows int, gen dataGenerator) error {
+	// Stream the generated rows as newline delimited JSON into the load job
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeNDJSON(ctx, pw, newGenerator(ctx, rows, runID, gen)))
+	}()
+
+	source := bigquery.NewReaderSource(pr)
+	source.SourceFormat = bigquery.JSON
+	source.Schema = schema
+	source.IgnoreUnknownValues = true
+
+	loader := table.LoaderFrom(source)
+	loader.WriteDisposition = bigquery.WriteAppend
+
+	job, err := loader.Run(ctx)
+	if err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// writeNDJSON encodes each generated record as a line of newline delimited
+// JSON, using the row produced by bigquery.ValueSaver.Save.
+func writeNDJSON(ctx context.Context, w io.Writer, records <-chan interface{}) error {
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	for data := range records {
+		saver, ok := data.(bigquery.ValueSaver)
+		if !ok {
+			return fmt.Errorf("record of type %T does not implement bigquery.ValueSaver", data)
+		}
+		row, _, err := saver.Save()
+		if err != nil {
+			return err
+		}
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,200 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Bytes per GiB, BigQuery pricing is quoted per GiB
+const bytesPerGiB = 1024 * 1024 * 1024
+
+// Minimum billable size of a single streamed row
+const minimumBillableRowBytes = 1024
+
+// streamingPricePerGiB holds the on-demand streaming insert list price in USD
+// per GiB for each region. Prices change over time and negotiated rates
+// differ, so these can be replaced using --pricing-overrides.
+var streamingPricePerGiB = map[string]float64{
+	"US":                      0.050,
+	"EU":                      0.050,
+	"us-central1":             0.050,
+	"us-east1":                0.050,
+	"us-east4":                0.050,
+	"us-west1":                0.050,
+	"us-west2":                0.060,
+	"northamerica-northeast1": 0.055,
+	"southamerica-east1":      0.075,
+	"europe-west1":            0.055,
+	"europe-west2":            0.060,
+	"europe-west3":            0.060,
+	"europe-north1":           0.055,
+	"asia-east1":              0.055,
+	"asia-northeast1":         0.060,
+	"asia-south1":             0.060,
+	"asia-southeast1":         0.060,
+	"australia-southeast1":    0.065,
+}
+
+// RegionCost holds the estimated streaming cost for a single region
+type RegionCost struct {
+	Region   string
+	Cost     float64
+	Cheapest bool
+}
+
+// LoadPricingOverrides replaces the hardcoded streaming prices with those
+// read from a JSON file containing a map of region to USD per GiB.
+func LoadPricingOverrides(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var overrides map[string]float64
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return fmt.Errorf("failed to parse pricing overrides %q: %w", path, err)
+	}
+
+	for region, price := range overrides {
+		if price < 0 {
+			return fmt.Errorf("pricing override for region %q must not be negative", region)
+		}
+		streamingPricePerGiB[region] = price
+	}
+	return nil
+}
+
+// ParseRegions splits a comma separated list of regions, verifying pricing
+// data is available for each of them.
+func ParseRegions(value string) ([]string, error) {
+	var regions []string
+	for _, region := range SplitList(value) {
+		if _, ok := streamingPricePerGiB[region]; !ok {
+			return nil, fmt.Errorf("no streaming pricing data for region %q, add it using --pricing-overrides", region)
+		}
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
+
+// BigQueryStreamingPricing returns the estimated streaming insert cost in USD
+// for the given number of billable bytes in the region.
+func BigQueryStreamingPricing(region string, bytes int64) float64 {
+	return float64(bytes) / bytesPerGiB * streamingPricePerGiB[region]
+}
+
+// CompareRegionCosts estimates the streaming cost in each region, flagging
+// the cheapest option.
+func CompareRegionCosts(regions []string, bytes int64) []RegionCost {
+	costs := make([]RegionCost, 0, len(regions))
+	cheapest := -1
+	for i, region := range regions {
+		costs = append(costs, RegionCost{Region: region, Cost: BigQueryStreamingPricing(region, bytes)})
+		if cheapest < 0 || costs[i].Cost < costs[cheapest].Cost {
+			cheapest = i
+		}
+	}
+	if cheapest >= 0 {
+		costs[cheapest].Cheapest = true
+	}
+	return costs
+}
+
+// LogRegionCosts outputs the estimated streaming cost per region
+func LogRegionCosts(costs []RegionCost, bytes int64) {
+	logger.Info().Int64("Billable Bytes", bytes).Msg("Estimated Streaming Cost by Region")
+	for _, cost := range costs {
+		event := logger.Info().Str("Region", cost.Region).Str("Cost (USD)", fmt.Sprintf("%.6f", cost.Cost))
+		if cost.Cheapest {
+			event.Bool("Cheapest", true)
+		}
+		event.Msg(indent)
+	}
+}
+
+// Supported write APIs used when computing the cost of a run
+const (
+	apiInsertAll = "insertall"
+	apiStorage   = "storage"
+)
+
+// Storage Write API and storage list prices in USD per GiB for the US
+// multi-region, scaled for other regions relative to the streaming price.
+const (
+	storageWriteTierBytes       = 10 * 1024 * bytesPerGiB
+	storageWriteTierPricePerGiB = 0.025
+	storageWriteOveragePerGiB   = 0.020
+	activeStoragePricePerGiB    = 0.020
+)
+
+// CostBreakdown holds the estimated cost in USD of writing a volume of data
+// using one of the write APIs, including one month of active storage.
+type CostBreakdown struct {
+	StorageWriteFirst10TB float64 `json:"storage_write_first_10TB"`
+	StorageWriteOverage   float64 `json:"storage_write_overage"`
+	StreamingInsert       float64 `json:"streaming_insert"`
+	Storage               float64 `json:"storage"`
+}
+
+// Total returns the sum of all cost components
+func (c CostBreakdown) Total() float64 {
+	return c.StorageWriteFirst10TB + c.StorageWriteOverage + c.StreamingInsert + c.Storage
+}
+
+// ComputeCost estimates the cost of writing the given number of bytes into
+// the region using the named write API.
+func ComputeCost(api string, bytesWritten int64, region string) CostBreakdown {
+	multiplier := 1.0
+	if price, ok := streamingPricePerGiB[region]; ok && streamingPricePerGiB["US"] > 0 {
+		multiplier = price / streamingPricePerGiB["US"]
+	}
+
+	var cost CostBreakdown
+	switch api {
+	case apiStorage:
+		tierBytes, overageBytes := bytesWritten, int64(0)
+		if tierBytes > storageWriteTierBytes {
+			tierBytes, overageBytes = storageWriteTierBytes, bytesWritten-storageWriteTierBytes
+		}
+		cost.StorageWriteFirst10TB = float64(tierBytes) / bytesPerGiB * storageWriteTierPricePerGiB * multiplier
+		cost.StorageWriteOverage = float64(overageBytes) / bytesPerGiB * storageWriteOveragePerGiB * multiplier
+	default:
+		cost.StreamingInsert = BigQueryStreamingPricing(region, bytesWritten)
+	}
+	cost.Storage = float64(bytesWritten) / bytesPerGiB * activeStoragePricePerGiB * multiplier
+	return cost
+}
+
+// ExtrapolateMonthlyBytes scales the bytes written by a run up to the given
+// number of records per month.
+func ExtrapolateMonthlyBytes(bytesWritten int64, recordsSent, monthlyRecords int) int64 {
+	if recordsSent == 0 {
+		return 0
+	}
+	return int64(float64(bytesWritten) / float64(recordsSent) * float64(monthlyRecords))
+}
+
+// LogCostBreakdown outputs the per-run and monthly cost breakdown for an API
+func LogCostBreakdown(api string, perRun, monthly CostBreakdown) {
+	logger.Info().Str("API", api).Msg("Estimated Cost Breakdown (USD)")
+	logger.Info().Str("Per Run", fmt.Sprintf("%.6f", perRun.StorageWriteFirst10TB)).Str("Monthly", fmt.Sprintf("%.2f", monthly.StorageWriteFirst10TB)).Msg("  storage_write_first_10TB")
+	logger.Info().Str("Per Run", fmt.Sprintf("%.6f", perRun.StorageWriteOverage)).Str("Monthly", fmt.Sprintf("%.2f", monthly.StorageWriteOverage)).Msg("  storage_write_overage")
+	logger.Info().Str("Per Run", fmt.Sprintf("%.6f", perRun.StreamingInsert)).Str("Monthly", fmt.Sprintf("%.2f", monthly.StreamingInsert)).Msg("  streaming_insert")
+	logger.Info().Str("Per Run", fmt.Sprintf("%.6f", perRun.Storage)).Str("Monthly", fmt.Sprintf("%.2f", monthly.Storage)).Msg("  storage")
+	logger.Info().Str("Per Run", fmt.Sprintf("%.6f", perRun.Total())).Str("Monthly", fmt.Sprintf("%.2f", monthly.Total())).Msg("  total")
+}
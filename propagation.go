@@ -0,0 +1,115 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+// Backoff between propagation retries and polls of the table metadata,
+// doubling from the initial backoff
+const (
+	propagationInitialBackoff = 250 * time.Millisecond
+	propagationMaxBackoff     = 5 * time.Second
+)
+
+// AwaitTableState polls the metadata of a table just created or deleted,
+// with a backoff doubling from the initial backoff, until the table is seen
+// to exist or not as expected, returning an error once the timeout passes.
+// A timeout of zero returns at once.
+func AwaitTableState(ctx context.Context, table *bigquery.Table, exists bool, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	state := "Created"
+	if !exists {
+		state = "Deleted"
+	}
+	logger.Info().Dur("Initial Poll Interval", propagationInitialBackoff).Dur("Max Poll Interval", propagationMaxBackoff).Dur("Timeout", timeout).
+		Msgf("  Waiting for the Table to be Seen as %s", state)
+
+	start := time.Now()
+	backoff := propagationInitialBackoff
+	for polls := 1; ; polls++ {
+		_, err := table.Metadata(ctx)
+		var apiErr *googleapi.Error
+		notFound := errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+		if err != nil && !notFound {
+			return err
+		}
+		if notFound != exists {
+			logger.Info().Int("Polls", polls).Dur("Time Taken", time.Since(start)).Msg(indent)
+			return nil
+		}
+		if time.Since(start)+backoff > timeout {
+			return fmt.Errorf("table %s.%s was not seen as %s within the -table-wait of %s", table.DatasetID, table.TableID, strings.ToLower(state), timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > propagationMaxBackoff {
+			backoff = propagationMaxBackoff
+		}
+	}
+}
+
+// AwaitTablePropagation streams a single probe record, tagged with the run_id
+// suffixed by -probe, into a table the tool has just created.  A notFound
+// within the window after the table was created means the streaming frontend
+// has not yet learned about the table, so it is retried with a short backoff
+// and counted as a propagation retry.  Outside the window notFound remains a
+// hard error.
+func AwaitTablePropagation(ctx context.Context, client *bigquery.Client, datasetID, tableID, runID string, gen dataGenerator, created time.Time, window time.Duration) (int, error) {
+	inserter := client.Dataset(datasetID).Table(tableID).Inserter()
+	probe := gen(randomNames[0], 0, time.Now().UTC(), runID+"-probe")
+
+	retries := 0
+	backoff := propagationInitialBackoff
+	for {
+		err := inserter.Put(ctx, probe)
+		if err == nil {
+			return retries, nil
+		}
+
+		var apiErr *googleapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+			return retries, err
+		}
+		if time.Since(created)+backoff > window {
+			return retries, fmt.Errorf("table %s.%s was not found %s after it was created: %w", datasetID, tableID, window, err)
+		}
+
+		retries++
+		select {
+		case <-ctx.Done():
+			return retries, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > propagationMaxBackoff {
+			backoff = propagationMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Records between the quota lines logged during the run
+const quotaLogRecords = 1000
+
+// Default rows per second limit the estimated quota utilization is measured
+// against
+const defaultQuotaRowsPerSecond = 10000
+
+// Response headers carrying the remaining quota and its limit, should the
+// service return them, in the order looked for
+var (
+	quotaRemainingHeaders = []string{"X-RateLimit-Remaining", "RateLimit-Remaining"}
+	quotaLimitHeaders     = []string{"X-RateLimit-Limit", "RateLimit-Limit"}
+)
+
+// QuotaMeter measures the quota consumed by the run.  The remaining quota
+// is taken from the rate limit headers of the insertAll responses when the
+// service returns them, otherwise the utilization is estimated as the
+// records per second written relative to the rows per second limit.
+type QuotaMeter struct {
+	limit int
+	start time.Time
+	sent  atomic.Int64
+
+	mu        sync.Mutex
+	remaining int64
+	quota     int64
+	observed  bool
+}
+
+// NewQuotaMeter creates the meter estimating the utilization against the
+// rows per second limit
+func NewQuotaMeter(rowsPerSecond int) *QuotaMeter {
+	return &QuotaMeter{limit: rowsPerSecond}
+}
+
+// Start begins measuring the records per second, a nil meter does nothing
+func (m *QuotaMeter) Start() {
+	if m == nil {
+		return
+	}
+	m.start = time.Now()
+	m.sent.Store(0)
+}
+
+// AddSent accumulates the records written, logging the quota every 1000
+// records.  A nil meter ignores them.
+func (m *QuotaMeter) AddSent(n int) {
+	if m == nil {
+		return
+	}
+	sent := m.sent.Add(int64(n))
+	if sent/quotaLogRecords != (sent-int64(n))/quotaLogRecords {
+		m.log("Quota", sent, time.Since(m.start))
+	}
+}
+
+// Finish logs the quota utilization of the whole run, a nil meter does
+// nothing
+func (m *QuotaMeter) Finish(elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.log("  Quota Utilization", m.sent.Load(), elapsed)
+}
+
+// log outputs the remaining quota from the response headers when observed,
+// otherwise the utilization estimated from the records per second
+func (m *QuotaMeter) log(message string, sent int64, elapsed time.Duration) {
+	m.mu.Lock()
+	remaining, quota, observed := m.remaining, m.quota, m.observed
+	m.mu.Unlock()
+	if observed && quota > 0 {
+		logger.Info().Int64("Records Sent", sent).Int64("Remaining", remaining).Int64("Limit", quota).
+			Str("Remaining %", fmt.Sprintf("%.1f", float64(remaining)/float64(quota)*100)).Str("Source", "headers").Msg(message)
+		return
+	}
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(sent) / elapsed.Seconds()
+	}
+	logger.Info().Int64("Records Sent", sent).Str("Records per Second", fmt.Sprintf("%.1f", rate)).Int("Limit", m.limit).
+		Str("Utilization %", fmt.Sprintf("%.1f", rate/float64(m.limit)*100)).Str("Source", "estimated").Msg(message)
+}
+
+// observe records the remaining quota and its limit from the headers of a
+// response, ignoring a response without them
+func (m *QuotaMeter) observe(header http.Header) {
+	remaining, ok := quotaHeader(header, quotaRemainingHeaders)
+	if !ok {
+		return
+	}
+	quota, _ := quotaHeader(header, quotaLimitHeaders)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remaining, m.quota, m.observed = remaining, quota, true
+}
+
+// quotaHeader returns the integer value of the first of the headers present
+func quotaHeader(header http.Header, names []string) (int64, bool) {
+	for _, name := range names {
+		if value := header.Get(name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// quotaTransport exposes the headers of every insertAll response made
+// through it to the quota meter
+type quotaTransport struct {
+	base  http.RoundTripper
+	meter *QuotaMeter
+}
+
+// Transport wraps the base transport, observing the quota headers of every
+// insertAll response made through it
+func (m *QuotaMeter) Transport(base http.RoundTripper) http.RoundTripper {
+	return &quotaTransport{base: base, meter: m}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *quotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && isInsertAll(req) {
+		t.meter.observe(resp.Header)
+	}
+	return resp, err
+}
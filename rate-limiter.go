@@ -0,0 +1,87 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// RateLimiter is a token bucket used to pace writes to a target rate in
+// records per second.  A rate of zero means unlimited.
+type RateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a token bucket for the given records per second
+func NewRateLimiter(rate float64) *RateLimiter {
+	r := &RateLimiter{}
+	r.SetRate(rate)
+	return r
+}
+
+// SetRate changes the target rate, allowing a burst of roughly 10ms worth of
+// records so high rates sleep in batches rather than per record.
+func (r *RateLimiter) SetRate(rate float64) {
+	r.rate = rate
+	r.burst = rate / 100
+	if r.burst < 1 {
+		r.burst = 1
+	}
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+}
+
+// Rate returns the current target rate
+func (r *RateLimiter) Rate() float64 {
+	return r.rate
+}
+
+// Wait blocks until a single record may be written or the context is done
+func (r *RateLimiter) Wait(ctx context.Context) error {
+	if r.rate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	if r.last.IsZero() {
+		r.last = now
+		r.tokens = 1
+	}
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		wait := time.Duration((1 - r.tokens) / r.rate * float64(time.Second))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		r.tokens += time.Since(r.last).Seconds() * r.rate
+		r.last = time.Now()
+	}
+	r.tokens--
+	return nil
+}
@@ -0,0 +1,313 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Number of recent failing requests retained for the summary
+const maxRecentFailedRequests = 20
+
+// Response headers which may carry a request identifier, in order of preference
+var requestIDHeaders = []string{"X-Goog-Request-Id", "X-Request-Id", "X-Cloud-Trace-Context"}
+
+// RequestRecord holds the identifying details of a single API request
+type RequestRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// RequestIDTracker retains a bounded list of recent failing requests and,
+// optionally, records every request observed to a file.
+type RequestIDTracker struct {
+	mu       sync.Mutex
+	recent   []RequestRecord
+	failures int
+	quota    int
+	file     *os.File
+	writer   *bufio.Writer
+}
+
+// NewRequestIDTracker creates a tracker, recording every request to the
+// given file when the path is not empty.
+func NewRequestIDTracker(path string) (*RequestIDTracker, error) {
+	tracker := &RequestIDTracker{}
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		tracker.file = f
+		tracker.writer = bufio.NewWriter(f)
+	}
+	return tracker, nil
+}
+
+// CaptureAll reports whether every request is being recorded to a file
+func (t *RequestIDTracker) CaptureAll() bool {
+	return t.writer != nil
+}
+
+// ObserveError records a failed request, extracting the request identifier
+// from either the HTTP response headers or the gRPC status details.
+func (t *RequestIDTracker) ObserveError(err error) {
+	record := RequestRecord{Time: time.Now().UTC(), RequestID: RequestIDFromError(err), Status: "error", Error: err.Error()}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		record.Status = fmt.Sprint(apiErr.Code)
+	} else if s, ok := status.FromError(err); ok {
+		record.Status = s.Code().String()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures++
+	if IsQuotaError(err) {
+		t.quota++
+	}
+	t.recent = append(t.recent, record)
+	if len(t.recent) > maxRecentFailedRequests {
+		t.recent = t.recent[1:]
+	}
+	t.writeRecord(record)
+}
+
+// ObserveResponse records a completed HTTP request when capturing every
+// request, and retains it as a failure when the status is not successful.
+func (t *RequestIDTracker) ObserveResponse(resp *http.Response) {
+	record := RequestRecord{Time: time.Now().UTC(), RequestID: requestIDFromHeader(resp.Header), Status: fmt.Sprint(resp.StatusCode)}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if resp.StatusCode >= http.StatusBadRequest {
+		record.Error = fmt.Sprintf("%s %s", resp.Request.Method, resp.Request.URL.Path)
+		t.failures++
+		if resp.StatusCode == http.StatusTooManyRequests {
+			t.quota++
+		}
+		t.recent = append(t.recent, record)
+		if len(t.recent) > maxRecentFailedRequests {
+			t.recent = t.recent[1:]
+		}
+	}
+	t.writeRecord(record)
+}
+
+// writeRecord appends a request to the capture file, the caller holds the lock
+func (t *RequestIDTracker) writeRecord(record RequestRecord) {
+	if t.writer == nil {
+		return
+	}
+	fmt.Fprintf(t.writer, "%s\t%s\t%s\t%s\n", record.Time.Format(time.RFC3339Nano), record.Status, record.RequestID, record.Error)
+}
+
+// Recent returns the most recent failing requests, oldest first
+func (t *RequestIDTracker) Recent() []RequestRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]RequestRecord(nil), t.recent...)
+}
+
+// Failures returns the total number of failed requests observed
+func (t *RequestIDTracker) Failures() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failures
+}
+
+// QuotaErrors returns the number of failed requests rejected by a quota or
+// rate limit
+func (t *RequestIDTracker) QuotaErrors() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.quota
+}
+
+// Close flushes and closes the capture file
+func (t *RequestIDTracker) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.writer == nil {
+		return nil
+	}
+	if err := t.writer.Flush(); err != nil {
+		t.file.Close()
+		return err
+	}
+	return t.file.Close()
+}
+
+// Log outputs the error section of the summary, listing the recent failing
+// requests so they can be quoted when escalating to Google support.
+func (t *RequestIDTracker) Log() {
+	recent := t.Recent()
+	if len(recent) == 0 {
+		return
+	}
+	logger.Info().Int("Failed Requests", t.Failures()).Msg("Errors")
+	for _, record := range recent {
+		logger.Info().Time("Time", record.Time).Str("Request ID", record.RequestID).Str("Status", record.Status).Str("Error", record.Error).Msg(indent)
+	}
+}
+
+// IsQuotaError reports whether the error was caused by a quota or rate limit
+func IsQuotaError(err error) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if apiErr.Code == http.StatusTooManyRequests {
+			return true
+		}
+		for _, item := range apiErr.Errors {
+			if item.Reason == "quotaExceeded" || item.Reason == "rateLimitExceeded" {
+				return true
+			}
+		}
+		return false
+	}
+	return status.Code(err) == codes.ResourceExhausted
+}
+
+// RequestIDFromError extracts a request identifier from an API error
+func RequestIDFromError(err error) string {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return requestIDFromHeader(apiErr.Header)
+	}
+	if s, ok := status.FromError(err); ok {
+		for _, detail := range s.Details() {
+			if info, ok := detail.(*errdetails.RequestInfo); ok {
+				return info.GetRequestId()
+			}
+		}
+	}
+	return ""
+}
+
+// requestIDFromHeader returns the first request identifier header present
+func requestIDFromHeader(header http.Header) string {
+	for _, name := range requestIDHeaders {
+		if value := header.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// instrumentedTransport exposes the response metadata of every request made
+// through it to the request ID tracker.
+type instrumentedTransport struct {
+	base    http.RoundTripper
+	tracker *RequestIDTracker
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.tracker.ObserveError(err)
+		return resp, err
+	}
+	t.tracker.ObserveResponse(resp)
+	return resp, nil
+}
+
+// Transport wraps the base transport, exposing every request made through it
+// to the request ID tracker
+func (t *RequestIDTracker) Transport(base http.RoundTripper) http.RoundTripper {
+	return &instrumentedTransport{base: base, tracker: t}
+}
+
+// transportWrapper wraps a base transport with one which observes every
+// request made through it, such as RequestIDTracker.Transport
+type transportWrapper func(base http.RoundTripper) http.RoundTripper
+
+// InstrumentedClientOptions returns the client options which route the
+// BigQuery client's requests through each of the wrapped transports, the
+// first wrapper being the innermost.
+func InstrumentedClientOptions(ctx context.Context, wrappers ...transportWrapper) ([]option.ClientOption, error) {
+	httpClient, err := google.DefaultClient(ctx, bigquery.Scope)
+	if err != nil {
+		return nil, err
+	}
+	for _, wrap := range wrappers {
+		httpClient.Transport = wrap(httpClient.Transport)
+	}
+	return []option.ClientOption{option.WithHTTPClient(httpClient)}, nil
+}
+
+// streamerLogger adapts zerolog for use by the bqwriter streamer, passing
+// any errors reported by the workers to the request ID tracker and, when
+// reporting errors, the error aggregator, and counting the rows reported as
+// failed for the record error handler.
+type streamerLogger struct {
+	tracker  *RequestIDTracker
+	errors   *ErrorAggregator
+	failures *AsyncFailures
+}
+
+// Debug implements log.Logger.Debug
+func (l *streamerLogger) Debug(args ...interface{}) {
+	logger.Debug().Msg(fmt.Sprint(args...))
+}
+
+// Debugf implements log.Logger.Debugf
+func (l *streamerLogger) Debugf(template string, args ...interface{}) {
+	logger.Debug().Msgf(template, args...)
+}
+
+// Error implements log.Logger.Error
+func (l *streamerLogger) Error(args ...interface{}) {
+	l.observe(args)
+	logger.Error().Msg(fmt.Sprint(args...))
+}
+
+// Errorf implements log.Logger.Errorf
+func (l *streamerLogger) Errorf(template string, args ...interface{}) {
+	l.observe(args)
+	l.failures.Observe(template, args)
+	logger.Error().Msgf(template, args...)
+}
+
+// observe passes any error arguments to the tracker
+func (l *streamerLogger) observe(args []interface{}) {
+	if l.tracker == nil {
+		return
+	}
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			l.tracker.ObserveError(err)
+			l.errors.Add(err)
+		}
+	}
+}
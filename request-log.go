@@ -0,0 +1,268 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// Bytes per MiB, the unit of the request log rotation size
+const bytesPerMiB = 1024 * 1024
+
+// Mode recorded for requests other than insertAll made by the BigQuery client
+const modeAPI = "api"
+
+// RequestLogRecord holds the details of a single API request written to the
+// request log
+type RequestLogRecord struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Mode        string    `json:"mode"`
+	Rows        int       `json:"rows"`
+	Bytes       int64     `json:"bytes"`
+	LatencyMS   float64   `json:"latency_ms"`
+	Status      string    `json:"status"`
+	ErrorReason string    `json:"error_reason,omitempty"`
+	Attempt     int       `json:"attempt"`
+	RequestID   string    `json:"request_id,omitempty"`
+}
+
+// RequestLog writes one NDJSON record per API request through a buffered
+// writer, rotating the file once it reaches the maximum size.  The rotated
+// files are suffixed with .1, .2 and so on, oldest first.
+type RequestLog struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	file     *os.File
+	writer   *bufio.Writer
+	written  int64
+	rotated  int
+	attempts map[[sha256.Size]byte]int
+}
+
+// NewRequestLog creates the request log at the given path, rotating it each
+// time it reaches maxBytes
+func NewRequestLog(path string, maxBytes int64) (*RequestLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &RequestLog{path: path, maxBytes: maxBytes, file: f, writer: bufio.NewWriter(f), attempts: make(map[[sha256.Size]byte]int)}, nil
+}
+
+// Write appends the record to the log, rotating the file first if the
+// record would take it beyond the maximum size.  A nil log ignores the
+// record.
+func (l *RequestLog) Write(record RequestLogRecord) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.written > 0 && l.written+int64(len(line)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			logger.Warn().Err(err).Str("Request Log", l.path).Msg("  Failed to Rotate the Request Log")
+			return
+		}
+	}
+	n, _ := l.writer.Write(line)
+	l.written += int64(n)
+}
+
+// rotate closes the current file, renames it with the next suffix and
+// starts a new file, the caller holds the lock
+func (l *RequestLog) rotate() error {
+	if err := l.writer.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.rotated++
+	if err := os.Rename(l.path, fmt.Sprintf("%s.%d", l.path, l.rotated)); err != nil {
+		return err
+	}
+	f, err := os.Create(l.path)
+	if err != nil {
+		return err
+	}
+	l.file, l.writer, l.written = f, bufio.NewWriter(f), 0
+	return nil
+}
+
+// Attempt returns the attempt number of a request with the given body,
+// counting the earlier failed requests sent with an identical body
+func (l *RequestLog) Attempt(body []byte, failed bool) int {
+	key := sha256.Sum256(body)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	attempt := l.attempts[key] + 1
+	if failed {
+		l.attempts[key] = attempt
+	} else {
+		delete(l.attempts, key)
+	}
+	return attempt
+}
+
+// Close flushes and closes the request log
+func (l *RequestLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.writer.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// requestLogTransport writes a request log record for every HTTP request
+// made through it, buffering the request and response bodies to count the
+// rows and extract the error reason.
+type requestLogTransport struct {
+	base http.RoundTripper
+	log  *RequestLog
+}
+
+// Transport wraps the base transport, writing a request log record for every
+// request made through it
+func (l *RequestLog) Transport(base http.RoundTripper) http.RoundTripper {
+	return &requestLogTransport{base: base, log: l}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *requestLogTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	record := RequestLogRecord{Timestamp: time.Now().UTC(), Mode: modeAPI, Bytes: int64(len(body))}
+	if isInsertAll(req) {
+		record.Mode = modeInsertAll
+		record.Rows = insertAllRowCount(body)
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	record.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		record.Status, record.ErrorReason = "error", err.Error()
+		record.Attempt = t.log.Attempt(body, true)
+		t.log.Write(record)
+		return resp, err
+	}
+
+	record.Status = fmt.Sprint(resp.StatusCode)
+	record.RequestID = requestIDFromHeader(resp.Header)
+	if resp.StatusCode >= http.StatusBadRequest || record.Mode == modeInsertAll {
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		if err == nil {
+			record.ErrorReason = responseErrorReason(data)
+		}
+	}
+	record.Attempt = t.log.Attempt(body, resp.StatusCode >= http.StatusBadRequest)
+	t.log.Write(record)
+	return resp, nil
+}
+
+// isInsertAll reports whether the request is an insertAll request
+func isInsertAll(req *http.Request) bool {
+	return strings.HasSuffix(req.URL.Path, "/insertAll")
+}
+
+// insertAllRowCount returns the number of rows in the body of an insertAll
+// request, or zero if it cannot be parsed
+func insertAllRowCount(body []byte) int {
+	var insert struct {
+		Rows []json.RawMessage `json:"rows"`
+	}
+	if json.Unmarshal(body, &insert) != nil {
+		return 0
+	}
+	return len(insert.Rows)
+}
+
+// responseErrorReason returns the reason of the first error in an API error
+// response, or of the first row error of an insertAll response
+func responseErrorReason(data []byte) string {
+	var response struct {
+		Error struct {
+			Status string `json:"status"`
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+		InsertErrors []struct {
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	if json.Unmarshal(data, &response) != nil {
+		return ""
+	}
+	switch {
+	case len(response.Error.Errors) > 0:
+		return response.Error.Errors[0].Reason
+	case response.Error.Status != "":
+		return response.Error.Status
+	case len(response.InsertErrors) > 0 && len(response.InsertErrors[0].Errors) > 0:
+		return response.InsertErrors[0].Errors[0].Reason
+	}
+	return ""
+}
+
+// LogAppend writes a request log record for an append to a committed stream,
+// completed with the given error after the latency
+func (l *RequestLog) LogAppend(sent time.Time, rows int, size int64, attempt int, err error) {
+	if l == nil {
+		return
+	}
+	record := RequestLogRecord{Timestamp: sent.UTC(), Mode: modeCommitted, Rows: rows, Bytes: size, LatencyMS: float64(time.Since(sent)) / float64(time.Millisecond), Status: "OK", Attempt: attempt}
+	if err != nil {
+		record.Status, record.ErrorReason, record.RequestID = status.Code(err).String(), err.Error(), RequestIDFromError(err)
+	}
+	l.Write(record)
+}
@@ -0,0 +1,259 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Default maximum size of an insertAll request body, safely under the
+// documented 10 MB limit of the HTTP request
+const defaultMaxRequestBytes = 9000000
+
+// Bytes of the JSON wrapping each row of an insertAll request, beyond the
+// encoded record, allowing for the insertId
+const insertAllRowOverhead = 128
+
+// RequestSplitter splits every insertAll request whose body exceeds the
+// maximum size into consecutive requests under it, merging their responses
+// so the streamer sees a single request.  The rows of a batch are accumulated
+// by the streamer by count alone, so large records and batch sizes would
+// otherwise fail the whole request.
+//
+// Should a chunk fail, the client retries the whole request, so the chunks
+// already accepted are remembered by the body of the request and skipped by
+// the retry.  The rows never carry random insert IDs, so a retried request
+// has the same body.
+type RequestSplitter struct {
+	maxBytes int
+	splits   atomic.Int64
+	mu       sync.Mutex
+	accepted map[[sha256.Size]byte]splitProgress
+}
+
+// splitProgress is the number of chunks of a split request accepted before
+// one failed, along with their row errors
+type splitProgress struct {
+	chunks       int
+	insertErrors []insertAllError
+}
+
+// NewRequestSplitter creates the splitter for the maximum request size
+func NewRequestSplitter(maxBytes int) *RequestSplitter {
+	return &RequestSplitter{maxBytes: maxBytes, accepted: make(map[[sha256.Size]byte]splitProgress)}
+}
+
+// progress returns the chunks of the request already accepted, removing
+// them until the request fails again
+func (s *RequestSplitter) progress(key [sha256.Size]byte) splitProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	progress := s.accepted[key]
+	delete(s.accepted, key)
+	return progress
+}
+
+// remember records the chunks of the request accepted before one failed
+func (s *RequestSplitter) remember(key [sha256.Size]byte, progress splitProgress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accepted[key] = progress
+}
+
+// Splits returns the number of insertAll requests split so far, zero for a
+// nil splitter
+func (s *RequestSplitter) Splits() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.splits.Load()
+}
+
+// CheckRecord rejects a record whose encoded size alone would exceed the
+// maximum request size, before it is sent.  A nil splitter accepts every
+// record.
+func (s *RequestSplitter) CheckRecord(size int) error {
+	if s == nil || size+insertAllRowOverhead <= s.maxBytes {
+		return nil
+	}
+	return fmt.Errorf("a record encodes to %d bytes, which exceeds the -max-request-bytes limit of %d on a single insertAll request", size, s.maxBytes)
+}
+
+// requestSplitTransport splits the oversized insertAll requests made through
+// it
+type requestSplitTransport struct {
+	base     http.RoundTripper
+	splitter *RequestSplitter
+}
+
+// Transport wraps the base transport, splitting every oversized insertAll
+// request made through it
+func (s *RequestSplitter) Transport(base http.RoundTripper) http.RoundTripper {
+	return &requestSplitTransport{base: base, splitter: s}
+}
+
+// insertAllRequest is the body of an insertAll request, keeping the fields
+// other than the rows as given
+type insertAllRequest struct {
+	fields map[string]json.RawMessage
+	rows   []json.RawMessage
+}
+
+// insertAllError is a row error of an insertAll response
+type insertAllError struct {
+	Index  int             `json:"index"`
+	Errors json.RawMessage `json:"errors"`
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *requestSplitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isInsertAll(req) || req.Body == nil || req.ContentLength > 0 && req.ContentLength <= int64(t.splitter.maxBytes) {
+		return t.base.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	insert, ok := parseInsertAllRequest(body)
+	if len(body) <= t.splitter.maxBytes || !ok || len(insert.rows) < 2 {
+		return t.base.RoundTrip(cloneWithBody(req, body))
+	}
+
+	chunks := insert.split(t.splitter.maxBytes)
+	key := sha256.Sum256(body)
+	progress := t.splitter.progress(key)
+	if progress.chunks == 0 {
+		t.splitter.splits.Add(1)
+		logger.Debug().Int("Bytes", len(body)).Int("Rows", len(insert.rows)).Int("Requests", len(chunks)).Msg("  Splitting an Oversized insertAll Request")
+	}
+
+	// Send each chunk in turn, skipping those accepted by an earlier attempt,
+	// and offsetting the index of its row errors by the rows of the chunks
+	// before it
+	var resp *http.Response
+	insertErrors := progress.insertErrors
+	offset := 0
+	for i, chunk := range chunks {
+		if i < progress.chunks {
+			offset += chunk.rows
+			continue
+		}
+		resp, err = t.base.RoundTrip(cloneWithBody(req, chunk.body))
+		if err != nil || resp.StatusCode >= http.StatusBadRequest {
+			t.splitter.remember(key, splitProgress{chunks: i, insertErrors: insertErrors})
+			return resp, err
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		var response struct {
+			InsertErrors []insertAllError `json:"insertErrors"`
+		}
+		if err := json.Unmarshal(data, &response); err != nil {
+			return nil, err
+		}
+		for _, insertError := range response.InsertErrors {
+			insertError.Index += offset
+			insertErrors = append(insertErrors, insertError)
+		}
+		offset += chunk.rows
+	}
+
+	merged, err := json.Marshal(map[string]interface{}{"kind": "bigquery#tableDataInsertAllResponse", "insertErrors": insertErrors})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(merged))
+	resp.ContentLength = int64(len(merged))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(merged)))
+	return resp, nil
+}
+
+// parseInsertAllRequest parses the body of an insertAll request, returning
+// false if it cannot be parsed
+func parseInsertAllRequest(body []byte) (insertAllRequest, bool) {
+	var insert insertAllRequest
+	if json.Unmarshal(body, &insert.fields) != nil {
+		return insert, false
+	}
+	if json.Unmarshal(insert.fields["rows"], &insert.rows) != nil {
+		return insert, false
+	}
+	delete(insert.fields, "rows")
+	return insert, true
+}
+
+// insertAllChunk is the body of one of the requests an insertAll request is
+// split into, along with its number of rows
+type insertAllChunk struct {
+	body []byte
+	rows int
+}
+
+// split accumulates the rows into consecutive request bodies, starting a new
+// body whenever the next row would take it beyond the maximum size.  A single
+// row beyond the maximum size is sent alone.
+func (r insertAllRequest) split(maxBytes int) []insertAllChunk {
+	fields, _ := json.Marshal(r.fields)
+	base := len(fields) + len(`,"rows":[]`)
+	var chunks []insertAllChunk
+	var rows []json.RawMessage
+	size := base
+	for _, row := range r.rows {
+		if len(rows) > 0 && size+len(row)+1 > maxBytes {
+			chunks = append(chunks, r.chunk(rows))
+			rows, size = nil, base
+		}
+		rows = append(rows, row)
+		size += len(row) + 1
+	}
+	if len(rows) > 0 {
+		chunks = append(chunks, r.chunk(rows))
+	}
+	return chunks
+}
+
+// chunk encodes the request body holding just the rows
+func (r insertAllRequest) chunk(rows []json.RawMessage) insertAllChunk {
+	fields := make(map[string]interface{}, len(r.fields)+1)
+	for key, value := range r.fields {
+		fields[key] = value
+	}
+	fields["rows"] = rows
+	body, _ := json.Marshal(fields)
+	return insertAllChunk{body: body, rows: len(rows)}
+}
+
+// cloneWithBody returns a copy of the request sending the body
+func cloneWithBody(req *http.Request, body []byte) *http.Request {
+	clone := req.Clone(req.Context())
+	clone.Body = io.NopCloser(bytes.NewReader(body))
+	clone.ContentLength = int64(len(body))
+	clone.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return clone
+}
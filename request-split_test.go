@@ -0,0 +1,103 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+func TestInsertAllRequestSplit(t *testing.T) {
+	row := json.RawMessage(`{"json":{"name":"` + strings.Repeat("x", 80) + `"}}`)
+	tests := []struct {
+		name     string
+		rows     int
+		maxBytes int
+		chunks   int
+	}{
+		{"Under the Maximum", 3, 4096, 1},
+		{"Even Split", 10, 5 * (len(row) + 1), 3},
+		{"Row Beyond the Maximum", 2, 10, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			insert := insertAllRequest{fields: map[string]json.RawMessage{"skipInvalidRows": json.RawMessage("false")}}
+			for i := 0; i < tt.rows; i++ {
+				insert.rows = append(insert.rows, row)
+			}
+			chunks := insert.split(tt.maxBytes)
+			if len(chunks) != tt.chunks {
+				t.Fatalf("%d chunks, expected %d", len(chunks), tt.chunks)
+			}
+			rows := 0
+			for _, chunk := range chunks {
+				rows += chunk.rows
+				if chunk.rows > 1 && len(chunk.body) > tt.maxBytes {
+					t.Errorf("a chunk of %d rows is %d bytes, above the maximum of %d", chunk.rows, len(chunk.body), tt.maxBytes)
+				}
+			}
+			if rows != tt.rows {
+				t.Errorf("the chunks hold %d rows, expected %d", rows, tt.rows)
+			}
+		})
+	}
+}
+
+func TestRequestSplitterRetriesOnlyTheFailedChunk(t *testing.T) {
+	server := NewFakeBigQueryServer()
+	defer server.Close()
+	server.CreateTable("bqwrite", "split", nil)
+
+	// Fail the second chunk of the first split request once, which the
+	// client retries as the whole request
+	server.SetFaultScenario(FaultScenario{UnavailableEvery: 2, UnavailableLimit: 1})
+	splitter := NewRequestSplitter(4096)
+	config := &BenchmarkConfig{
+		ProjectID:        "bqwrite-test",
+		DatasetID:        "bqwrite",
+		TableID:          "split",
+		RunID:            "split-run",
+		BatchSize:        50,
+		NumberWorkers:    1,
+		NumberIterations: 100,
+		DrainTimeout:     30 * time.Second,
+		Splitter:         splitter,
+		StreamerOptions:  FakeClientOptions(server, option.WithHTTPClient(&http.Client{Transport: splitter.Transport(http.DefaultTransport)})),
+	}
+	summary, err := ExecuteLegacyStream(context.Background(), config)
+	if err != nil {
+		t.Fatalf("ExecuteLegacyStream: %v", err)
+	}
+
+	switch {
+	case summary.RequestSplits == 0:
+		t.Fatal("no requests were split")
+	case server.FaultStats().Unavailable != 1:
+		t.Fatalf("%d chunks failed, expected 1", server.FaultStats().Unavailable)
+	}
+	sent := int64(summary.RecordsSent)
+	if got := server.RunRows("bqwrite", "split", config.RunID); got != sent {
+		t.Errorf("%d rows landed, expected the %d records sent", got, sent)
+	}
+	if got := server.RunDistinctRows("bqwrite", "split", config.RunID); got != sent {
+		t.Errorf("%d distinct rows landed, expected the %d records sent", got, sent)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Formats of the -results file
+const (
+	resultsFormatJSON = "json"
+	resultsFormatCSV  = "csv"
+)
+
+// Columns of a CSV results file, one row per run
+var resultsCSVHeader = []string{
+	"timestamp", "run_id", "hostname", "project_id", "dataset_id", "table_id", "mode",
+	"workers", "batch_size", "iterations", "records_sent", "elapsed_seconds",
+	"records_per_second", "error_count", "status", "error", "tags",
+}
+
+// ResultsCSVRecord returns the CSV row of the results, in the order of the
+// columns of resultsCSVHeader
+func ResultsCSVRecord(results *RunResults) []string {
+	return []string{
+		results.Timestamp.Format(time.RFC3339),
+		results.RunID,
+		results.Hostname,
+		results.ProjectID,
+		results.DatasetID,
+		results.TableID,
+		results.Mode,
+		strconv.Itoa(results.NumberWorkers),
+		strconv.Itoa(results.BatchSize),
+		strconv.Itoa(results.Iterations),
+		strconv.Itoa(results.RecordsSent),
+		strconv.FormatFloat(results.ElapsedSeconds, 'f', 3, 64),
+		strconv.FormatFloat(results.RecordsPerSecond, 'f', 2, 64),
+		strconv.Itoa(results.ErrorCount),
+		results.Status,
+		results.Error,
+		results.Tags.String(),
+	}
+}
+
+// csvResultsSink appends the results of each run as a row of a CSV file, so
+// the runs of a nightly job accumulate in a single file
+type csvResultsSink struct {
+	path string
+}
+
+// CSVResultsSink returns the sink appending the results to the CSV file,
+// writing the header first when the file is new or empty
+func CSVResultsSink(path string) ResultsSink {
+	return &csvResultsSink{path: path}
+}
+
+// Name implements ResultsSink
+func (s *csvResultsSink) Name() string {
+	return "csv:" + s.path
+}
+
+// Retryable implements ResultsSink, as retrying an append could write the
+// row twice
+func (s *csvResultsSink) Retryable() bool {
+	return false
+}
+
+// Render implements ResultsRenderer
+func (s *csvResultsSink) Render(results *RunResults) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(ResultsCSVRecord(results))
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Write implements ResultsSink, appending the row in a single write
+func (s *csvResultsSink) Write(ctx context.Context, data []byte) error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil && info.Size() == 0 {
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		w.Write(resultsCSVHeader)
+		w.Flush()
+		data = append(buf.Bytes(), data...)
+	}
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,206 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Attempts made to write the results to a sink which may be retried, and
+// the delay before the first retry, doubling before each further retry
+const (
+	resultsSinkAttempts = 3
+	resultsSinkBackoff  = time.Second
+)
+
+// ResultsSink is a destination the results of a run are delivered to
+type ResultsSink interface {
+	Name() string
+	Retryable() bool
+	Write(ctx context.Context, data []byte) error
+}
+
+// ResultsRenderer is implemented by a sink rendering the results in its own
+// format, in place of the JSON shared by the other sinks
+type ResultsRenderer interface {
+	Render(results *RunResults) ([]byte, error)
+}
+
+// SinkDelivery records the outcome of delivering the results to a sink
+type SinkDelivery struct {
+	Sink     string
+	Attempts int
+	Err      error
+}
+
+// ResultsDispatcher renders the results of a run once, other than for a sink
+// rendering its own format, and writes them to
+// every sink independently, so a failure of one sink neither prevents the
+// others being written nor causes them to be written twice
+type ResultsDispatcher struct {
+	sinks     []ResultsSink
+	backoff   time.Duration
+	delivered bool
+}
+
+// NewResultsDispatcher creates the dispatcher for the sinks
+func NewResultsDispatcher(sinks ...ResultsSink) *ResultsDispatcher {
+	return &ResultsDispatcher{sinks: sinks, backoff: resultsSinkBackoff}
+}
+
+// Deliver writes the results to every sink, retrying a retryable sink with
+// an increasing delay, and logs the delivery report.  A failed sink never
+// fails the run, its failure being visible in the report returned.
+func (d *ResultsDispatcher) Deliver(ctx context.Context, results *RunResults) []SinkDelivery {
+	d.delivered = true
+	if len(d.sinks) == 0 {
+		return nil
+	}
+	data, err := MarshalResults(results)
+	deliveries := make([]SinkDelivery, 0, len(d.sinks))
+	for _, sink := range d.sinks {
+		delivery := SinkDelivery{Sink: sink.Name(), Err: err}
+		sinkData := data
+		if renderer, ok := sink.(ResultsRenderer); ok {
+			sinkData, delivery.Err = renderer.Render(results)
+		}
+		if delivery.Err == nil {
+			delivery.Attempts, delivery.Err = d.write(ctx, sink, sinkData)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	LogResultsDelivery(deliveries)
+	return deliveries
+}
+
+// Delivered reports whether the results of the run have been delivered, so
+// a run ending early can deliver the results it has instead
+func (d *ResultsDispatcher) Delivered() bool {
+	return d.delivered
+}
+
+// write writes the results to the sink, returning the attempts made
+func (d *ResultsDispatcher) write(ctx context.Context, sink ResultsSink, data []byte) (int, error) {
+	attempts := 1
+	if sink.Retryable() {
+		attempts = resultsSinkAttempts
+	}
+	backoff := d.backoff
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = sink.Write(ctx, data); err == nil {
+			return attempt, nil
+		}
+		if attempt == attempts {
+			return attempt, err
+		}
+		logger.Warn().Err(err).Str("Sink", sink.Name()).Int("Attempt", attempt).Msg("  Retrying the Delivery of the Results")
+		select {
+		case <-ctx.Done():
+			return attempt, errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return attempts, err
+}
+
+// LogResultsDelivery outputs the sinks the results were delivered to, and
+// the error of each which failed
+func LogResultsDelivery(deliveries []SinkDelivery) {
+	logger.Info().Msg("Results Delivery")
+	for _, delivery := range deliveries {
+		if delivery.Err != nil {
+			logger.Warn().Err(delivery.Err).Str("Sink", delivery.Sink).Int("Attempts", delivery.Attempts).Msg("  Failed")
+			continue
+		}
+		logger.Info().Str("Sink", delivery.Sink).Int("Attempts", delivery.Attempts).Msg("  Delivered")
+	}
+}
+
+// fileResultsSink writes the results to a local file, via a temporary file
+// renamed into place so a failed write never leaves a partial file
+type fileResultsSink struct {
+	path string
+}
+
+// FileResultsSink returns the sink writing the results to the file
+func FileResultsSink(path string) ResultsSink {
+	return &fileResultsSink{path: path}
+}
+
+// Name implements ResultsSink
+func (s *fileResultsSink) Name() string {
+	return "file:" + s.path
+}
+
+// Retryable implements ResultsSink, a local write failing repeatably
+func (s *fileResultsSink) Retryable() bool {
+	return false
+}
+
+// Write implements ResultsSink
+func (s *fileResultsSink) Write(ctx context.Context, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// cloudRunResultsSink writes the results of a Cloud Run Job task to the
+// Cloud Storage location read by the submitting process
+type cloudRunResultsSink struct {
+	location string
+	task     *CloudRunTask
+}
+
+// CloudRunResultsSink returns the sink writing the results of the task
+func CloudRunResultsSink(location string, task *CloudRunTask) ResultsSink {
+	return &cloudRunResultsSink{location: location, task: task}
+}
+
+// Name implements ResultsSink
+func (s *cloudRunResultsSink) Name() string {
+	return fmt.Sprintf("cloud-run-task:%s/"+cloudRunResultsFile, s.location, s.task.Index)
+}
+
+// Retryable implements ResultsSink
+func (s *cloudRunResultsSink) Retryable() bool {
+	return true
+}
+
+// Write implements ResultsSink
+func (s *cloudRunResultsSink) Write(ctx context.Context, data []byte) error {
+	return WriteCloudRunTaskResults(ctx, s.location, s.task, data)
+}
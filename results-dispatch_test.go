@@ -0,0 +1,196 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeResultsSink is a results sink failing the given number of writes
+// before succeeding, a negative number failing every write, and optionally
+// rendering its own format
+type fakeResultsSink struct {
+	name      string
+	retryable bool
+	failures  int
+	renderErr error
+	writes    int
+	delivered int
+}
+
+// Name implements ResultsSink
+func (s *fakeResultsSink) Name() string {
+	return s.name
+}
+
+// Retryable implements ResultsSink
+func (s *fakeResultsSink) Retryable() bool {
+	return s.retryable
+}
+
+// Write implements ResultsSink
+func (s *fakeResultsSink) Write(ctx context.Context, data []byte) error {
+	s.writes++
+	if s.failures < 0 || s.writes <= s.failures {
+		return fmt.Errorf("write %d to %s failed", s.writes, s.name)
+	}
+	s.delivered++
+	return nil
+}
+
+// renderingResultsSink is a fake results sink rendering its own format
+type renderingResultsSink struct {
+	fakeResultsSink
+}
+
+// Render implements ResultsRenderer
+func (s *renderingResultsSink) Render(results *RunResults) ([]byte, error) {
+	return []byte(results.RunID), s.renderErr
+}
+
+// TestResultsDispatcherPartialFailures delivers the results to each
+// combination of failing sinks, checking every sink is written
+// independently, retried only where retryable, and never written twice once
+// delivered
+func TestResultsDispatcherPartialFailures(t *testing.T) {
+	errRender := errors.New("render failed")
+
+	tests := []struct {
+		name            string
+		fileFailures    int
+		storageFailures int
+		csvRenderErr    error
+		fileWrites      int
+		storageWrites   int
+		csvWrites       int
+	}{
+		{"Every Sink Delivered", 0, 0, nil, 1, 1, 1},
+		{"File Failed", -1, 0, nil, 1, 1, 1},
+		{"Storage Retried Twice", 0, 2, nil, 1, 3, 1},
+		{"Storage Failed", 0, -1, nil, 1, resultsSinkAttempts, 1},
+		{"CSV Failed to Render", 0, 0, errRender, 1, 1, 0},
+		{"File and Storage Failed", -1, -1, nil, 1, resultsSinkAttempts, 1},
+		{"Every Sink Failed", -1, -1, errRender, 1, resultsSinkAttempts, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := &fakeResultsSink{name: "file", failures: tt.fileFailures}
+			storage := &fakeResultsSink{name: "storage", retryable: true, failures: tt.storageFailures}
+			csv := &renderingResultsSink{fakeResultsSink{name: "csv", renderErr: tt.csvRenderErr}}
+			dispatcher := NewResultsDispatcher(file, storage, csv)
+			dispatcher.backoff = time.Millisecond
+
+			deliveries := dispatcher.Deliver(context.Background(), &RunResults{RunID: "run-1"})
+			if len(deliveries) != 3 {
+				t.Fatalf("%d deliveries, expected 3", len(deliveries))
+			}
+			sinks := []*fakeResultsSink{file, storage, &csv.fakeResultsSink}
+			writes := []int{tt.fileWrites, tt.storageWrites, tt.csvWrites}
+			for i, sink := range sinks {
+				failed := sink.failures < 0 || sink.renderErr != nil
+				switch {
+				case deliveries[i].Sink != sink.name:
+					t.Errorf("delivery %d to %s, expected %s", i, deliveries[i].Sink, sink.name)
+				case sink.writes != writes[i] || deliveries[i].Attempts != writes[i]:
+					t.Errorf("wrote %s %d times, reporting %d attempts, expected %d", sink.name, sink.writes, deliveries[i].Attempts, writes[i])
+				case failed != (deliveries[i].Err != nil):
+					t.Errorf("%s reported error %v, expected failed %t", sink.name, deliveries[i].Err, failed)
+				case !failed && sink.delivered != 1:
+					t.Errorf("delivered to %s %d times, expected once", sink.name, sink.delivered)
+				}
+			}
+		})
+	}
+}
+
+func TestResultsDispatcherCancelledRetry(t *testing.T) {
+	storage := &fakeResultsSink{name: "storage", retryable: true, failures: -1}
+	file := &fakeResultsSink{name: "file"}
+	dispatcher := NewResultsDispatcher(storage, file)
+	dispatcher.backoff = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	deliveries := dispatcher.Deliver(ctx, &RunResults{})
+	switch {
+	case !errors.Is(deliveries[0].Err, context.Canceled) || deliveries[0].Attempts != 1:
+		t.Errorf("storage reported %d attempts with error %v, expected 1 attempt cancelled", deliveries[0].Attempts, deliveries[0].Err)
+	case deliveries[1].Err != nil || file.delivered != 1:
+		t.Errorf("file reported error %v, delivered %d times, expected once", deliveries[1].Err, file.delivered)
+	}
+}
+
+func TestFileResultsSink(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name  string
+		path  string
+		valid bool
+	}{
+		{"Written", filepath.Join(dir, "results.json"), true},
+		{"Missing Directory", filepath.Join(dir, "missing", "results.json"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := FileResultsSink(tt.path).Write(context.Background(), []byte("{}\n"))
+			if (err == nil) != tt.valid {
+				t.Fatalf("Write returned %v, expected valid %t", err, tt.valid)
+			}
+			if tt.valid {
+				if data, err := os.ReadFile(tt.path); err != nil || string(data) != "{}\n" {
+					t.Errorf("read back %q, %v", data, err)
+				}
+			}
+			if temps, _ := filepath.Glob(filepath.Join(filepath.Dir(tt.path), "*.tmp")); len(temps) > 0 {
+				t.Errorf("temporary files left behind: %v", temps)
+			}
+		})
+	}
+}
+
+// TestResultsDispatcherDelivered expects the dispatcher to report the results
+// delivered once Deliver is called, so a run ending early delivers partial
+// results holding the error and the phase it ended in only when the run has
+// not delivered them
+func TestResultsDispatcherDelivered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.json")
+	dispatcher := NewResultsDispatcher(FileResultsSink(path))
+	if dispatcher.Delivered() {
+		t.Fatal("the results are delivered before Deliver is called")
+	}
+	runErr := NewBQWriteTestError(phaseCreateTable, "CreateBigQueryTable", errors.New("access denied"))
+	dispatcher.Deliver(context.Background(), NewRunResults(&BenchmarkConfig{RunID: "early"}, modeInsertAll, nil, runErr))
+	if !dispatcher.Delivered() {
+		t.Fatal("the results are not delivered once Deliver is called")
+	}
+
+	results, err := ReadResults(path)
+	switch {
+	case err != nil:
+		t.Fatalf("ReadResults: %v", err)
+	case results.Status != resultsStatusPartial:
+		t.Errorf("the results have status %s, expected %s", results.Status, resultsStatusPartial)
+	case !strings.HasPrefix(results.Error, phaseCreateTable):
+		t.Errorf("the results have error %q, expected the phase %s", results.Error, phaseCreateTable)
+	}
+}
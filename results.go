@@ -0,0 +1,272 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the results schema.  Within a major version fields are only
+// ever added, so any release reads the results of an older one; removing,
+// renaming or changing the type of a field increments the major version.
+const (
+	resultsSchemaMajor = 1
+	resultsSchemaMinor = 9
+)
+
+// Module path of the bqwriter library, whose version is recorded in the results
+const bqwriterModule = "github.com/OTA-Insight/bqwriter"
+
+// Status of the results of a run which completed, or ended early with an error
+const (
+	resultsStatusComplete = "complete"
+	resultsStatusPartial  = "partial"
+)
+
+// Version assumed of the results written before the schema was versioned,
+// which only ever added fields
+const legacyResultsSchemaVersion = "1.0"
+
+// RunResults is the machine-readable record of a run written by -output
+type RunResults struct {
+	SchemaVersion      string          `json:"schema_version"`
+	BqwriterVersion    string          `json:"bqwriter_version"`
+	RunID              string          `json:"run_id"`
+	Timestamp          time.Time       `json:"timestamp"`
+	Hostname           string          `json:"hostname,omitempty"`
+	ProjectID          string          `json:"project_id"`
+	DatasetID          string          `json:"dataset_id"`
+	TableID            string          `json:"table_id"`
+	Mode               string          `json:"mode"`
+	Status             string          `json:"status"`
+	Tags               RunTags         `json:"tags,omitempty"`
+	Kubernetes         *KubernetesInfo `json:"kubernetes,omitempty"`
+	NumberWorkers      int             `json:"workers"`
+	BatchSize          int             `json:"batch_size"`
+	Iterations         int             `json:"iterations"`
+	RecordsSent        int             `json:"records_sent"`
+	RecordsAbandoned   int             `json:"records_abandoned"`
+	RecordsSkipped     int             `json:"records_skipped"`
+	RecordsRetried     int             `json:"records_retried"`
+	RetryTelemetry     *RetryTelemetry `json:"retry_telemetry,omitempty"`
+	PropagationRetries int             `json:"propagation_retries,omitempty"`
+	ElapsedSeconds     float64         `json:"elapsed_seconds"`
+	RecordsPerSecond   float64         `json:"records_per_second"`
+	TargetRate         float64         `json:"target_records_per_second,omitempty"`
+	BytesSent          int64           `json:"bytes_sent"`
+	BytesPerSecond     float64         `json:"bytes_per_second,omitempty"`
+	Batches            int             `json:"batches,omitempty"`
+	AverageBatchFill   float64         `json:"average_batch_fill_pct,omitempty"`
+	BillableBytes      int64           `json:"billable_bytes"`
+	EstimatedCost      float64         `json:"estimated_cost,omitempty"`
+	MaxCost            float64         `json:"max_cost,omitempty"`
+	BudgetExhausted    bool            `json:"budget_exhausted,omitempty"`
+	ErrorCount         int             `json:"error_count"`
+	Error              string          `json:"error,omitempty"`
+	FailedRequests     []RequestRecord `json:"failed_requests,omitempty"`
+	ErrorReport        []ErrorGroup    `json:"error_report,omitempty"`
+	Escalations        int             `json:"heartbeat_escalations,omitempty"`
+	ReplayFidelity     *ReplayFidelity `json:"replay_fidelity,omitempty"`
+	TimingBreakdown    *TimingAverages `json:"timing_breakdown,omitempty"`
+	WriteLatency       *WriteLatency   `json:"write_latency,omitempty"`
+	Offsets            *OffsetTracker  `json:"offsets,omitempty"`
+	Landed             []LandedSample  `json:"landed,omitempty"`
+	Acks               []AckSample     `json:"ack_tokens,omitempty"`
+	EstimatedSlots     float64         `json:"estimated_processing_slots,omitempty"`
+	Sweep              []SweepResult   `json:"sweep,omitempty"`
+	Soak               []SoakSlice     `json:"soak,omitempty"`
+	SoakComparison     *SoakComparison `json:"soak_comparison,omitempty"`
+	Compare            []CompareResult `json:"compare,omitempty"`
+	CloudRunTasks      []*RunResults   `json:"cloud_run_tasks,omitempty"`
+	ShutdownStages     []StageTiming   `json:"shutdown_stages,omitempty"`
+}
+
+// NewRunResults collects the results of a run from its configuration and
+// summary, along with the error which ended the run, if any
+func NewRunResults(config *BenchmarkConfig, mode string, summary *RunSummary, err error) *RunResults {
+	results := &RunResults{
+		SchemaVersion:   ResultsSchemaVersion(),
+		BqwriterVersion: BqwriterVersion(),
+		RunID:           config.RunID,
+		Timestamp:       time.Now().UTC(),
+		ProjectID:       config.ProjectID,
+		DatasetID:       config.DatasetID,
+		TableID:         config.TableID,
+		Mode:            mode,
+		Status:          resultsStatusComplete,
+		NumberWorkers:   config.NumberWorkers,
+		BatchSize:       config.BatchSize,
+		Iterations:      config.NumberIterations,
+		Tags:            config.Tags,
+		Kubernetes:      config.Kubernetes,
+	}
+	if config.RequestIDs != nil {
+		results.FailedRequests = config.RequestIDs.Recent()
+	}
+	results.Hostname, _ = os.Hostname()
+	results.ErrorReport = config.Errors.Report()
+	for _, group := range results.ErrorReport {
+		results.ErrorCount += group.Count
+	}
+	results.Escalations = config.Heartbeat.Escalations()
+	if err != nil {
+		results.Status = resultsStatusPartial
+		results.Error = err.Error()
+	}
+	if summary == nil {
+		return results
+	}
+
+	results.RecordsSent = summary.RecordsSent
+	results.RecordsAbandoned = summary.RecordsAbandoned
+	results.RecordsSkipped = summary.RecordsSkipped
+	results.RecordsRetried = summary.RecordsRetried
+	results.RetryTelemetry = summary.Retries
+	results.PropagationRetries = summary.PropagationRetries
+	results.ElapsedSeconds = summary.Elapsed.Seconds()
+	if summary.Elapsed > 0 {
+		results.RecordsPerSecond = float64(summary.RecordsSent) / summary.Elapsed.Seconds()
+	}
+	results.TargetRate = summary.TargetRate
+	results.BytesSent = summary.BytesSent
+	throughput := NewThroughput(summary, config.BatchSize)
+	results.BytesPerSecond, results.Batches, results.AverageBatchFill = throughput.BytesPerSecond, throughput.Batches, throughput.AverageBatchFill
+	results.BillableBytes = summary.BillableBytes
+	results.BudgetExhausted = summary.BudgetExhausted
+	if config.Budget != nil {
+		results.EstimatedCost = config.Budget.EstimatedCost(config.Budget.SpentBytes(summary))
+		results.MaxCost = config.Budget.MaxCost
+	}
+	results.Offsets = summary.Offsets
+	results.Landed = summary.Landed
+	results.Acks = summary.Acks
+	results.EstimatedSlots = summary.EstimatedSlots
+	results.ReplayFidelity = NewReplayFidelity(summary.ReplayDrift)
+	results.TimingBreakdown = summary.Timing
+	results.WriteLatency = NewWriteLatency(summary.Latency)
+	return results
+}
+
+// WriteLatency holds the percentiles of the sampled write latency of a run
+type WriteLatency struct {
+	Samples int     `json:"samples"`
+	P50MS   float64 `json:"p50_ms"`
+	P95MS   float64 `json:"p95_ms"`
+	P99MS   float64 `json:"p99_ms"`
+}
+
+// NewWriteLatency summarises the write latency sampled, nil when the write
+// latency was not sampled
+func NewWriteLatency(latency *LatencyRecorder) *WriteLatency {
+	if latency == nil || latency.Count() == 0 {
+		return nil
+	}
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return &WriteLatency{
+		Samples: latency.Count(),
+		P50MS:   ms(latency.Percentile(50)),
+		P95MS:   ms(latency.Percentile(95)),
+		P99MS:   ms(latency.Percentile(99)),
+	}
+}
+
+// WriteResults writes the results as indented JSON to the given path,
+// replacing any existing file only once written in full
+func WriteResults(path string, results *RunResults) error {
+	data, err := MarshalResults(results)
+	if err != nil {
+		return err
+	}
+	return FileResultsSink(path).Write(context.Background(), data)
+}
+
+// BqwriterVersion returns the version of the bqwriter library built into the
+// binary, or unknown when the build information is not available, such as in
+// a GOPATH build, so results can be correlated with library upgrades
+func BqwriterVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != bqwriterModule {
+			continue
+		}
+		if dep.Replace != nil && dep.Replace.Version != "" {
+			return dep.Replace.Version
+		}
+		if dep.Version != "" {
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// ResultsSchemaVersion returns the version of the results schema written by
+// this release
+func ResultsSchemaVersion() string {
+	return fmt.Sprintf("%d.%d", resultsSchemaMajor, resultsSchemaMinor)
+}
+
+// ReadResults reads a results file written by -output
+func ReadResults(path string) (*RunResults, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	results, err := ParseResults(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the results %s: %w", path, err)
+	}
+	return results, nil
+}
+
+// ParseResults parses the results written by this or an older release, or
+// by a newer release of the same major version, whose added fields are
+// ignored.  Results of a newer major version are rejected.
+func ParseResults(data []byte) (*RunResults, error) {
+	var results RunResults
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, err
+	}
+	if results.SchemaVersion == "" {
+		results.SchemaVersion = legacyResultsSchemaVersion
+	}
+	major, _, _ := strings.Cut(results.SchemaVersion, ".")
+	version, err := strconv.Atoi(major)
+	if err != nil {
+		return nil, fmt.Errorf("invalid results schema version %q", results.SchemaVersion)
+	}
+	if version > resultsSchemaMajor {
+		return nil, fmt.Errorf("results schema version %s was written by a newer release, this release reads up to %d.x", results.SchemaVersion, resultsSchemaMajor)
+	}
+	return &results, nil
+}
+
+// MarshalResults encodes the results as indented JSON
+func MarshalResults(results *RunResults) ([]byte, error) {
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
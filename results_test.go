@@ -0,0 +1,86 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestReadResultsFixtures reads the results files of every historical
+// version of the results schema under testdata/results
+func TestReadResultsFixtures(t *testing.T) {
+	tests := []struct {
+		file    string
+		version string
+		valid   bool
+	}{
+		{"unversioned.json", legacyResultsSchemaVersion, true},
+		{"v1.0.json", "1.0", true},
+		{"v1.9.json", "1.9", true},
+		{"v1.10-added-field.json", "1.10", true},
+		{"v2.0.json", "", false},
+	}
+
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "results", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) != len(tests) {
+		t.Errorf("%d results fixtures, expected %d", len(fixtures), len(tests))
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			results, err := ReadResults(filepath.Join("testdata", "results", tt.file))
+			if !tt.valid {
+				if err == nil {
+					t.Fatalf("results of version %s were not rejected", results.SchemaVersion)
+				}
+				return
+			}
+			switch {
+			case err != nil:
+				t.Fatalf("ReadResults: %v", err)
+			case results.SchemaVersion != tt.version:
+				t.Errorf("schema version %s, expected %s", results.SchemaVersion, tt.version)
+			case results.RunID != "20230801T101500-1a2b3c4d" || results.RecordsSent != 100:
+				t.Errorf("run %s with %d records, expected run 20230801T101500-1a2b3c4d with 100 records", results.RunID, results.RecordsSent)
+			}
+		})
+	}
+}
+
+// TestResultsFixtureOfThisRelease requires a fixture of the results schema
+// version written by this release, so every version bump adds one
+func TestResultsFixtureOfThisRelease(t *testing.T) {
+	path := filepath.Join("testdata", "results", "v"+ResultsSchemaVersion()+".json")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("no results fixture of version %s: %v", ResultsSchemaVersion(), err)
+	}
+
+	data, err := MarshalResults(NewRunResults(&BenchmarkConfig{RunID: "20230801T101500-1a2b3c4d"}, modeInsertAll, &RunSummary{RecordsSent: 100}, nil))
+	if err != nil {
+		t.Fatalf("MarshalResults: %v", err)
+	}
+	results, err := ParseResults(data)
+	switch {
+	case err != nil:
+		t.Fatalf("ParseResults: %v", err)
+	case results.SchemaVersion != ResultsSchemaVersion() || results.RecordsSent != 100:
+		t.Errorf("results round tripped as version %s with %d records", results.SchemaVersion, results.RecordsSent)
+	}
+}
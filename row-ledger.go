@@ -0,0 +1,131 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/OTA-Insight/bqwriter"
+)
+
+// RowLedger tracks the rows written to a streamer until a streamer worker
+// takes them into a request.  Closing a bqwriter streamer flushes the rows
+// its workers have taken but drops those still queued for them, so the rows
+// a ledger holds once its streamer has closed are exactly those dropped,
+// which are then replayed into the streamer replacing it.  bqwriter does not
+// report the rows of a request failing after its retries, so a row is
+// released once taken into a request rather than once the request succeeds.
+type RowLedger struct {
+	rows []*ledgerRecord
+}
+
+// Interval between the checks of a drain waiting for the rows to be taken
+const ledgerPollInterval = 10 * time.Millisecond
+
+// ledgerRecord is a row written to a streamer, marked once a streamer worker
+// encodes it into a request
+type ledgerRecord struct {
+	record interface{}
+	taken  atomic.Bool
+}
+
+// Save implements bigquery.ValueSaver.Save for the insertAll API, which
+// saves the rows of a batch as its request is built
+func (lr *ledgerRecord) Save() (row map[string]bigquery.Value, insertID string, err error) {
+	lr.taken.Store(true)
+	saver, ok := lr.record.(bigquery.ValueSaver)
+	if !ok {
+		return nil, "", fmt.Errorf("%T does not implement bigquery.ValueSaver", lr.record)
+	}
+	return saver.Save()
+}
+
+// MarshalJSON implements json.Marshaler.MarshalJSON for the Storage Write
+// API, which encodes each row as a worker takes it from the queue
+func (lr *ledgerRecord) MarshalJSON() ([]byte, error) {
+	lr.taken.Store(true)
+	if marshaler, ok := lr.record.(json.Marshaler); ok {
+		return marshaler.MarshalJSON()
+	}
+	return json.Marshal(lr.record)
+}
+
+// Write writes the record to the streamer, tracking it once accepted
+func (l *RowLedger) Write(streamer *bqwriter.Streamer, record interface{}) error {
+	lr := &ledgerRecord{record: record}
+	if err := streamer.Write(lr); err != nil {
+		return err
+	}
+	l.track(lr)
+	return nil
+}
+
+// track appends the row, releasing the rows at the front already taken
+func (l *RowLedger) track(lr *ledgerRecord) {
+	for len(l.rows) > 0 && l.rows[0].taken.Load() {
+		l.rows[0] = nil
+		l.rows = l.rows[1:]
+	}
+	l.rows = append(l.rows, lr)
+}
+
+// Pending returns the number of rows tracked which have not been taken
+func (l *RowLedger) Pending() int {
+	pending := 0
+	for _, lr := range l.rows {
+		if !lr.taken.Load() {
+			pending++
+		}
+	}
+	return pending
+}
+
+// WaitTaken waits until every row tracked has been taken, returning false
+// if the timeout expires first
+func (l *RowLedger) WaitTaken(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for l.Pending() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(ledgerPollInterval)
+	}
+	return true
+}
+
+// Replay writes the rows not taken by the closed streamer into the streamer
+// replacing it, in the order they were first written, returning the number
+// of rows replayed
+func (l *RowLedger) Replay(streamer *bqwriter.Streamer) (int, error) {
+	dropped := l.rows
+	l.rows = nil
+	replayed := 0
+	for i, lr := range dropped {
+		if lr.taken.Load() {
+			continue
+		}
+		if err := streamer.Write(lr); err != nil {
+			l.rows = append(l.rows, dropped[i:]...)
+			return replayed, err
+		}
+		l.track(lr)
+		replayed++
+	}
+	return replayed, nil
+}
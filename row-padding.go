@@ -0,0 +1,125 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Column of every generated row holding the padding of -row-bytes
+const paddingColumn = "padding"
+
+// Largest serialized row size requested with -row-bytes
+const maxRowBytes = 1 << 20
+
+// Number of distinct offsets into the padding block, so consecutive rows
+// do not carry identical padding
+const paddingOffsets = 4096
+
+// Characters the padding block is drawn from, none of which are escaped in
+// JSON
+const paddingAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// WithPaddingColumn returns the schema with the NULLABLE STRING column of
+// the padding appended
+func WithPaddingColumn(schema bigquery.Schema) bigquery.Schema {
+	return append(append(bigquery.Schema{}, schema...), &bigquery.FieldSchema{Name: paddingColumn, Type: bigquery.StringFieldType})
+}
+
+// PaddingGenerator wraps the generator, padding each record so its
+// serialized row is approximately rowBytes.  The padding is sized from the
+// first record generated, and every record's padding is a slice of a single
+// block of random characters generated up front, so padding a record never
+// allocates.
+func PaddingGenerator(gen dataGenerator, rowBytes int) dataGenerator {
+	var once sync.Once
+	var block string
+	var length int
+	return func(name string, uuid int64, create_time time.Time, run_id string) interface{} {
+		record := gen(name, uuid, create_time, run_id)
+		once.Do(func() {
+			length = max(rowBytes-RecordSize(&paddedRecord{record: record}), 0)
+			block = newPaddingBlock(length + paddingOffsets)
+		})
+		offset := int(uint64(uuid) % paddingOffsets)
+		return &paddedRecord{record: record, padding: block[offset : offset+length]}
+	}
+}
+
+// newPaddingBlock returns a block of random characters of the given length
+func newPaddingBlock(length int) string {
+	r := rand.New(rand.NewSource(1))
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = paddingAlphabet[r.Intn(len(paddingAlphabet))]
+	}
+	return string(b)
+}
+
+// paddedRecord is a generated record along with its padding
+type paddedRecord struct {
+	record  interface{}
+	padding string
+}
+
+// Save implements bigquery.ValueSaver.Save
+func (pr *paddedRecord) Save() (row map[string]bigquery.Value, insertID string, err error) {
+	saver, ok := pr.record.(bigquery.ValueSaver)
+	if !ok {
+		return nil, "", fmt.Errorf("%T does not implement bigquery.ValueSaver", pr.record)
+	}
+	row, insertID, err = saver.Save()
+	if err != nil {
+		return nil, "", err
+	}
+	row[paddingColumn] = pr.padding
+	return row, insertID, nil
+}
+
+// MarshalJSON implements json.Marshaler.MarshalJSON
+func (pr *paddedRecord) MarshalJSON() ([]byte, error) {
+	row, _, err := pr.Save()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(row)
+}
+
+// jsonSize implements jsonSizer, measuring the padding column on top of the
+// wrapped record when it too implements jsonSizer, or serializing the row
+func (pr *paddedRecord) jsonSize() int {
+	s, ok := pr.record.(jsonSizer)
+	if !ok {
+		b, err := pr.MarshalJSON()
+		if err != nil {
+			return 0
+		}
+		return len(b)
+	}
+	return s.jsonSize() + len(`,"`+paddingColumn+`":`) + jsonStringSize(pr.padding)
+}
+
+// EnableInsertID implements insertIDEnabler for the wrapped record
+func (pr *paddedRecord) EnableInsertID() {
+	if r, ok := pr.record.(insertIDEnabler); ok {
+		r.EnableInsertID()
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "context"
+
+// RowSource wraps the generator channel with an acknowledgement boundary.
+// A row returned by Next remains held until it is acknowledged, so a row
+// which the write path did not accept, such as one in hand while a streamer
+// is torn down and rebuilt, is returned again rather than lost.
+type RowSource struct {
+	ch       <-chan interface{}
+	held     interface{}
+	holding  bool
+	consumed int
+}
+
+// NewRowSource creates a RowSource reading from the generator channel
+func NewRowSource(ch <-chan interface{}) *RowSource {
+	return &RowSource{ch: ch}
+}
+
+// Next returns the held row if it has not been acknowledged, otherwise the
+// next row from the generator.  It returns false once the generator is
+// exhausted or the context is done, without waiting on the generator.
+func (s *RowSource) Next(ctx context.Context) (interface{}, bool) {
+	if ctx.Err() != nil {
+		return nil, false
+	}
+	if s.holding {
+		return s.held, true
+	}
+	select {
+	case <-ctx.Done():
+		return nil, false
+	case data, ok := <-s.ch:
+		if !ok {
+			return nil, false
+		}
+		s.held, s.holding = data, true
+		return data, true
+	}
+}
+
+// Ack marks the held row as consumed, once the write path has accepted it
+func (s *RowSource) Ack() {
+	if s.holding {
+		s.held, s.holding = nil, false
+		s.consumed++
+	}
+}
+
+// Pending reports whether a row is held awaiting acknowledgement
+func (s *RowSource) Pending() bool {
+	return s.holding
+}
+
+// Consumed returns the number of rows acknowledged
+func (s *RowSource) Consumed() int {
+	return s.consumed
+}
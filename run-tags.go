@@ -0,0 +1,149 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// tagKeyPattern restricts tag keys to valid column names, so every tag can
+// also be written as a column of the generated rows
+var tagKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,127}$`)
+
+// RunTags holds the key=value pairs attached to a run with -tag, which may
+// be repeated
+type RunTags map[string]string
+
+// String implements flag.Value
+func (t RunTags) String() string {
+	pairs := make([]string, 0, len(t))
+	for _, key := range t.Keys() {
+		pairs = append(pairs, key+"="+t[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value, adding a single key=value pair
+func (t RunTags) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || !tagKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid tag %q, expected key=value with a key of letters, digits and underscores", value)
+	}
+	if _, exists := t[key]; exists {
+		return fmt.Errorf("tag %q is given more than once", key)
+	}
+	t[key] = val
+	return nil
+}
+
+// Keys returns the tag keys, sorted
+func (t RunTags) Keys() []string {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Validate rejects tag keys colliding with a field of the results, or with
+// a column of the schema when the tags are also written as columns
+func (t RunTags) Validate(schema bigquery.Schema, columns bool) error {
+	reserved := make(map[string]bool)
+	results := reflect.TypeOf(RunResults{})
+	for i := 0; i < results.NumField(); i++ {
+		name, _, _ := strings.Cut(results.Field(i).Tag.Get("json"), ",")
+		reserved[strings.ToLower(name)] = true
+	}
+	for _, key := range t.Keys() {
+		if reserved[strings.ToLower(key)] {
+			return fmt.Errorf("tag %q collides with the %s field of the results", key, key)
+		}
+		if !columns {
+			continue
+		}
+		for _, field := range schema {
+			if strings.EqualFold(field.Name, key) {
+				return fmt.Errorf("tag %q collides with the %s column of the table schema", key, field.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// WithTagColumns returns the schema with a NULLABLE STRING column appended
+// for each tag
+func (t RunTags) WithTagColumns(schema bigquery.Schema) bigquery.Schema {
+	tagged := append(bigquery.Schema{}, schema...)
+	for _, key := range t.Keys() {
+		tagged = append(tagged, &bigquery.FieldSchema{Name: key, Type: bigquery.StringFieldType})
+	}
+	return tagged
+}
+
+// Generator wraps the generator, setting the value of every tag column on
+// each record generated
+func (t RunTags) Generator(gen dataGenerator) dataGenerator {
+	return func(name string, uuid int64, create_time time.Time, run_id string) interface{} {
+		return &taggedRecord{record: gen(name, uuid, create_time, run_id), tags: t}
+	}
+}
+
+// taggedRecord is a generated record along with the values of the tag
+// columns
+type taggedRecord struct {
+	record interface{}
+	tags   RunTags
+}
+
+// Save implements bigquery.ValueSaver.Save
+func (tr *taggedRecord) Save() (row map[string]bigquery.Value, insertID string, err error) {
+	saver, ok := tr.record.(bigquery.ValueSaver)
+	if !ok {
+		return nil, "", fmt.Errorf("%T does not implement bigquery.ValueSaver", tr.record)
+	}
+	row, insertID, err = saver.Save()
+	if err != nil {
+		return nil, "", err
+	}
+	for key, value := range tr.tags {
+		row[key] = value
+	}
+	return row, insertID, nil
+}
+
+// MarshalJSON implements json.Marshaler.MarshalJSON
+func (tr *taggedRecord) MarshalJSON() ([]byte, error) {
+	row, _, err := tr.Save()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(row)
+}
+
+// EnableInsertID implements insertIDEnabler for the wrapped record
+func (tr *taggedRecord) EnableInsertID() {
+	if r, ok := tr.record.(insertIDEnabler); ok {
+		r.EnableInsertID()
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Label set on every table created by the tool, which safe mode requires
+// before streaming into or overwriting a table
+const (
+	safeModeLabel      = "bqwrite-test"
+	safeModeLabelValue = "true"
+)
+
+// Environment variable enabling safe mode, for platforms which enforce it
+const safeModeEnv = "BQWRITE_TEST_SAFE"
+
+// errUnsafeTable is returned in safe mode for a table not created by the tool
+var errUnsafeTable = errors.New("safe mode refuses to write to a table not created by bqwrite-test")
+
+// createdTableLabels are the labels set on every table created by the tool
+var createdTableLabels = map[string]string{safeModeLabel: safeModeLabelValue}
+
+// SafeMode refuses to stream into or overwrite an existing table which lacks
+// the label the tool sets at creation, unless forced
+type SafeMode struct {
+	Enabled bool
+	Force   bool
+}
+
+// NewSafeMode enables safe mode when requested by the flag or by the
+// environment variable holding a true value
+func NewSafeMode(safe, force bool) SafeMode {
+	env, _ := strconv.ParseBool(os.Getenv(safeModeEnv))
+	return SafeMode{Enabled: safe || env, Force: force}
+}
+
+// Check verifies the existing table carries the label set by the tool, from
+// the metadata already fetched.  A forced check passes with a warning.
+func (m SafeMode) Check(datasetID, tableID string, tableMetaData *bigquery.TableMetadata) error {
+	if !m.Enabled || tableMetaData == nil || tableMetaData.Labels[safeModeLabel] == safeModeLabelValue {
+		return nil
+	}
+	if m.Force {
+		logger.Warn().Str("Dataset", datasetID).Str("Table", tableID).
+			Msgf("!!! SAFE MODE OVERRIDDEN BY -force, WRITING TO A TABLE WITHOUT THE %s=%s LABEL !!!", safeModeLabel, safeModeLabelValue)
+		return nil
+	}
+	return fmt.Errorf("%w, %s.%s lacks the label %s=%s; if the table is meant for benchmarking, label it with "+
+		"bq update --set_label %s:%s %s.%s, or use -force to override", errUnsafeTable, datasetID, tableID,
+		safeModeLabel, safeModeLabelValue, safeModeLabel, safeModeLabelValue, datasetID, tableID)
+}
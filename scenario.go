@@ -0,0 +1,232 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Supported scenario phase traffic patterns
+const (
+	patternConstant = "constant"
+	patternRamp     = "ramp"
+)
+
+// Scenario describes an ordered list of phases executed over one streamer
+type Scenario struct {
+	Phases []ScenarioPhase `yaml:"phases"`
+}
+
+// ScenarioPhase describes a single phase of a scenario.  A rate of zero is
+// unlimited, and a batch size of zero inherits the -b flag.
+type ScenarioPhase struct {
+	Name      string        `yaml:"name"`
+	Duration  time.Duration `yaml:"duration"`
+	Pattern   string        `yaml:"pattern"`
+	Rate      float64       `yaml:"rate"`
+	BatchSize int           `yaml:"batch_size"`
+	Mode      string        `yaml:"mode"`
+}
+
+// PhaseSummary holds the metrics measured for a single phase
+type PhaseSummary struct {
+	Name        string
+	RecordsSent int
+	Elapsed     time.Duration
+	TargetRate  float64
+}
+
+// LoadScenario reads and validates a YAML scenario file, rejecting unknown
+// fields so mistakes are caught before any writes.
+func LoadScenario(path string, defaultBatchSize int) (*Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var scenario Scenario
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&scenario); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario %q: %w", path, err)
+	}
+
+	if err := scenario.Validate(defaultBatchSize); err != nil {
+		return nil, fmt.Errorf("invalid scenario %q: %w", path, err)
+	}
+	return &scenario, nil
+}
+
+// Validate applies the defaults to each phase and verifies the phases and
+// the transitions between them are possible.
+func (s *Scenario) Validate(defaultBatchSize int) error {
+	if len(s.Phases) == 0 {
+		return errors.New("at least one phase is required")
+	}
+
+	for i := range s.Phases {
+		phase := &s.Phases[i]
+		if phase.Name == "" {
+			phase.Name = fmt.Sprintf("phase-%d", i+1)
+		}
+		if phase.Pattern == "" {
+			phase.Pattern = patternConstant
+		}
+		if phase.BatchSize == 0 {
+			phase.BatchSize = defaultBatchSize
+		}
+		if phase.Mode == "" {
+			phase.Mode = apiInsertAll
+		}
+
+		if phase.Duration <= 0 {
+			return fmt.Errorf("phase %q: duration must be greater than zero", phase.Name)
+		}
+		if phase.Rate < 0 {
+			return fmt.Errorf("phase %q: rate must not be negative", phase.Name)
+		}
+		if phase.BatchSize < 1 || phase.BatchSize > 50000 {
+			return fmt.Errorf("phase %q: batch_size must be between 1 and 50000", phase.Name)
+		}
+		if phase.Mode != apiInsertAll {
+			return fmt.Errorf("phase %q: unsupported mode %q", phase.Name, phase.Mode)
+		}
+
+		switch phase.Pattern {
+		case patternConstant:
+		case patternRamp:
+			if phase.Rate == 0 {
+				return fmt.Errorf("phase %q: a ramp requires a target rate", phase.Name)
+			}
+			if i > 0 && s.Phases[i-1].Rate == 0 {
+				return fmt.Errorf("phase %q: cannot ramp from the unlimited rate of phase %q", phase.Name, s.Phases[i-1].Name)
+			}
+		default:
+			return fmt.Errorf("phase %q: unsupported pattern %q", phase.Name, phase.Pattern)
+		}
+	}
+	return nil
+}
+
+// ExecuteScenario executes each phase of the scenario in order over a single
+// streamer, rebuilding the streamer only when the batch size or mode change
+// and replaying the rows the old streamer dropped from its queue.
+func ExecuteScenario(ctx context.Context, config *BenchmarkConfig, scenario *Scenario) ([]PhaseSummary, *RunSummary, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	source := NewRowSource(newGenerator(ctx, math.MaxInt, config.RunID, config.DataGenerator()))
+
+	target := config.StreamTargets()[0]
+	var current *ScenarioPhase
+	summary := &RunSummary{}
+	phases := make([]PhaseSummary, 0, len(scenario.Phases))
+	limiter := NewRateLimiter(0)
+	startRate := 0.0
+	startTime := time.Now()
+
+	for i := range scenario.Phases {
+		phase := &scenario.Phases[i]
+
+		// Rebuild the streamer when the phase changes an immutable setting
+		if current == nil || current.BatchSize != phase.BatchSize || current.Mode != phase.Mode {
+			if target.streamer != nil {
+				logger.Info().Msg("Closing BigQuery Streaming Client")
+				if !CloseStreamer(target.streamer, config.DrainTimeout) {
+					summary.RecordsAbandoned = EstimateUnflushedRecords(summary.RecordsSent, config.NumberWorkers, CalculateWorkerQueueSize(current.BatchSize), current.BatchSize)
+					return phases, summary, errDrainTimeout
+				}
+			}
+			logger.Info().Int("Batch Size", phase.BatchSize).Str("Mode", phase.Mode).Msg("Establish BigQuery Streaming Client")
+			streamer, err := NewLegacyStreamer(config, target, phase.BatchSize)
+			if err != nil {
+				return phases, summary, err
+			}
+			target.streamer, target.BatchSize = streamer, phase.BatchSize
+			if err = ReplayTarget(target); err != nil {
+				target.streamer.Close()
+				return phases, summary, err
+			}
+		}
+		current = phase
+
+		logger.Info().Str("Phase", phase.Name).Dur("Duration", phase.Duration).Str("Pattern", phase.Pattern).Float64("Rate", phase.Rate).Msg("Start Phase")
+		phaseSummary := PhaseSummary{Name: phase.Name, TargetRate: phase.Rate}
+		phaseStart := time.Now()
+		deadline := phaseStart.Add(phase.Duration)
+		limiter.SetRate(phase.Rate)
+
+		for now := phaseStart; now.Before(deadline); now = time.Now() {
+			if phase.Pattern == patternRamp {
+				progress := float64(now.Sub(phaseStart)) / float64(phase.Duration)
+				limiter.SetRate(startRate + (phase.Rate-startRate)*progress)
+			}
+			if err := limiter.Wait(ctx); err != nil {
+				target.streamer.Close()
+				return phases, summary, err
+			}
+
+			data, ok := source.Next(ctx)
+			if !ok {
+				break
+			}
+			if err := target.ledger.Write(target.streamer, data); err != nil {
+				target.streamer.Close()
+				return phases, summary, err
+			}
+			source.Ack()
+			phaseSummary.RecordsSent++
+			config.Landed.AddSent(1)
+			config.Heartbeat.AddSent(1)
+			config.Health.AddSent(1)
+			summary.AddRecordBytes(RecordSize(data))
+		}
+
+		phaseSummary.Elapsed = time.Since(phaseStart)
+		summary.RecordsSent += phaseSummary.RecordsSent
+		phases = append(phases, phaseSummary)
+		startRate = phase.Rate
+		LogPhaseSummary(phaseSummary)
+	}
+
+	summary.Elapsed = time.Since(startTime)
+	logger.Info().Msg("Closing BigQuery Streaming Client")
+	drained, err := DrainTargets(config, []*StreamTarget{target})
+	if err != nil {
+		return phases, summary, err
+	}
+	if !drained {
+		summary.RecordsAbandoned = EstimateUnflushedRecords(summary.RecordsSent, config.NumberWorkers, CalculateWorkerQueueSize(current.BatchSize), current.BatchSize)
+		return phases, summary, errDrainTimeout
+	}
+	return phases, summary, nil
+}
+
+// LogPhaseSummary outputs the metrics measured for a single phase
+func LogPhaseSummary(phase PhaseSummary) {
+	rate := 0.0
+	if phase.Elapsed > 0 {
+		rate = float64(phase.RecordsSent) / phase.Elapsed.Seconds()
+	}
+	logger.Info().Str("Phase", phase.Name).Int("Records Sent", phase.RecordsSent).Dur("Time Taken", phase.Elapsed).
+		Float64("Target Rate", phase.TargetRate).Float64("Achieved Rate", rate).Msg(indent)
+}
@@ -0,0 +1,64 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExecuteScenarioLosesNoRowsBetweenPhases(t *testing.T) {
+	server := NewFakeBigQueryServer()
+	defer server.Close()
+	server.CreateTable("bqwrite", "scenario", nil)
+
+	config := &BenchmarkConfig{
+		ProjectID:       "bqwrite-test",
+		DatasetID:       "bqwrite",
+		TableID:         "scenario",
+		RunID:           "scenario-run",
+		BatchSize:       10,
+		NumberWorkers:   2,
+		DrainTimeout:    30 * time.Second,
+		StreamerOptions: FakeClientOptions(server),
+	}
+	scenario := &Scenario{Phases: []ScenarioPhase{
+		{Name: "small", Duration: 200 * time.Millisecond},
+		{Name: "large", Duration: 200 * time.Millisecond, BatchSize: 100},
+		{Name: "small-again", Duration: 200 * time.Millisecond},
+	}}
+	if err := scenario.Validate(config.BatchSize); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	phases, summary, err := ExecuteScenario(context.Background(), config, scenario)
+	if err != nil {
+		t.Fatalf("ExecuteScenario: %v", err)
+	}
+	if len(phases) != len(scenario.Phases) {
+		t.Fatalf("%d phases were executed, expected %d", len(phases), len(scenario.Phases))
+	}
+	if summary.RecordsSent == 0 {
+		t.Fatal("no records were sent")
+	}
+	sent := int64(summary.RecordsSent)
+	if got := server.RunRows("bqwrite", "scenario", config.RunID); got != sent {
+		t.Errorf("%d rows landed, expected the %d records sent", got, sent)
+	}
+	if got := server.RunDistinctRows("bqwrite", "scenario", config.RunID); got != sent {
+		t.Errorf("%d distinct rows landed, expected the %d records sent", got, sent)
+	}
+}
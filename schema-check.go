@@ -0,0 +1,249 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Number of rows generated by the startup self-check, and the number of
+// violations reported before giving up
+const (
+	selfCheckRows          = 10
+	selfCheckMaxViolations = 5
+)
+
+// SchemaViolation describes a generated value which does not match the
+// declared schema
+type SchemaViolation struct {
+	Row    int
+	Field  string
+	Reason string
+}
+
+// String implements fmt.Stringer
+func (v SchemaViolation) String() string {
+	return fmt.Sprintf("row %d, field %q: %s", v.Row, v.Field, v.Reason)
+}
+
+// ValidateGeneratedRows generates a handful of rows and validates each one
+// against the schema, returning the violations found.  This catches a
+// generator which disagrees with the schema before any table is created.
+func ValidateGeneratedRows(schema bigquery.Schema, gen dataGenerator, runID string, rows int) []SchemaViolation {
+	var violations []SchemaViolation
+	for i := 0; i < rows; i++ {
+		data := gen(randomNames[i%len(randomNames)], int64(i)*42, time.Now().UTC(), runID)
+		saver, ok := data.(bigquery.ValueSaver)
+		if !ok {
+			return append(violations, SchemaViolation{Row: i, Reason: fmt.Sprintf("%T does not implement bigquery.ValueSaver", data)})
+		}
+		row, _, err := saver.Save()
+		if err != nil {
+			return append(violations, SchemaViolation{Row: i, Reason: err.Error()})
+		}
+		for _, v := range ValidateRow(schema, row) {
+			v.Row = i
+			violations = append(violations, v)
+		}
+	}
+	return violations
+}
+
+// ValidateRow validates a single row against the schema, checking that every
+// key is a declared field, REQUIRED fields are present and non-nil, and each
+// value is compatible with the field type, including nested and repeated
+// fields.
+func ValidateRow(schema bigquery.Schema, row map[string]bigquery.Value) []SchemaViolation {
+	return validateFields("", schema, row)
+}
+
+// validateFields validates the values of a RECORD, prefixing field names
+// with the path to the record
+func validateFields(path string, schema bigquery.Schema, row map[string]bigquery.Value) []SchemaViolation {
+	var violations []SchemaViolation
+
+	declared := make(map[string]bool, len(schema))
+	for _, field := range schema {
+		declared[field.Name] = true
+		name := path + field.Name
+		value, present := row[field.Name]
+		if value == nil {
+			if field.Required {
+				reason := "REQUIRED field is nil"
+				if !present {
+					reason = "REQUIRED field is missing"
+				}
+				violations = append(violations, SchemaViolation{Field: name, Reason: reason})
+			}
+			continue
+		}
+		violations = append(violations, validateValue(name, field, value)...)
+	}
+
+	// Sort the undeclared keys so the report is stable
+	var undeclared []string
+	for key := range row {
+		if !declared[key] {
+			undeclared = append(undeclared, key)
+		}
+	}
+	sort.Strings(undeclared)
+	for _, key := range undeclared {
+		violations = append(violations, SchemaViolation{Field: path + key, Reason: "field is not declared in the schema"})
+	}
+	return violations
+}
+
+// validateValue validates a non-nil value, expanding REPEATED fields
+func validateValue(name string, field *bigquery.FieldSchema, value bigquery.Value) []SchemaViolation {
+	if !field.Repeated {
+		return validateScalar(name, field, value)
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return []SchemaViolation{{Field: name, Reason: fmt.Sprintf("REPEATED field requires a slice, got %T", value)}}
+	}
+	var violations []SchemaViolation
+	for i := 0; i < rv.Len(); i++ {
+		element := rv.Index(i).Interface()
+		elementName := fmt.Sprintf("%s[%d]", name, i)
+		if element == nil {
+			violations = append(violations, SchemaViolation{Field: elementName, Reason: "REPEATED field contains a nil element"})
+			continue
+		}
+		violations = append(violations, validateScalar(elementName, field, element)...)
+	}
+	return violations
+}
+
+// validateScalar validates a single value against the field type
+func validateScalar(name string, field *bigquery.FieldSchema, value bigquery.Value) []SchemaViolation {
+	if field.Type == bigquery.RecordFieldType {
+		record, ok := asRecord(value)
+		if !ok {
+			return []SchemaViolation{{Field: name, Reason: fmt.Sprintf("RECORD field requires a map, got %T", value)}}
+		}
+		return validateFields(name+".", field.Schema, record)
+	}
+	if !compatibleValue(field.Type, value) {
+		return []SchemaViolation{{Field: name, Reason: fmt.Sprintf("%T value %v is not compatible with %s", value, value, field.Type)}}
+	}
+	return nil
+}
+
+// asRecord returns the value as the row of a RECORD field
+func asRecord(value bigquery.Value) (map[string]bigquery.Value, bool) {
+	switch v := value.(type) {
+	case map[string]bigquery.Value:
+		return v, true
+	case bigquery.ValueSaver:
+		row, _, err := v.Save()
+		return row, err == nil
+	}
+	return nil, false
+}
+
+// Layouts accepted for the string form of the date and time types
+var (
+	timestampLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999 MST", "2006-01-02 15:04:05.999999Z07:00", "2006-01-02 15:04:05.999999"}
+	dateTimeLayouts  = []string{"2006-01-02 15:04:05.999999", "2006-01-02T15:04:05.999999"}
+	dateLayouts      = []string{"2006-01-02"}
+	timeLayouts      = []string{"15:04:05.999999"}
+)
+
+// compatibleValue reports whether BigQuery will accept the value for a
+// field of the given type
+func compatibleValue(fieldType bigquery.FieldType, value bigquery.Value) bool {
+	switch fieldType {
+	case bigquery.StringFieldType, bigquery.GeographyFieldType, bigquery.JSONFieldType:
+		_, ok := value.(string)
+		return ok
+	case bigquery.BytesFieldType:
+		switch v := value.(type) {
+		case []byte:
+			return true
+		case string:
+			_, err := base64.StdEncoding.DecodeString(v)
+			return err == nil
+		}
+	case bigquery.IntegerFieldType:
+		switch reflect.ValueOf(value).Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint8, reflect.Uint16, reflect.Uint32:
+			return true
+		}
+	case bigquery.FloatFieldType:
+		switch reflect.ValueOf(value).Kind() {
+		case reflect.Float32, reflect.Float64, reflect.Int, reflect.Int32, reflect.Int64:
+			return true
+		}
+	case bigquery.NumericFieldType, bigquery.BigNumericFieldType:
+		switch v := value.(type) {
+		case *big.Rat, float64, int, int64:
+			return true
+		case string:
+			_, ok := new(big.Rat).SetString(v)
+			return ok
+		}
+	case bigquery.BooleanFieldType:
+		_, ok := value.(bool)
+		return ok
+	case bigquery.TimestampFieldType:
+		return isTimeValue(value, timestampLayouts)
+	case bigquery.DateTimeFieldType:
+		return isTimeValue(value, dateTimeLayouts)
+	case bigquery.DateFieldType:
+		return isTimeValue(value, dateLayouts)
+	case bigquery.TimeFieldType:
+		return isTimeValue(value, timeLayouts)
+	}
+	return false
+}
+
+// isTimeValue reports whether the value is a time.Time, or a string in one
+// of the layouts
+func isTimeValue(value bigquery.Value, layouts []string) bool {
+	switch v := value.(type) {
+	case time.Time:
+		return true
+	case string:
+		for _, layout := range layouts {
+			if _, err := time.Parse(layout, v); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LogSchemaViolations logs the first few violations found by the self-check
+func LogSchemaViolations(violations []SchemaViolation) {
+	logger.Error().Int("Violations", len(violations)).Msg("Generated Records Do Not Match the Table Schema")
+	for i, v := range violations {
+		if i == selfCheckMaxViolations {
+			logger.Error().Int("Not Shown", len(violations)-i).Msg(indent)
+			break
+		}
+		logger.Error().Str("Violation", v.String()).Msg(indent)
+	}
+}
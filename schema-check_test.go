@@ -0,0 +1,247 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// nestedSchemaFile is a BigQuery JSON schema with REQUIRED, nested and
+// REPEATED fields of every generated type
+const nestedSchemaFile = `[
+	{"name": "name", "type": "STRING", "mode": "REQUIRED"},
+	{"name": "uuid", "type": "INTEGER", "mode": "REQUIRED"},
+	{"name": "create_time", "type": "DATETIME"},
+	{"name": "payload", "type": "BYTES"},
+	{"name": "score", "type": "FLOAT"},
+	{"name": "amount", "type": "NUMERIC"},
+	{"name": "active", "type": "BOOLEAN"},
+	{"name": "seen_at", "type": "TIMESTAMP"},
+	{"name": "seen_on", "type": "DATE"},
+	{"name": "seen_time", "type": "TIME"},
+	{"name": "tags", "type": "STRING", "mode": "REPEATED"},
+	{"name": "address", "type": "RECORD", "fields": [
+		{"name": "street", "type": "STRING", "mode": "REQUIRED"},
+		{"name": "lines", "type": "RECORD", "mode": "REPEATED", "fields": [
+			{"name": "number", "type": "INTEGER"},
+			{"name": "labels", "type": "STRING", "mode": "REPEATED"}
+		]}
+	]}
+]`
+
+func TestValidateGeneratedRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(path, []byte(nestedSchemaFile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fileSchema, err := LoadBigQuerySchema(path)
+	if err != nil {
+		t.Fatalf("LoadBigQuerySchema: %v", err)
+	}
+	fileSchema = WithRunIDColumn(fileSchema)
+
+	min, max := 1.0, 1000.0
+	profile := &DataProfile{Columns: []ColumnProfile{
+		{Name: "uuid", Type: "INTEGER", Cardinality: 10, Min: &min, Max: &max},
+		{Name: "score", Type: "FLOAT", Cardinality: 5, NullFraction: 0.5, Min: &min, Max: &max},
+		{Name: "payload", Type: "BYTES", Cardinality: 3, LengthQuantiles: []int64{1, 4, 16}},
+	}}
+	profileGenerator, _ := NewProfileDataGenerator(fileSchema, profile)
+	tags := RunTags{"team": "ingest", "build": "42"}
+
+	tests := []struct {
+		name   string
+		schema bigquery.Schema
+		gen    dataGenerator
+	}{
+		{"Schema File", fileSchema, NewSchemaDataGenerator(fileSchema)},
+		{"Data Profile", fileSchema, profileGenerator},
+		{"Tag Columns", tags.WithTagColumns(tableDataBigQuerySchema), tags.Generator(NewTableData)},
+		{"Tag Columns of a Schema File", tags.WithTagColumns(fileSchema), tags.Generator(NewSchemaDataGenerator(fileSchema))},
+		{"Row Padding", WithPaddingColumn(tableDataBigQuerySchema), PaddingGenerator(NewTableData, 1024)},
+		{"Ack Tokens", WithAckTokenColumn(tableDataBigQuerySchema), NewAckVerifier(time.Second, 10).Generator(NewTableData)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if violations := ValidateGeneratedRows(tt.schema, tt.gen, "run-1", selfCheckRows); len(violations) > 0 {
+				t.Errorf("%d violations, the first %s", len(violations), violations[0])
+			}
+		})
+	}
+
+	// Every Registered Generator Matches the Built-In Table Schema
+	for _, name := range GeneratorNames() {
+		t.Run("Generator "+name, func(t *testing.T) {
+			gen, err := LookupGenerator(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if violations := ValidateGeneratedRows(tableDataBigQuerySchema, gen, "run-1", selfCheckRows); len(violations) > 0 {
+				t.Errorf("%d violations, the first %s", len(violations), violations[0])
+			}
+		})
+	}
+}
+
+func TestValidateGeneratedRowsMismatch(t *testing.T) {
+	renamed := bigquery.Schema{
+		{Name: "full_name", Type: bigquery.StringFieldType, Required: true},
+		{Name: "uuid", Type: bigquery.IntegerFieldType},
+		{Name: "create_time", Type: bigquery.DateTimeFieldType},
+		{Name: "run_id", Type: bigquery.StringFieldType},
+	}
+	retyped := bigquery.Schema{
+		{Name: "name", Type: bigquery.StringFieldType},
+		{Name: "uuid", Type: bigquery.BooleanFieldType},
+		{Name: "create_time", Type: bigquery.DateTimeFieldType},
+		{Name: "run_id", Type: bigquery.StringFieldType},
+	}
+	notSaver := func(name string, uuid int64, create_time time.Time, run_id string) interface{} {
+		return struct{ Name string }{name}
+	}
+
+	tests := []struct {
+		name       string
+		schema     bigquery.Schema
+		gen        dataGenerator
+		violations int
+		first      SchemaViolation
+	}{
+		{"Renamed Field", renamed, NewTableData, 2 * selfCheckRows, SchemaViolation{Row: 0, Field: "full_name", Reason: "REQUIRED field is missing"}},
+		{"Retyped Field", retyped, NewTableData, selfCheckRows, SchemaViolation{Row: 0, Field: "uuid", Reason: "int64 value 0 is not compatible with BOOLEAN"}},
+		{"Not a ValueSaver", tableDataBigQuerySchema, notSaver, 1, SchemaViolation{Row: 0, Reason: "struct { Name string } does not implement bigquery.ValueSaver"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := ValidateGeneratedRows(tt.schema, tt.gen, "run-1", selfCheckRows)
+			if len(violations) != tt.violations {
+				t.Fatalf("%d violations, expected %d: %v", len(violations), tt.violations, violations)
+			}
+			if violations[0] != tt.first {
+				t.Errorf("first violation %s, expected %s", violations[0], tt.first)
+			}
+		})
+	}
+}
+
+func TestValidateRow(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType, Required: true},
+		{Name: "note", Type: bigquery.StringFieldType},
+		{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+		{Name: "address", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "street", Type: bigquery.StringFieldType, Required: true},
+			{Name: "lines", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+				{Name: "number", Type: bigquery.IntegerFieldType},
+			}},
+		}},
+	}
+
+	tests := []struct {
+		name string
+		row  map[string]bigquery.Value
+		want []SchemaViolation
+	}{
+		{"Valid", map[string]bigquery.Value{"id": 1, "note": "x", "tags": []string{"a", "b"}, "address": map[string]bigquery.Value{"street": "High St", "lines": []map[string]bigquery.Value{{"number": 4}}}}, nil},
+		{"Only the REQUIRED Fields", map[string]bigquery.Value{"id": int64(1)}, nil},
+		{"NULLABLE Field is nil", map[string]bigquery.Value{"id": 1, "note": nil}, nil},
+		{"REQUIRED Field is Missing", map[string]bigquery.Value{"note": "x"}, []SchemaViolation{{Field: "id", Reason: "REQUIRED field is missing"}}},
+		{"REQUIRED Field is nil", map[string]bigquery.Value{"id": nil}, []SchemaViolation{{Field: "id", Reason: "REQUIRED field is nil"}}},
+		{"Incompatible Type", map[string]bigquery.Value{"id": "1"}, []SchemaViolation{{Field: "id", Reason: "string value 1 is not compatible with INTEGER"}}},
+		{"Undeclared Fields Sorted", map[string]bigquery.Value{"id": 1, "zeta": 1, "alpha": 2}, []SchemaViolation{
+			{Field: "alpha", Reason: "field is not declared in the schema"},
+			{Field: "zeta", Reason: "field is not declared in the schema"},
+		}},
+		{"REPEATED Field is not a Slice", map[string]bigquery.Value{"id": 1, "tags": "a"}, []SchemaViolation{{Field: "tags", Reason: "REPEATED field requires a slice, got string"}}},
+		{"REPEATED Field of Bytes", map[string]bigquery.Value{"id": 1, "tags": []byte("a")}, []SchemaViolation{{Field: "tags", Reason: "REPEATED field requires a slice, got []uint8"}}},
+		{"REPEATED Field with a nil Element", map[string]bigquery.Value{"id": 1, "tags": []bigquery.Value{"a", nil}}, []SchemaViolation{{Field: "tags[1]", Reason: "REPEATED field contains a nil element"}}},
+		{"REPEATED Field with an Incompatible Element", map[string]bigquery.Value{"id": 1, "tags": []bigquery.Value{"a", 2}}, []SchemaViolation{{Field: "tags[1]", Reason: "int value 2 is not compatible with STRING"}}},
+		{"RECORD Field is not a Map", map[string]bigquery.Value{"id": 1, "address": "High St"}, []SchemaViolation{{Field: "address", Reason: "RECORD field requires a map, got string"}}},
+		{"Nested REQUIRED Field is Missing", map[string]bigquery.Value{"id": 1, "address": map[string]bigquery.Value{}}, []SchemaViolation{{Field: "address.street", Reason: "REQUIRED field is missing"}}},
+		{"Nested Undeclared Field", map[string]bigquery.Value{"id": 1, "address": map[string]bigquery.Value{"street": "High St", "city": "Perth"}}, []SchemaViolation{{Field: "address.city", Reason: "field is not declared in the schema"}}},
+		{"Nested REPEATED RECORD Field", map[string]bigquery.Value{"id": 1, "address": map[string]bigquery.Value{"street": "High St", "lines": []map[string]bigquery.Value{{"number": 1}, {"number": "2"}}}}, []SchemaViolation{{Field: "address.lines[1].number", Reason: "string value 2 is not compatible with INTEGER"}}},
+		{"RECORD Field as a ValueSaver", map[string]bigquery.Value{"id": 1, "address": &bigquery.ValuesSaver{Schema: bigquery.Schema{{Name: "street", Type: bigquery.StringFieldType}}, Row: []bigquery.Value{"High St"}}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ValidateRow(schema, tt.row)
+			if len(got) != len(tt.want) {
+				t.Fatalf("violations %v, expected %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("violation %s, expected %s", got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCompatibleValue(t *testing.T) {
+	tests := []struct {
+		fieldType bigquery.FieldType
+		value     bigquery.Value
+		want      bool
+	}{
+		{bigquery.StringFieldType, "x", true},
+		{bigquery.StringFieldType, 1, false},
+		{bigquery.GeographyFieldType, "POINT(1 2)", true},
+		{bigquery.JSONFieldType, `{"a":1}`, true},
+		{bigquery.BytesFieldType, []byte("x"), true},
+		{bigquery.BytesFieldType, "eA==", true},
+		{bigquery.BytesFieldType, "not base64!", false},
+		{bigquery.IntegerFieldType, int64(1), true},
+		{bigquery.IntegerFieldType, uint32(1), true},
+		{bigquery.IntegerFieldType, uint64(1), false},
+		{bigquery.IntegerFieldType, 1.5, false},
+		{bigquery.FloatFieldType, 1.5, true},
+		{bigquery.FloatFieldType, float32(1.5), true},
+		{bigquery.FloatFieldType, 1, true},
+		{bigquery.FloatFieldType, "1.5", false},
+		{bigquery.NumericFieldType, big.NewRat(1, 3), true},
+		{bigquery.NumericFieldType, "12.34", true},
+		{bigquery.NumericFieldType, "twelve", false},
+		{bigquery.BigNumericFieldType, int64(12), true},
+		{bigquery.BooleanFieldType, true, true},
+		{bigquery.BooleanFieldType, "true", false},
+		{bigquery.TimestampFieldType, time.Now(), true},
+		{bigquery.TimestampFieldType, "2023-08-01T10:15:00Z", true},
+		{bigquery.TimestampFieldType, "2023-08-01 10:15:00.000000 UTC", true},
+		{bigquery.TimestampFieldType, "2023-08-01 10:15:00", true},
+		{bigquery.TimestampFieldType, "yesterday", false},
+		{bigquery.DateTimeFieldType, "2023-08-01 10:15:00.000000", true},
+		{bigquery.DateTimeFieldType, "2023-08-01T10:15:00", true},
+		{bigquery.DateTimeFieldType, "2023-08-01", false},
+		{bigquery.DateFieldType, "2023-08-01", true},
+		{bigquery.DateFieldType, "2023-08-01 10:15:00", false},
+		{bigquery.TimeFieldType, "10:15:00.5", true},
+		{bigquery.TimeFieldType, "10:15", false},
+		{bigquery.IntervalFieldType, "1-0 0 0:0:0", false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %T %v", tt.fieldType, tt.value, tt.value), func(t *testing.T) {
+			if got := compatibleValue(tt.fieldType, tt.value); got != tt.want {
+				t.Errorf("compatibleValue(%s, %T %v) = %t, expected %t", tt.fieldType, tt.value, tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Maximum number of elements generated for a REPEATED field
+const maxRepeatedElements = 3
+
+// schemaDataRecord is a single record of random data generated to match an
+// arbitrary bigquery.Schema.  Values are held in their JSON representation so
+// the same row serves both the insertAll and storage write paths.
+type schemaDataRecord struct {
+	row map[string]bigquery.Value
+}
+
+// Save implements bigquery.ValueSaver.Save
+func (sd *schemaDataRecord) Save() (row map[string]bigquery.Value, insertID string, err error) {
+	return sd.row, bigquery.NoDedupeID, nil
+}
+
+// MarshalJSON implements json.Marshaler.MarshalJSON
+func (sd *schemaDataRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sd.row)
+}
+
+// WithRunIDColumn returns the schema with a NULLABLE run_id column appended
+// if it does not already have one, so every run can be verified.
+func WithRunIDColumn(schema bigquery.Schema) bigquery.Schema {
+	for _, field := range schema {
+		if field.Name == "run_id" {
+			return schema
+		}
+	}
+	return append(append(bigquery.Schema{}, schema...), &bigquery.FieldSchema{Name: "run_id", Type: bigquery.StringFieldType})
+}
+
+// PrintSchema writes the schema in the standard BigQuery JSON schema format,
+// as accepted by bq mk --schema
+func PrintSchema(w io.Writer, schema bigquery.Schema) error {
+	data, err := schema.ToJSONFields()
+	if err != nil {
+		return err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, data, "", "  "); err != nil {
+		return err
+	}
+	indented.WriteByte('\n')
+	_, err = indented.WriteTo(w)
+	return err
+}
+
+// LoadBigQuerySchema reads a table schema in the standard BigQuery JSON
+// schema format, as emitted by bq show --schema, either the list of fields
+// or an object holding them in fields.  Every field must be of a type the
+// random data generator produces.
+func LoadBigQuerySchema(path string) (bigquery.Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var wrapped struct {
+		Fields json.RawMessage `json:"fields"`
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &wrapped); err != nil || wrapped.Fields == nil {
+			return nil, fmt.Errorf("invalid BigQuery schema %s, expected a list of fields or an object holding them in fields", path)
+		}
+		data = wrapped.Fields
+	}
+	schema, err := bigquery.SchemaFromJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid BigQuery schema %s: %w", path, err)
+	}
+	if len(schema) == 0 {
+		return nil, fmt.Errorf("the BigQuery schema %s has no fields", path)
+	}
+	if err := checkGeneratedFields(schema, ""); err != nil {
+		return nil, fmt.Errorf("invalid BigQuery schema %s: %w", path, err)
+	}
+	return schema, nil
+}
+
+// generatedFieldTypes are the field types the random data generator produces
+var generatedFieldTypes = map[bigquery.FieldType]bool{
+	bigquery.StringFieldType:     true,
+	bigquery.BytesFieldType:      true,
+	bigquery.IntegerFieldType:    true,
+	bigquery.FloatFieldType:      true,
+	bigquery.NumericFieldType:    true,
+	bigquery.BigNumericFieldType: true,
+	bigquery.BooleanFieldType:    true,
+	bigquery.TimestampFieldType:  true,
+	bigquery.DateTimeFieldType:   true,
+	bigquery.DateFieldType:       true,
+	bigquery.TimeFieldType:       true,
+	bigquery.GeographyFieldType:  true,
+	bigquery.JSONFieldType:       true,
+	bigquery.RecordFieldType:     true,
+}
+
+// checkGeneratedFields rejects a field, including a nested field of a
+// RECORD, of a type the random data generator does not produce
+func checkGeneratedFields(schema bigquery.Schema, prefix string) error {
+	for _, field := range schema {
+		if !generatedFieldTypes[field.Type] {
+			return fmt.Errorf("field %s%s is of type %s, which cannot be generated", prefix, field.Name, field.Type)
+		}
+		if field.Type == bigquery.RecordFieldType {
+			if len(field.Schema) == 0 {
+				return fmt.Errorf("RECORD field %s%s has no fields", prefix, field.Name)
+			}
+			if err := checkGeneratedFields(field.Schema, prefix+field.Name+"."); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// NewSchemaDataGenerator returns a dataGenerator producing random values
+// appropriate to each field of the schema.  Columns named name, uuid,
+// create_time and run_id of a compatible type take the generated values, and
+// the randomness is seeded from the uuid so generation is deterministic.
+func NewSchemaDataGenerator(schema bigquery.Schema) dataGenerator {
+	return newSchemaDataGenerator(schema, randomFieldValue)
+}
+
+// generatedColumns are the columns taking the generated name, uuid,
+// create_time and run_id when of a compatible type
+var generatedColumns = map[string]bool{"name": true, "uuid": true, "create_time": true, "run_id": true}
+
+// newSchemaDataGenerator returns a dataGenerator taking the value of every
+// column other than the generated columns from the value function
+func newSchemaDataGenerator(schema bigquery.Schema, value func(r *rand.Rand, field *bigquery.FieldSchema) bigquery.Value) dataGenerator {
+	return func(name string, uuid int64, create_time time.Time, run_id string) interface{} {
+		r := seededRand(uint64(uuid))
+		row := make(map[string]bigquery.Value, len(schema))
+		for _, field := range schema {
+			switch {
+			case field.Name == "name" && field.Type == bigquery.StringFieldType && !field.Repeated:
+				row[field.Name] = name
+			case field.Name == "uuid" && field.Type == bigquery.IntegerFieldType && !field.Repeated:
+				row[field.Name] = uuid
+			case field.Name == "create_time" && !field.Repeated && (field.Type == bigquery.DateTimeFieldType || field.Type == bigquery.TimestampFieldType):
+				row[field.Name] = create_time.Format("2006-01-02 15:04:05.000000")
+			case field.Name == "run_id" && field.Type == bigquery.StringFieldType && !field.Repeated:
+				row[field.Name] = run_id
+			default:
+				row[field.Name] = value(r, field)
+			}
+		}
+		return &schemaDataRecord{row: row}
+	}
+}
+
+// seededRand returns a random generator seeded from the value, a PCG source
+// being cheap enough to seed afresh for every record
+func seededRand(seed uint64) *rand.Rand {
+	seed = splitMix64(seed)
+	return rand.New(rand.NewPCG(seed, splitMix64(seed)))
+}
+
+// randomFieldValue generates a random value for the field, including the
+// elements of a REPEATED field and the nested fields of a RECORD.
+func randomFieldValue(r *rand.Rand, field *bigquery.FieldSchema) bigquery.Value {
+	if field.Repeated {
+		values := make([]bigquery.Value, 1+r.IntN(maxRepeatedElements))
+		for i := range values {
+			values[i] = randomScalarValue(r, field)
+		}
+		return values
+	}
+	return randomScalarValue(r, field)
+}
+
+// randomScalarValue generates a single random value of the field's type
+func randomScalarValue(r *rand.Rand, field *bigquery.FieldSchema) bigquery.Value {
+	switch field.Type {
+	case bigquery.StringFieldType:
+		return randomNames[r.IntN(len(randomNames))]
+	case bigquery.BytesFieldType:
+		b := make([]byte, 16)
+		for i := range b {
+			b[i] = byte(r.Uint32())
+		}
+		return base64.StdEncoding.EncodeToString(b)
+	case bigquery.IntegerFieldType:
+		return r.Int64N(1000000)
+	case bigquery.FloatFieldType:
+		return r.Float64() * 1000
+	case bigquery.NumericFieldType, bigquery.BigNumericFieldType:
+		return fmt.Sprintf("%d.%09d", r.Int64N(1000000), r.Int64N(1000000000))
+	case bigquery.BooleanFieldType:
+		return r.IntN(2) == 1
+	case bigquery.TimestampFieldType:
+		return randomTime(r).Format("2006-01-02 15:04:05.000000 UTC")
+	case bigquery.DateTimeFieldType:
+		return randomTime(r).Format("2006-01-02 15:04:05.000000")
+	case bigquery.DateFieldType:
+		return randomTime(r).Format("2006-01-02")
+	case bigquery.TimeFieldType:
+		return randomTime(r).Format("15:04:05.000000")
+	case bigquery.GeographyFieldType:
+		return fmt.Sprintf("POINT(%.6f %.6f)", r.Float64()*360-180, r.Float64()*180-90)
+	case bigquery.JSONFieldType:
+		return fmt.Sprintf(`{"value":%d}`, r.IntN(1000))
+	case bigquery.RecordFieldType:
+		nested := make(map[string]bigquery.Value, len(field.Schema))
+		for _, child := range field.Schema {
+			nested[child.Name] = randomFieldValue(r, child)
+		}
+		return nested
+	}
+	return nil
+}
+
+// randomTimeEpoch is the start of the day the process started, anchoring the
+// random times so the same seed generates the same time throughout a run
+var randomTimeEpoch = time.Now().UTC().Truncate(24 * time.Hour)
+
+// randomTime generates a random time within the year before randomTimeEpoch
+func randomTime(r *rand.Rand) time.Time {
+	return randomTimeEpoch.Add(-time.Duration(r.Int64N(int64(365 * 24 * time.Hour))))
+}
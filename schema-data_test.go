@@ -0,0 +1,128 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// orderJSONSchema is a JSON Schema document with nested and repeated
+// properties
+const orderJSONSchema = `{
+	"type": "object",
+	"required": ["name", "uuid"],
+	"properties": {
+		"name": {"type": "string"},
+		"uuid": {"type": "integer"},
+		"create_time": {"type": "string", "format": "date-time"},
+		"total": {"type": "number"},
+		"items": {"type": "array", "items": {
+			"type": "object",
+			"properties": {"sku": {"type": "string"}, "quantity": {"type": "integer"}}
+		}}
+	}
+}`
+
+// TestPrintSchemaRoundTrip feeds the printed schema back as a -schema file,
+// which must load as the same schema and generate the same rows
+func TestPrintSchemaRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	fileSchema, err := LoadBigQuerySchema(writeFile("nested.json", nestedSchemaFile))
+	if err != nil {
+		t.Fatalf("LoadBigQuerySchema: %v", err)
+	}
+	fileSchema = WithRunIDColumn(fileSchema)
+	jsonSchema, err := LoadJSONSchema(writeFile("order.schema.json", orderJSONSchema))
+	if err != nil {
+		t.Fatalf("LoadJSONSchema: %v", err)
+	}
+	convertedSchema, err := JSONSchemaToBigQuerySchema(jsonSchema)
+	if err != nil {
+		t.Fatalf("JSONSchemaToBigQuerySchema: %v", err)
+	}
+	convertedSchema = WithRunIDColumn(convertedSchema)
+
+	tests := []struct {
+		name   string
+		schema bigquery.Schema
+		gen    dataGenerator
+	}{
+		{"Built-In Table Schema", tableDataBigQuerySchema, NewTableData},
+		{"Schema File", fileSchema, NewSchemaDataGenerator(fileSchema)},
+		{"JSON Schema", convertedSchema, NewSchemaDataGenerator(convertedSchema)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var printed bytes.Buffer
+			if err := PrintSchema(&printed, tt.schema); err != nil {
+				t.Fatalf("PrintSchema: %v", err)
+			}
+			reloaded, err := LoadBigQuerySchema(writeFile("printed.json", printed.String()))
+			if err != nil {
+				t.Fatalf("LoadBigQuerySchema of the printed schema: %v", err)
+			}
+			reloaded = WithRunIDColumn(reloaded)
+
+			var reprinted bytes.Buffer
+			if err := PrintSchema(&reprinted, reloaded); err != nil {
+				t.Fatalf("PrintSchema: %v", err)
+			}
+			if reprinted.String() != printed.String() {
+				t.Fatalf("reloaded schema prints as\n%s\nexpected\n%s", reprinted.String(), printed.String())
+			}
+
+			gen := NewSchemaDataGenerator(reloaded)
+			createTime := time.Date(2023, 8, 1, 10, 15, 0, 0, time.UTC)
+			for i := int64(0); i < selfCheckRows; i++ {
+				want := generatedRowJSON(t, tt.gen(randomNames[i], i*42, createTime, "run-1"))
+				got := generatedRowJSON(t, gen(randomNames[i], i*42, createTime, "run-1"))
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("row %d generated from the printed schema as %v, expected %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// generatedRowJSON returns the JSON encoding of a generated record decoded
+// into a map, so rows compare regardless of the order of their keys
+func generatedRowJSON(t *testing.T, data interface{}) map[string]interface{} {
+	t.Helper()
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	var row map[string]interface{}
+	if err := json.Unmarshal(encoded, &row); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	return row
+}
@@ -0,0 +1,820 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/rs/zerolog"
+	"google.golang.org/api/option"
+)
+
+// Project, dataset and table used by the self-test against the fake server
+const (
+	selfTestProject = "bqwrite-selftest"
+	selfTestDataset = "selftest"
+	selfTestTable   = "bqwrite_test"
+)
+
+// errSelfTestSkipped marks a check which cannot run against the fake server
+var errSelfTestSkipped = errors.New("skipped")
+
+// selfTest holds the state shared by the self-test checks
+type selfTest struct {
+	ctx     context.Context
+	server  *FakeBigQueryServer
+	client  *bigquery.Client
+	config  *BenchmarkConfig
+	summary *RunSummary
+}
+
+// selfTestCheck is a single named check of the self-test
+type selfTestCheck struct {
+	name string
+	run  func(*selfTest) error
+}
+
+// selfTestChecks lists the checks of the self-test in the order executed,
+// each building on the state left by the previous checks
+var selfTestChecks = []selfTestCheck{
+	{"Create Table", (*selfTest).checkCreateTable},
+	{"Add Missing Columns", (*selfTest).checkAddMissingColumns},
+	{"insertAll Write", (*selfTest).checkInsertAll},
+	{"insertAll Retries", (*selfTest).checkInsertAllRetries},
+	{"Committed Stream Write", (*selfTest).checkCommittedStream},
+	{"Verification", (*selfTest).checkVerification},
+	{"Results Output", (*selfTest).checkResultsOutput},
+	{"Adaptive Heartbeat", (*selfTest).checkAdaptiveHeartbeat},
+	{"Interrupted Query Cancellation", (*selfTest).checkInterruptedQuery},
+	{"Request Splitting", (*selfTest).checkRequestSplitting},
+	{"Results Compatibility", (*selfTest).checkResultsCompatibility},
+	{"Baseline Comparison", (*selfTest).checkBaselineComparison},
+	{"Acknowledgment High-Water Mark", (*selfTest).checkAckHighWaterMark},
+	{"Retry Telemetry", (*selfTest).checkRetryTelemetry},
+	{"Shutdown Ordering", (*selfTest).checkShutdownOrdering},
+	{"Nested Field Statistics", (*selfTest).checkNestedStats},
+	{"CSV Results", (*selfTest).checkCSVResults},
+	{"Row Count Verification", (*selfTest).checkRowCountVerification},
+	{"Duplicate Injection", (*selfTest).checkDuplicateInjection},
+	{"Table Layout", (*selfTest).checkTableLayout},
+	{"Table Cleanup", (*selfTest).checkTableCleanup},
+}
+
+// RunSelfTest executes the whole pipeline end-to-end against the embedded
+// fake server without credentials, logging pass or fail for each check, and
+// returns the exit status, non-zero if any check failed.  The conformance
+// checks of any fault scenarios selected by -fault-scenario follow.
+func RunSelfTest(args []string) int {
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	var faultScenario = flags.String("fault-scenario", "", "Also Run the Conformance Check of a Fault Scenario, one of "+strings.Join(FaultScenarioNames(), ", ")+" or all")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	checks, err := SelfTestChecks(*faultScenario)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	server := NewFakeBigQueryServer()
+	defer server.Close()
+
+	t, err := newSelfTest(context.Background(), server)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error [bigquery.NewClient]")
+		return 1
+	}
+	defer t.client.Close()
+
+	logger.Info().Str("Server", server.URL()).Msg("Self-Test Against the Fake BigQuery Server")
+	failures := 0
+	for _, check := range checks {
+		err := check.run(t)
+		switch {
+		case err == nil:
+			logger.Info().Str("Check", check.name).Msg("  PASS")
+		case errors.Is(err, errSelfTestSkipped):
+			logger.Warn().Str("Check", check.name).Str("Reason", err.Error()).Msg("  SKIP")
+		default:
+			failures++
+			logger.Error().Str("Check", check.name).Err(err).Msg("  FAIL")
+		}
+	}
+
+	if failures > 0 {
+		logger.Error().Int("Failed Checks", failures).Msg("Self-Test Failed")
+		return 1
+	}
+	logger.Info().Msg("Self-Test Passed")
+	return 0
+}
+
+// newSelfTest creates the state shared by the checks, with a BigQuery client
+// and the configuration of the runs pointed at the fake server
+func newSelfTest(ctx context.Context, server *FakeBigQueryServer) (*selfTest, error) {
+	client, err := bigquery.NewClient(ctx, selfTestProject, FakeClientOptions(server)...)
+	if err != nil {
+		return nil, err
+	}
+	t := &selfTest{ctx: ctx, server: server, client: client}
+	t.config = &BenchmarkConfig{
+		ProjectID:        selfTestProject,
+		DatasetID:        selfTestDataset,
+		TableID:          selfTestTable,
+		NumberWorkers:    2,
+		BatchSize:        10,
+		NumberIterations: 100,
+		DrainTimeout:     time.Minute,
+		StreamerOptions:  FakeClientOptions(server),
+		StorageOptions:   FakeStorageWriteOptions(server),
+	}
+	return t, nil
+}
+
+// checkCreateTable creates the target table, then overwrites it, polling
+// until the deletion and creation are seen
+func (t *selfTest) checkCreateTable() error {
+	for _, overwrite := range []bool{false, true} {
+		created, _, err := CreateBigQueryTable(t.ctx, t.client, selfTestDataset, selfTestTable, tableDataBigQuerySchema, TableLayout{}, overwrite, SafeMode{})
+		if err != nil {
+			return err
+		}
+		if !created || !t.server.HasTable(selfTestDataset, selfTestTable) {
+			return fmt.Errorf("the table was not created with overwrite %t", overwrite)
+		}
+	}
+	return nil
+}
+
+// checkAddMissingColumns adds the run_id column to a table created without it
+func (t *selfTest) checkAddMissingColumns() error {
+	tableID := selfTestTable + "_legacy"
+	t.server.CreateTable(selfTestDataset, tableID, json.RawMessage(`[{"name":"name","type":"STRING"}]`))
+	if _, _, err := CreateBigQueryTable(t.ctx, t.client, selfTestDataset, tableID, tableDataBigQuerySchema, TableLayout{}, false, SafeMode{}); err != nil {
+		return err
+	}
+	if !strings.Contains(string(t.server.TableSchema(selfTestDataset, tableID)), `"run_id"`) {
+		return errors.New("the run_id column was not added")
+	}
+	return nil
+}
+
+// checkInsertAll streams the records using the insertAll API, checking every
+// record arrived
+func (t *selfTest) checkInsertAll() error {
+	t.config.RunID = NewRunID()
+	summary, err := ExecuteLegacyStream(t.ctx, t.config)
+	if err != nil {
+		return err
+	}
+	t.summary = summary
+	return t.expectRows(summary.RecordsSent)
+}
+
+// checkInsertAllRetries streams the records while the fake server fails every
+// third insertAll request with a 503, checking each failed request was
+// retried after a backoff and the retries delivered every record
+func (t *selfTest) checkInsertAllRetries() error {
+	t.server.SetFaultScenario(faultScenarios["unavailable"])
+	defer t.server.SetFaultScenario(FaultScenario{})
+
+	t.config.RunID = NewRunID()
+	summary, err := ExecuteLegacyStream(t.ctx, t.config)
+	if err != nil {
+		return err
+	}
+	t.summary = summary
+
+	stats := t.server.FaultStats()
+	switch {
+	case stats.Unavailable == 0:
+		return errors.New("no failures were injected")
+	case len(stats.RetryDelays) != stats.Unavailable:
+		return fmt.Errorf("%d of the %d failed requests were retried", len(stats.RetryDelays), stats.Unavailable)
+	case stats.MinRetryDelay() <= 0:
+		return errors.New("a failed request was retried without a backoff")
+	}
+	return t.expectRows(summary.RecordsSent)
+}
+
+// checkCommittedStream streams the records through a committed stream of the
+// fake Storage Write API, checking every record arrives and the offsets
+// progress contiguously to the final offset
+func (t *selfTest) checkCommittedStream() error {
+	config := *t.config
+	config.RunID = NewRunID()
+	summary, err := ExecuteCommittedStream(t.ctx, &config)
+	if err != nil {
+		return err
+	}
+	if offsets := summary.Offsets; !offsets.Contiguous() || offsets.FinalOffset != int64(summary.RecordsSent) {
+		return fmt.Errorf("%d offset gaps and a final offset of %d, expected none and %d", offsets.GapCount, offsets.FinalOffset, summary.RecordsSent)
+	}
+	if rows := t.server.RunRows(selfTestDataset, selfTestTable, config.RunID); rows != int64(summary.RecordsSent) {
+		return fmt.Errorf("the server holds %d rows, expected %d", rows, summary.RecordsSent)
+	}
+	return nil
+}
+
+// lastRun returns the summary of the last insertAll run, skipping the check
+// when no run completed, as the insertAll checks have then failed
+func (t *selfTest) lastRun() (*RunSummary, error) {
+	if t.summary == nil {
+		return nil, fmt.Errorf("%w, no insertAll run completed", errSelfTestSkipped)
+	}
+	return t.summary, nil
+}
+
+// checkVerification counts the rows of the last run with a query
+func (t *selfTest) checkVerification() error {
+	summary, err := t.lastRun()
+	if err != nil {
+		return err
+	}
+	rows, err := CountRunRows(t.ctx, t.client, selfTestDataset, selfTestTable, t.config.RunID)
+	if err != nil {
+		return err
+	}
+	if rows != int64(summary.RecordsSent) {
+		return fmt.Errorf("counted %d rows, expected %d", rows, summary.RecordsSent)
+	}
+	return nil
+}
+
+// checkResultsOutput writes the results file of the last run and reads it back
+func (t *selfTest) checkResultsOutput() error {
+	summary, err := t.lastRun()
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "bqwrite-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "results.json")
+	if err := WriteResults(path, NewRunResults(t.config, modeInsertAll, summary, nil)); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var results RunResults
+	if err := json.Unmarshal(data, &results); err != nil {
+		return err
+	}
+	if results.RunID != t.config.RunID || results.RecordsSent != summary.RecordsSent {
+		return fmt.Errorf("results file recorded run %q with %d records, expected run %q with %d records",
+			results.RunID, results.RecordsSent, t.config.RunID, summary.RecordsSent)
+	}
+	return nil
+}
+
+// checkAdaptiveHeartbeat streams the records through a heartbeat, once while
+// healthy and once while the fake server fails every third insertAll request,
+// checking the heartbeat escalates only for the failures and restores the log
+// level once stopped
+func (t *selfTest) checkAdaptiveHeartbeat() error {
+	level := zerolog.GlobalLevel()
+	thresholds := HeartbeatThresholds{ErrorRate: 0.1, P99: 10 * time.Second, Gap: 1000}
+	for _, fault := range []string{"", "unavailable"} {
+		t.server.SetFaultScenario(faultScenarios[fault])
+		heartbeat := NewHeartbeat(time.Minute, thresholds, &RequestIDTracker{})
+		config := *t.config
+		config.RunID = NewRunID()
+		config.Heartbeat = heartbeat
+		config.StreamerOptions = FakeClientOptions(t.server, option.WithHTTPClient(&http.Client{Transport: heartbeat.Transport(http.DefaultTransport)}))
+		_, err := ExecuteLegacyStream(t.ctx, &config)
+		t.server.SetFaultScenario(FaultScenario{})
+		if err != nil {
+			return err
+		}
+
+		// Beat once for the whole run rather than waiting for the interval
+		heartbeat.beat()
+		escalations := heartbeat.Stop()
+		switch {
+		case fault == "" && escalations != 0:
+			return fmt.Errorf("the heartbeat escalated %d times during a healthy run", escalations)
+		case fault != "" && escalations == 0:
+			return fmt.Errorf("the heartbeat never escalated during the %s fault scenario", fault)
+		case zerolog.GlobalLevel() != level:
+			return fmt.Errorf("the log level was left at %s, expected %s", zerolog.GlobalLevel(), level)
+		}
+	}
+	return nil
+}
+
+// blockingJob is a fake query job whose Wait blocks until its context is
+// cancelled, recording whether the job was then cancelled
+type blockingJob struct {
+	cancelled bool
+}
+
+// Wait implements queryJob
+func (j *blockingJob) Wait(ctx context.Context) (*bigquery.JobStatus, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// Cancel implements queryJob
+func (j *blockingJob) Cancel(ctx context.Context) error {
+	j.cancelled = true
+	return nil
+}
+
+// checkInterruptedQuery verifies a query interrupted while its job is running
+// returns promptly as interrupted, cancelling the job server-side, and that
+// the verification is reported as skipped
+func (t *selfTest) checkInterruptedQuery() error {
+	ctx, cancel := context.WithCancel(t.ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	job := &blockingJob{}
+	_, err := WaitForJob(ctx, job)
+	switch {
+	case !errors.Is(err, errInterrupted):
+		return fmt.Errorf("the interrupted query returned %v, expected it to be interrupted", err)
+	case !job.cancelled:
+		return fmt.Errorf("the job of the interrupted query was not cancelled")
+	case !SkippedOnInterrupt("Self-Test", err):
+		return fmt.Errorf("the interrupted verification was not reported as skipped")
+	}
+
+	// A query run after the interrupt is interrupted rather than sent
+	if _, err := CountRunRows(ctx, t.client, selfTestDataset, selfTestTable, t.config.RunID); !errors.Is(err, errInterrupted) {
+		return fmt.Errorf("a query run after the interrupt returned %v, expected it to be interrupted", err)
+	}
+	return nil
+}
+
+// checkRequestSplitting streams the records with a maximum request size
+// smaller than a batch, checking the oversized requests are split and every
+// row lands, then checks a record larger than a request is rejected
+func (t *selfTest) checkRequestSplitting() error {
+	splitter := NewRequestSplitter(4096)
+	config := *t.config
+	config.RunID = NewRunID()
+	config.BatchSize = 50
+	config.Splitter = splitter
+	config.StreamerOptions = FakeClientOptions(t.server, option.WithHTTPClient(&http.Client{Transport: splitter.Transport(http.DefaultTransport)}))
+	summary, err := ExecuteLegacyStream(t.ctx, &config)
+	switch {
+	case err != nil:
+		return err
+	case summary.RequestSplits == 0:
+		return fmt.Errorf("no requests were split with a maximum request size of 4096 bytes")
+	}
+	if rows := t.server.RunRows(selfTestDataset, selfTestTable, config.RunID); rows != int64(summary.RecordsSent) {
+		return fmt.Errorf("the server holds %d rows of the split requests, expected %d", rows, summary.RecordsSent)
+	}
+
+	if err := NewRequestSplitter(1024).CheckRecord(RecordSize(NewStressTableData(randomNames[0], 0, time.Now(), config.RunID))); err == nil {
+		return fmt.Errorf("a record larger than the maximum request size was not rejected")
+	}
+	return nil
+}
+
+// resultsFixtures are results files of each historical version of the
+// results schema, along with a newer minor version adding a field, all of
+// which must still parse
+var resultsFixtures = []struct {
+	version string
+	data    string
+}{
+	{legacyResultsSchemaVersion, `{"run_id":"20230801T101500-1a2b3c4d","project_id":"p","dataset_id":"d","table_id":"t","mode":"insertall","workers":10,"batch_size":500,"records_sent":100,"records_abandoned":0,"records_skipped":0,"records_retried":0,"elapsed_seconds":2,"records_per_second":50,"bytes_sent":0,"billable_bytes":0}`},
+	{"1.0", `{"schema_version":"1.0","run_id":"20230801T101500-1a2b3c4d","project_id":"p","dataset_id":"d","table_id":"t","mode":"insertall","workers":10,"batch_size":500,"records_sent":100,"records_abandoned":0,"records_skipped":0,"records_retried":0,"elapsed_seconds":2,"records_per_second":50,"bytes_sent":0,"billable_bytes":0}`},
+	{"1.9", `{"schema_version":"1.9","run_id":"20230801T101500-1a2b3c4d","mode":"insertall","records_sent":100,"added_in_1_9":{"nested":true}}`},
+}
+
+// checkResultsCompatibility parses the results of every historical version,
+// then checks results of a newer major version are rejected
+func (t *selfTest) checkResultsCompatibility() error {
+	for _, fixture := range resultsFixtures {
+		results, err := ParseResults([]byte(fixture.data))
+		switch {
+		case err != nil:
+			return fmt.Errorf("the version %s results failed to parse: %w", fixture.version, err)
+		case results.SchemaVersion != fixture.version || results.RunID != "20230801T101500-1a2b3c4d" || results.RecordsSent != 100:
+			return fmt.Errorf("the version %s results parsed as version %s, run %s with %d records", fixture.version, results.SchemaVersion, results.RunID, results.RecordsSent)
+		}
+	}
+
+	// Results written by this release round trip
+	data, err := MarshalResults(NewRunResults(t.config, modeInsertAll, nil, nil))
+	if err != nil {
+		return err
+	}
+	if results, err := ParseResults(data); err != nil || results.SchemaVersion != ResultsSchemaVersion() {
+		return fmt.Errorf("the results of this release failed to round trip: %v", err)
+	}
+
+	if _, err := ParseResults([]byte(fmt.Sprintf(`{"schema_version":"%d.0"}`, resultsSchemaMajor+1))); err == nil {
+		return fmt.Errorf("results of a newer major version were not rejected")
+	}
+	return nil
+}
+
+// baselineCases are the results of runs compared against a baseline of 1000
+// records per second with 10 ms p99 latency, along with the metrics expected
+// to deviate
+var baselineCases = []struct {
+	recordsPerSecond float64
+	p99MS            float64
+	errors           int
+	deviations       []string
+}{
+	{1050, 11, 0, nil},
+	{850, 10, 0, []string{"records_per_second"}},
+	{1200, 10, 0, []string{"records_per_second"}},
+	{1000, 20, 0, []string{"p99_ms"}},
+	{1000, 10, 50, []string{"error_rate"}},
+}
+
+// checkBaselineComparison blesses a baseline, reads it back, then compares
+// runs against it, checking exactly the expected metrics deviate
+func (t *selfTest) checkBaselineComparison() error {
+	blessed := &RunResults{SchemaVersion: ResultsSchemaVersion(), RunID: "baseline", RecordsSent: 1000, RecordsPerSecond: 1000, WriteLatency: &WriteLatency{P50MS: 5, P95MS: 8, P99MS: 10}}
+	data, err := MarshalBaseline(&Baseline{Name: "selftest", Results: blessed, Tolerances: BaselineTolerances{ThroughputPercent: 10, MaxErrorRate: 0.01, LatencyPercent: 25}})
+	if err != nil {
+		return err
+	}
+	baseline, err := ParseBaseline(data)
+	if err != nil {
+		return err
+	}
+	if baseline.Name != "selftest" || baseline.Results.RecordsPerSecond != 1000 || baseline.Tolerances.ThroughputPercent != 10 {
+		return fmt.Errorf("the baseline read back as %q at %.1f records per second", baseline.Name, baseline.Results.RecordsPerSecond)
+	}
+	if _, err := ParseBaseline([]byte(resultsFixtures[1].data)); err == nil {
+		return fmt.Errorf("results without tolerances were accepted as a baseline")
+	}
+
+	for i, baselineCase := range baselineCases {
+		results := &RunResults{RecordsSent: 1000, RecordsPerSecond: baselineCase.recordsPerSecond, WriteLatency: &WriteLatency{P50MS: 5, P95MS: 8, P99MS: baselineCase.p99MS}}
+		if baselineCase.errors > 0 {
+			results.ErrorReport = []ErrorGroup{{Type: errorTypeSchema, Count: baselineCase.errors}}
+		}
+		var deviations []string
+		for _, check := range CompareBaseline(baseline, results) {
+			if !check.Passed {
+				deviations = append(deviations, check.Metric)
+			}
+		}
+		if !slices.Equal(deviations, baselineCase.deviations) {
+			return fmt.Errorf("case %d deviated in %v, expected %v", i+1, deviations, baselineCase.deviations)
+		}
+	}
+	return nil
+}
+
+// ackWindowCases are the tokens visible in the window beyond a confirmed
+// token, along with the confirmed token expected to follow
+var ackWindowCases = []struct {
+	confirmed int64
+	window    []int64
+	expected  int64
+}{
+	{0, nil, 0},
+	{0, []int64{1, 2, 3}, 3},
+	{0, []int64{2, 3}, 0},
+	{10, []int64{11, 12, 14, 15}, 12},
+}
+
+// checkAckHighWaterMark advances the confirmed token over each window,
+// checking it stops at the first missing token
+func (t *selfTest) checkAckHighWaterMark() error {
+	for i, ackCase := range ackWindowCases {
+		if confirmed := AdvanceConfirmedToken(ackCase.confirmed, ackCase.window); confirmed != ackCase.expected {
+			return fmt.Errorf("case %d confirmed token %d, expected %d", i+1, confirmed, ackCase.expected)
+		}
+	}
+
+	// Every record written carries the next token, written as its column
+	verifier := NewAckVerifier(0, 1)
+	gen := verifier.Generator(NewTableData)
+	for expected := int64(1); expected <= 3; expected++ {
+		record := gen("name", expected, time.Now(), "run")
+		verifier.Assign(record)
+		row, _, err := record.(bigquery.ValueSaver).Save()
+		if err != nil {
+			return err
+		}
+		if row[ackTokenColumn] != expected {
+			return fmt.Errorf("record %d carried token %v", expected, row[ackTokenColumn])
+		}
+		verifier.AddSent(record)
+	}
+	if sent := verifier.sent.Load(); sent != 3 {
+		return fmt.Errorf("the sent token was %d, expected 3", sent)
+	}
+	return nil
+}
+
+// checkRetryTelemetry checks the retries of each record are counted, with the
+// record still being retried when the run ends counted as failed
+func (t *selfTest) checkRetryTelemetry() error {
+	if telemetry := NewRetryTelemetry(skipErrorHandler{}); telemetry != nil {
+		return errors.New("telemetry was created for the skip error handler")
+	}
+	telemetry := NewRetryTelemetry(&retryErrorHandler{retries: 3})
+	telemetry.Done(true)
+	telemetry.Retry()
+	telemetry.Done(true)
+	telemetry.Retry()
+	telemetry.Retry()
+	telemetry.Done(true)
+	telemetry.Retry()
+	telemetry.Retry()
+	telemetry.Retry()
+	telemetry.Finish()
+
+	if telemetry.TotalRetryAttempts != 6 || telemetry.MaxRetriesForSingleRecord != 3 {
+		return fmt.Errorf("%d retry attempts with at most %d for a record, expected 6 and 3", telemetry.TotalRetryAttempts, telemetry.MaxRetriesForSingleRecord)
+	}
+	if !slices.Equal(telemetry.RetriesPerRecord, []int{1, 1, 1, 1}) {
+		return fmt.Errorf("retries per record %v, expected [1 1 1 1]", telemetry.RetriesPerRecord)
+	}
+	if rate := telemetry.RetrySuccessRate; math.Abs(rate-2.0/3) > 1e-9 {
+		return fmt.Errorf("retry success rate %.3f, expected 0.667", rate)
+	}
+	return nil
+}
+
+// checkShutdownOrdering checks the stages of the shutdown run in order, the
+// cleanup in the reverse order registered, with verification still run after
+// a failed run and cancelled by an interrupt while the later stages still run
+func (t *selfTest) checkShutdownOrdering() error {
+	newShutdown := func(ran *[]string) *Shutdown {
+		shutdown := NewShutdown()
+		hook := func(name string) ShutdownHook {
+			return func(context.Context) error {
+				*ran = append(*ran, name)
+				return nil
+			}
+		}
+		shutdown.RegisterClose("Client", func() error { return hook("Client")(nil) })
+		shutdown.RegisterClose("Log", func() error { return hook("Log")(nil) })
+		shutdown.Register(stageReport, "Results", hook("Results"))
+		shutdown.Register(stageVerify, "Verify", hook("Verify"))
+		shutdown.Register(stageReconcile, "Acks", hook("Acks"))
+		shutdown.Drained("Streamers", time.Second)
+		shutdown.Register(stageStopProducers, "Generator", hook("Generator"))
+		return shutdown
+	}
+
+	var ran []string
+	if err := newShutdown(&ran).Run(t.ctx, nil); err != nil {
+		return err
+	}
+	if expected := []string{"Generator", "Acks", "Verify", "Results", "Log", "Client"}; !slices.Equal(ran, expected) {
+		return fmt.Errorf("hooks ran in the order %v, expected %v", ran, expected)
+	}
+
+	ran = nil
+	runErr := errors.New("failed run")
+	shutdown := newShutdown(&ran)
+	if err := shutdown.Run(t.ctx, runErr); err != nil {
+		return err
+	}
+	if expected := []string{"Generator", "Acks", "Verify", "Results", "Log", "Client"}; !slices.Equal(ran, expected) {
+		return fmt.Errorf("hooks of a failed run ran in the order %v, expected %v", ran, expected)
+	}
+	timings := shutdown.Timings()
+	if len(timings) != len(shutdownStages) || timings[3].Hooks != 1 || timings[1].Seconds < 1 {
+		return fmt.Errorf("stage timings of a failed run %+v, expected verification after a drain of a second", timings)
+	}
+
+	ran = nil
+	shutdown = newShutdown(&ran)
+	shutdown.notify = func(ctx context.Context) (context.Context, func()) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		return ctx, cancel
+	}
+	if err := shutdown.Run(t.ctx, nil); err != nil {
+		return err
+	}
+	if expected := []string{"Generator", "Acks", "Results", "Log", "Client"}; !slices.Equal(ran, expected) {
+		return fmt.Errorf("hooks of an interrupted shutdown ran in the order %v, expected %v", ran, expected)
+	}
+	if timings := shutdown.Timings(); !timings[3].Interrupted || timings[4].Interrupted {
+		return fmt.Errorf("stage timings of an interrupted shutdown %+v, expected only verification interrupted", timings)
+	}
+	return nil
+}
+
+// checkNestedStats checks the queries unnest every REPEATED field along the
+// path to each REPEATED field, including those nested within a RECORD
+func (t *selfTest) checkNestedStats() error {
+	schema := bigquery.Schema{
+		{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+		{Name: "items", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+			{Name: "codes", Type: bigquery.IntegerFieldType, Repeated: true},
+		}},
+	}
+	expected := map[string]string{
+		"tags":        "SELECT CAST(e0 AS STRING) AS value, COUNT(*) AS count FROM `d.t` AS t, UNNEST(t.`tags`) AS e0 WHERE t.run_id = @run_id GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT 10",
+		"items":       "SELECT TO_JSON_STRING(e0) AS value, COUNT(*) AS count FROM `d.t` AS t, UNNEST(t.`items`) AS e0 WHERE t.run_id = @run_id GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT 10",
+		"items.codes": "SELECT CAST(e1 AS STRING) AS value, COUNT(*) AS count FROM `d.t` AS t, UNNEST(t.`items`) AS e0, UNNEST(e0.`codes`) AS e1 WHERE t.run_id = @run_id GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT 10",
+	}
+	paths := RepeatedFieldPaths(schema)
+	if len(paths) != len(expected) {
+		return fmt.Errorf("%d REPEATED fields found, expected %d", len(paths), len(expected))
+	}
+	for _, path := range paths {
+		name := FieldPathName(path)
+		if query := NestedStatsQuery("d", "t", path); query != expected[name] {
+			return fmt.Errorf("the query of %s is %q, expected %q", name, query, expected[name])
+		}
+	}
+	return nil
+}
+
+// checkCSVResults delivers the results of a completed and a failed run to a
+// CSV file, checking a single header is written and each run appends a row
+// holding its status and tags
+func (t *selfTest) checkCSVResults() error {
+	summary, err := t.lastRun()
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "bqwrite-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "results.csv")
+	dispatcher := NewResultsDispatcher(CSVResultsSink(path))
+	tags := RunTags{"vm": "n2-standard-8", "team": "storage"}
+	for _, runErr := range []error{nil, errors.New("run ended early")} {
+		results := NewRunResults(t.config, modeInsertAll, summary, runErr)
+		results.Tags = tags
+		for _, delivery := range dispatcher.Deliver(context.Background(), results) {
+			if delivery.Err != nil {
+				return delivery.Err
+			}
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	switch {
+	case err != nil:
+		return err
+	case len(rows) != 3 || !slices.Equal(rows[0], resultsCSVHeader):
+		return fmt.Errorf("the CSV file holds %d rows with header %v, expected a header and 2 rows", len(rows), rows[0])
+	}
+	status := slices.Index(resultsCSVHeader, "status")
+	if rows[1][status] != resultsStatusComplete || rows[2][status] != resultsStatusPartial {
+		return fmt.Errorf("the CSV rows have status %s and %s, expected %s and %s", rows[1][status], rows[2][status], resultsStatusComplete, resultsStatusPartial)
+	}
+	column := slices.Index(resultsCSVHeader, "tags")
+	for _, row := range rows[1:] {
+		if row[column] != tags.String() {
+			return fmt.Errorf("the CSV row has tags %q, expected %q", row[column], tags.String())
+		}
+	}
+	return nil
+}
+
+// checkRowCountVerification verifies the row count of the insertAll run,
+// then expects the count of one more row than sent to be retried over the
+// window before failing with rows missing
+func (t *selfTest) checkRowCountVerification() error {
+	summary, err := t.lastRun()
+	if err != nil {
+		return err
+	}
+	targets := []*StreamTarget{{DatasetID: selfTestDataset, TableID: selfTestTable}}
+	sent := int64(summary.RecordsSent)
+	if err := VerifyRowCount(t.ctx, t.client, targets, t.config.RunID, sent, 0, false, false); err != nil {
+		return err
+	}
+
+	defer func(interval time.Duration) { verifyRetryInterval = interval }(verifyRetryInterval)
+	verifyRetryInterval = 10 * time.Millisecond
+	start := time.Now()
+	err = VerifyRowCount(t.ctx, t.client, targets, t.config.RunID, sent+1, 50*time.Millisecond, false, false)
+	switch {
+	case !errors.Is(err, errRowsMissing):
+		return fmt.Errorf("verifying %d rows returned %v, expected rows missing", sent+1, err)
+	case time.Since(start) < 40*time.Millisecond:
+		return fmt.Errorf("the row count was not retried over the window")
+	}
+	return nil
+}
+
+// checkDuplicateInjection expects each percentage of duplicates to re-send
+// that many of every 100 records, and no record when 0
+func (t *selfTest) checkDuplicateInjection() error {
+	for _, percent := range []float64{0, 12.5, 25, 100} {
+		schedule := NewDuplicateSchedule(percent)
+		var duplicates int
+		for range 200 {
+			if schedule.Next() {
+				duplicates++
+			}
+		}
+		if duplicates != int(percent*2) {
+			return fmt.Errorf("%v%% duplicates re-sent %d of 200 records, expected %d", percent, duplicates, int(percent*2))
+		}
+	}
+	return nil
+}
+
+// selfTestLayouts are the -partition-field, -partition-type and -cluster
+// flags of the built-in schema, and the layout expected or the error
+var selfTestLayouts = []struct {
+	field, partitionType, cluster string
+	expected                      string
+}{
+	{"", "", "", "none none"},
+	{"create_time", "", "", "DAY(create_time) none"},
+	{"CREATE_TIME", "hour", "name, uuid", "HOUR(create_time) name, uuid"},
+	{"", "month", "run_id", "MONTH(_PARTITIONTIME) run_id"},
+	{"created", "", "", "-partition-field created is not a column of the table schema"},
+	{"name", "", "", "-partition-field name is a STRING column, must be one of DATE, TIMESTAMP, DATETIME"},
+	{"", "week", "", `invalid -partition-type "week", must be one of hour, day, month or year`},
+	{"", "", "name,uuid,run_id,create_time,name", "-cluster takes at most 4 fields, 5 were given"},
+	{"", "", "name,name", "-cluster names the name column more than once"},
+}
+
+// checkTableLayout expects each layout of the built-in schema to be created,
+// or rejected with a clear error
+func (t *selfTest) checkTableLayout() error {
+	for _, c := range selfTestLayouts {
+		layout, err := NewTableLayout(c.field, c.partitionType, c.cluster, tableDataBigQuerySchema)
+		got := DescribePartitioning(layout.Partitioning) + " " + DescribeClustering(layout.Clustering)
+		if err != nil {
+			got = err.Error()
+		}
+		if got != c.expected {
+			return fmt.Errorf("the layout of -partition-field %q -partition-type %q -cluster %q was %q, expected %q", c.field, c.partitionType, c.cluster, got, c.expected)
+		}
+	}
+	return nil
+}
+
+// checkTableCleanup creates an expiring table beside one which already
+// exists, expecting the cleanup to remove the created table alone
+func (t *selfTest) checkTableCleanup() error {
+	cleanup := NewTableCleanup(t.client)
+	existingID, createdID := selfTestTable+"_existing", selfTestTable+"_cleanup"
+	t.server.CreateTable(selfTestDataset, existingID, json.RawMessage(`[{"name":"name","type":"STRING"}]`))
+	for _, tableID := range []string{existingID, createdID} {
+		created, _, err := CreateBigQueryTable(t.ctx, t.client, selfTestDataset, tableID, tableDataBigQuerySchema, TableLayout{Expiration: time.Hour}, false, SafeMode{})
+		if err != nil {
+			return err
+		}
+		cleanup.Add(selfTestDataset, tableID, created)
+	}
+
+	cleanup.Run(t.ctx)
+	switch {
+	case t.server.HasTable(selfTestDataset, createdID):
+		return errors.New("the table created was not removed")
+	case !t.server.HasTable(selfTestDataset, existingID):
+		return errors.New("the table existing before the run was removed")
+	}
+	return nil
+}
+
+// expectRows checks the fake server holds the expected rows for the run
+func (t *selfTest) expectRows(expected int) error {
+	if rows := t.server.RunRows(selfTestDataset, selfTestTable, t.config.RunID); rows != int64(expected) {
+		return fmt.Errorf("the server holds %d rows, expected %d", rows, expected)
+	}
+	return nil
+}
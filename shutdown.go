@@ -0,0 +1,160 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Stages of the shutdown at the end of a run, in the order executed
+const (
+	stageStopProducers = "Stop Producers"
+	stageDrain         = "Drain Streamers"
+	stageReconcile     = "Reconcile Acknowledgments"
+	stageVerify        = "Verify"
+	stageReport        = "Report"
+	stageCleanup       = "Cleanup"
+)
+
+// shutdownStages lists the stages of the shutdown in the order executed.
+// The streamers are drained before verification, so verification always
+// sees the rows flushed rather than racing the close of a streamer.
+var shutdownStages = []string{stageStopProducers, stageDrain, stageReconcile, stageVerify, stageReport, stageCleanup}
+
+// ShutdownHook is a named action run in a stage of the shutdown
+type ShutdownHook func(ctx context.Context) error
+
+// StageTiming is the time taken by a stage of the shutdown, written to the
+// results file
+type StageTiming struct {
+	Stage       string  `json:"stage"`
+	Hooks       int     `json:"hooks"`
+	Seconds     float64 `json:"seconds"`
+	Interrupted bool    `json:"interrupted,omitempty"`
+}
+
+// shutdownHook is a hook registered in a stage, along with any time spent on
+// it before the shutdown began
+type shutdownHook struct {
+	name    string
+	run     ShutdownHook
+	elapsed time.Duration
+}
+
+// Shutdown runs the actions hooked to the end of a run in ordered stages:
+// stop the producers, drain the streamers, reconcile the acknowledgments,
+// verify, report and finally clean up.  Every feature acting at the end of a
+// run registers a hook into its stage rather than deferring its own action,
+// so the order is explicit and each stage is timed.
+type Shutdown struct {
+	hooks   map[string][]shutdownHook
+	skipped map[string]string
+	timings []StageTiming
+	notify  func(context.Context) (context.Context, func())
+}
+
+// NewShutdown creates the shutdown, verification being cancelled on the first
+// interrupt
+func NewShutdown() *Shutdown {
+	return &Shutdown{hooks: make(map[string][]shutdownHook), skipped: make(map[string]string), notify: NotifyInterrupt}
+}
+
+// Register adds the hook to the end of the stage
+func (s *Shutdown) Register(stage, name string, hook ShutdownHook) {
+	s.hooks[stage] = append(s.hooks[stage], shutdownHook{name: name, run: hook})
+}
+
+// RegisterClose adds a hook to the cleanup stage closing a resource.  The
+// cleanup stage runs its hooks in the reverse order registered, as deferred
+// closes would, so a resource is closed before those it was created from.
+func (s *Shutdown) RegisterClose(name string, close func() error) {
+	s.Register(stageCleanup, name, func(context.Context) error { return close() })
+}
+
+// Skip skips the hooks of the stage, registered before or after, logging the
+// reason when the shutdown runs
+func (s *Shutdown) Skip(stage, reason string) {
+	s.skipped[stage] = reason
+}
+
+// Drained records the streamers drained by the runner before it returned, as
+// the drain decides the outcome of the run, along with the time taken
+func (s *Shutdown) Drained(name string, elapsed time.Duration) {
+	s.hooks[stageDrain] = append(s.hooks[stageDrain], shutdownHook{name: name, run: func(context.Context) error { return nil }, elapsed: elapsed})
+}
+
+// Run executes the stages in order, logging the time taken by each.  The
+// verification also runs when the run failed, reporting what landed before
+// the failure, and is cancelled by an interrupt while the later stages still
+// run.  Every stage runs whatever the errors of the hooks before it, the first
+// error being returned.
+func (s *Shutdown) Run(ctx context.Context, runErr error) error {
+	var firstErr error
+	logger.Info().Msg("Shutdown")
+	for _, stage := range shutdownStages {
+		hooks := s.hooks[stage]
+		delete(s.hooks, stage)
+		if stage == stageCleanup {
+			slices.Reverse(hooks)
+		}
+		timing := StageTiming{Stage: stage, Hooks: len(hooks)}
+		if reason, ok := s.skipped[stage]; ok && len(hooks) > 0 {
+			logger.Warn().Str("Stage", stage).Int("Hooks", len(hooks)).Str("Reason", reason).Msg("  Skipped")
+			s.timings = append(s.timings, timing)
+			continue
+		}
+		stageCtx, stop := ctx, func() {}
+		if stage == stageVerify {
+			stageCtx, stop = s.notify(ctx)
+			if runErr != nil && len(hooks) > 0 {
+				logger.Warn().Err(runErr).Msg("Verifying a Failed Run")
+			}
+		}
+		start := time.Now()
+		for _, hook := range hooks {
+			if stage == stageVerify && stageCtx.Err() != nil {
+				timing.Interrupted = true
+				continue
+			}
+			timing.Seconds += hook.elapsed.Seconds()
+			if err := hook.run(stageCtx); err != nil {
+				logger.Error().Err(err).Str("Stage", stage).Msgf("Error [%s]", hook.name)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		if stage == stageVerify && stageCtx.Err() != nil && len(hooks) > 0 {
+			timing.Interrupted = true
+		}
+		stop()
+		timing.Seconds += time.Since(start).Seconds()
+		s.timings = append(s.timings, timing)
+
+		event := logger.Info()
+		if timing.Interrupted {
+			event = logger.Warn().Bool("Interrupted", timing.Interrupted)
+		}
+		event.Str("Stage", stage).Int("Hooks", timing.Hooks).Float64("Seconds", timing.Seconds).Msg(indent)
+	}
+	return firstErr
+}
+
+// Timings returns the time taken by each stage completed so far
+func (s *Shutdown) Timings() []StageTiming {
+	return append([]StageTiming(nil), s.timings...)
+}
@@ -0,0 +1,154 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// recordingShutdown creates a shutdown with a hook in every stage, registered
+// out of order, appending the name of each hook to ran as it runs
+func recordingShutdown(ran *[]string) *Shutdown {
+	shutdown := NewShutdown()
+	hook := func(name string) ShutdownHook {
+		return func(context.Context) error {
+			*ran = append(*ran, name)
+			return nil
+		}
+	}
+	shutdown.RegisterClose("Client", func() error { return hook("Client")(nil) })
+	shutdown.RegisterClose("Log", func() error { return hook("Log")(nil) })
+	shutdown.Register(stageReport, "Results", hook("Results"))
+	shutdown.Register(stageVerify, "Verify", hook("Verify"))
+	shutdown.Register(stageReconcile, "Acks", hook("Acks"))
+	shutdown.Drained("Streamers", time.Second)
+	shutdown.Register(stageStopProducers, "Generator", hook("Generator"))
+	return shutdown
+}
+
+// interruptImmediately replaces the interrupt notification of the
+// verification with a context already cancelled
+func interruptImmediately(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	return ctx, cancel
+}
+
+func TestShutdownOrdering(t *testing.T) {
+	tests := []struct {
+		name        string
+		runErr      error
+		interrupt   bool
+		expected    []string
+		interrupted bool
+	}{
+		{"Completed Run", nil, false, []string{"Generator", "Acks", "Verify", "Results", "Log", "Client"}, false},
+		{"Failed Run", errors.New("failed run"), false, []string{"Generator", "Acks", "Verify", "Results", "Log", "Client"}, false},
+		{"Interrupted Verification", nil, true, []string{"Generator", "Acks", "Results", "Log", "Client"}, true},
+		{"Failed and Interrupted", errors.New("failed run"), true, []string{"Generator", "Acks", "Results", "Log", "Client"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ran []string
+			shutdown := recordingShutdown(&ran)
+			if tt.interrupt {
+				shutdown.notify = interruptImmediately
+			}
+			if err := shutdown.Run(context.Background(), tt.runErr); err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if !slices.Equal(ran, tt.expected) {
+				t.Errorf("hooks ran in the order %v, expected %v", ran, tt.expected)
+			}
+
+			timings := shutdown.Timings()
+			if len(timings) != len(shutdownStages) {
+				t.Fatalf("%d stages timed, expected %d", len(timings), len(shutdownStages))
+			}
+			for i, timing := range timings {
+				if timing.Stage != shutdownStages[i] {
+					t.Errorf("stage %d is %q, expected %q", i, timing.Stage, shutdownStages[i])
+				}
+				if expected := tt.interrupted && timing.Stage == stageVerify; timing.Interrupted != expected {
+					t.Errorf("stage %q interrupted %t, expected %t", timing.Stage, timing.Interrupted, expected)
+				}
+			}
+			if timings[1].Seconds < 1 {
+				t.Errorf("the drain took %.3f seconds, expected the second spent before the shutdown", timings[1].Seconds)
+			}
+		})
+	}
+}
+
+func TestShutdownRunsEveryStageAfterAnError(t *testing.T) {
+	errVerify := errors.New("verify failed")
+	errCleanup := errors.New("cleanup failed")
+	var ran []string
+	shutdown := NewShutdown()
+	shutdown.Register(stageVerify, "Verify", func(context.Context) error {
+		ran = append(ran, "Verify")
+		return errVerify
+	})
+	shutdown.Register(stageReport, "Results", func(context.Context) error {
+		ran = append(ran, "Results")
+		return nil
+	})
+	shutdown.RegisterClose("Client", func() error {
+		ran = append(ran, "Client")
+		return errCleanup
+	})
+
+	if err := shutdown.Run(context.Background(), nil); !errors.Is(err, errVerify) {
+		t.Errorf("Run returned %v, expected the first error %v", err, errVerify)
+	}
+	if expected := []string{"Verify", "Results", "Client"}; !slices.Equal(ran, expected) {
+		t.Errorf("hooks ran %v, expected %v", ran, expected)
+	}
+}
+
+// TestShutdownSkipsVerifyWithoutASummary runs the shutdown of a run which
+// failed before it had a summary, whose verification is skipped rather than
+// reading the records sent from a nil summary
+func TestShutdownSkipsVerifyWithoutASummary(t *testing.T) {
+	var summary *RunSummary
+	var ran []string
+	shutdown := NewShutdown()
+	shutdown.Skip(stageVerify, "no summary")
+	shutdown.Register(stageVerify, "VerifyRowCount", func(context.Context) error {
+		ran = append(ran, "VerifyRowCount")
+		if summary.RecordsSent == 0 {
+			return errRowsMissing
+		}
+		return nil
+	})
+	shutdown.Register(stageReport, "Results", func(context.Context) error {
+		ran = append(ran, "Results")
+		return nil
+	})
+
+	if err := shutdown.Run(context.Background(), errors.New("streamer failed to start")); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !slices.Equal(ran, []string{"Results"}) {
+		t.Errorf("hooks ran %v, expected only Results", ran)
+	}
+	if timings := shutdown.Timings(); timings[slices.IndexFunc(timings, func(timing StageTiming) bool { return timing.Stage == stageVerify })].Hooks != 1 {
+		t.Errorf("the skipped verification was not timed with its hook")
+	}
+}
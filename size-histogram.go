@@ -0,0 +1,98 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Upper bounds, in bytes, of every bucket of the record size histogram but
+// the last, which holds the records of 10KB or more
+var sizeBucketBounds = [5]int{100, 500, 1024, 5 * 1024, 10 * 1024}
+
+// Labels of the record size histogram buckets
+var sizeBucketLabels = [6]string{"<100B", "100-500B", "500B-1KB", "1-5KB", "5-10KB", ">10KB"}
+
+// SizeHistogram counts the records of a run by the size of their row
+// serialized as JSON
+type SizeHistogram struct {
+	buckets [6]int64
+}
+
+// NewSizeHistogram creates an empty record size histogram
+func NewSizeHistogram() *SizeHistogram {
+	return &SizeHistogram{}
+}
+
+// Reset clears the histogram at the start of a run, a nil histogram is
+// ignored
+func (h *SizeHistogram) Reset() {
+	if h == nil {
+		return
+	}
+	h.buckets = [6]int64{}
+}
+
+// Add counts the record by the size of json.Marshal of its Save() row, a nil
+// histogram or a record which cannot be saved is ignored
+func (h *SizeHistogram) Add(data interface{}) {
+	if h == nil {
+		return
+	}
+	saver, ok := data.(bigquery.ValueSaver)
+	if !ok {
+		return
+	}
+	row, _, err := saver.Save()
+	if err != nil {
+		return
+	}
+	b, err := json.Marshal(row)
+	if err != nil {
+		return
+	}
+	h.buckets[sizeBucket(len(b))]++
+}
+
+// sizeBucket returns the index of the bucket holding records of the size
+func sizeBucket(size int) int {
+	for i, bound := range sizeBucketBounds {
+		if size < bound {
+			return i
+		}
+	}
+	return len(sizeBucketBounds)
+}
+
+// Log outputs the number and percentage of records in every bucket
+func (h *SizeHistogram) Log() {
+	if h == nil {
+		return
+	}
+	var total int64
+	for _, count := range h.buckets {
+		total += count
+	}
+	if total == 0 {
+		return
+	}
+	logger.Info().Msg("Record Size Histogram")
+	for i, count := range h.buckets {
+		logger.Info().Str("Size", sizeBucketLabels[i]).Int64("Records", count).
+			Float64("Percent", float64(count)/float64(total)*100).Msg(indent)
+	}
+}
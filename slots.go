@@ -0,0 +1,177 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Interval between polls of the streaming buffer
+const slotPollInterval = 30 * time.Second
+
+// Longest time the streaming buffer is polled after the run while draining
+const slotDrainWindow = 10 * time.Minute
+
+// Assumed streaming buffer bytes processed per second by a single slot, a
+// rough figure used only to turn the processing rate into a slot count
+const slotBytesPerSecond = 1024 * 1024
+
+// SlotSample holds a single poll of the streaming buffer
+type SlotSample struct {
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	BufferBytes    uint64  `json:"buffer_bytes"`
+	IncomingBytes  int64   `json:"incoming_bytes"`
+	ProcessedBytes int64   `json:"processed_bytes"`
+}
+
+// SlotEstimator polls the streaming buffer of the table, measuring the rate
+// BigQuery processes it from the bytes streamed in and the change in the
+// buffer size between polls.
+type SlotEstimator struct {
+	table    *bigquery.Table
+	incoming atomic.Int64
+
+	mu        sync.Mutex
+	samples   []SlotSample
+	processed int64
+	busy      time.Duration
+	cancel    context.CancelFunc
+	finished  chan struct{}
+}
+
+// NewSlotEstimator creates an estimator for the table
+func NewSlotEstimator(client *bigquery.Client, datasetID, tableID string) *SlotEstimator {
+	return &SlotEstimator{table: client.Dataset(datasetID).Table(tableID)}
+}
+
+// AddIncoming accumulates the bytes streamed, a nil estimator ignores them
+func (e *SlotEstimator) AddIncoming(size int) {
+	if e == nil {
+		return
+	}
+	e.incoming.Add(int64(size))
+}
+
+// Start begins polling the streaming buffer in the background
+func (e *SlotEstimator) Start(ctx context.Context) {
+	ctx, e.cancel = context.WithCancel(ctx)
+	e.finished = make(chan struct{})
+	go func() {
+		defer close(e.finished)
+		startTime := time.Now()
+		e.poll(ctx, 0)
+		ticker := time.NewTicker(slotPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				e.poll(ctx, time.Since(startTime))
+			}
+		}
+	}()
+}
+
+// Finish keeps polling after the run until the streaming buffer has drained
+// or the drain window expires, then returns the estimated processing slots
+func (e *SlotEstimator) Finish() float64 {
+	deadline := time.Now().Add(slotDrainWindow)
+	logger.Info().Dur("Drain Window", slotDrainWindow).Msg("Waiting for the Streaming Buffer to Drain")
+	for time.Now().Before(deadline) {
+		time.Sleep(slotPollInterval)
+		e.mu.Lock()
+		drained := len(e.samples) > 0 && e.samples[len(e.samples)-1].BufferBytes == 0
+		e.mu.Unlock()
+		if drained {
+			break
+		}
+	}
+	e.cancel()
+	<-e.finished
+	return e.EstimatedSlots()
+}
+
+// poll reads the streaming buffer size, attributing the bytes streamed in
+// less the growth of the buffer since the last poll to processing
+func (e *SlotEstimator) poll(ctx context.Context, elapsed time.Duration) {
+	incoming := e.incoming.Swap(0)
+	tableMetaData, err := e.table.Metadata(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Debug().Err(err).Msg("  Skipping Streaming Buffer Poll")
+		}
+		e.incoming.Add(incoming)
+		return
+	}
+	var buffer uint64
+	if tableMetaData.StreamingBuffer != nil {
+		buffer = tableMetaData.StreamingBuffer.EstimatedBytes
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sample := SlotSample{ElapsedSeconds: elapsed.Seconds(), BufferBytes: buffer, IncomingBytes: incoming}
+	if n := len(e.samples); n > 0 {
+		last := e.samples[n-1]
+		sample.ProcessedBytes = int64(last.BufferBytes) + incoming - int64(buffer)
+		if sample.ProcessedBytes < 0 {
+			sample.ProcessedBytes = 0
+		}
+		// Only intervals with data in the buffer measure the processing rate
+		if last.BufferBytes > 0 || incoming > 0 {
+			e.processed += sample.ProcessedBytes
+			e.busy += time.Duration((sample.ElapsedSeconds - last.ElapsedSeconds) * float64(time.Second))
+		}
+	}
+	e.samples = append(e.samples, sample)
+	logger.Debug().Uint64("Buffer Bytes", sample.BufferBytes).Int64("Processed Bytes", sample.ProcessedBytes).Msg("  Streaming Buffer")
+}
+
+// ProcessingRate returns the bytes per second processed from the buffer
+func (e *SlotEstimator) ProcessingRate() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.busy <= 0 {
+		return 0
+	}
+	return float64(e.processed) / e.busy.Seconds()
+}
+
+// EstimatedSlots converts the processing rate into an approximate slot count
+func (e *SlotEstimator) EstimatedSlots() float64 {
+	return e.ProcessingRate() / slotBytesPerSecond
+}
+
+// Samples returns the polls of the streaming buffer
+func (e *SlotEstimator) Samples() []SlotSample {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]SlotSample(nil), e.samples...)
+}
+
+// LogSlotEstimate outputs the processing rate and estimated slots
+func LogSlotEstimate(e *SlotEstimator) {
+	logger.Info().Int("Polls", len(e.Samples())).Msg("Streaming Buffer Processing")
+	logger.Info().Str("Processing Rate", fmt.Sprintf("%.0f bytes/s", e.ProcessingRate())).Msg(indent)
+	logger.Info().Str("Estimated Processing Slots", fmt.Sprintf("%.1f", e.EstimatedSlots())).Msg(indent)
+	logger.Info().Msg("  Note: A rough capacity planning figure, assuming 1 MiB/s of streaming buffer processed per slot")
+}
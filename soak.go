@@ -0,0 +1,237 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+)
+
+// SoakSlice holds the metrics measured for a single slice of an alternating
+// soak, excluding the records written during the warm-up
+type SoakSlice struct {
+	Index            int     `json:"index"`
+	Mode             string  `json:"mode"`
+	RecordsSent      int     `json:"records_sent"`
+	RecordsMeasured  int     `json:"records_measured"`
+	RecordsPerSecond float64 `json:"records_per_second"`
+	P50Millis        float64 `json:"p50_ms"`
+	P95Millis        float64 `json:"p95_ms"`
+}
+
+// SoakComparison holds the condition-controlled comparison of the two APIs,
+// pairing adjacent slices so each pair saw similar service conditions
+type SoakComparison struct {
+	Pairs                  int     `json:"pairs"`
+	MedianRateDelta        float64 `json:"median_records_per_second_delta"`
+	MedianRateDeltaPct     float64 `json:"median_records_per_second_delta_pct"`
+	MedianP95DeltaMillis   float64 `json:"median_p95_ms_delta"`
+	StorageFasterInPairs   int     `json:"storage_faster_in_pairs"`
+	InsertAllFasterInPairs int     `json:"insertall_faster_in_pairs"`
+}
+
+// soakSliceWriter writes the records of a single slice using one of the APIs
+type soakSliceWriter func(ctx context.Context, config *BenchmarkConfig, source *RowSource, deadline, measureFrom time.Time, slice *SoakSlice) error
+
+// ExecuteSoak alternates between the insertAll API and a committed stream of
+// the Storage Write API every slice for the total duration, against the same
+// table, recording the throughput and latency of each slice.
+func ExecuteSoak(ctx context.Context, config *BenchmarkConfig, duration, sliceDuration, warmup time.Duration) ([]SoakSlice, *SoakComparison, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	source := NewRowSource(newGenerator(ctx, math.MaxInt, config.RunID, config.DataGenerator()))
+
+	writers := []soakSliceWriter{writeInsertAllSlice, writeCommittedSlice}
+	modes := []string{modeInsertAll, modeCommitted}
+	var slices []SoakSlice
+	end := time.Now().Add(duration)
+	for i := 0; time.Until(end) >= sliceDuration; i++ {
+		slice := SoakSlice{Index: i + 1, Mode: modes[i%len(modes)]}
+		start := time.Now()
+		logger.Info().Int("Slice", slice.Index).Str("Mode", slice.Mode).Msg("Start Soak Slice")
+		if err := writers[i%len(writers)](ctx, config, source, start.Add(sliceDuration), start.Add(warmup), &slice); err != nil {
+			return slices, nil, err
+		}
+		logger.Info().Int("Slice", slice.Index).Str("Mode", slice.Mode).Int("Records Sent", slice.RecordsSent).
+			Float64("Records per Second", slice.RecordsPerSecond).Float64("p95 ms", slice.P95Millis).Msg(indent)
+		slices = append(slices, slice)
+	}
+	return slices, CompareSoakSlices(slices), nil
+}
+
+// writeInsertAllSlice writes records via the insertAll API until the
+// deadline, timing each write made after the warm-up
+func writeInsertAllSlice(ctx context.Context, config *BenchmarkConfig, source *RowSource, deadline, measureFrom time.Time, slice *SoakSlice) error {
+	streamer, err := NewLegacyStreamer(config, config.StreamTargets()[0], config.BatchSize)
+	if err != nil {
+		return err
+	}
+	latency := NewLatencyRecorder(1)
+	for now := time.Now(); now.Before(deadline); now = time.Now() {
+		data, ok := source.Next(ctx)
+		if !ok {
+			break
+		}
+		if err := streamer.Write(data); err != nil {
+			streamer.Close()
+			return err
+		}
+		source.Ack()
+		slice.RecordsSent++
+		config.Landed.AddSent(1)
+		config.Heartbeat.AddSent(1)
+		config.Health.AddSent(1)
+		if now.After(measureFrom) {
+			latency.Record(time.Since(now))
+			slice.RecordsMeasured++
+		}
+	}
+	if !CloseStreamer(streamer, config.DrainTimeout) {
+		return errDrainTimeout
+	}
+	finishSoakSlice(slice, latency, deadline.Sub(measureFrom))
+	return nil
+}
+
+// writeCommittedSlice writes records via a committed stream until the
+// deadline, timing each append made after the warm-up
+func writeCommittedSlice(ctx context.Context, config *BenchmarkConfig, source *RowSource, deadline, measureFrom time.Time, slice *SoakSlice) error {
+	schema := config.TableSchema()
+	descriptor, err := rowDescriptor(schema)
+	if err != nil {
+		return err
+	}
+	writeClient, err := managedwriter.NewClient(ctx, config.ProjectID)
+	if err != nil {
+		return err
+	}
+	defer writeClient.Close()
+	stream, err := writeClient.NewManagedStream(ctx,
+		managedwriter.WithDestinationTable(managedwriter.TableParentFromParts(config.ProjectID, config.DatasetID, config.TableID)),
+		managedwriter.WithType(managedwriter.CommittedStream),
+		managedwriter.WithSchemaDescriptor(descriptor),
+	)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	latency := NewLatencyRecorder(1)
+	for now := time.Now(); now.Before(deadline); now = time.Now() {
+		batch := make([][]byte, 0, config.BatchSize)
+		for len(batch) < config.BatchSize {
+			data, ok := source.Next(ctx)
+			if !ok {
+				break
+			}
+			row, err := encodeRow(schema, data)
+			if err != nil {
+				return err
+			}
+			source.Ack()
+			batch = append(batch, row)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		result, err := stream.AppendRows(ctx, batch)
+		if err != nil {
+			return err
+		}
+		if _, err := result.GetResult(ctx); err != nil {
+			return err
+		}
+		slice.RecordsSent += len(batch)
+		config.Landed.AddSent(len(batch))
+		config.Heartbeat.AddSent(len(batch))
+		config.Health.AddSent(len(batch))
+		if now.After(measureFrom) {
+			latency.Record(time.Since(now))
+			slice.RecordsMeasured += len(batch)
+		}
+	}
+	if _, err := stream.Finalize(ctx); err != nil {
+		return err
+	}
+	finishSoakSlice(slice, latency, deadline.Sub(measureFrom))
+	return nil
+}
+
+// finishSoakSlice computes the throughput and latency of the measured part
+// of the slice
+func finishSoakSlice(slice *SoakSlice, latency *LatencyRecorder, measured time.Duration) {
+	if measured > 0 {
+		slice.RecordsPerSecond = float64(slice.RecordsMeasured) / measured.Seconds()
+	}
+	slice.P50Millis = float64(latency.Percentile(50)) / float64(time.Millisecond)
+	slice.P95Millis = float64(latency.Percentile(95)) / float64(time.Millisecond)
+}
+
+// CompareSoakSlices pairs adjacent slices and computes the median delta of
+// the Storage Write API over the insertAll API across the pairs
+func CompareSoakSlices(slices []SoakSlice) *SoakComparison {
+	var rateDeltas, ratePcts, p95Deltas []float64
+	comparison := &SoakComparison{}
+	for i := 0; i+1 < len(slices); i += 2 {
+		insertAll, storage := slices[i], slices[i+1]
+		if insertAll.Mode != modeInsertAll {
+			insertAll, storage = storage, insertAll
+		}
+		comparison.Pairs++
+		delta := storage.RecordsPerSecond - insertAll.RecordsPerSecond
+		rateDeltas = append(rateDeltas, delta)
+		if insertAll.RecordsPerSecond > 0 {
+			ratePcts = append(ratePcts, delta/insertAll.RecordsPerSecond*100)
+		}
+		p95Deltas = append(p95Deltas, storage.P95Millis-insertAll.P95Millis)
+		if delta > 0 {
+			comparison.StorageFasterInPairs++
+		} else if delta < 0 {
+			comparison.InsertAllFasterInPairs++
+		}
+	}
+	comparison.MedianRateDelta = median(rateDeltas)
+	comparison.MedianRateDeltaPct = median(ratePcts)
+	comparison.MedianP95DeltaMillis = median(p95Deltas)
+	return comparison
+}
+
+// median returns the median of the values, or zero if there are none
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// LogSoakComparison outputs the condition-controlled comparison of the APIs
+func LogSoakComparison(comparison *SoakComparison) {
+	logger.Info().Int("Pairs", comparison.Pairs).Msg("Alternating Soak Comparison, Storage Write API Relative to insertAll")
+	logger.Info().Float64("Median Records per Second Delta", comparison.MedianRateDelta).
+		Float64("Median Delta %", comparison.MedianRateDeltaPct).Msg(indent)
+	logger.Info().Float64("Median p95 ms Delta", comparison.MedianP95DeltaMillis).Msg(indent)
+	logger.Info().Int("Storage Faster", comparison.StorageFasterInPairs).Int("insertAll Faster", comparison.InsertAllFasterInPairs).Msg(indent)
+}
@@ -0,0 +1,113 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// TableStorageStats holds the storage statistics reported for a table
+type TableStorageStats struct {
+	TotalRows           int64
+	TotalLogicalBytes   int64
+	TotalPhysicalBytes  int64
+	StreamingBufferRows uint64
+}
+
+// QueryTableStorageStats queries INFORMATION_SCHEMA.TABLE_STORAGE for the
+// target table.  The view does not expose the streaming buffer, so the
+// estimated buffered rows are taken from the table metadata instead.
+func QueryTableStorageStats(ctx context.Context, client *bigquery.Client, projectID, datasetID, tableID string) (*TableStorageStats, error) {
+	datasetMetaData, err := client.Dataset(datasetID).Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q := client.Query(fmt.Sprintf(
+		"SELECT total_rows, total_logical_bytes, total_physical_bytes "+
+			"FROM `%s`.`region-%s`.INFORMATION_SCHEMA.TABLE_STORAGE "+
+			"WHERE table_schema = @dataset AND table_name = @table",
+		projectID, strings.ToLower(datasetMetaData.Location)))
+	q.Location = datasetMetaData.Location
+	q.Parameters = []bigquery.QueryParameter{
+		{Name: "dataset", Value: datasetID},
+		{Name: "table", Value: tableID},
+	}
+
+	it, err := ReadQuery(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &TableStorageStats{}
+	var row []bigquery.Value
+	err = it.Next(&row)
+	if err == iterator.Done {
+		return nil, fmt.Errorf("table %s.%s not found in INFORMATION_SCHEMA.TABLE_STORAGE", datasetID, tableID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	stats.TotalRows = valueInt64(row[0])
+	stats.TotalLogicalBytes = valueInt64(row[1])
+	stats.TotalPhysicalBytes = valueInt64(row[2])
+
+	tableMetaData, err := client.Dataset(datasetID).Table(tableID).Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tableMetaData.StreamingBuffer != nil {
+		stats.StreamingBufferRows = tableMetaData.StreamingBuffer.EstimatedRows
+	}
+
+	return stats, nil
+}
+
+// LogTableStorageStats outputs the table storage statistics, comparing the
+// total rows against the number of records sent to detect silent drops.
+func LogTableStorageStats(stats *TableStorageStats, recordsSent int) {
+	logger.Info().Msg("Table Storage Statistics")
+	logger.Info().Int64("Total Rows", stats.TotalRows).Msg(indent)
+	logger.Info().Int64("Total Logical Bytes", stats.TotalLogicalBytes).Msg(indent)
+	logger.Info().Int64("Total Physical Bytes", stats.TotalPhysicalBytes).Msg(indent)
+	logger.Info().Uint64("Streaming Buffer Rows", stats.StreamingBufferRows).Msg(indent)
+	if stats.TotalRows > 0 {
+		logger.Info().Float64("Bytes per Record", float64(stats.TotalLogicalBytes)/float64(stats.TotalRows)).Msg(indent)
+	}
+
+	landed := stats.TotalRows + int64(stats.StreamingBufferRows)
+	if landed < int64(recordsSent) {
+		WarnPossibleDrops(int64(recordsSent), landed)
+	}
+	logger.Info().Msg("  Note: INFORMATION_SCHEMA.TABLE_STORAGE is refreshed roughly every 30 minutes, so these figures may be stale")
+}
+
+// WarnPossibleDrops warns that fewer rows were found than records sent
+func WarnPossibleDrops(recordsSent, rowsFound int64) {
+	logger.Warn().Int64("Records Sent", recordsSent).Int64("Rows Found", rowsFound).Msg("  Fewer Rows Found than Records Sent, Possible Silent Drops")
+}
+
+// valueInt64 converts a nullable INTEGER query result into an int64
+func valueInt64(v bigquery.Value) int64 {
+	if i, ok := v.(int64); ok {
+		return i
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+)
+
+// Provenance of each step of a sweep, measured by this run or reused from
+// the previous results
+const (
+	provenanceMeasured = "measured"
+	provenanceCached   = "cached"
+)
+
+// Layout of the timestamp prefixing every run ID
+const runIDTimeLayout = "20060102T150405"
+
+// SweepCache holds the sweep steps of a previous results file, reused in
+// place of re-running the steps measured recently whose results were stable
+type SweepCache struct {
+	results   []SweepResult
+	freshness time.Duration
+}
+
+// LoadSweepCache reads the sweep steps of a previous -output results file,
+// reusing those measured within the freshness window
+func LoadSweepCache(path string, freshness time.Duration) (*SweepCache, error) {
+	previous, err := ReadResults(path)
+	if err != nil {
+		return nil, err
+	}
+	return &SweepCache{results: previous.Sweep, freshness: freshness}, nil
+}
+
+// Lookup returns the previous result of the step with the same workers,
+// batch size, tables and records if it is fresh and stable, sending every
+// record without errors.  A nil cache never has a result.
+func (c *SweepCache) Lookup(workers, batchSize, tables, records int) (SweepResult, bool) {
+	if c == nil {
+		return SweepResult{}, false
+	}
+	for _, result := range c.results {
+		if result.Workers != workers || result.BatchSize != batchSize || max(result.Tables, 1) != tables || result.RecordsSent != records || result.Errors > 0 {
+			continue
+		}
+		measured, ok := RunIDTime(result.RunID)
+		if !ok || time.Since(measured) > c.freshness {
+			continue
+		}
+		result.Provenance = provenanceCached
+		return result, true
+	}
+	return SweepResult{}, false
+}
+
+// RunIDTime returns the time a run started, parsed from its run ID
+func RunIDTime(runID string) (time.Time, bool) {
+	if len(runID) < len(runIDTimeLayout) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(runIDTimeLayout, runID[:len(runIDTimeLayout)])
+	return t, err == nil
+}
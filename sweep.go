@@ -0,0 +1,272 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Worker counts run by -sweep-workers, up to the -w maximum
+var sweepWorkerCounts = []int{1, 2, 4, 8, 16, 32}
+
+// Width of the bars plotting the throughput of a table count sweep
+const sweepPlotWidth = 40
+
+// The knee of the curve is where the next step gains less than this fraction
+const sweepKneeThreshold = 0.10
+
+// SweepResult holds the metrics measured for a single step of a sweep
+type SweepResult struct {
+	Workers          int             `json:"workers"`
+	BatchSize        int             `json:"batch_size"`
+	Tables           int             `json:"tables"`
+	RunID            string          `json:"run_id"`
+	RecordsSent      int             `json:"records_sent"`
+	ElapsedSeconds   float64         `json:"elapsed_seconds"`
+	RecordsPerSecond float64         `json:"records_per_second"`
+	BytesPerRequest  float64         `json:"bytes_per_request"`
+	P95Millis        float64         `json:"p95_ms"`
+	Errors           int             `json:"errors"`
+	Timing           *TimingAverages `json:"timing_breakdown,omitempty"`
+	Provenance       string          `json:"provenance,omitempty"`
+	Efficiency       float64         `json:"scaling_efficiency_pct,omitempty"`
+}
+
+// SweepWorkerCounts returns the sweep worker counts up to the maximum
+func SweepWorkerCounts(maxWorkers int) []int {
+	var counts []int
+	for _, count := range sweepWorkerCounts {
+		if count <= maxWorkers {
+			counts = append(counts, count)
+		}
+	}
+	return counts
+}
+
+// SweepBatchSizes returns the sweep batch sizes, doubling from 1 up to the
+// maximum, which is always included
+func SweepBatchSizes(maxBatchSize int) []int {
+	var sizes []int
+	for size := 1; size < maxBatchSize; size *= 2 {
+		sizes = append(sizes, size)
+	}
+	return append(sizes, maxBatchSize)
+}
+
+// ParseScaleTables parses the comma separated table counts of -scale-tables,
+// optionally enclosed in brackets, each between 1 and 100, into ascending order
+func ParseScaleTables(value string) ([]int, error) {
+	var counts []int
+	seen := make(map[int]bool)
+	for _, item := range SplitList(strings.Trim(strings.TrimSpace(value), "[]")) {
+		count, err := strconv.Atoi(item)
+		if err != nil || count < 1 || count > 100 {
+			return nil, fmt.Errorf("invalid table count %q, must be between 1 and 100", item)
+		}
+		if !seen[count] {
+			seen[count] = true
+			counts = append(counts, count)
+		}
+	}
+	if len(counts) == 0 {
+		return nil, fmt.Errorf("-scale-tables lists no table counts")
+	}
+	sort.Ints(counts)
+	return counts, nil
+}
+
+// SweepTables runs the benchmark once for each table count, streaming to the
+// first tables of the targets and distributing the records evenly across
+// them.  The streamers are recreated for each count.
+func SweepTables(ctx context.Context, config *BenchmarkConfig, tableCounts []int) ([]SweepResult, error) {
+	if tableCounts[len(tableCounts)-1] > len(config.Targets) {
+		return nil, fmt.Errorf("-scale-tables needs %d tables, only %d are in the rotation", tableCounts[len(tableCounts)-1], len(config.Targets))
+	}
+	results, err := runSweep(ctx, config, tableCounts, func(c *BenchmarkConfig, tables int) {
+		c.Targets = c.Targets[:tables]
+	})
+	ScalingEfficiency(results)
+	return results, err
+}
+
+// SweepWorkers runs the benchmark once for each worker count, holding all
+// other parameters constant.  The streamers are recreated for each count.
+func SweepWorkers(ctx context.Context, config *BenchmarkConfig, workerCounts []int) ([]SweepResult, error) {
+	return runSweep(ctx, config, workerCounts, func(c *BenchmarkConfig, workers int) {
+		c.NumberWorkers = workers
+	})
+}
+
+// SweepBatch runs the benchmark once for each batch size, holding all other
+// parameters constant.  The streamers are recreated for each batch size.
+func SweepBatch(ctx context.Context, config *BenchmarkConfig, batchSizes []int) ([]SweepResult, error) {
+	return runSweep(ctx, config, batchSizes, func(c *BenchmarkConfig, batchSize int) {
+		c.BatchSize = batchSize
+		for _, target := range c.Targets {
+			target.BatchSize = batchSize
+		}
+	})
+}
+
+// runSweep runs the legacy stream once per value, after apply has set the
+// value on a copy of the configuration.  Each step streams to fresh copies of
+// the targets under its own run_id.
+func runSweep(ctx context.Context, config *BenchmarkConfig, values []int, apply func(*BenchmarkConfig, int)) ([]SweepResult, error) {
+	results := make([]SweepResult, 0, len(values))
+	for i, value := range values {
+		step := *config
+		step.RunID = fmt.Sprintf("%s-s%d", config.RunID, i+1)
+		step.Targets = make([]*StreamTarget, 0, len(config.Targets))
+		for _, target := range config.StreamTargets() {
+			step.Targets = append(step.Targets, &StreamTarget{DatasetID: target.DatasetID, TableID: target.TableID, BatchSize: target.BatchSize})
+		}
+		if step.LatencySample == 0 {
+			step.LatencySample = 1
+		}
+		apply(&step, value)
+
+		// Reuse the previous result of a step measured recently and stably
+		if cached, ok := config.SweepCache.Lookup(step.NumberWorkers, step.BatchSize, len(step.Targets), step.NumberIterations); ok {
+			logger.Info().Int("Workers", step.NumberWorkers).Int("Batch Size", step.BatchSize).Int("Tables", len(step.Targets)).Str("Run ID", cached.RunID).Msg("Sweep Step Reused from the Previous Results")
+			results = append(results, cached)
+			continue
+		}
+
+		logger.Info().Int("Workers", step.NumberWorkers).Int("Batch Size", step.BatchSize).Int("Tables", len(step.Targets)).Str("Run ID", step.RunID).Msg("Sweep Step")
+		failuresBefore := 0
+		if step.RequestIDs != nil {
+			failuresBefore = step.RequestIDs.Failures()
+		}
+		summary, err := ExecuteLegacyStream(ctx, &step)
+		if err != nil {
+			return results, err
+		}
+
+		result := SweepResult{
+			Workers:        step.NumberWorkers,
+			BatchSize:      step.BatchSize,
+			Tables:         len(step.Targets),
+			RunID:          step.RunID,
+			RecordsSent:    summary.RecordsSent,
+			ElapsedSeconds: summary.Elapsed.Seconds(),
+			Errors:         summary.RecordsSkipped,
+			Timing:         summary.Timing,
+			Provenance:     provenanceMeasured,
+		}
+		if summary.Elapsed > 0 {
+			result.RecordsPerSecond = float64(summary.RecordsSent) / summary.Elapsed.Seconds()
+		}
+		if requests := (summary.RecordsSent + step.BatchSize - 1) / step.BatchSize; requests > 0 && summary.BytesSent > 0 {
+			result.BytesPerRequest = float64(summary.BytesSent) / float64(requests)
+		}
+		if summary.Latency != nil {
+			result.P95Millis = float64(summary.Latency.Percentile(95)) / float64(time.Millisecond)
+		}
+		if step.RequestIDs != nil {
+			result.Errors += step.RequestIDs.Failures() - failuresBefore
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// SweepKnee returns the index of the knee of the curve, the step beyond
+// which the records per second increase by less than the threshold, or the
+// last step if every step gained more.
+func SweepKnee(results []SweepResult) int {
+	for i := 0; i+1 < len(results); i++ {
+		if results[i+1].RecordsPerSecond < results[i].RecordsPerSecond*(1+sweepKneeThreshold) {
+			return i
+		}
+	}
+	return len(results) - 1
+}
+
+// LogSweepWorkers outputs the table of worker sweep results and the knee
+func LogSweepWorkers(results []SweepResult) {
+	if len(results) == 0 {
+		return
+	}
+	logger.Info().Msg("Worker Sweep")
+	for _, result := range results {
+		logger.Info().Int("Workers", result.Workers).Float64("Records per Second", result.RecordsPerSecond).
+			Float64("p95 ms", result.P95Millis).Int("Errors", result.Errors).Msg(indent)
+	}
+	knee := results[SweepKnee(results)]
+	logger.Info().Int("Workers", knee.Workers).Float64("Records per Second", knee.RecordsPerSecond).
+		Msgf("  Knee of the Curve, More Workers Gain Less Than %.0f%%", sweepKneeThreshold*100)
+}
+
+// SweepOptimal returns the index of the step with the most records per second
+func SweepOptimal(results []SweepResult) int {
+	best := 0
+	for i, result := range results {
+		if result.RecordsPerSecond > results[best].RecordsPerSecond {
+			best = i
+		}
+	}
+	return best
+}
+
+// LogSweepBatch outputs the table of batch size sweep results and the
+// optimal batch size
+func LogSweepBatch(results []SweepResult) {
+	if len(results) == 0 {
+		return
+	}
+	logger.Info().Msg("Batch Size Sweep")
+	for _, result := range results {
+		logger.Info().Int("Batch Size", result.BatchSize).Float64("Records per Second", result.RecordsPerSecond).
+			Float64("Bytes per Request", result.BytesPerRequest).Float64("p95 ms", result.P95Millis).Msg(indent)
+	}
+	optimal := results[SweepOptimal(results)]
+	logger.Info().Int("Batch Size", optimal.BatchSize).Float64("Records per Second", optimal.RecordsPerSecond).Msg("  Optimal Batch Size")
+}
+
+// ScalingEfficiency sets the scaling efficiency of each step of a table count
+// sweep, its records per second as a percentage of the first step's records
+// per second per table scaled linearly to its table count
+func ScalingEfficiency(results []SweepResult) {
+	if len(results) == 0 || results[0].Tables == 0 || results[0].RecordsPerSecond == 0 {
+		return
+	}
+	perTable := results[0].RecordsPerSecond / float64(results[0].Tables)
+	for i := range results {
+		results[i].Efficiency = results[i].RecordsPerSecond / (perTable * float64(results[i].Tables)) * 100
+	}
+}
+
+// LogSweepTables outputs the table count sweep results, plotting the
+// aggregate records per second of each step along with its scaling efficiency
+func LogSweepTables(results []SweepResult) {
+	if len(results) == 0 {
+		return
+	}
+	best := results[SweepOptimal(results)].RecordsPerSecond
+	logger.Info().Msg("Table Count Sweep")
+	for _, result := range results {
+		bar := 0
+		if best > 0 {
+			bar = int(result.RecordsPerSecond / best * sweepPlotWidth)
+		}
+		logger.Info().Int("Tables", result.Tables).Float64("Records per Second", result.RecordsPerSecond).
+			Str("Scaling Efficiency", fmt.Sprintf("%.1f%%", result.Efficiency)).Msg("  " + strings.Repeat("#", bar))
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+)
+
+// Permission required to stream rows into a table
+const tableWritePermission = "bigquery.tables.updateData"
+
+// Permission required to update the metadata of a dataset
+const datasetUpdatePermission = "bigquery.datasets.update"
+
+// Description set on a dataset to verify its metadata can be updated
+const datasetUpdateDescription = "bqwrite-test run"
+
+// TableACL holds the result of verifying the current identity can write to
+// a table
+type TableACL struct {
+	Identity    string
+	DatasetRole bigquery.AccessRole
+	CanWrite    bool
+}
+
+// CurrentIdentity returns the email of the service account behind the
+// application default credentials, or an empty string if it cannot be
+// determined, such as for user credentials.
+func CurrentIdentity(ctx context.Context) string {
+	credentials, err := google.FindDefaultCredentials(ctx, bigquery.Scope)
+	if err != nil || credentials == nil || len(credentials.JSON) == 0 {
+		return ""
+	}
+	var key struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if err := json.Unmarshal(credentials.JSON, &key); err != nil {
+		return ""
+	}
+	return key.ClientEmail
+}
+
+// VerifyTableACL checks the access entries of the table's dataset for a
+// WRITER or OWNER role granted to the current identity.  As the table does
+// not carry its own access entries, and roles may also be granted at the
+// project or through a group, the effective permission to write to the
+// table is tested as well.
+func VerifyTableACL(ctx context.Context, client *bigquery.Client, datasetID, tableID string) (*TableACL, error) {
+	acl := &TableACL{Identity: CurrentIdentity(ctx)}
+
+	dataset := client.Dataset(datasetID)
+	if _, err := dataset.Table(tableID).Metadata(ctx); err != nil {
+		return nil, err
+	}
+	datasetMetaData, err := dataset.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if acl.Identity != "" {
+		for _, entry := range datasetMetaData.Access {
+			if accessEntryMatches(entry, acl.Identity) && isWriterRole(entry.Role) {
+				acl.DatasetRole = entry.Role
+				acl.CanWrite = true
+				break
+			}
+		}
+	}
+
+	if !acl.CanWrite {
+		granted, err := dataset.Table(tableID).IAM().TestPermissions(ctx, []string{tableWritePermission})
+		if err != nil {
+			return nil, err
+		}
+		acl.CanWrite = len(granted) > 0
+	}
+	return acl, nil
+}
+
+// accessEntryMatches reports whether the access entry names the identity
+func accessEntryMatches(entry *bigquery.AccessEntry, identity string) bool {
+	switch entry.EntityType {
+	case bigquery.UserEmailEntity:
+		return strings.EqualFold(entry.Entity, identity)
+	case bigquery.IAMMemberEntity:
+		_, member, _ := strings.Cut(entry.Entity, ":")
+		return strings.EqualFold(member, identity)
+	}
+	return false
+}
+
+// isWriterRole reports whether the role allows rows to be written, either
+// as a basic dataset role or the equivalent predefined IAM role
+func isWriterRole(role bigquery.AccessRole) bool {
+	switch role {
+	case bigquery.WriterRole, bigquery.OwnerRole, "roles/bigquery.dataEditor", "roles/bigquery.dataOwner", "roles/bigquery.admin":
+		return true
+	}
+	return false
+}
+
+// LogTableACL outputs the result of the table ACL verification
+func LogTableACL(datasetID, tableID string, acl *TableACL) {
+	identity := acl.Identity
+	if identity == "" {
+		identity = "unknown"
+	}
+	event := logger.Info()
+	if !acl.CanWrite {
+		event = logger.Warn()
+	}
+	event.Str("Dataset", datasetID).Str("Table", tableID).Str("Identity", identity).
+		Str("Dataset Role", string(acl.DatasetRole)).Bool("Can Write", acl.CanWrite).Msg(indent)
+}
+
+// UpdateDatasetMetadata sets the description of the dataset, verifying the
+// current identity holds the bigquery.datasets.update permission required by
+// some write workflows, which is separate from the permission to stream rows
+func UpdateDatasetMetadata(ctx context.Context, client *bigquery.Client, datasetID string) error {
+	_, err := client.Dataset(datasetID).Update(ctx, bigquery.DatasetMetadataToUpdate{Description: datasetUpdateDescription}, "")
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden {
+		return fmt.Errorf("the current identity lacks the %s permission on dataset %s: %w", datasetUpdatePermission, datasetID, err)
+	}
+	return err
+}
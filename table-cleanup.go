@@ -0,0 +1,74 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// TableCleanup deletes the tables created by the run once it has ended,
+// retaining any table which existed before the run so no real data is lost.
+// The cleanup runs once, whether from the shutdown or after a setup error.
+type TableCleanup struct {
+	client *bigquery.Client
+	once   sync.Once
+	tables []cleanupTable
+}
+
+// cleanupTable is a target table and whether the run created it
+type cleanupTable struct {
+	datasetID string
+	tableID   string
+	created   bool
+}
+
+// NewTableCleanup creates the cleanup of the tables added to it
+func NewTableCleanup(client *bigquery.Client) *TableCleanup {
+	return &TableCleanup{client: client}
+}
+
+// Add records a target table and whether it was created by the run, a nil
+// cleanup ignoring it
+func (c *TableCleanup) Add(datasetID, tableID string, created bool) {
+	if c == nil {
+		return
+	}
+	c.tables = append(c.tables, cleanupTable{datasetID: datasetID, tableID: tableID, created: created})
+}
+
+// Run deletes the tables created by the run, logging whether each table was
+// removed or retained.  A table failing to be deleted is logged and retained.
+func (c *TableCleanup) Run(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	c.once.Do(func() {
+		logger.Info().Msg("Table Cleanup")
+		for _, table := range c.tables {
+			if !table.created {
+				logger.Info().Str("Dataset", table.datasetID).Str("Table", table.tableID).Msg("  Retained, the Table Existed Before the Run")
+				continue
+			}
+			if err := c.client.Dataset(table.datasetID).Table(table.tableID).Delete(ctx); err != nil {
+				logger.Error().Err(err).Str("Dataset", table.datasetID).Str("Table", table.tableID).Msg("  Retained, the Table Failed to be Deleted")
+				continue
+			}
+			logger.Info().Str("Dataset", table.datasetID).Str("Table", table.tableID).Msg("  Removed")
+		}
+	})
+}
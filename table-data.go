@@ -17,6 +17,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/bigquery"
@@ -36,43 +40,115 @@ var tableDataBigQuerySchema = bigquery.Schema{
 		Name: "create_time",
 		Type: bigquery.DateTimeFieldType,
 	},
+	&bigquery.FieldSchema{
+		Name: "run_id",
+		Type: bigquery.StringFieldType,
+	},
 }
 
+// Layout of a DATETIME encoded as JSON, the canonical civil form accepted by
+// both the insertAll API and the Storage Write API
+const dateTimeJSONLayout = "2006-01-02 15:04:05.000000"
+
 // tableDataRecord is the data structure used to hold a single records
 // worth of data ready for streaming to BigQuery
 type tableDataRecord struct {
 	name        string
 	uuid        int64
 	create_time time.Time
+	run_id      string
+	insertID    string
 }
 
 // Save implements bigquery.ValueSaver.Save
 func (td *tableDataRecord) Save() (row map[string]bigquery.Value, insertID string, err error) {
+	insertID = bigquery.NoDedupeID
+	if td.insertID != "" {
+		insertID = td.insertID
+	}
 	return map[string]bigquery.Value{
 		"name":        td.name,
 		"uuid":        td.uuid,
-		"create_time": td.create_time.Format("2006-01-02 15:04:05"),
-	}, bigquery.NoDedupeID, nil
+		"create_time": td.create_time.Format(dateTimeJSONLayout),
+		"run_id":      td.run_id,
+	}, insertID, nil
+}
+
+// EnableInsertID assigns a deterministic Insert ID derived from the run_id
+// and uuid, allowing BigQuery to perform best-effort deduplication.
+func (td *tableDataRecord) EnableInsertID() {
+	td.insertID = fmt.Sprintf("%s-%d", td.run_id, td.uuid)
+}
+
+// insertIDEnabler is implemented by records which support deterministic
+// Insert IDs
+type insertIDEnabler interface {
+	EnableInsertID()
 }
 
 // Save implements json.JsonMarshaler.MarshalJSON
 func (td *tableDataRecord) MarshalJSON() ([]byte, error) {
+	if fastJSON {
+		return td.marshalJSONFast(), nil
+	}
 	return json.Marshal(map[string]interface{}{
 		"name":        td.name,
 		"uuid":        td.uuid,
-		"create_time": td.create_time,
+		"create_time": td.create_time.Format(dateTimeJSONLayout),
+		"run_id":      td.run_id,
 	})
 }
 
+// jsonSizer is implemented by records which can tell the length of their
+// JSON encoding without serializing it
+type jsonSizer interface {
+	jsonSize() int
+}
+
+// RecordSize returns the serialized JSON size of a generated record, or zero
+// if the record cannot be marshalled.  The built-in records are measured
+// without serializing them.
+func RecordSize(data interface{}) int {
+	if s, ok := data.(jsonSizer); ok {
+		return s.jsonSize()
+	}
+	if m, ok := data.(json.Marshaler); ok {
+		if b, err := m.MarshalJSON(); err == nil {
+			return len(b)
+		}
+	}
+	return 0
+}
+
+// NewRunID generates a unique identifier used to tag the records of a run
+func NewRunID() string {
+	return fmt.Sprintf("%s-%08x", time.Now().UTC().Format("20060102T150405"), rand.Uint32())
+}
+
+// Stride between the uuids of consecutive records generated
+const uuidStride = 42
+
+// OffsetGenerator wraps the generator, offsetting the uuid of every record by
+// the given number of records, so several processes generate distinct uuids
+func OffsetGenerator(gen dataGenerator, offset int) dataGenerator {
+	if offset == 0 {
+		return gen
+	}
+	return func(name string, uuid int64, create_time time.Time, run_id string) interface{} {
+		return gen(name, uuid+int64(offset)*uuidStride, create_time, run_id)
+	}
+}
+
 // Interface for Data Generation
-type dataGenerator = func(name string, uuid int64, create_time time.Time) interface{}
+type dataGenerator = func(name string, uuid int64, create_time time.Time, run_id string) interface{}
 
 // NewTableData creates a ValueSaver/JsonMarshal-based temporary data model, implented using the dataGenerator syntax.
-func NewTableData(name string, uuid int64, create_time time.Time) interface{} {
+func NewTableData(name string, uuid int64, create_time time.Time, run_id string) interface{} {
 	return &tableDataRecord{
 		name:        name,
 		uuid:        uuid,
 		create_time: create_time,
+		run_id:      run_id,
 	}
 }
 
@@ -80,25 +156,55 @@ func NewTableData(name string, uuid int64, create_time time.Time) interface{} {
 var randomNames = []string{"Louis Green", "Skyla Morrison", "Annalise Rosario", "Francisco Cole", "Aron Downs", "Alvin Buck",
 	"Fletcher Clarke", "Sophie Salazar", "Kaleigh Hughes", "Winston Mason", "Braelyn Ho", "Finley Gibson"}
 
+// Records buffered per streamer worker between parallel generators and the
+// write loop, so the workers never wait on a single handoff
+const generatorBufferPerWorker = 64
+
 // newGenerator will generate a random dataset
-func newGenerator(ctx context.Context, iterations int, gen dataGenerator) <-chan interface{} {
-	ch := make(chan interface{}, 1)
-	go func() {
-		defer close(ch)
-		loc, _ := time.LoadLocation("UTC")
-		for i := 0; i < iterations; i++ {
-			data := gen(
-				randomNames[i%len(randomNames)],
-				int64(i)*42,
-				time.Now().In(loc),
-			)
-
-			select {
-			case <-ctx.Done():
-				return
-			case ch <- data:
+func newGenerator(ctx context.Context, iterations int, runID string, gen dataGenerator) <-chan interface{} {
+	return newParallelGenerator(ctx, iterations, runID, gen, 1, 1)
+}
+
+// newParallelGenerator generates the random dataset across the given number
+// of goroutines, into a channel holding the given number of records.  Each
+// goroutine claims the index of its next record from a shared atomic
+// counter, so the uuids remain unique, though with several goroutines the
+// records are no longer delivered in order.
+func newParallelGenerator(ctx context.Context, iterations int, runID string, gen dataGenerator, generators, buffer int) <-chan interface{} {
+	if generators < 1 {
+		generators = 1
+	}
+	ch := make(chan interface{}, max(buffer, 1))
+	loc, _ := time.LoadLocation("UTC")
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for g := 0; g < generators; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := next.Add(1) - 1
+				if i >= int64(iterations) {
+					return
+				}
+				data := gen(
+					randomNames[i%int64(len(randomNames))],
+					i*uuidStride,
+					time.Now().In(loc),
+					runID,
+				)
+
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- data:
+				}
 			}
-		}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
 	}()
 	return ch
 }
@@ -0,0 +1,134 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Most fields a table can be clustered on
+const maxClusterFields = 4
+
+// Column types a table can be partitioned on by time unit
+var partitionFieldTypes = []bigquery.FieldType{bigquery.DateFieldType, bigquery.TimestampFieldType, bigquery.DateTimeFieldType}
+
+// Column types a table can be clustered on
+var clusterFieldTypes = []bigquery.FieldType{
+	bigquery.StringFieldType, bigquery.IntegerFieldType, bigquery.NumericFieldType, bigquery.BigNumericFieldType,
+	bigquery.BooleanFieldType, bigquery.DateFieldType, bigquery.DateTimeFieldType, bigquery.TimestampFieldType,
+	bigquery.GeographyFieldType, bigquery.RangeFieldType,
+}
+
+// TableLayout holds the partitioning and clustering of the tables created,
+// either of which may be nil, along with the time after which they expire
+type TableLayout struct {
+	Partitioning *bigquery.TimePartitioning
+	Clustering   *bigquery.Clustering
+	Expiration   time.Duration
+}
+
+// NewTableLayout creates the layout of -partition-field, -partition-type and
+// -cluster, partitioning by ingestion time when a type is given without a
+// field, and by day when a field is given without a type.  The fields must be
+// top-level columns of the schema of a partitionable or clusterable type.
+func NewTableLayout(field, partitionType, cluster string, schema bigquery.Schema) (TableLayout, error) {
+	var layout TableLayout
+	if field != "" || partitionType != "" {
+		partitioning := &bigquery.TimePartitioning{Type: bigquery.DayPartitioningType}
+		if partitionType != "" {
+			partitioning.Type = bigquery.TimePartitioningType(strings.ToUpper(partitionType))
+			if _, ok := partitionLayouts[partitioning.Type]; !ok {
+				return layout, fmt.Errorf("invalid -partition-type %q, must be one of hour, day, month or year", partitionType)
+			}
+		}
+		if field != "" {
+			column, err := layoutColumn("-partition-field", field, schema, partitionFieldTypes)
+			if err != nil {
+				return layout, err
+			}
+			if column.Type == bigquery.DateFieldType && partitioning.Type == bigquery.HourPartitioningType {
+				return layout, fmt.Errorf("-partition-field %s is a DATE column, which cannot be partitioned by hour", column.Name)
+			}
+			partitioning.Field = column.Name
+		}
+		layout.Partitioning = partitioning
+	}
+
+	if fields := SplitList(cluster); len(fields) > 0 {
+		if len(fields) > maxClusterFields {
+			return layout, fmt.Errorf("-cluster takes at most %d fields, %d were given", maxClusterFields, len(fields))
+		}
+		clustering := &bigquery.Clustering{}
+		for _, name := range fields {
+			column, err := layoutColumn("-cluster", name, schema, clusterFieldTypes)
+			if err != nil {
+				return layout, err
+			}
+			if slices.Contains(clustering.Fields, column.Name) {
+				return layout, fmt.Errorf("-cluster names the %s column more than once", column.Name)
+			}
+			clustering.Fields = append(clustering.Fields, column.Name)
+		}
+		layout.Clustering = clustering
+	}
+	return layout, nil
+}
+
+// layoutColumn finds the top-level column of the schema named by a flag,
+// requiring it be a non-repeated column of one of the types
+func layoutColumn(flagName, name string, schema bigquery.Schema, types []bigquery.FieldType) (*bigquery.FieldSchema, error) {
+	index := slices.IndexFunc(schema, func(field *bigquery.FieldSchema) bool { return strings.EqualFold(field.Name, name) })
+	if index < 0 {
+		return nil, fmt.Errorf("%s %s is not a column of the table schema", flagName, name)
+	}
+	column := schema[index]
+	if column.Repeated {
+		return nil, fmt.Errorf("%s %s is a REPEATED column", flagName, column.Name)
+	}
+	if !slices.Contains(types, column.Type) {
+		names := make([]string, len(types))
+		for i, fieldType := range types {
+			names[i] = string(fieldType)
+		}
+		return nil, fmt.Errorf("%s %s is a %s column, must be one of %s", flagName, column.Name, column.Type, strings.Join(names, ", "))
+	}
+	return column, nil
+}
+
+// DescribePartitioning renders the partitioning of a table, such as
+// DAY(create_time), or DAY(_PARTITIONTIME) partitioned by ingestion time
+func DescribePartitioning(partitioning *bigquery.TimePartitioning) string {
+	if partitioning == nil {
+		return "none"
+	}
+	field := partitioning.Field
+	if field == "" {
+		field = "_PARTITIONTIME"
+	}
+	return fmt.Sprintf("%s(%s)", partitioning.Type, field)
+}
+
+// DescribeClustering renders the clustering fields of a table
+func DescribeClustering(clustering *bigquery.Clustering) string {
+	if clustering == nil || len(clustering.Fields) == 0 {
+		return "none"
+	}
+	return strings.Join(clustering.Fields, ", ")
+}
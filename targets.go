@@ -0,0 +1,217 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/OTA-Insight/bqwriter"
+)
+
+// StreamTarget is a single table streamed to, with its own streamer, batch
+// size and record counters
+type StreamTarget struct {
+	DatasetID   string
+	TableID     string
+	BatchSize   int
+	RecordsSent int
+	Rebuilds    int
+	Replayed    int
+	Latency     *LatencyRecorder
+	streamer    *bqwriter.Streamer
+	ledger      RowLedger
+}
+
+// Maximum number of times a target's streamer is rebuilt during a run
+const maxStreamerRebuilds = 1
+
+// SplitList splits a comma separated flag value, ignoring empty entries
+func SplitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ParseBatchSizes parses a comma separated list of batch sizes, one per
+// table, each between 1 and 50000
+func ParseBatchSizes(value string, tableCount int) ([]int, error) {
+	items := SplitList(value)
+	if len(items) != tableCount {
+		return nil, fmt.Errorf("-batch-sizes lists %d batch sizes for %d tables", len(items), tableCount)
+	}
+	sizes := make([]int, 0, len(items))
+	for _, item := range items {
+		size, err := strconv.Atoi(item)
+		if err != nil || size < 1 || size > 50000 {
+			return nil, fmt.Errorf("invalid batch size %q, must be between 1 and 50000", item)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// TableNames returns the names of the tables to fan out across, the table
+// itself for a single table, otherwise the table suffixed 1 to tableCount
+func TableNames(tableID string, tableCount int) []string {
+	if tableCount <= 1 {
+		return []string{tableID}
+	}
+	names := make([]string, 0, tableCount)
+	for i := 1; i <= tableCount; i++ {
+		names = append(names, fmt.Sprintf("%s_%d", tableID, i))
+	}
+	return names
+}
+
+// CloseTargets closes the streamers of every target in parallel, returning
+// false if any have not completed flushing before the timeout expires.
+func CloseTargets(targets []*StreamTarget, timeout time.Duration) bool {
+	streamers := make([]*bqwriter.Streamer, 0, len(targets))
+	for _, target := range targets {
+		streamers = append(streamers, target.streamer)
+	}
+	return CloseStreamers(timeout, streamers...)
+}
+
+// RebuildTarget tears down the target's streamer and replaces it with a new
+// streamer.  The old streamer flushes the rows its workers have taken, and
+// the rows it dropped from its queue are replayed into the new streamer
+// ahead of any further writes.
+func RebuildTarget(config *BenchmarkConfig, target *StreamTarget) error {
+	if !CloseStreamer(target.streamer, config.DrainTimeout) {
+		return errDrainTimeout
+	}
+	streamer, err := NewTargetStreamer(config, target, target.BatchSize)
+	if err != nil {
+		target.streamer = nil
+		return err
+	}
+	target.streamer = streamer
+	target.Rebuilds++
+	return ReplayTarget(target)
+}
+
+// ReplayTarget writes the rows dropped by the target's closed streamer into
+// its new streamer
+func ReplayTarget(target *StreamTarget) error {
+	replayed, err := target.ledger.Replay(target.streamer)
+	target.Replayed += replayed
+	if replayed > 0 {
+		logger.Info().Str("Dataset", target.DatasetID).Str("Table", target.TableID).Int("Rows Replayed", replayed).Msg("  Replayed the Rows Dropped by the Streamer")
+	}
+	return err
+}
+
+// DrainTargets closes the streamers of every target, then writes any rows
+// dropped from their queues through a new streamer sending one row per
+// request, closing it once every row has been taken.  It returns false if
+// a streamer has not completed flushing before the timeout expires.
+func DrainTargets(config *BenchmarkConfig, targets []*StreamTarget) (bool, error) {
+	if !CloseTargets(targets, config.DrainTimeout) {
+		return false, nil
+	}
+	for _, target := range targets {
+		target.streamer = nil
+		if target.ledger.Pending() == 0 {
+			continue
+		}
+		streamer, err := NewTargetStreamer(config, target, 1)
+		if err != nil {
+			return false, err
+		}
+		target.streamer = streamer
+		if err = ReplayTarget(target); err != nil {
+			CloseStreamer(streamer, config.DrainTimeout)
+			return false, err
+		}
+		if !target.ledger.WaitTaken(config.DrainTimeout) || !CloseStreamer(streamer, config.DrainTimeout) {
+			return false, nil
+		}
+		target.streamer = nil
+	}
+	return true, nil
+}
+
+// ResizeTargets closes the streamers of every target, replacing each with a
+// new streamer of the batch size into which the rows the old streamer
+// dropped from its queue are replayed
+func ResizeTargets(config *BenchmarkConfig, targets []*StreamTarget, batchSize int) error {
+	if !CloseTargets(targets, config.DrainTimeout) {
+		return errDrainTimeout
+	}
+	for _, target := range targets {
+		target.streamer = nil
+	}
+	for _, target := range targets {
+		streamer, err := NewTargetStreamer(config, target, batchSize)
+		if err != nil {
+			return err
+		}
+		target.streamer, target.BatchSize = streamer, batchSize
+		if err = ReplayTarget(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LogTargetSummary outputs the records sent, throughput and p95 write latency
+// of each target, along with its batch size
+func LogTargetSummary(targets []*StreamTarget, elapsed time.Duration) {
+	logger.Info().Msg("Per-Table Summary")
+	for _, target := range targets {
+		rate := 0.0
+		if elapsed > 0 {
+			rate = float64(target.RecordsSent) / elapsed.Seconds()
+		}
+		event := logger.Info().Str("Dataset", target.DatasetID).Str("Table", target.TableID).Int("Batch Size", target.BatchSize).
+			Int("Records Sent", target.RecordsSent).Float64("Records per Second", rate)
+		if target.Latency != nil && target.Latency.Count() > 0 {
+			event.Float64("p95 ms", float64(target.Latency.Percentile(95).Microseconds())/1000)
+		}
+		event.Msg(indent)
+	}
+}
+
+// VerifyTargets counts the rows tagged with the run_id in each target table,
+// comparing them to the records sent to that target.
+func VerifyTargets(ctx context.Context, client *bigquery.Client, targets []*StreamTarget, runID string) {
+	logger.Info().Msg("Verifying Rows per Target")
+	for _, target := range targets {
+		rows, err := CountRunRows(ctx, client, target.DatasetID, target.TableID, runID)
+		if SkippedOnInterrupt("Rows per Target", err) {
+			return
+		}
+		if err != nil {
+			logger.Warn().Err(err).Str("Dataset", target.DatasetID).Msg("  Failed to Count Rows")
+			continue
+		}
+
+		event := logger.Info()
+		if rows < int64(target.RecordsSent) {
+			event = logger.Warn()
+		}
+		event.Str("Dataset", target.DatasetID).Str("Table", target.TableID).Int("Records Sent", target.RecordsSent).Int64("Rows Found", rows).Msg(indent)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+)
+
+// sequenceRow is a row of sequential data, numbered by its uuid
+type sequenceRow struct {
+	runID string
+	seq   int
+}
+
+// Save implements bigquery.ValueSaver.Save
+func (r sequenceRow) Save() (map[string]bigquery.Value, string, error) {
+	return map[string]bigquery.Value{"run_id": r.runID, dedupKey: strconv.Itoa(r.seq)}, bigquery.NoDedupeID, nil
+}
+
+// gatedTransport holds every request until the gate is closed, keeping the
+// streamer workers busy so rows queue up behind them
+type gatedTransport struct {
+	gate chan struct{}
+}
+
+// RoundTrip implements http.RoundTripper.RoundTrip
+func (t gatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	<-t.gate
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Workers, batch size and rows of the tests rebuilding a streamer mid-run
+const (
+	rebuildWorkers   = 2
+	rebuildBatchSize = 50
+	rebuildRows      = 1000
+)
+
+// newGatedTarget creates a target streaming to the fake server with every
+// request held until the gate is closed
+func newGatedTarget(t *testing.T, server *FakeBigQueryServer, gate chan struct{}) (*BenchmarkConfig, *StreamTarget) {
+	t.Helper()
+	server.CreateTable("bqwrite", "rebuild", nil)
+	config := &BenchmarkConfig{
+		ProjectID:       "bqwrite-test",
+		RunID:           "rebuild-run",
+		NumberWorkers:   rebuildWorkers,
+		DrainTimeout:    30 * time.Second,
+		StreamerOptions: FakeClientOptions(server, option.WithHTTPClient(&http.Client{Transport: gatedTransport{gate: gate}})),
+	}
+	target := &StreamTarget{DatasetID: "bqwrite", TableID: "rebuild", BatchSize: rebuildBatchSize}
+	streamer, err := NewTargetStreamer(config, target, target.BatchSize)
+	if err != nil {
+		t.Fatalf("NewTargetStreamer: %v", err)
+	}
+	target.streamer = streamer
+	return config, target
+}
+
+// writeSequence writes the sequential rows to the target, calling rebuild
+// once a batch per worker is held at the gate and the queue behind them is
+// full, opening the gate once the streamer is closing.  It then drains the
+// target and checks every row landed exactly once.
+func writeSequence(t *testing.T, server *FakeBigQueryServer, gate chan struct{}, config *BenchmarkConfig, target *StreamTarget, rebuild func() error) {
+	t.Helper()
+	queued := rebuildWorkers * (rebuildBatchSize + CalculateWorkerQueueSize(rebuildBatchSize))
+	for seq := 0; seq < rebuildRows; seq++ {
+		if seq == queued {
+			time.AfterFunc(100*time.Millisecond, func() { close(gate) })
+			if err := rebuild(); err != nil {
+				t.Fatalf("rebuild: %v", err)
+			}
+		}
+		if err := target.ledger.Write(target.streamer, sequenceRow{runID: config.RunID, seq: seq}); err != nil {
+			t.Fatalf("Write row %d: %v", seq, err)
+		}
+	}
+	drained, err := DrainTargets(config, []*StreamTarget{target})
+	if err != nil || !drained {
+		t.Fatalf("DrainTargets: drained %v, %v", drained, err)
+	}
+
+	if target.Replayed == 0 {
+		t.Errorf("no rows were replayed, so the rebuild did not drop any queued rows")
+	}
+	if got := server.RunRows("bqwrite", "rebuild", config.RunID); got != rebuildRows {
+		t.Errorf("%d rows landed, expected %d", got, rebuildRows)
+	}
+	if got := server.RunDistinctRows("bqwrite", "rebuild", config.RunID); got != rebuildRows {
+		t.Errorf("%d distinct rows landed, expected %d", got, rebuildRows)
+	}
+}
+
+func TestRebuildTargetLosesNoRows(t *testing.T) {
+	server := NewFakeBigQueryServer()
+	defer server.Close()
+	gate := make(chan struct{})
+	config, target := newGatedTarget(t, server, gate)
+	writeSequence(t, server, gate, config, target, func() error {
+		return RebuildTarget(config, target)
+	})
+	if target.Rebuilds != 1 {
+		t.Errorf("the streamer was rebuilt %d times, expected once", target.Rebuilds)
+	}
+}
+
+func TestResizeTargetsLosesNoRows(t *testing.T) {
+	server := NewFakeBigQueryServer()
+	defer server.Close()
+	gate := make(chan struct{})
+	config, target := newGatedTarget(t, server, gate)
+	writeSequence(t, server, gate, config, target, func() error {
+		return ResizeTargets(config, []*StreamTarget{target}, 2*rebuildBatchSize)
+	})
+	if target.BatchSize != 2*rebuildBatchSize {
+		t.Errorf("the batch size is %d, expected %d", target.BatchSize, 2*rebuildBatchSize)
+	}
+}
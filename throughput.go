@@ -0,0 +1,140 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// BatchCounter counts the insertAll requests made by the streamers, each
+// being a batch of records submitted
+type BatchCounter struct {
+	requests atomic.Int64
+}
+
+// NewBatchCounter creates the counter
+func NewBatchCounter() *BatchCounter {
+	return &BatchCounter{}
+}
+
+// Count returns the insertAll requests made so far, zero for a nil counter
+func (c *BatchCounter) Count() int {
+	if c == nil {
+		return 0
+	}
+	return int(c.requests.Load())
+}
+
+// batchCountTransport counts every insertAll request made through it
+type batchCountTransport struct {
+	base    http.RoundTripper
+	counter *BatchCounter
+}
+
+// Transport wraps the base transport, counting every insertAll request made
+// through it
+func (c *BatchCounter) Transport(base http.RoundTripper) http.RoundTripper {
+	return &batchCountTransport{base: base, counter: c}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *batchCountTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isInsertAll(req) {
+		t.counter.requests.Add(1)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// EstimateBatches estimates the batches submitted by the streamers of the
+// targets when they cannot be counted, each target's records filling whole
+// batches of its batch size
+func EstimateBatches(targets []*StreamTarget) int {
+	batches := 0
+	for _, target := range targets {
+		if target.BatchSize > 0 {
+			batches += (target.RecordsSent + target.BatchSize - 1) / target.BatchSize
+		}
+	}
+	return batches
+}
+
+// Throughput is the throughput of a run, computed from its summary
+type Throughput struct {
+	RowsPerSecond    float64
+	TargetRate       float64
+	TargetAchieved   float64
+	BytesPerSecond   float64
+	AverageRowBytes  float64
+	Batches          int
+	BatchesEstimated bool
+	AverageBatchRows float64
+	AverageBatchFill float64
+}
+
+// NewThroughput computes the throughput of the run, the batch fill being the
+// average rows of a batch as a percentage of the batch size
+func NewThroughput(summary *RunSummary, batchSize int) Throughput {
+	throughput := Throughput{TargetRate: summary.TargetRate, Batches: summary.Batches, BatchesEstimated: summary.BatchesEstimated}
+	if summary.Elapsed > 0 {
+		throughput.RowsPerSecond = float64(summary.RecordsSent) / summary.Elapsed.Seconds()
+		throughput.BytesPerSecond = float64(summary.BytesSent) / summary.Elapsed.Seconds()
+	}
+	if summary.TargetRate > 0 {
+		throughput.TargetAchieved = throughput.RowsPerSecond / summary.TargetRate * 100
+	}
+	if summary.RecordsSent > 0 {
+		throughput.AverageRowBytes = float64(summary.BytesSent) / float64(summary.RecordsSent)
+	}
+	if summary.Batches > 0 {
+		throughput.AverageBatchRows = float64(summary.RecordsSent) / float64(summary.Batches)
+		if batchSize > 0 {
+			throughput.AverageBatchFill = throughput.AverageBatchRows / float64(batchSize) * 100
+		}
+	}
+	return throughput
+}
+
+// LogThroughput outputs the throughput of the run, line by line for the
+// console followed by a single event holding every figure for automation
+func LogThroughput(summary *RunSummary, batchSize int) {
+	throughput := NewThroughput(summary, batchSize)
+	if summary.Interrupted {
+		logger.Info().Msg("Throughput (Interrupted)")
+	} else {
+		logger.Info().Msg("Throughput")
+	}
+	logger.Info().Str("Rows per Second", fmt.Sprintf("%.1f", throughput.RowsPerSecond)).Msg(indent)
+	if throughput.TargetRate > 0 {
+		logger.Info().Str("Target Rows per Second", fmt.Sprintf("%.1f", throughput.TargetRate)).
+			Str("Target Achieved", fmt.Sprintf("%.1f%%", throughput.TargetAchieved)).Msg(indent)
+	}
+	logger.Info().Str("Estimated Bytes per Second", fmt.Sprintf("%.0f", throughput.BytesPerSecond)).Msg(indent)
+	event := logger.Info().Str("Average Row Bytes", fmt.Sprintf("%.1f", throughput.AverageRowBytes))
+	if summary.RowBytes > 0 {
+		event.Int("Requested Row Bytes", summary.RowBytes)
+	}
+	event.Msg(indent)
+	logger.Info().Int("Batches Submitted", throughput.Batches).Bool("Estimated", throughput.BatchesEstimated).Msg(indent)
+	logger.Info().Str("Average Batch Rows", fmt.Sprintf("%.1f", throughput.AverageBatchRows)).
+		Str("Average Batch Fill", fmt.Sprintf("%.1f%%", throughput.AverageBatchFill)).Msg(indent)
+	logger.Info().Int("records_sent", summary.RecordsSent).Float64("elapsed_seconds", summary.Elapsed.Seconds()).
+		Float64("rows_per_second", throughput.RowsPerSecond).Float64("target_rows_per_second", throughput.TargetRate).
+		Float64("target_achieved_pct", throughput.TargetAchieved).Int64("bytes_sent", summary.BytesSent).
+		Float64("bytes_per_second", throughput.BytesPerSecond).Float64("average_row_bytes", throughput.AverageRowBytes).Int("batches", throughput.Batches).
+		Bool("batches_estimated", throughput.BatchesEstimated).Float64("average_batch_rows", throughput.AverageBatchRows).
+		Float64("average_batch_fill_pct", throughput.AverageBatchFill).Bool("interrupted", summary.Interrupted).Msg("Throughput Summary")
+}
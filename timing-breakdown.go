@@ -0,0 +1,165 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Capacity of the channel of generation times, comfortably above the records
+// the generator can produce ahead of the write loop
+const timingStampBuffer = 8
+
+// TimingAverages holds the average time each record spent in each phase
+type TimingAverages struct {
+	QueueWaitMS float64 `json:"queue_wait_ms"`
+	SerializeMS float64 `json:"serialize_ms"`
+	NetworkMS   float64 `json:"network_ms"`
+}
+
+// TimingBreakdown accumulates the time each record spends in three phases:
+// queue wait, from generation until streamer.Write is called; serialization,
+// the streamer.Write call handing the record to a worker; and network, the
+// insertAll request carrying the record, weighted by the rows of each
+// request.  The network phase is measured by a transport on the streamer
+// clients, as the workers send the requests after Write returns.
+type TimingBreakdown struct {
+	mu             sync.Mutex
+	queueWait      time.Duration
+	serialize      time.Duration
+	records        int64
+	network        time.Duration
+	networkRecords int64
+}
+
+// NewTimingBreakdown creates an empty timing breakdown
+func NewTimingBreakdown() *TimingBreakdown {
+	return &TimingBreakdown{}
+}
+
+// Reset clears the breakdown at the start of a run, a nil breakdown is
+// ignored
+func (b *TimingBreakdown) Reset() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queueWait, b.serialize, b.records, b.network, b.networkRecords = 0, 0, 0, 0, 0
+}
+
+// AddRecord accumulates the queue wait and serialization of a record written,
+// a nil breakdown ignores them
+func (b *TimingBreakdown) AddRecord(queueWait, serialize time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queueWait += queueWait
+	b.serialize += serialize
+	b.records++
+}
+
+// addRequest accumulates the latency of an insertAll request for each of its
+// rows
+func (b *TimingBreakdown) addRequest(latency time.Duration, rows int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.network += latency * time.Duration(rows)
+	b.networkRecords += int64(rows)
+}
+
+// Averages returns the average time per record of each phase, nil for a nil
+// breakdown
+func (b *TimingBreakdown) Averages() *TimingAverages {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ms := func(total time.Duration, n int64) float64 {
+		if n == 0 {
+			return 0
+		}
+		return float64(total) / float64(n) / float64(time.Millisecond)
+	}
+	return &TimingAverages{
+		QueueWaitMS: ms(b.queueWait, b.records),
+		SerializeMS: ms(b.serialize, b.records),
+		NetworkMS:   ms(b.network, b.networkRecords),
+	}
+}
+
+// LogTimingBreakdown outputs the average time per record of each phase
+func LogTimingBreakdown(averages *TimingAverages) {
+	if averages == nil {
+		return
+	}
+	logger.Info().Msg("Timing Breakdown per Record")
+	logger.Info().Float64("Average (ms)", averages.QueueWaitMS).Msg("  Queue Wait")
+	logger.Info().Float64("Average (ms)", averages.SerializeMS).Msg("  Serialize")
+	logger.Info().Float64("Average (ms)", averages.NetworkMS).Msg("  Network")
+}
+
+// stampGenerator wraps the generator, sending the time each record is
+// generated to the channel in the order generated
+func stampGenerator(gen dataGenerator, generated chan<- time.Time) dataGenerator {
+	return func(name string, uuid int64, create_time time.Time, run_id string) interface{} {
+		data := gen(name, uuid, create_time, run_id)
+		select {
+		case generated <- time.Now():
+		default:
+		}
+		return data
+	}
+}
+
+// timingTransport times every insertAll request made through it for the
+// network phase of the breakdown
+type timingTransport struct {
+	base      http.RoundTripper
+	breakdown *TimingBreakdown
+}
+
+// Transport wraps the base transport, timing every successful insertAll
+// request made through it
+func (b *TimingBreakdown) Transport(base http.RoundTripper) http.RoundTripper {
+	return &timingTransport{base: base, breakdown: b}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *timingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isInsertAll(req) || req.Body == nil {
+		return t.base.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode < http.StatusBadRequest {
+		t.breakdown.addRequest(time.Since(start), insertAllRowCount(body))
+	}
+	return resp, err
+}
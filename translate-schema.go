@@ -0,0 +1,206 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	migration "cloud.google.com/go/bigquery/migration/apiv2"
+	"cloud.google.com/go/bigquery/migration/apiv2/migrationpb"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// Location of the BigQuery Migration Service used for translation
+const translationLocation = "us"
+
+// Interval between polls of the translation workflow state
+const translationPollInterval = 5 * time.Second
+
+// Name of the DDL file uploaded for, and downloaded from, translation
+const translationFileName = "schema.sql"
+
+// translationDialect describes a supported source dialect
+type translationDialect struct {
+	TaskType string
+	Dialect  *migrationpb.Dialect
+}
+
+// translationDialects maps each --translate-schema dialect to the migration
+// task type and source dialect
+var translationDialects = map[string]translationDialect{
+	"redshift":  {"Translation_Redshift2BQ", &migrationpb.Dialect{DialectValue: &migrationpb.Dialect_RedshiftDialect{RedshiftDialect: &migrationpb.RedshiftDialect{}}}},
+	"hive":      {"Translation_HiveQL2BQ", &migrationpb.Dialect{DialectValue: &migrationpb.Dialect_HiveqlDialect{HiveqlDialect: &migrationpb.HiveQLDialect{}}}},
+	"spark":     {"Translation_SparkSQL2BQ", &migrationpb.Dialect{DialectValue: &migrationpb.Dialect_SparksqlDialect{SparksqlDialect: &migrationpb.SparkSQLDialect{}}}},
+	"teradata":  {"Translation_Teradata2BQ", &migrationpb.Dialect{DialectValue: &migrationpb.Dialect_TeradataDialect{TeradataDialect: &migrationpb.TeradataDialect{}}}},
+	"snowflake": {"Translation_Snowflake2BQ", &migrationpb.Dialect{DialectValue: &migrationpb.Dialect_SnowflakeDialect{SnowflakeDialect: &migrationpb.SnowflakeDialect{}}}},
+}
+
+// TranslationDialects returns the sorted names of the supported dialects
+func TranslationDialects() []string {
+	names := make([]string, 0, len(translationDialects))
+	for name := range translationDialects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SchemaTranslationClient bundles the clients needed to run a translation,
+// the BigQuery Migration Service reads its input from, and writes its output
+// to, Cloud Storage.
+type SchemaTranslationClient struct {
+	ProjectID string
+	Bucket    string
+	Prefix    string
+	Migration *migration.Client
+	Storage   *storage.Service
+}
+
+// NewSchemaTranslationClient creates the clients used for translation, with
+// the files staged under the gs://bucket/prefix location.
+func NewSchemaTranslationClient(ctx context.Context, projectID, location string) (*SchemaTranslationClient, error) {
+	bucket, prefix, err := ParseStorageLocation(location)
+	if err != nil {
+		return nil, err
+	}
+
+	migrationClient, err := migration.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	storageService, err := storage.NewService(ctx)
+	if err != nil {
+		migrationClient.Close()
+		return nil, err
+	}
+	return &SchemaTranslationClient{
+		ProjectID: projectID,
+		Bucket:    bucket,
+		Prefix:    prefix,
+		Migration: migrationClient,
+		Storage:   storageService,
+	}, nil
+}
+
+// Close releases the migration client
+func (c *SchemaTranslationClient) Close() error {
+	return c.Migration.Close()
+}
+
+// TranslateSchema translates a DDL statement from the dialect into BigQuery
+// DDL using a BigQuery Migration Service workflow, and converts the first
+// CREATE TABLE statement of the result into a bigquery.Schema.
+func TranslateSchema(ctx context.Context, client *SchemaTranslationClient, dialect, ddl string) (bigquery.Schema, error) {
+	source, ok := translationDialects[dialect]
+	if !ok {
+		return nil, fmt.Errorf("unsupported dialect %q, expected one of %s", dialect, strings.Join(TranslationDialects(), ", "))
+	}
+
+	// Stage the DDL under a unique path for this translation
+	base := path.Join(client.Prefix, fmt.Sprintf("translate-%d", time.Now().UnixNano()))
+	inputPath, outputPath := path.Join(base, "input"), path.Join(base, "output")
+	_, err := client.Storage.Objects.Insert(client.Bucket, &storage.Object{Name: path.Join(inputPath, translationFileName)}).
+		Media(strings.NewReader(ddl)).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload the DDL: %w", err)
+	}
+
+	logger.Info().Str("Dialect", dialect).Str("Task Type", source.TaskType).Msg("Translating Schema")
+	workflow, err := client.Migration.CreateMigrationWorkflow(ctx, &migrationpb.CreateMigrationWorkflowRequest{
+		Parent: fmt.Sprintf("projects/%s/locations/%s", client.ProjectID, translationLocation),
+		MigrationWorkflow: &migrationpb.MigrationWorkflow{
+			DisplayName: "bqwrite-test schema translation",
+			Tasks: map[string]*migrationpb.MigrationTask{
+				"translate": {
+					Type: source.TaskType,
+					TaskDetails: &migrationpb.MigrationTask_TranslationConfigDetails{
+						TranslationConfigDetails: &migrationpb.TranslationConfigDetails{
+							SourceLocation: &migrationpb.TranslationConfigDetails_GcsSourcePath{GcsSourcePath: fmt.Sprintf("gs://%s/%s", client.Bucket, inputPath)},
+							TargetLocation: &migrationpb.TranslationConfigDetails_GcsTargetPath{GcsTargetPath: fmt.Sprintf("gs://%s/%s", client.Bucket, outputPath)},
+							SourceDialect:  source.Dialect,
+							TargetDialect:  &migrationpb.Dialect{DialectValue: &migrationpb.Dialect_BigqueryDialect{BigqueryDialect: &migrationpb.BigQueryDialect{}}},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the migration workflow: %w", err)
+	}
+	defer func() {
+		_ = client.Migration.DeleteMigrationWorkflow(context.Background(), &migrationpb.DeleteMigrationWorkflowRequest{Name: workflow.GetName()})
+	}()
+
+	// Wait for the workflow to complete
+	for workflow.GetState() != migrationpb.MigrationWorkflow_COMPLETED {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(translationPollInterval):
+		}
+		workflow, err = client.Migration.GetMigrationWorkflow(ctx, &migrationpb.GetMigrationWorkflowRequest{Name: workflow.GetName()})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the migration workflow: %w", err)
+		}
+	}
+	for _, task := range workflow.GetTasks() {
+		if task.GetState() != migrationpb.MigrationTask_SUCCEEDED {
+			return nil, fmt.Errorf("translation task finished in state %s: %s", task.GetState(), task.GetProcessingError().GetReason())
+		}
+	}
+
+	// Download the translated DDL
+	response, err := client.Storage.Objects.Get(client.Bucket, path.Join(outputPath, translationFileName)).Context(ctx).Download()
+	if err != nil {
+		return nil, fmt.Errorf("failed to download the translated DDL: %w", err)
+	}
+	defer response.Body.Close()
+	translated, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := ParseBigQueryDDL(string(translated))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the translated DDL: %w", err)
+	}
+	return schema, nil
+}
+
+// TranslateSchemaFile reads the DDL file and translates it from the dialect,
+// staging the files under the Cloud Storage location.
+func TranslateSchemaFile(projectID, dialect, ddlPath, location string) (bigquery.Schema, error) {
+	ddl, err := os.ReadFile(ddlPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	client, err := NewSchemaTranslationClient(ctx, projectID, location)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return TranslateSchema(ctx, client, dialect, string(ddl))
+}
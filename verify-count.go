@@ -0,0 +1,121 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Exit status returned when -verify found fewer rows than records sent
+const exitRowsMissing = 5
+
+// verifyRetryInterval is the time between the row counts of -verify, while
+// the rows sent are still becoming visible to queries
+var verifyRetryInterval = 10 * time.Second
+
+// errRowsMissing is returned when the rows counted by -verify never reached
+// the records sent within the window
+var errRowsMissing = errors.New("rows missing from the table")
+
+// VerifyRowCount counts the rows tagged with the run_id across the targets,
+// repeating the count every retry interval until the expected rows are found
+// or the window has passed.  The delta between the records sent and the rows
+// found is logged, the error wrapping errRowsMissing when rows are missing.
+// The distinct rows are counted when duplicates were sent, so the duplicates
+// surviving deduplication cannot hide records missing from the table.  When
+// mirrored, as with -dual-write, every target holds every record, so each is
+// compared with the expected rows on its own and reported per table.
+func VerifyRowCount(ctx context.Context, client *bigquery.Client, targets []*StreamTarget, runID string, expected int64, window time.Duration, distinct, mirrored bool) error {
+	countRows := CountRunRows
+	if distinct {
+		countRows = CountDistinctRunRows
+	}
+	logger.Info().Msg("Verifying Row Count")
+	deadline := time.Now().Add(window)
+	counts := make([]int64, len(targets))
+	var missing int64
+	for attempt := 1; ; attempt++ {
+		for i, target := range targets {
+			count, err := countRows(ctx, client, target.DatasetID, target.TableID, runID)
+			if err != nil {
+				return err
+			}
+			counts[i] = count
+		}
+		missing = rowsMissing(counts, expected, mirrored)
+		if missing == 0 || time.Until(deadline) < verifyRetryInterval {
+			break
+		}
+		logger.Info().Int("Attempt", attempt).Int64("Rows Missing", missing).Msg("  Retrying the Row Count")
+		select {
+		case <-ctx.Done():
+			return interruptedError(ctx, ctx.Err())
+		case <-time.After(verifyRetryInterval):
+		}
+	}
+
+	if !mirrored {
+		var rows int64
+		for _, count := range counts {
+			rows += count
+		}
+		event := logger.Info()
+		if rows < expected {
+			event = logger.Warn()
+		}
+		event.Int64("Records Sent", expected).Int64("Rows Found", rows).Int64("Delta", rows-expected).Msg(indent)
+		if rows < expected {
+			return fmt.Errorf("%w, %d of %d rows not found after %s", errRowsMissing, expected-rows, expected, window)
+		}
+		return nil
+	}
+
+	var short []string
+	for i, target := range targets {
+		event := logger.Info()
+		if counts[i] < expected {
+			event = logger.Warn()
+			short = append(short, fmt.Sprintf("%d of %d rows not found in %s.%s", expected-counts[i], expected, target.DatasetID, target.TableID))
+		}
+		event.Str("Dataset", target.DatasetID).Str("Table", target.TableID).Int64("Records Sent", expected).Int64("Rows Found", counts[i]).Int64("Delta", counts[i]-expected).Msg(indent)
+	}
+	if len(short) > 0 {
+		return fmt.Errorf("%w, %s after %s", errRowsMissing, strings.Join(short, ", "), window)
+	}
+	return nil
+}
+
+// rowsMissing returns the rows still missing from the counts of the targets,
+// summing the shortfall of each target when mirrored, otherwise the shortfall
+// of the total across the targets
+func rowsMissing(counts []int64, expected int64, mirrored bool) int64 {
+	var missing, rows int64
+	for _, count := range counts {
+		rows += count
+		if mirrored && count < expected {
+			missing += expected - count
+		}
+	}
+	if !mirrored && rows < expected {
+		missing = expected - rows
+	}
+	return missing
+}
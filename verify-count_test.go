@@ -0,0 +1,76 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// TestVerifyRowCount expects the rows of round-robin targets to be summed,
+// and each table of a dual write to be compared with the records sent alone
+func TestVerifyRowCount(t *testing.T) {
+	ctx := context.Background()
+	server := NewFakeBigQueryServer()
+	defer server.Close()
+	client, err := bigquery.NewClient(ctx, selfTestProject, FakeClientOptions(server)...)
+	if err != nil {
+		t.Fatalf("bigquery.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	const runID = "verify-run"
+	rows := map[string]int{"old": 10, "new": 8}
+	for tableID, count := range rows {
+		server.CreateTable(selfTestDataset, tableID, nil)
+		var sequence []sequenceRow
+		for seq := 0; seq < count; seq++ {
+			sequence = append(sequence, sequenceRow{runID: runID, seq: seq})
+		}
+		if err := client.Dataset(selfTestDataset).Table(tableID).Inserter().Put(ctx, sequence); err != nil {
+			t.Fatalf("Put %s: %v", tableID, err)
+		}
+	}
+	targets := []*StreamTarget{{DatasetID: selfTestDataset, TableID: "old"}, {DatasetID: selfTestDataset, TableID: "new"}}
+
+	tests := []struct {
+		name     string
+		expected int64
+		mirrored bool
+		missing  string
+	}{
+		{name: "Round-Robin", expected: 18},
+		{name: "Round-Robin Missing", expected: 19, missing: "1 of 19 rows not found"},
+		{name: "Dual Write", expected: 8, mirrored: true},
+		{name: "Dual Write Missing", expected: 10, mirrored: true, missing: "2 of 10 rows not found in " + selfTestDataset + ".new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyRowCount(ctx, client, targets, runID, tt.expected, 0, false, tt.mirrored)
+			switch {
+			case tt.missing == "" && err != nil:
+				t.Fatalf("VerifyRowCount: %v", err)
+			case tt.missing != "" && !errors.Is(err, errRowsMissing):
+				t.Fatalf("VerifyRowCount returned %v, expected rows missing", err)
+			case tt.missing != "" && !strings.Contains(err.Error(), tt.missing):
+				t.Errorf("VerifyRowCount returned %q, expected it to report %q", err, tt.missing)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// ReadSampleRows reads up to n rows of the table through the BigQuery Storage
+// Read API rather than a query, exercising the read path consumers of the
+// table use
+func ReadSampleRows(ctx context.Context, projectID, datasetID, tableID string, n int) ([]map[string]interface{}, error) {
+	client, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	if err := client.EnableStorageReadClient(ctx); err != nil {
+		return nil, err
+	}
+
+	it := client.Dataset(datasetID).Table(tableID).Read(ctx)
+	var rows []map[string]interface{}
+	for len(rows) < n {
+		var row map[string]bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		sample := make(map[string]interface{}, len(row))
+		for column, value := range row {
+			sample[column] = value
+		}
+		rows = append(rows, sample)
+	}
+	if !it.IsAccelerated() {
+		return nil, fmt.Errorf("the rows of %s.%s were not read through the Storage Read API", datasetID, tableID)
+	}
+	return rows, nil
+}
+
+// MissingSampleNames returns the names of which no row of the sample holds
+// the name
+func MissingSampleNames(rows []map[string]interface{}, names []string) []string {
+	seen := make(map[string]bool, len(names))
+	for _, row := range rows {
+		if name, ok := row["name"].(string); ok {
+			seen[name] = true
+		}
+	}
+	var missing []string
+	for _, name := range names {
+		if !seen[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// VerifySampleRows reads a sample of n rows of the table through the Storage
+// Read API, returning an error unless every name written is held by at least
+// one row
+func VerifySampleRows(ctx context.Context, projectID, datasetID, tableID string, n int) error {
+	logger.Info().Str("Table", tableID).Int("Rows", n).Msg("Verifying a Sample Read through the Storage Read API")
+	rows, err := ReadSampleRows(ctx, projectID, datasetID, tableID, n)
+	if err != nil {
+		return err
+	}
+	missing := MissingSampleNames(rows, randomNames)
+	logger.Info().Int("Rows Read", len(rows)).Int("Names Found", len(randomNames)-len(missing)).Int("Names", len(randomNames)).Msg(indent)
+	if len(missing) > 0 {
+		logger.Warn().Strs("Names", missing).Msg("  Names Missing from the Sample")
+		return fmt.Errorf("%d of the %d names are missing from the %d rows sampled from %s", len(missing), len(randomNames), len(rows), tableID)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// Coefficients of variation of the per-worker record counts below which
+// the distribution is fair, and above which it is significantly unfair
+const (
+	fairnessFair   = 0.05
+	fairnessUnfair = 0.20
+)
+
+// Fairness verdicts
+const (
+	fairnessVerdictFair     = "fair"
+	fairnessVerdictUneven   = "uneven"
+	fairnessVerdictUnfair   = "unfair"
+	fairnessVerdictNoRecord = "no records"
+)
+
+// WorkerStats counts the records and requests of each streamer worker.
+// bqwriter gives every worker its own client and sends each request on the
+// worker's goroutine, so the workers are told apart by the goroutine
+// calling the transport, numbered in the order first seen.
+type WorkerStats struct {
+	mu       sync.Mutex
+	workers  map[uint64]int
+	records  []int64
+	requests []int
+}
+
+// NewWorkerStats creates empty worker stats
+func NewWorkerStats() *WorkerStats {
+	return &WorkerStats{workers: make(map[uint64]int)}
+}
+
+// add counts a successful request of the given number of rows sent by the
+// worker running on the goroutine
+func (s *WorkerStats) add(goroutine uint64, rows int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	worker, ok := s.workers[goroutine]
+	if !ok {
+		worker = len(s.records)
+		s.workers[goroutine] = worker
+		s.records = append(s.records, 0)
+		s.requests = append(s.requests, 0)
+	}
+	s.records[worker] += int64(rows)
+	s.requests[worker]++
+}
+
+// Records returns the number of records sent by each worker, padded with
+// zeros for the workers which never sent a request
+func (s *WorkerStats) Records(workers int) []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]int64, max(workers, len(s.records)))
+	copy(records, s.records)
+	return records
+}
+
+// Requests returns the number of requests sent by each worker, padded with
+// zeros for the workers which never sent a request
+func (s *WorkerStats) Requests(workers int) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := make([]int, max(workers, len(s.requests)))
+	copy(requests, s.requests)
+	return requests
+}
+
+// CoefficientOfVariation returns the population standard deviation of the
+// counts divided by their mean, zero when there are no records
+func CoefficientOfVariation(counts []int64) float64 {
+	if len(counts) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, count := range counts {
+		sum += float64(count)
+	}
+	mean := sum / float64(len(counts))
+	if mean == 0 {
+		return 0
+	}
+	var squares float64
+	for _, count := range counts {
+		squares += (float64(count) - mean) * (float64(count) - mean)
+	}
+	return math.Sqrt(squares/float64(len(counts))) / mean
+}
+
+// FairnessVerdict classifies the coefficient of variation of the per-worker
+// record counts
+func FairnessVerdict(counts []int64) string {
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	cv := CoefficientOfVariation(counts)
+	switch {
+	case total == 0:
+		return fairnessVerdictNoRecord
+	case cv < fairnessFair:
+		return fairnessVerdictFair
+	case cv > fairnessUnfair:
+		return fairnessVerdictUnfair
+	}
+	return fairnessVerdictUneven
+}
+
+// LogWorkerStats outputs the records and requests of each worker and, when
+// testing fairness, the coefficient of variation of the records and its
+// verdict
+func LogWorkerStats(stats *WorkerStats, workers int, fairness bool) {
+	records, requests := stats.Records(workers), stats.Requests(workers)
+	logger.Info().Int("Workers", len(records)).Msg("Worker Stats")
+	for i := range records {
+		logger.Info().Int("Worker", i+1).Int64("Records", records[i]).Int("Requests", requests[i]).Msg(indent)
+	}
+	if fairness {
+		logger.Info().Str("Coefficient of Variation", fmt.Sprintf("%.4f", CoefficientOfVariation(records))).
+			Str("Verdict", FairnessVerdict(records)).Msg(indent)
+	}
+}
+
+// workerStatsTransport counts the rows of each successful insertAll request
+// against the worker whose goroutine sent it
+type workerStatsTransport struct {
+	base  http.RoundTripper
+	stats *WorkerStats
+}
+
+// Transport wraps the base transport, counting the rows of every successful
+// insertAll request made through it against the sending worker
+func (s *WorkerStats) Transport(base http.RoundTripper) http.RoundTripper {
+	return &workerStatsTransport{base: base, stats: s}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *workerStatsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isInsertAll(req) || req.Body == nil {
+		return t.base.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	goroutine := currentGoroutineID()
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode < http.StatusBadRequest {
+		t.stats.add(goroutine, insertAllRowCount(body))
+	}
+	return resp, err
+}
+
+// currentGoroutineID parses the identifier of the calling goroutine from
+// the header of its stack trace, "goroutine 123 [running]:"
+func currentGoroutineID() uint64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	fields := bytes.Fields(buf[:n])
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(fields[1]), 10, 64)
+	return id
+}
@@ -0,0 +1,216 @@
+// Copyright 2021-2023, Matthew Winter
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Replay timings selected with -replay-timing
+const (
+	replayTimingAsFast   = "asfast"
+	replayTimingOriginal = "original"
+	replayTimingScaled   = "scaled:"
+)
+
+// Maximum size of a single line of a workload file
+const maxWorkloadLine = 16 * 1024 * 1024
+
+// WorkloadRecord is a single row of a workload file, along with the time it
+// was sent relative to the first row of the capture
+type WorkloadRecord struct {
+	OffsetMS float64                   `json:"offset_ms"`
+	Row      map[string]bigquery.Value `json:"row"`
+}
+
+// WorkloadRecorder writes each row sent to a workload file as NDJSON, so the
+// run can be replayed with its original timing
+type WorkloadRecorder struct {
+	file   *os.File
+	writer *bufio.Writer
+	start  time.Time
+}
+
+// NewWorkloadRecorder creates the workload file at the given path
+func NewWorkloadRecorder(path string) (*WorkloadRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &WorkloadRecorder{file: f, writer: bufio.NewWriter(f)}, nil
+}
+
+// Record appends the row to the workload file with its offset from the first
+// row recorded.  A nil recorder ignores the row.
+func (r *WorkloadRecorder) Record(data interface{}) error {
+	if r == nil {
+		return nil
+	}
+	saver, ok := data.(bigquery.ValueSaver)
+	if !ok {
+		return fmt.Errorf("cannot record a row of type %T", data)
+	}
+	row, _, err := saver.Save()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if r.start.IsZero() {
+		r.start = now
+	}
+	line, err := json.Marshal(WorkloadRecord{OffsetMS: float64(now.Sub(r.start)) / float64(time.Millisecond), Row: row})
+	if err != nil {
+		return err
+	}
+	r.writer.Write(line)
+	return r.writer.WriteByte('\n')
+}
+
+// Close flushes and closes the workload file
+func (r *WorkloadRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	if err := r.writer.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// ParseReplayTiming returns the speed at which a workload is replayed, zero
+// to ignore the original timing, one to reproduce it, and N for scaled:N,
+// which replays N times as fast
+func ParseReplayTiming(timing string) (float64, error) {
+	switch {
+	case timing == replayTimingAsFast:
+		return 0, nil
+	case timing == replayTimingOriginal:
+		return 1, nil
+	case strings.HasPrefix(timing, replayTimingScaled):
+		speed, err := strconv.ParseFloat(strings.TrimPrefix(timing, replayTimingScaled), 64)
+		if err == nil && speed > 0 {
+			return speed, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid replay timing %q, expected asfast, original or scaled:N with N greater than 0", timing)
+}
+
+// replayRecord is a row read from a workload file, along with the time it
+// is scheduled to be sent
+type replayRecord struct {
+	schemaDataRecord
+	scheduled time.Time
+}
+
+// newReplayGenerator replays the rows of a workload file, tagged with the
+// run_id of this run.  At a speed of zero the rows are sent as fast as
+// possible, otherwise each row is held until its offset divided by the speed
+// has elapsed.
+func newReplayGenerator(ctx context.Context, path, runID string, speed float64) (<-chan interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan interface{}, 1)
+	go func() {
+		defer close(ch)
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, maxWorkloadLine)
+		start := time.Now()
+		for line := 1; scanner.Scan(); line++ {
+			var record WorkloadRecord
+			decoder := json.NewDecoder(strings.NewReader(scanner.Text()))
+			decoder.UseNumber()
+			if err := decoder.Decode(&record); err != nil || record.Row == nil {
+				logger.Warn().Err(err).Int("Line", line).Msg("  Skipping an Invalid Workload Record")
+				continue
+			}
+			record.Row["run_id"] = runID
+
+			data := &replayRecord{schemaDataRecord: schemaDataRecord{row: record.Row}}
+			if speed > 0 {
+				data.scheduled = start.Add(time.Duration(record.OffsetMS / speed * float64(time.Millisecond)))
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Until(data.scheduled)):
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case ch <- data:
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			logger.Warn().Err(err).Str("Workload", path).Msg("  Failed to Read the Workload File")
+		}
+	}()
+	return ch, nil
+}
+
+// ReplayFidelity holds how far the send times of a replayed workload drifted
+// from its schedule
+type ReplayFidelity struct {
+	Records    int     `json:"records"`
+	P50DriftMS float64 `json:"p50_drift_ms"`
+	P99DriftMS float64 `json:"p99_drift_ms"`
+	MaxDriftMS float64 `json:"max_drift_ms"`
+}
+
+// NewReplayFidelity summarises the drift recorded, nil when no scheduled
+// rows were replayed
+func NewReplayFidelity(drift *LatencyRecorder) *ReplayFidelity {
+	if drift == nil || drift.Count() == 0 {
+		return nil
+	}
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return &ReplayFidelity{
+		Records:    drift.Count(),
+		P50DriftMS: ms(drift.Percentile(50)),
+		P99DriftMS: ms(drift.Percentile(99)),
+		MaxDriftMS: ms(drift.Max()),
+	}
+}
+
+// ObserveReplayDrift records how far the row was sent after its scheduled
+// time, when it is a replayed row with a schedule
+func ObserveReplayDrift(drift *LatencyRecorder, data interface{}) {
+	if r, ok := data.(*replayRecord); ok && drift != nil && !r.scheduled.IsZero() {
+		drift.Record(time.Since(r.scheduled))
+	}
+}
+
+// LogReplayFidelity outputs how far the send times drifted from the schedule
+// of the replayed workload
+func LogReplayFidelity(drift *LatencyRecorder) {
+	if drift == nil || drift.Count() == 0 {
+		return
+	}
+	logger.Info().Int("Records", drift.Count()).Dur("p50 Drift", drift.Percentile(50)).Dur("p99 Drift", drift.Percentile(99)).
+		Dur("Max Drift", drift.Max()).Msg("Replay Fidelity")
+}